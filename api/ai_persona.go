@@ -0,0 +1,103 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"my-chat-app/services"
+	"my-chat-app/utils"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// AIPersonaHandler serves the AI personas of groups, configured by group
+// admins and answering mentions of their handles.
+type AIPersonaHandler struct {
+	personaService services.AIPersonaService
+}
+
+func NewAIPersonaHandler(personaService services.AIPersonaService) *AIPersonaHandler {
+	return &AIPersonaHandler{personaService}
+}
+
+// List returns a group's personas and whether the user may configure them
+// (GET /api/groups/:id/ai-personas).
+func (h *AIPersonaHandler) List(c *gin.Context) {
+	userID, ok := personaRequest(c)
+	if !ok {
+		return
+	}
+	personas, canConfigure, err := h.personaService.List(c.Param("id"), userID)
+	if err != nil {
+		respondPersonaError(c, err, "Failed to retrieve AI personas")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"personas": personas, "can_configure": canConfigure})
+}
+
+// Save creates or updates the persona with the given handle
+// (PUT /api/groups/:id/ai-personas/:handle).
+func (h *AIPersonaHandler) Save(c *gin.Context) {
+	userID, ok := personaRequest(c)
+	if !ok {
+		return
+	}
+	var settings services.AIPersonaSettings
+	if err := c.ShouldBindJSON(&settings); err != nil {
+		utils.RespondWithError(c, http.StatusBadRequest, "Invalid request payload")
+		return
+	}
+	persona, err := h.personaService.Save(c.Param("id"), userID, c.Param("handle"), settings)
+	if err != nil {
+		respondPersonaError(c, err, "Failed to save AI persona")
+		return
+	}
+	c.JSON(http.StatusOK, persona)
+}
+
+// Delete removes a persona (DELETE /api/groups/:id/ai-personas/:handle).
+func (h *AIPersonaHandler) Delete(c *gin.Context) {
+	userID, ok := personaRequest(c)
+	if !ok {
+		return
+	}
+	if err := h.personaService.Delete(c.Param("id"), userID, c.Param("handle")); err != nil {
+		respondPersonaError(c, err, "Failed to delete AI persona")
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// personaRequest returns the authenticated user, after checking the group ID.
+func personaRequest(c *gin.Context) (string, bool) {
+	userID, _ := c.Get("userID")
+	id, ok := userID.(string)
+	if !ok {
+		utils.RespondWithError(c, http.StatusUnauthorized, "User not authenticated")
+		return "", false
+	}
+	if _, err := uuid.Parse(c.Param("id")); err != nil {
+		utils.RespondWithError(c, http.StatusNotFound, "Group not found")
+		return "", false
+	}
+	return id, true
+}
+
+func respondPersonaError(c *gin.Context, err error, message string) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		status, message = http.StatusNotFound, "Group or persona not found"
+	case errors.Is(err, services.ErrNotGroupMember), errors.Is(err, services.ErrNotGroupAdmin):
+		status, message = http.StatusForbidden, err.Error()
+	case errors.Is(err, services.ErrInvalidPersona):
+		status, message = http.StatusBadRequest, err.Error()
+	case errors.Is(err, services.ErrPersonaUsernameTaken):
+		status, message = http.StatusConflict, err.Error()
+	default:
+		log.Printf("AIPersonaHandler: %s: %v", message, err)
+	}
+	utils.RespondWithError(c, status, message)
+}
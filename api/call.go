@@ -0,0 +1,48 @@
+package api
+
+import (
+	"log"
+	"my-chat-app/services"
+	"my-chat-app/utils"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultCallHistoryLimit = 50
+
+type CallHandler struct {
+	callService services.CallService
+}
+
+func NewCallHandler(callService services.CallService) *CallHandler {
+	return &CallHandler{callService}
+}
+
+// ListCalls returns the authenticated user's recent calls (GET /api/calls).
+func (h *CallHandler) ListCalls(c *gin.Context) {
+	// Get userID from JWT context (set by middleware)
+	value, exists := c.Get("userID")
+	if !exists {
+		utils.RespondWithError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	userID, ok := value.(string)
+	if !ok {
+		utils.RespondWithError(c, http.StatusInternalServerError, "Invalid user ID format")
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultCallHistoryLimit)))
+	if err != nil || limit <= 0 || limit > defaultCallHistoryLimit {
+		limit = defaultCallHistoryLimit
+	}
+	calls, err := h.callService.ListCalls(userID, limit)
+	if err != nil {
+		log.Printf("ListCalls: Error listing calls for %s: %v", userID, err)
+		utils.RespondWithError(c, http.StatusInternalServerError, "Failed to retrieve calls")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"calls": calls})
+}
@@ -4,14 +4,17 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
-	"github.com/streadway/amqp"
 	"gorm.io/gorm"
 	"io"
 	"log"
+	"my-chat-app/broker"
+	"my-chat-app/config"
+	"my-chat-app/consumer"
 	"my-chat-app/models"
 	"my-chat-app/services"
 	"my-chat-app/utils"
@@ -20,6 +23,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 const (
@@ -29,14 +33,32 @@ const (
 
 type ChatHandler struct {
 	chatService services.ChatService
+	callService services.CallService
 	hub         *websockets.Hub // Inject the WebSocket hub
 	db          *gorm.DB
-	amqpChannel *amqp.Channel
+	broker      broker.Broker
 	jwtService  services.JWTService
+	upgrader    websocket.Upgrader
+	wsLimits    websockets.Limits
+	replies     *pendingReplies // Nil when ?wait=true is unavailable
 }
 
-func NewChatHandler(chatService services.ChatService, hub *websockets.Hub, db *gorm.DB, amqpChannel *amqp.Channel, jwtService services.JWTService) *ChatHandler {
-	return &ChatHandler{chatService, hub, db, amqpChannel, jwtService}
+func NewChatHandler(chatService services.ChatService, callService services.CallService, hub *websockets.Hub, db *gorm.DB, b broker.Broker, jwtService services.JWTService) *ChatHandler {
+	replies, err := newPendingReplies(b)
+	if err != nil {
+		log.Printf("NewChatHandler: Waiting for sent messages is disabled: %v", err)
+	}
+	return &ChatHandler{
+		replies:     replies,
+		chatService: chatService,
+		callService: callService,
+		hub:         hub,
+		db:          db,
+		broker:      b,
+		jwtService:  jwtService,
+		upgrader:    newUpgrader(config.AppConfig),
+		wsLimits:    websockets.LimitsFromConfig(config.AppConfig),
+	}
 }
 
 // GetConversation handles retrieving the conversation history between two users.
@@ -64,13 +86,18 @@ func (h *ChatHandler) GetConversation(c *gin.Context) {
 	})
 }
 
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		// Allow all origins for development.  In production, you *MUST* restrict this.
-		return true
-	}, // Allow all origins for development
+func newUpgrader(cfg config.Config) websocket.Upgrader {
+	return websocket.Upgrader{
+		ReadBufferSize:    cfg.WSReadBufferSize,
+		WriteBufferSize:   cfg.WSWriteBufferSize,
+		EnableCompression: cfg.WSCompression, // permessage-deflate, when the client offers it
+		// Clients pick the wire format through Sec-WebSocket-Protocol; none means JSON.
+		Subprotocols: websockets.Subprotocols,
+		CheckOrigin: func(r *http.Request) bool {
+			// Allow all origins for development.  In production, you *MUST* restrict this.
+			return true
+		}, // Allow all origins for development
+	}
 }
 
 func (h *ChatHandler) WebSocketHandler(c *gin.Context) {
@@ -94,22 +121,39 @@ func (h *ChatHandler) WebSocketHandler(c *gin.Context) {
 		return
 	}
 
-	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	// Decide before upgrading: gorilla negotiates deflate only when the client offers it.
+	compression := h.upgrader.EnableCompression &&
+		strings.Contains(c.GetHeader("Sec-WebSocket-Extensions"), "permessage-deflate")
+
+	conn, err := h.upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-
-	client := &websockets.Client{
-		Hub:    h.hub,
-		Conn:   conn,
-		Send:   make(chan []byte, 256),
-		UserID: userID,
+	if compression {
+		if err := conn.SetCompressionLevel(config.AppConfig.WSCompressionLevel); err != nil {
+			log.Printf("WebSocketHandler: invalid compression level: %v", err)
+		}
 	}
-	client.Hub.Register <- client
+
+	client := websockets.NewClient(h.hub, conn, userID, h.wsLimits)
+	client.Compression = compression
+	client.Hub.Connect(client)
 
 	go client.WritePump()
-	go client.ReadPump(h.chatService.(websockets.MessageSaver))
+	go client.ReadPump(websockets.Commands{
+		Saver:     h.chatService,
+		Publisher: h,
+		Access:    h.chatService,
+		Calls:     h.callService,
+		AI:        h.chatService,
+	})
+}
+
+// WebSocketStats returns traffic counters for every open WebSocket connection.
+// They name connected users, so the route is for admins only.
+func (h *ChatHandler) WebSocketStats(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"connections": h.hub.ConnectionStats()})
 }
 
 // --- File Upload Handler ---
@@ -255,63 +299,136 @@ func (h *ChatHandler) SendMessage(c *gin.Context) {
 		return
 	}
 
+	if c.Query("wait") == "true" && h.replies != nil {
+		h.sendAndWait(c, wsMessage)
+		return
+	}
+
+	if err := h.PublishMessage(wsMessage); err != nil {
+		c.JSON(commandErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	response := gin.H{"message": "Message queued for sending"} // Indicate successful queuing
+	if wsMessage.ClientMessageID != "" {
+		// Retries with the same client_message_id resolve to this message.
+		response["message_id"] = models.ClientMessageUUID(wsMessage.SenderID, wsMessage.ClientMessageID).String()
+		response["client_message_id"] = wsMessage.ClientMessageID
+	}
+	c.JSON(http.StatusOK, response)
+
+}
+
+// sendAndWait publishes the message and waits for the consumer's reply
+// (POST /api/messages?wait=true). It answers 201 with the persisted message,
+// 422 with the error that dead-lettered it, or 202 if the consumer did not
+// answer within the timeout; the message may still be saved after that.
+func (h *ChatHandler) sendAndWait(c *gin.Context, wsMessage websockets.WebSocketMessage) {
+	correlationID := uuid.New().String()
+	reply := h.replies.expect(correlationID)
+	defer h.replies.forget(correlationID)
+
+	if err := h.publish(wsMessage, h.replies.queue, correlationID); err != nil {
+		c.JSON(commandErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+
+	timer := time.NewTimer(config.AppConfig.MessageWaitTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-reply:
+		if r.Status != consumer.ReplySaved {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": r.Error})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"message": r.Message})
+	case <-timer.C:
+		c.JSON(http.StatusAccepted, gin.H{"message": "Message queued for sending; no result yet"})
+	case <-c.Request.Context().Done():
+	}
+}
+
+// PublishMessage validates a chat message and publishes it to chat_queue, where
+// the consumer saves and broadcasts it. It backs both POST /api/messages and
+// new_message commands on the WebSocket.
+func (h *ChatHandler) PublishMessage(wsMessage websockets.WebSocketMessage) error {
+	return h.publish(wsMessage, "", "")
+}
+
+// publish validates and publishes wsMessage, asking the consumer to reply to
+// replyTo when it is set.
+func (h *ChatHandler) publish(wsMessage websockets.WebSocketMessage, replyTo, correlationID string) error {
 	// Basic validation
 	if wsMessage.SenderID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing sender_id"})
-		return
+		return websockets.NewCommandError(websockets.ErrCodeBadRequest, "Missing sender_id")
 	}
 	if (wsMessage.ReceiverID == "" && wsMessage.GroupID == "") ||
 		(wsMessage.ReceiverID != "" && wsMessage.GroupID != "") {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Specify either receiver_id or group_id, not both"})
-		return
+		return websockets.NewCommandError(websockets.ErrCodeBadRequest, "Specify either receiver_id or group_id, not both")
 	}
 	if wsMessage.FileName == "" && wsMessage.Content == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Content or file is required"})
-		return
+		return websockets.NewCommandError(websockets.ErrCodeBadRequest, "Content or file is required")
+	}
+	if len(wsMessage.ClientMessageID) > models.MaxClientMessageIDLength {
+		return websockets.NewCommandError(websockets.ErrCodeBadRequest, "client_message_id is too long")
 	}
 
 	// Check content size
 	const maxContentSize = 8192 // 8KB
 	if len(wsMessage.Content) > maxContentSize {
-		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
-			"error": "Message content exceeds maximum size limit",
-		})
-		return
+		return websockets.NewCommandError(websockets.ErrCodeTooLarge, "Message content exceeds maximum size limit")
 	}
 
 	// File existence check
 	if wsMessage.FileName != "" {
 		filePath := filepath.Join(UploadDir, wsMessage.FileName)
 		if _, err := os.Stat(filePath); os.IsNotExist(err) {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "File does not exist"})
-			return
+			return websockets.NewCommandError(websockets.ErrCodeBadRequest, "File does not exist")
 		}
 	}
+	// The request ID only matters to the connection that sent it.
+	wsMessage.RequestID = ""
 	// Convert the WebSocketMessage to JSON
 	msgBytes, err := json.Marshal(wsMessage)
 	if err != nil {
 		log.Printf("Error marshaling message to JSON: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process message"})
-		return
+		return websockets.NewCommandError(websockets.ErrCodeFailed, "Failed to process message")
 	}
-	// Publish the message to RabbitMQ
-	err = h.amqpChannel.Publish(
+	// Publish the message to the broker
+	err = h.broker.Publish(
 		"",           // exchange
 		"chat_queue", // routing key (queue name)
-		false,        // mandatory
-		false,        // immediate
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        msgBytes,
+		broker.Message{
+			ContentType:   "application/json",
+			Body:          msgBytes,
+			ReplyTo:       replyTo,
+			CorrelationID: correlationID,
 		})
 	if err != nil {
-		log.Printf("Error publishing message to RabbitMQ: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send message"})
-		return
+		log.Printf("Error publishing message to the broker: %v", err)
+		return websockets.NewCommandError(websockets.ErrCodeUnavailable, "Failed to send message")
 	}
+	return nil
+}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Message queued for sending"}) // Indicate successful queuing
-
+// commandErrorStatus maps a command error code to an HTTP status.
+func commandErrorStatus(err error) int {
+	var cmdErr *websockets.CommandError
+	if !errors.As(err, &cmdErr) {
+		return http.StatusInternalServerError
+	}
+	switch cmdErr.Code {
+	case websockets.ErrCodeBadRequest, websockets.ErrCodeUnknownCommand:
+		return http.StatusBadRequest
+	case websockets.ErrCodeForbidden:
+		return http.StatusForbidden
+	case websockets.ErrCodeTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case websockets.ErrCodeUnavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
 }
 
 // GetGroupConversation handles retrieving the conversation history for a group.
@@ -0,0 +1,205 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"my-chat-app/services"
+	"my-chat-app/utils"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultDeadLetterPageSize = 50
+	maxDeadLetterPageSize     = 200
+)
+
+// DeadLetterHandler serves the admin endpoints for messages the consumer gave
+// up on.
+type DeadLetterHandler struct {
+	deadLetterService services.DeadLetterService
+}
+
+func NewDeadLetterHandler(deadLetterService services.DeadLetterService) *DeadLetterHandler {
+	return &DeadLetterHandler{deadLetterService}
+}
+
+// List returns a page of dead letters, most recent first
+// (GET /api/admin/dead-letters?limit=&offset=).
+func (h *DeadLetterHandler) List(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultDeadLetterPageSize)))
+	if err != nil || limit <= 0 || limit > maxDeadLetterPageSize {
+		limit = defaultDeadLetterPageSize
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	deadLetters, total, err := h.deadLetterService.List(limit, offset)
+	if err != nil {
+		log.Printf("DeadLetterHandler: Error listing dead letters: %v", err)
+		utils.RespondWithError(c, http.StatusInternalServerError, "Failed to retrieve dead letters")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"dead_letters": deadLetters, "total": total})
+}
+
+// Get returns one dead letter (GET /api/admin/dead-letters/:id).
+func (h *DeadLetterHandler) Get(c *gin.Context) {
+	if !validDeadLetterIDs(c, c.Param("id")) {
+		return
+	}
+	deadLetter, err := h.deadLetterService.Get(c.Param("id"))
+	if err != nil {
+		respondDeadLetterError(c, err, "Failed to retrieve dead letter")
+		return
+	}
+	c.JSON(http.StatusOK, deadLetter)
+}
+
+// Replay sends one dead letter back to its queue
+// (POST /api/admin/dead-letters/:id/replay). With {"body": {...}} the body is
+// replaced first, to fix whatever made it fail.
+func (h *DeadLetterHandler) Replay(c *gin.Context) {
+	var req struct {
+		Body json.RawMessage `json:"body"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			utils.RespondWithError(c, http.StatusBadRequest, "Invalid request payload")
+			return
+		}
+	}
+
+	id := c.Param("id")
+	if !validDeadLetterIDs(c, id) {
+		return
+	}
+	var err error
+	if len(req.Body) > 0 {
+		err = h.deadLetterService.EditAndReplay(id, req.Body)
+	} else {
+		_, err = h.deadLetterService.Replay([]string{id})
+	}
+	if err != nil {
+		respondDeadLetterError(c, err, "Failed to replay dead letter")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"replayed": 1})
+}
+
+// ReplayBulk replays the listed dead letters, or all of them
+// (POST /api/admin/dead-letters/replay with {"ids": [...]} or {"all": true}).
+func (h *DeadLetterHandler) ReplayBulk(c *gin.Context) {
+	var req struct {
+		IDs []string `json:"ids"`
+		All bool     `json:"all"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || (len(req.IDs) == 0 && !req.All) {
+		utils.RespondWithError(c, http.StatusBadRequest, "ids or all is required")
+		return
+	}
+	if !validDeadLetterIDs(c, req.IDs...) {
+		return
+	}
+
+	var replayed int
+	var err error
+	if req.All {
+		replayed, err = h.deadLetterService.ReplayAll()
+	} else {
+		replayed, err = h.deadLetterService.Replay(req.IDs)
+	}
+	if err != nil {
+		log.Printf("DeadLetterHandler: Replay stopped after %d: %v", replayed, err)
+		c.JSON(statusForDeadLetterError(err), gin.H{"error": "Replay stopped: " + err.Error(), "replayed": replayed})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"replayed": replayed})
+}
+
+// Delete purges one dead letter (DELETE /api/admin/dead-letters/:id).
+func (h *DeadLetterHandler) Delete(c *gin.Context) {
+	if !validDeadLetterIDs(c, c.Param("id")) {
+		return
+	}
+	purged, err := h.deadLetterService.Purge([]string{c.Param("id")})
+	if err != nil {
+		respondDeadLetterError(c, err, "Failed to purge dead letter")
+		return
+	}
+	if purged == 0 {
+		utils.RespondWithError(c, http.StatusNotFound, "Dead letter not found")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"purged": purged})
+}
+
+// Purge deletes the listed dead letters, or all of them
+// (DELETE /api/admin/dead-letters with {"ids": [...]} or {"all": true}).
+func (h *DeadLetterHandler) Purge(c *gin.Context) {
+	var req struct {
+		IDs []string `json:"ids"`
+		All bool     `json:"all"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || (len(req.IDs) == 0 && !req.All) {
+		utils.RespondWithError(c, http.StatusBadRequest, "ids or all is required")
+		return
+	}
+	if !validDeadLetterIDs(c, req.IDs...) {
+		return
+	}
+
+	var purged int64
+	var err error
+	if req.All {
+		purged, err = h.deadLetterService.PurgeAll()
+	} else {
+		purged, err = h.deadLetterService.Purge(req.IDs)
+	}
+	if err != nil {
+		respondDeadLetterError(c, err, "Failed to purge dead letters")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"purged": purged})
+}
+
+// validDeadLetterIDs reports whether every ID is a UUID, answering 400 if not.
+func validDeadLetterIDs(c *gin.Context, ids ...string) bool {
+	for _, id := range ids {
+		if _, err := uuid.Parse(id); err != nil {
+			utils.RespondWithError(c, http.StatusBadRequest, "Invalid dead letter ID: "+id)
+			return false
+		}
+	}
+	return true
+}
+
+func respondDeadLetterError(c *gin.Context, err error, message string) {
+	status := statusForDeadLetterError(err)
+	switch status {
+	case http.StatusNotFound:
+		message = "Dead letter not found"
+	case http.StatusBadRequest:
+		message = err.Error()
+	default:
+		log.Printf("DeadLetterHandler: %s: %v", message, err)
+	}
+	utils.RespondWithError(c, status, message)
+}
+
+// statusForDeadLetterError maps lookup and validation failures to 404 and 400.
+func statusForDeadLetterError(err error) int {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, services.ErrInvalidDeadLetterBody):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
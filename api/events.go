@@ -0,0 +1,143 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"my-chat-app/config"
+	"my-chat-app/services"
+	"my-chat-app/utils"
+	"my-chat-app/websockets"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultPollTimeout = 25 * time.Second
+	maxPollTimeout     = 55 * time.Second
+	pollSessionIdle    = 2 * time.Minute
+)
+
+// EventsHandler serves the hub's event stream over fallback transports for
+// clients whose network blocks WebSocket upgrades. Sending still goes through
+// POST /api/messages.
+type EventsHandler struct {
+	hub          *websockets.Hub
+	groupService services.GroupService
+	limits       websockets.Limits
+	polls        *websockets.PollSessions
+}
+
+// NewEventsHandler creates the handler; idle long-poll sessions are reaped
+// until ctx is done.
+func NewEventsHandler(ctx context.Context, hub *websockets.Hub, groupService services.GroupService) *EventsHandler {
+	limits := websockets.LimitsFromConfig(config.AppConfig)
+	polls := websockets.NewPollSessions(hub, limits, pollSessionIdle)
+	polls.StartReaper(ctx, pollSessionIdle/2)
+	return &EventsHandler{
+		hub:          hub,
+		groupService: groupService,
+		limits:       limits,
+		polls:        polls,
+	}
+}
+
+// joinGroups adds a virtual client to its user's groups. WebSocket clients do
+// this themselves with join_group frames after connecting.
+func (h *EventsHandler) joinGroups(client *websockets.Client) {
+	groups, err := h.groupService.ListGroupsForUser(client.UserID)
+	if err != nil {
+		log.Printf("joinGroups: Error listing groups for %s: %v", client.UserID, err)
+		return
+	}
+	for _, group := range groups {
+		h.hub.AddClientToGroup(client.UserID, group.ID.String())
+	}
+}
+
+// subscribe applies the ?topics=group:<id>,presence filter to a virtual
+// client. WebSocket clients send subscribe frames instead.
+func subscribe(c *gin.Context, client *websockets.Client) error {
+	if c.Query("topics") == "" {
+		return nil
+	}
+	return client.Subscribe(strings.Split(c.Query("topics"), ","))
+}
+
+// ServerSentEvents streams events as text/event-stream (GET /api/events).
+func (h *EventsHandler) ServerSentEvents(c *gin.Context) {
+	// Get userID from JWT context (set by middleware)
+	value, exists := c.Get("userID")
+	if !exists {
+		utils.RespondWithError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	userID, ok := value.(string)
+	if !ok {
+		utils.RespondWithError(c, http.StatusInternalServerError, "Invalid user ID format")
+		return
+	}
+
+	client := websockets.NewVirtualClient(h.hub, userID, h.limits)
+	if err := subscribe(c, client); err != nil {
+		utils.RespondWithError(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	h.joinGroups(client)
+	h.hub.Connect(client)
+	defer h.hub.Disconnect(client)
+
+	if err := websockets.ServeSSE(c.Writer, c.Request, client); err != nil {
+		log.Printf("ServerSentEvents: stream for %s ended: %v", userID, err)
+	}
+}
+
+// LongPoll returns queued events, waiting up to ?timeout seconds for the first
+// one (GET /api/poll). Pass the returned session_id on the next poll.
+func (h *EventsHandler) LongPoll(c *gin.Context) {
+	// Get userID from JWT context (set by middleware)
+	value, exists := c.Get("userID")
+	if !exists {
+		utils.RespondWithError(c, http.StatusUnauthorized, "User not authenticated")
+		return
+	}
+	userID, ok := value.(string)
+	if !ok {
+		utils.RespondWithError(c, http.StatusInternalServerError, "Invalid user ID format")
+		return
+	}
+
+	timeout := defaultPollTimeout
+	if seconds, err := strconv.Atoi(c.Query("timeout")); err == nil && seconds >= 0 {
+		timeout = time.Duration(seconds) * time.Second
+		if timeout > maxPollTimeout {
+			timeout = maxPollTimeout
+		}
+	}
+
+	// Topics only apply when a new session is opened.
+	var topicErr error
+	sessionID, client := h.polls.Open(c.Query("session"), userID, func(client *websockets.Client) {
+		topicErr = subscribe(c, client)
+		h.joinGroups(client)
+	})
+	if topicErr != nil {
+		h.polls.Close(sessionID)
+		utils.RespondWithError(c, http.StatusBadRequest, topicErr.Error())
+		return
+	}
+	events, err := h.polls.Poll(c.Request.Context(), sessionID, client, timeout)
+	if errors.Is(err, websockets.ErrClientClosed) {
+		utils.RespondWithError(c, http.StatusGone, "Session closed, start a new one")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"session_id": sessionID,
+		"events":     events,
+	})
+}
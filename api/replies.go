@@ -0,0 +1,66 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"my-chat-app/broker"
+	"my-chat-app/consumer"
+	"sync"
+)
+
+// pendingReplies routes consumer replies from this process's exclusive reply
+// queue to the requests waiting on them, by correlation ID.
+type pendingReplies struct {
+	queue string
+
+	mu      sync.Mutex
+	waiting map[string]chan consumer.Reply
+}
+
+// newPendingReplies declares a broker-named reply queue and starts
+// dispatching the replies that arrive on it.
+func newPendingReplies(b broker.Broker) (*pendingReplies, error) {
+	queue, err := b.DeclareQueue("", broker.QueueOptions{AutoDelete: true, Exclusive: true})
+	if err != nil {
+		return nil, err
+	}
+	deliveries, err := b.Subscribe(queue, "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &pendingReplies{queue: queue, waiting: make(map[string]chan consumer.Reply)}
+	go func() {
+		for d := range deliveries {
+			d.Ack() // A lost reply only makes the request time out
+			var reply consumer.Reply
+			if err := json.Unmarshal(d.Body, &reply); err != nil {
+				log.Printf("pendingReplies: Error decoding reply %s: %v", d.CorrelationID, err)
+				continue
+			}
+			p.mu.Lock()
+			waiter, ok := p.waiting[d.CorrelationID]
+			delete(p.waiting, d.CorrelationID)
+			p.mu.Unlock()
+			if ok {
+				waiter <- reply // Buffered; the waiter may have timed out
+			}
+		}
+	}()
+	return p, nil
+}
+
+// expect registers a waiter for correlationID. Call forget when done waiting.
+func (p *pendingReplies) expect(correlationID string) <-chan consumer.Reply {
+	waiter := make(chan consumer.Reply, 1)
+	p.mu.Lock()
+	p.waiting[correlationID] = waiter
+	p.mu.Unlock()
+	return waiter
+}
+
+func (p *pendingReplies) forget(correlationID string) {
+	p.mu.Lock()
+	delete(p.waiting, correlationID)
+	p.mu.Unlock()
+}
@@ -0,0 +1,119 @@
+// Package broker abstracts the message broker behind chat_queue, the dead
+// letter queue and the events exchange, so the app can run on RabbitMQ or on
+// an in-process broker for development and tests.
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"my-chat-app/config"
+	"sync"
+	"time"
+)
+
+// ErrTopologyMismatch is returned when declaring an exchange or queue that
+// already exists with different arguments.
+var ErrTopologyMismatch = errors.New("declared with different arguments")
+
+// Exchange kinds.
+const (
+	Direct = "direct"
+	Fanout = "fanout"
+	Topic  = "topic"
+)
+
+// Message is what gets published and delivered.
+type Message struct {
+	Body          []byte
+	ContentType   string
+	MessageID     string
+	CorrelationID string
+	ReplyTo       string
+	Headers       map[string]interface{}
+	// Expiration dead-letters the message if it is still queued after this
+	// long. Zero means no per-message expiry.
+	Expiration time.Duration
+}
+
+// Delivery is a message handed to a subscriber. It must be acked or nacked.
+type Delivery struct {
+	Message
+
+	once sync.Once
+	ack  func() error
+	nack func(requeue bool) error
+}
+
+// NewDelivery wraps msg with settle callbacks, for Subscriber implementations.
+func NewDelivery(msg Message, ack func() error, nack func(requeue bool) error) *Delivery {
+	return &Delivery{Message: msg, ack: ack, nack: nack}
+}
+
+// Ack confirms the delivery was handled.
+func (d *Delivery) Ack() error {
+	err := fmt.Errorf("delivery already settled")
+	d.once.Do(func() { err = d.ack() })
+	return err
+}
+
+// Nack rejects the delivery. Without requeue it is dead-lettered when the
+// queue has a dead letter exchange, and dropped otherwise.
+func (d *Delivery) Nack(requeue bool) error {
+	err := fmt.Errorf("delivery already settled")
+	d.once.Do(func() { err = d.nack(requeue) })
+	return err
+}
+
+// QueueOptions configures a queue. Declaring an existing queue with
+// different options fails with ErrTopologyMismatch.
+type QueueOptions struct {
+	Durable              bool
+	AutoDelete           bool
+	Exclusive            bool
+	DeadLetterExchange   string
+	DeadLetterRoutingKey string
+	// MessageTTL dead-letters messages queued for longer. Zero means no TTL.
+	MessageTTL time.Duration
+}
+
+// Publisher publishes to an exchange; the empty exchange routes to the queue
+// named by routingKey. Publish returns once the broker has taken the message.
+type Publisher interface {
+	Publish(exchange, routingKey string, msg Message) error
+}
+
+// Subscriber delivers a queue's messages until Cancel is called with the same
+// consumer tag, after which the delivery channel is closed. At most prefetch
+// deliveries are unacked at a time; zero means no limit.
+type Subscriber interface {
+	Subscribe(queue, consumerTag string, prefetch int) (<-chan *Delivery, error)
+	Cancel(consumerTag string) error
+}
+
+// Broker is a Publisher and Subscriber that also manages topology.
+type Broker interface {
+	Publisher
+	Subscriber
+
+	DeclareExchange(name, kind string) error
+	// DeclareQueue creates the queue if needed and returns its name; an empty
+	// name asks the broker to generate one.
+	DeclareQueue(name string, opts QueueOptions) (string, error)
+	BindQueue(queue, exchange, routingKey string) error
+	DeleteQueue(name string) error
+	// QueueDepth returns the number of messages ready for delivery.
+	QueueDepth(name string) (int, error)
+	Close() error
+}
+
+// Open connects to the broker selected by cfg.Broker: rabbitmq (the default)
+// or memory.
+func Open(cfg config.Config) (Broker, error) {
+	switch cfg.Broker {
+	case "", "rabbitmq":
+		return NewRabbitMQ(cfg.RabbitMQURL)
+	case "memory":
+		return NewMemory(), nil
+	}
+	return nil, fmt.Errorf("unknown broker %q", cfg.Broker)
+}
@@ -0,0 +1,375 @@
+package broker
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Memory is an in-process broker with RabbitMQ's routing, acknowledgement and
+// dead-lettering semantics, including message TTLs, enough to run the app
+// without RabbitMQ. Nothing survives a restart.
+type Memory struct {
+	mu        sync.Mutex
+	queues    map[string]*memoryQueue
+	exchanges map[string]*memoryExchange
+	consumers map[string]chan struct{} // Cancel signal by consumer tag
+}
+
+type memoryExchange struct {
+	kind     string
+	bindings []memoryBinding
+}
+
+type memoryBinding struct {
+	queue, key string
+}
+
+type memoryQueue struct {
+	name string
+	opts QueueOptions
+
+	mu       sync.Mutex
+	messages []memoryMessage
+	nextSeq  uint64
+	ready    chan struct{} // Signalled when messages arrive
+}
+
+// memoryMessage is a queued message; seq identifies it for expiry.
+type memoryMessage struct {
+	Message
+	seq uint64
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		queues:    make(map[string]*memoryQueue),
+		exchanges: make(map[string]*memoryExchange),
+		consumers: make(map[string]chan struct{}),
+	}
+}
+
+func (m *Memory) DeclareExchange(name, kind string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if existing, ok := m.exchanges[name]; ok {
+		if existing.kind != kind {
+			return fmt.Errorf("exchange %s exists with type %s, not %s: %w", name, existing.kind, kind, ErrTopologyMismatch)
+		}
+		return nil
+	}
+	m.exchanges[name] = &memoryExchange{kind: kind}
+	return nil
+}
+
+func (m *Memory) DeclareQueue(name string, opts QueueOptions) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if name == "" {
+		name = "amq.gen-" + uuid.New().String()
+	}
+	if existing, ok := m.queues[name]; ok {
+		if existing.opts != opts {
+			return "", fmt.Errorf("queue %s exists with options %+v, not %+v: %w", name, existing.opts, opts, ErrTopologyMismatch)
+		}
+		return name, nil
+	}
+	m.queues[name] = &memoryQueue{name: name, opts: opts, ready: make(chan struct{}, 1)}
+	return name, nil
+}
+
+func (m *Memory) BindQueue(queue, exchange, routingKey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ex, ok := m.exchanges[exchange]
+	if !ok {
+		return fmt.Errorf("no exchange %s", exchange)
+	}
+	if _, ok := m.queues[queue]; !ok {
+		return fmt.Errorf("no queue %s", queue)
+	}
+	binding := memoryBinding{queue: queue, key: routingKey}
+	for _, existing := range ex.bindings {
+		if existing == binding {
+			return nil // Like RabbitMQ, binding twice is a no-op
+		}
+	}
+	ex.bindings = append(ex.bindings, binding)
+	return nil
+}
+
+func (m *Memory) DeleteQueue(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.queues, name)
+	for _, ex := range m.exchanges {
+		kept := ex.bindings[:0]
+		for _, b := range ex.bindings {
+			if b.queue != name {
+				kept = append(kept, b)
+			}
+		}
+		ex.bindings = kept
+	}
+	return nil
+}
+
+func (m *Memory) QueueDepth(name string) (int, error) {
+	q, err := m.queue(name)
+	if err != nil {
+		return 0, err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.messages), nil
+}
+
+// Publish routes msg to the bound queues. Like RabbitMQ, unroutable messages
+// are dropped.
+func (m *Memory) Publish(exchange, routingKey string, msg Message) error {
+	m.mu.Lock()
+	var targets []*memoryQueue
+	if exchange == "" {
+		if q, ok := m.queues[routingKey]; ok {
+			targets = append(targets, q)
+		}
+	} else {
+		ex, ok := m.exchanges[exchange]
+		if !ok {
+			m.mu.Unlock()
+			return fmt.Errorf("no exchange %s", exchange)
+		}
+		for _, b := range ex.bindings {
+			if routes(ex.kind, b.key, routingKey) {
+				targets = append(targets, m.queues[b.queue])
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	for _, q := range targets {
+		m.enqueue(q, msg, false)
+	}
+	return nil
+}
+
+// enqueue adds msg to q and, when q or msg has a TTL, schedules its expiry.
+func (m *Memory) enqueue(q *memoryQueue, msg Message, front bool) {
+	ttl := q.opts.MessageTTL
+	if msg.Expiration > 0 && (ttl == 0 || msg.Expiration < ttl) {
+		ttl = msg.Expiration
+	}
+	seq := q.push(msg, front)
+	if ttl > 0 {
+		time.AfterFunc(ttl, func() {
+			if q.remove(seq) {
+				m.deadLetter(q, msg)
+			}
+		})
+	}
+}
+
+func (m *Memory) Subscribe(queue, consumerTag string, prefetch int) (<-chan *Delivery, error) {
+	q, err := m.queue(queue)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	if consumerTag == "" {
+		consumerTag = "ctag-" + uuid.New().String()
+	}
+	if _, ok := m.consumers[consumerTag]; ok {
+		m.mu.Unlock()
+		return nil, fmt.Errorf("consumer tag %s in use", consumerTag)
+	}
+	cancel := make(chan struct{})
+	m.consumers[consumerTag] = cancel
+	m.mu.Unlock()
+
+	// A slot is held by each unacked delivery.
+	var slots chan struct{}
+	if prefetch > 0 {
+		slots = make(chan struct{}, prefetch)
+	}
+	out := make(chan *Delivery)
+	go func() {
+		defer close(out)
+		for {
+			if slots != nil {
+				select {
+				case slots <- struct{}{}:
+				case <-cancel:
+					return
+				}
+			}
+			msg, ok := q.pop()
+			for !ok {
+				select {
+				case <-q.ready:
+					msg, ok = q.pop()
+				case <-cancel:
+					return
+				}
+			}
+			release := func() {
+				if slots != nil {
+					<-slots
+				}
+			}
+			delivery := NewDelivery(msg,
+				func() error {
+					release()
+					return nil
+				},
+				func(requeue bool) error {
+					if requeue {
+						m.enqueue(q, msg, true)
+					} else {
+						m.deadLetter(q, msg)
+					}
+					release()
+					return nil
+				})
+			select {
+			case out <- delivery:
+			case <-cancel:
+				m.enqueue(q, msg, true)
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (m *Memory) Cancel(consumerTag string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cancel, ok := m.consumers[consumerTag]
+	if !ok {
+		return fmt.Errorf("no consumer %s", consumerTag)
+	}
+	delete(m.consumers, consumerTag)
+	close(cancel)
+	return nil
+}
+
+// Close cancels every subscription.
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for tag, cancel := range m.consumers {
+		close(cancel)
+		delete(m.consumers, tag)
+	}
+	return nil
+}
+
+func (m *Memory) queue(name string) (*memoryQueue, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q, ok := m.queues[name]
+	if !ok {
+		return nil, fmt.Errorf("no queue %s", name)
+	}
+	return q, nil
+}
+
+// deadLetter republishes a rejected or expired message to the queue's dead
+// letter exchange, keeping the routing key unless the queue overrides it.
+// Without a dead letter exchange the message is dropped.
+func (m *Memory) deadLetter(q *memoryQueue, msg Message) {
+	if q.opts.DeadLetterExchange == "" {
+		return
+	}
+	key := q.opts.DeadLetterRoutingKey
+	if key == "" {
+		key = q.name
+	}
+	msg.Expiration = 0 // Like RabbitMQ, expiry does not follow the message
+	m.Publish(q.opts.DeadLetterExchange, key, msg)
+}
+
+// push queues msg and returns its sequence number.
+func (q *memoryQueue) push(msg Message, front bool) uint64 {
+	q.mu.Lock()
+	q.nextSeq++
+	queued := memoryMessage{Message: msg, seq: q.nextSeq}
+	if front {
+		q.messages = append([]memoryMessage{queued}, q.messages...)
+	} else {
+		q.messages = append(q.messages, queued)
+	}
+	q.mu.Unlock()
+	q.signal()
+	return queued.seq
+}
+
+func (q *memoryQueue) pop() (Message, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.messages) == 0 {
+		return Message{}, false
+	}
+	msg := q.messages[0]
+	q.messages = q.messages[1:]
+	if len(q.messages) > 0 {
+		// Wake another subscriber for the rest.
+		q.signal()
+	}
+	return msg.Message, true
+}
+
+// remove takes the message with seq out of the queue, reporting whether it
+// was still there.
+func (q *memoryQueue) remove(seq uint64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, msg := range q.messages {
+		if msg.seq == seq {
+			q.messages = append(q.messages[:i], q.messages[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (q *memoryQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// routes reports whether a message with key reaches a binding on an exchange
+// of the given kind.
+func routes(kind, binding, key string) bool {
+	switch kind {
+	case Fanout:
+		return true
+	case Topic:
+		return topicMatch(strings.Split(binding, "."), strings.Split(key, "."))
+	}
+	return binding == key
+}
+
+// topicMatch matches AMQP topic patterns: * is one word, # is zero or more.
+func topicMatch(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if topicMatch(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatch(pattern[1:], words[1:])
+	}
+	return len(words) > 0 && pattern[0] == words[0] && topicMatch(pattern[1:], words[1:])
+}
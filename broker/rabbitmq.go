@@ -0,0 +1,263 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// RabbitMQ implements Broker over one AMQP connection. Publishes go through
+// a confirm-mode channel and wait for the broker's ack; each subscription
+// gets its own channel.
+type RabbitMQ struct {
+	conn *amqp.Connection
+
+	topologyMu sync.Mutex
+	topology   *amqp.Channel // Declarations and inspection
+
+	publishMu sync.Mutex
+	publish   *amqp.Channel
+	confirms  chan amqp.Confirmation
+
+	consumersMu sync.Mutex
+	consumers   map[string]*amqp.Channel
+}
+
+// NewRabbitMQ dials url and opens the topology and publishing channels.
+func NewRabbitMQ(url string) (*RabbitMQ, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	topology, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	publish, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := publish.Confirm(false); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &RabbitMQ{
+		conn:      conn,
+		topology:  topology,
+		publish:   publish,
+		confirms:  publish.NotifyPublish(make(chan amqp.Confirmation, 1)),
+		consumers: make(map[string]*amqp.Channel),
+	}, nil
+}
+
+func (r *RabbitMQ) DeclareExchange(name, kind string) error {
+	return r.declare(func(ch *amqp.Channel) error {
+		return ch.ExchangeDeclare(
+			name,  // name
+			kind,  // type
+			true,  // durable
+			false, // auto-deleted
+			false, // internal
+			false, // no-wait
+			nil,   // arguments
+		)
+	})
+}
+
+func (r *RabbitMQ) DeclareQueue(name string, opts QueueOptions) (string, error) {
+	args := amqp.Table{}
+	if opts.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = opts.DeadLetterExchange
+		if opts.DeadLetterRoutingKey != "" {
+			args["x-dead-letter-routing-key"] = opts.DeadLetterRoutingKey
+		}
+	}
+	if opts.MessageTTL > 0 {
+		args["x-message-ttl"] = opts.MessageTTL.Milliseconds()
+	}
+	err := r.declare(func(ch *amqp.Channel) error {
+		q, err := ch.QueueDeclare(
+			name,            // name
+			opts.Durable,    // durable
+			opts.AutoDelete, // delete when unused
+			opts.Exclusive,  // exclusive
+			false,           // no-wait
+			args,            // arguments
+		)
+		name = q.Name
+		return err
+	})
+	return name, err
+}
+
+func (r *RabbitMQ) BindQueue(queue, exchange, routingKey string) error {
+	return r.onTopology(func(ch *amqp.Channel) error {
+		return ch.QueueBind(queue, routingKey, exchange, false, nil)
+	})
+}
+
+func (r *RabbitMQ) DeleteQueue(name string) error {
+	return r.onTopology(func(ch *amqp.Channel) error {
+		_, err := ch.QueueDelete(
+			name,  // name
+			false, // ifUnused (false = delete even if in use)
+			false, // ifEmpty (false = delete even if not empty)
+			false, // noWait
+		)
+		return err
+	})
+}
+
+func (r *RabbitMQ) QueueDepth(name string) (int, error) {
+	var depth int
+	err := r.onTopology(func(ch *amqp.Channel) error {
+		q, err := ch.QueueInspect(name)
+		depth = q.Messages
+		return err
+	})
+	return depth, err
+}
+
+// declare runs a declaration, reporting PRECONDITION_FAILED, RabbitMQ's
+// answer to redeclaring with other arguments, as ErrTopologyMismatch.
+func (r *RabbitMQ) declare(fn func(ch *amqp.Channel) error) error {
+	err := r.onTopology(fn)
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed {
+		return fmt.Errorf("%s: %w", amqpErr.Reason, ErrTopologyMismatch)
+	}
+	return err
+}
+
+// onTopology runs fn on the topology channel. A failed declaration closes an
+// AMQP channel, so the channel is reopened after any error.
+func (r *RabbitMQ) onTopology(fn func(ch *amqp.Channel) error) error {
+	r.topologyMu.Lock()
+	defer r.topologyMu.Unlock()
+	err := fn(r.topology)
+	if err != nil {
+		if ch, reopenErr := r.conn.Channel(); reopenErr == nil {
+			r.topology.Close()
+			r.topology = ch
+		}
+	}
+	return err
+}
+
+// Publish sends msg persistently and waits for the broker to confirm it.
+func (r *RabbitMQ) Publish(exchange, routingKey string, msg Message) error {
+	var expiration string
+	if msg.Expiration > 0 {
+		expiration = strconv.FormatInt(msg.Expiration.Milliseconds(), 10)
+	}
+
+	r.publishMu.Lock()
+	defer r.publishMu.Unlock()
+	err := r.publish.Publish(
+		exchange,   // exchange
+		routingKey, // routing key
+		false,      // mandatory
+		false,      // immediate
+		amqp.Publishing{
+			ContentType:   msg.ContentType,
+			DeliveryMode:  amqp.Persistent,
+			MessageId:     msg.MessageID,
+			CorrelationId: msg.CorrelationID,
+			ReplyTo:       msg.ReplyTo,
+			Expiration:    expiration,
+			Headers:       amqp.Table(msg.Headers),
+			Body:          msg.Body,
+		},
+	)
+	if err != nil {
+		return err
+	}
+	confirm, ok := <-r.confirms
+	if !ok {
+		return fmt.Errorf("publish channel closed before confirming")
+	}
+	if !confirm.Ack {
+		return fmt.Errorf("broker rejected message to %s/%s", exchange, routingKey)
+	}
+	return nil
+}
+
+func (r *RabbitMQ) Subscribe(queue, consumerTag string, prefetch int) (<-chan *Delivery, error) {
+	ch, err := r.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	if prefetch > 0 {
+		if err := ch.Qos(prefetch, 0, false); err != nil {
+			ch.Close()
+			return nil, err
+		}
+	}
+	deliveries, err := ch.Consume(
+		queue,       // queue
+		consumerTag, // consumer
+		false,       // auto-ack
+		false,       // exclusive
+		false,       // no-local
+		false,       // no-wait
+		nil,         // args
+	)
+	if err != nil {
+		ch.Close()
+		return nil, err
+	}
+	if consumerTag != "" {
+		r.consumersMu.Lock()
+		r.consumers[consumerTag] = ch
+		r.consumersMu.Unlock()
+	}
+
+	out := make(chan *Delivery)
+	go func() {
+		defer close(out)
+		for d := range deliveries {
+			d := d
+			out <- NewDelivery(Message{
+				Body:          d.Body,
+				ContentType:   d.ContentType,
+				MessageID:     d.MessageId,
+				CorrelationID: d.CorrelationId,
+				ReplyTo:       d.ReplyTo,
+				Headers:       map[string]interface{}(d.Headers),
+			},
+				func() error { return d.Ack(false) },
+				func(requeue bool) error { return d.Nack(false, requeue) })
+		}
+	}()
+	return out, nil
+}
+
+// Cancel stops the subscription. Its channel stays open so the delivery in
+// hand can still be acked; Close releases it.
+func (r *RabbitMQ) Cancel(consumerTag string) error {
+	r.consumersMu.Lock()
+	ch, ok := r.consumers[consumerTag]
+	r.consumersMu.Unlock()
+	if !ok {
+		return fmt.Errorf("no consumer %s", consumerTag)
+	}
+	return ch.Cancel(consumerTag, false)
+}
+
+// Close closes every channel and the connection.
+func (r *RabbitMQ) Close() error {
+	r.consumersMu.Lock()
+	for tag, ch := range r.consumers {
+		ch.Close()
+		delete(r.consumers, tag)
+	}
+	r.consumersMu.Unlock()
+	r.publish.Close()
+	r.topology.Close()
+	return r.conn.Close()
+}
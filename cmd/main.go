@@ -1,14 +1,19 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"my-chat-app/middleware"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	"my-chat-app/api"
+	"my-chat-app/broker"
 	"my-chat-app/config"
 	"my-chat-app/consumer"
 	"my-chat-app/repositories"
@@ -22,7 +27,6 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/streadway/amqp"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
@@ -97,6 +101,38 @@ var (
 		Name: "chat_app_dead_letter_messages_total",
 		Help: "Total number of messages sent to dead letter queue.",
 	})
+
+	consumerInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "chat_app_consumer_in_flight",
+		Help: "Messages taken from the queue and not yet handled by a worker.",
+	})
+
+	consumerWorkerLatency = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "chat_app_consumer_worker_duration_seconds",
+			Help:    "Time a consumer worker takes to handle a message.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"worker"},
+	)
+
+	deadLettersStored = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "chat_app_dead_letters",
+		Help: "Number of stored dead letters awaiting replay or purge.",
+	})
+
+	oldestDeadLetterAge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "chat_app_dead_letter_oldest_age_seconds",
+		Help: "Age of the oldest stored dead letter, 0 when there are none.",
+	})
+
+	wsDeliveries = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "chat_app_ws_deliveries_total",
+			Help: "WebSocket event deliveries by backpressure policy and outcome.",
+		},
+		[]string{"policy", "outcome"}, // Labels for slow-consumer policy and what happened to the event
+	)
 )
 
 // Gin middleware for HTTP request metrics
@@ -140,74 +176,103 @@ func main() {
 	// Wrap db
 	wrappedDB := &wrappedGormDB{db}
 
-	// Connect to RabbitMQ
-	conn, err := amqp.Dial(config.AppConfig.RabbitMQURL)
-	if err != nil {
-		log.Fatal("Failed to connect to RabbitMQ:", err)
-	}
-	defer conn.Close()
+	// Background goroutines stop when ctx is cancelled during shutdown.
+	ctx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
 
-	ch, err := conn.Channel()
+	// Connect to the message broker: RabbitMQ, or in-process with BROKER=memory
+	messageBroker, err := broker.Open(config.AppConfig)
 	if err != nil {
-		log.Fatal("Failed to open a channel:", err)
+		log.Fatal("Failed to connect to the message broker:", err)
 	}
-	defer ch.Close()
-
-	// Declare the queue
-	_, err = ch.QueueDeclare(
-		"chat_queue", // name
-		true,         // durable
-		false,        // delete when unused
-		false,        // exclusive
-		false,        // no-wait
-		nil,          // arguments
-	)
-	if err != nil {
-		log.Fatal("Failed to declare a queue:", err)
+
+	// Declare the exchanges and queues, or refuse to start if they were
+	// declared differently by another version
+	topology := consumer.ChatTopology()
+	if err := topology.Declare(messageBroker, config.AppConfig.BrokerMigrateTopology); err != nil {
+		log.Fatal("Failed to declare the broker topology: ", err)
 	}
 
 	// Initialize repositories. Use wrappedDB.DB
 	userRepo := repositories.NewUserRepository(wrappedDB.DB)       // Pass wrappedDB.DB
 	messageRepo := repositories.NewMessageRepository(wrappedDB.DB) // Pass wrappedDB.DB
 	groupRepo := repositories.NewGroupRepository(wrappedDB.DB)     // Pass wrappedDB.DB
+	callRepo := repositories.NewCallRepository(wrappedDB.DB)
 
 	// Initialize WebSocket hub
 	hub := websockets.NewHub()
+	hub.Backpressure = websockets.BackpressureFromConfig(config.AppConfig)
+	hub.DeliveryMetric = wsDeliveries
+	hub.Presence = websockets.NewPresence(hub, userRepo, config.AppConfig.PresenceIdleAfter, config.AppConfig.PresenceAwayAfter)
+	hub.Presence.StartSweeper(ctx, 30*time.Second)
+	hub.Ephemeral = websockets.NewEphemeral(hub, websockets.DefaultEphemeralKinds())
 	go hub.Run() // Run the hub in a separate goroutine
 
 	// Monitor active connections
 	go func() {
+		ticker := time.NewTicker(5 * time.Second) // Update every 5 seconds (adjust as needed)
+		defer ticker.Stop()
 		for {
-			activeConnections.Set(float64(len(hub.Clients)))
-			time.Sleep(5 * time.Second) // Update every 5 seconds (adjust as needed)
+			activeConnections.Set(float64(len(hub.ConnectionStats())))
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
 	// Initialize AI service
-	aiService, err := services.NewAIService()
+	aiService, err := services.NewAIService(config.AppConfig)
 	if err != nil {
-		log.Printf("Warning: Failed to initialize AI service: %v", err)
+		log.Printf("Warning: AI replies disabled: %v", err)
 	}
 
 	// Initialize services
 	jwtService := services.NewJWTService()
 	authService := services.NewAuthService(userRepo, jwtService)
-	chatService := services.NewChatService(messageRepo, groupRepo, userRepo, hub, aiService) // Inject the hub
+	outboxRepo := repositories.NewOutboxRepository(wrappedDB.DB)
+	deadLetterRepo := repositories.NewDeadLetterRepository(wrappedDB.DB)
+	eventPublisher, err := services.NewBrokerEventPublisher(messageBroker)
+	if err != nil {
+		log.Fatal("Failed to set up the event publisher:", err)
+	}
+	outboxRelay := services.NewOutboxRelay(outboxRepo, eventPublisher, hub, config.AppConfig.OutboxPollInterval, config.AppConfig.OutboxBatchSize, config.AppConfig.OutboxMaxAttempts)
+	outboxRelay.Start(ctx)
+	aiMemoryRepo := repositories.NewAIMemoryRepository(wrappedDB.DB)
+	aiContext := services.NewAIContextBuilder(messageRepo, userRepo, aiMemoryRepo, config.AppConfig.AIContextMessages, config.AppConfig.AIContextTokens)
+	personaRepo := repositories.NewGroupAISettingsRepository(wrappedDB.DB)
+	var aiTools *services.AIToolRegistry
+	if config.AppConfig.AIToolsEnabled {
+		aiTools = services.NewAIToolRegistry(messageRepo, groupRepo, userRepo, repositories.NewAIToolInvocationRepository(wrappedDB.DB))
+	}
+	chatService := services.NewChatService(messageRepo, groupRepo, userRepo, hub, aiService, aiContext, personaRepo, aiTools, outboxRelay) // Inject the hub
 	groupService := services.NewGroupService(groupRepo, userRepo, hub)
+	personaService := services.NewAIPersonaService(personaRepo, groupRepo, userRepo, config.AppConfig.AdminUserIDs)
+	deadLetterService := services.NewDeadLetterService(deadLetterRepo, messageBroker)
+	callService := services.NewCallService(callRepo, messageRepo, groupRepo, userRepo, hub, outboxRelay, config.AppConfig.CallRingTimeout, config.AppConfig.CallMaxParticipants)
+	hub.OnOffline = callService.Disconnected // End the calls of users who went away
 
 	// Initialize and start the cleanup service
 	cleanupService := services.NewCleanupService(userRepo)
-	cleanupService.StartCleanupScheduler(24 * time.Hour) // Run cleanup once a day
+	cleanupService.StartCleanupScheduler(ctx, 24*time.Hour) // Run cleanup once a day
 
 	// Initialize handlers
 	authHandler := api.NewAuthHandler(authService, userRepo)
-	chatHandler := api.NewChatHandler(chatService, hub, wrappedDB.DB, ch, jwtService) // Use wrappedDB.DB and Pass the amqp channel
+	chatHandler := api.NewChatHandler(chatService, callService, hub, wrappedDB.DB, messageBroker, jwtService) // Use wrappedDB.DB and Pass the broker
 	groupHandler := api.NewGroupHandler(groupService)
+	personaHandler := api.NewAIPersonaHandler(personaService)
+	eventsHandler := api.NewEventsHandler(ctx, hub, groupService)
+	callHandler := api.NewCallHandler(callService)
+	deadLetterHandler := api.NewDeadLetterHandler(deadLetterService)
 
 	// Expose Prometheus metrics
+	http.Handle("/metrics", promhttp.Handler())
+	metricsServer := &http.Server{Addr: ":6060"}
 	go func() {
-		http.Handle("/metrics", promhttp.Handler())
-		log.Fatal(http.ListenAndServe(":6060", nil))
+		if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
 	}()
 
 	// Initialize Gin router
@@ -246,6 +311,10 @@ func main() {
 		// WebSocket route
 		protected.GET("/ws", chatHandler.WebSocketHandler)
 
+		// Fallback transports for networks that block WebSocket upgrades
+		protected.GET("/events", eventsHandler.ServerSentEvents)
+		protected.GET("/poll", eventsHandler.LongPoll)
+
 		// Message routes
 		protected.GET("/messages", chatHandler.GetConversation)
 		protected.POST("/messages", func(c *gin.Context) {
@@ -265,11 +334,33 @@ func main() {
 		protected.GET("/groups", groupHandler.GetAllGroups)
 		protected.GET("/groups/:id/messages", chatHandler.GetGroupConversation)
 		protected.GET("/groups/:id/members", groupHandler.GetGroupMembers)
+		protected.GET("/groups/:id/ai-personas", personaHandler.List)
+		protected.PUT("/groups/:id/ai-personas/:handle", personaHandler.Save)
+		protected.DELETE("/groups/:id/ai-personas/:handle", personaHandler.Delete)
+
+		// Call history
+		protected.GET("/calls", callHandler.ListCalls)
 
 		// File upload route
 		protected.POST("/upload", chatHandler.UploadFile)
 	}
 
+	// Admin routes, for the users listed in ADMIN_USER_IDS
+	admin := protected.Group("/admin")
+	admin.Use(middleware.AdminOnly(config.AppConfig.AdminUserIDs))
+	{
+		// Dead letters: messages the consumer gave up on
+		admin.GET("/dead-letters", deadLetterHandler.List)
+		admin.GET("/dead-letters/:id", deadLetterHandler.Get)
+		admin.POST("/dead-letters/replay", deadLetterHandler.ReplayBulk)
+		admin.POST("/dead-letters/:id/replay", deadLetterHandler.Replay)
+		admin.DELETE("/dead-letters", deadLetterHandler.Purge)
+		admin.DELETE("/dead-letters/:id", deadLetterHandler.Delete)
+
+		// Traffic counters of every open WebSocket connection, by user
+		admin.GET("/ws/stats", chatHandler.WebSocketStats)
+	}
+
 	// Serve static files from 'frontend/dist', but under a /static prefix
 	r.Static("/static", "./frontend/dist")
 
@@ -289,50 +380,136 @@ func main() {
 	})
 
 	// --- START CONSUMER
-	go func() {
-		consumerService, err := consumer.NewConsumer(
-			config.AppConfig.RabbitMQURL,
-			chatService,
-			messageRetryCount,
-			deadLetterMessages,
-		)
-		if err != nil {
-			log.Fatalf("Failed to create consumer: %v", err)
-		}
+	consumerService := consumer.NewConsumer(
+		messageBroker,
+		chatService,
+		consumer.OptionsFromConfig(config.AppConfig),
+		messageRetryCount,
+		deadLetterMessages,
+	)
+	consumerService.InFlightMetric = consumerInFlight
+	consumerService.LatencyMetric = consumerWorkerLatency
 
-		// Wrap the consumer's message processing to increment a counter
-		wrappedChatService := &wrappedChatService{
-			ChatService: consumerService.ChatService,
-		}
-		consumerService.ChatService = wrappedChatService
+	// Wrap the consumer's message processing to increment a counter
+	wrappedChatService := &wrappedChatService{
+		ChatService: consumerService.ChatService,
+	}
+	consumerService.ChatService = wrappedChatService
 
-		// Start processing the dead letter queue
-		if err := consumerService.ProcessDeadLetterQueue(); err != nil {
-			log.Printf("Failed to start DLQ consumer: %v", err)
+	// AI replies are generated by their own consumer
+	aiConsumer := consumer.NewAIConsumer(messageBroker, chatService, consumer.AIOptionsFromConfig(config.AppConfig))
+	if err := aiConsumer.StartConsuming(); err != nil {
+		log.Fatal("Failed to start the AI consumer:", err)
+	}
+
+	// Start processing the dead letter queue
+	if err := consumerService.ProcessDeadLetterQueue(deadLetterRepo); err != nil {
+		log.Printf("Failed to start DLQ consumer: %v", err)
+	}
+
+	// Monitor messages in queue
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		for {
+			depth, err := messageBroker.QueueDepth("chat_queue")
+			if err != nil {
+				log.Printf("Failed to inspect queue: %v", err)
+			} else {
+				messagesInQueue.Set(float64(depth))
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
 		}
+	}()
 
-		// Monitor messages in queue
-		go func() {
-			for {
-				q, err := ch.QueueInspect("chat_queue") // Use QueueInspect to get queue stats
-				if err != nil {
-					log.Printf("Failed to inspect queue: %v", err)
-				} else {
-					messagesInQueue.Set(float64(q.Messages)) // Get message from Queue
+	// Monitor stored dead letters
+	go func() {
+		ticker := time.NewTicker(15 * time.Second)
+		defer ticker.Stop()
+		for {
+			count, oldest, err := deadLetterRepo.Stats()
+			if err != nil {
+				log.Printf("Failed to read dead letter stats: %v", err)
+			} else {
+				deadLettersStored.Set(float64(count))
+				age := 0.0
+				if oldest != nil {
+					age = time.Since(*oldest).Seconds()
 				}
-				time.Sleep(5 * time.Second)
+				oldestDeadLetterAge.Set(age)
 			}
-		}()
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
 
+	go func() {
 		if err := consumerService.StartConsuming(); err != nil {
 			log.Fatalf("Consumer error: %v", err)
 		}
-
 	}()
 
 	// Start the server
-	log.Printf("Server listening on port %s", config.AppConfig.AppPort)
-	log.Fatal(http.ListenAndServe(":"+config.AppConfig.AppPort, r))
+	server := &http.Server{Addr: ":" + config.AppConfig.AppPort, Handler: r}
+	go func() {
+		log.Printf("Server listening on port %s", config.AppConfig.AppPort)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// Wait for a deploy or Ctrl+C, then drain within the configured deadline.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Printf("Received %s, shutting down (deadline %s)", sig, config.AppConfig.ShutdownTimeout)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.AppConfig.ShutdownTimeout)
+	defer cancel()
+	shutdown(shutdownCtx, server, metricsServer, hub, consumerService, aiConsumer, stopBackground, messageBroker, db)
+}
+
+// shutdown stops accepting connections, tells connected clients to reconnect
+// elsewhere, lets the consumer ack its current delivery, and then closes the
+// message broker and the database, in that order.
+func shutdown(ctx context.Context, server, metricsServer *http.Server, hub *websockets.Hub, consumerService *consumer.Consumer, aiConsumer *consumer.AIConsumer, stopBackground context.CancelFunc, messageBroker broker.Broker, db *gorm.DB) {
+	// Shutdown closes the listener at once but waits for SSE and long-poll
+	// requests, which only finish after the hub closes their clients.
+	serverDone := make(chan error, 1)
+	go func() { serverDone <- server.Shutdown(ctx) }()
+
+	hub.Shutdown(config.AppConfig.ShutdownReconnectWithin)
+
+	if err := <-serverDone; err != nil {
+		log.Printf("Shutdown: HTTP server: %v", err)
+	}
+	if err := consumerService.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown: consumer did not finish in time: %v", err)
+	}
+	if err := aiConsumer.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown: AI consumer did not finish in time: %v", err)
+	}
+	stopBackground()
+
+	if err := messageBroker.Close(); err != nil {
+		log.Printf("Shutdown: Error closing the message broker: %v", err)
+	}
+	if sqlDB, err := db.DB(); err == nil {
+		if err := sqlDB.Close(); err != nil {
+			log.Printf("Shutdown: Error closing database: %v", err)
+		}
+	}
+	if err := metricsServer.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown: metrics server: %v", err)
+	}
+	log.Printf("Shutdown complete")
 }
 
 // CORSMiddleware handles Cross-Origin Resource Sharing (CORS)
@@ -357,9 +534,9 @@ type wrappedChatService struct {
 	services.ChatService
 }
 
-func (w *wrappedChatService) SendMessage(senderID, receiverID, groupID, content, replyToMessageID, fileName, filePath, fileType string, fileSize int64, checksum string) (string, error) {
+func (w *wrappedChatService) SendMessage(senderID, receiverID, groupID, content, replyToMessageID, fileName, filePath, fileType string, fileSize int64, checksum, clientMessageID string) (string, error) {
 	messagesReceived.Inc() // Increment received message.
-	return w.ChatService.SendMessage(senderID, receiverID, groupID, content, replyToMessageID, fileName, filePath, fileType, fileSize, checksum)
+	return w.ChatService.SendMessage(senderID, receiverID, groupID, content, replyToMessageID, fileName, filePath, fileType, fileSize, checksum, clientMessageID)
 }
 
 // Helper function to wrap gorm.DB for counting database query.
@@ -0,0 +1,154 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"my-chat-app/broker"
+	"my-chat-app/config"
+	"my-chat-app/services"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// AI jobs are retried fewer times than messages: the sender is watching
+	// the typing indicator meanwhile.
+	AIMaxRetryCount = 3
+
+	aiJobsQueue        = "ai_jobs"
+	aiRetryQueuePrefix = "ai_retry_"
+	aiConsumerTag      = "ai_consumer"
+)
+
+// AIConsumer answers AI jobs off the message hot path: a slow or failing AI
+// provider delays the AI's reply, never the user's message.
+type AIConsumer struct {
+	broker      broker.Broker
+	chatService services.ChatService
+	options     Options
+
+	// Closed once the workers have handled their last job.
+	done chan struct{}
+}
+
+// AIOptionsFromConfig reads the AI consumer settings from cfg. Jobs are
+// independent, so each worker takes the next one and prefetch matches the
+// worker count.
+func AIOptionsFromConfig(cfg config.Config) Options {
+	return Options{
+		Workers:        cfg.AIWorkers,
+		Prefetch:       cfg.AIWorkers,
+		RetryBaseDelay: cfg.ConsumerRetryBaseDelay,
+	}
+}
+
+// NewAIConsumer consumes ai_jobs; ChatTopology must already be declared.
+func NewAIConsumer(b broker.Broker, chatService services.ChatService, options Options) *AIConsumer {
+	return &AIConsumer{
+		broker:      b,
+		chatService: chatService,
+		options:     options,
+		done:        make(chan struct{}),
+	}
+}
+
+// StartConsuming answers jobs on the configured number of workers until
+// Shutdown.
+func (c *AIConsumer) StartConsuming() error {
+	jobs, err := c.broker.Subscribe(aiJobsQueue, aiConsumerTag, c.options.Prefetch)
+	if err != nil {
+		return err
+	}
+
+	workers := c.options.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range jobs {
+				c.handle(d)
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(c.done)
+	}()
+
+	log.Printf(" [*] Waiting for AI jobs with %d workers", workers)
+	return nil
+}
+
+// handle answers one job. Transient failures are retried up to
+// AIMaxRetryCount times with exponential backoff; after that, or at once for
+// permanent failures, the sender gets an apology instead.
+func (c *AIConsumer) handle(d *broker.Delivery) {
+	var job services.AIJob
+	if err := json.Unmarshal(d.Body, &job); err != nil {
+		log.Printf("AIConsumer: Dropping malformed job: %v", err)
+		d.Ack()
+		return
+	}
+
+	err := c.chatService.ProcessAIJob(job)
+	if err == nil {
+		d.Ack()
+		return
+	}
+	log.Printf("AIConsumer: Error answering message %s: %v", job.MessageID, err)
+
+	attempt := retryCount(d.Headers)
+	if services.IsPermanent(err) || attempt >= AIMaxRetryCount {
+		c.fail(d, job)
+		return
+	}
+
+	attempt++
+	delay := jittered(retryDelay(c.options.RetryBaseDelay, attempt))
+	log.Printf("AIConsumer: Retrying message %s in %s, attempt %d of %d", job.MessageID, delay, attempt, AIMaxRetryCount)
+	if err := scheduleRetry(c.broker, aiRetryQueue(attempt), d, attempt, delay); err != nil {
+		log.Printf("AIConsumer: Error scheduling retry: %v", err)
+		if err := retryInPlace(c.broker, aiJobsQueue, d, attempt, delay); err != nil {
+			log.Printf("AIConsumer: Error requeueing message %s, giving up: %v", job.MessageID, err)
+			c.fail(d, job)
+			return
+		}
+	}
+	d.Ack()
+}
+
+// fail gives up on job and posts the apology. If that cannot be saved either,
+// the job goes back on the queue to post it later.
+func (c *AIConsumer) fail(d *broker.Delivery, job services.AIJob) {
+	if err := c.chatService.FailAIJob(job); err != nil {
+		log.Printf("AIConsumer: Error posting failure reply to %s: %v", job.MessageID, err)
+		time.Sleep(c.options.RetryBaseDelay)
+		d.Nack(true)
+		return
+	}
+	d.Ack()
+}
+
+func aiRetryQueue(attempt int) string {
+	return aiRetryQueuePrefix + strconv.Itoa(attempt)
+}
+
+// Shutdown stops taking jobs and waits for the workers to finish the ones in
+// hand, or for ctx to be done.
+func (c *AIConsumer) Shutdown(ctx context.Context) error {
+	if err := c.broker.Cancel(aiConsumerTag); err != nil {
+		log.Printf("AIConsumer: Error cancelling %s: %v", aiConsumerTag, err)
+	}
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
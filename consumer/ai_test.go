@@ -0,0 +1,112 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"my-chat-app/broker"
+	"my-chat-app/services"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// flakyAIChatService fails the first failures jobs and records the outcome.
+type flakyAIChatService struct {
+	services.ChatService
+
+	mu       sync.Mutex
+	failures int
+	attempts int
+	answered chan services.AIJob
+	failed   chan services.AIJob
+}
+
+func (s *flakyAIChatService) ProcessAIJob(job services.AIJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts++
+	if s.attempts <= s.failures {
+		return errors.New("AI provider unavailable")
+	}
+	s.answered <- job
+	return nil
+}
+
+func (s *flakyAIChatService) FailAIJob(job services.AIJob) error {
+	s.failed <- job
+	return nil
+}
+
+// startAIConsumer runs an AI consumer on an in-memory broker and returns the
+// broker.
+func startAIConsumer(t *testing.T, chatService services.ChatService) broker.Broker {
+	t.Helper()
+	b := broker.NewMemory()
+	if err := ChatTopology().Declare(b, false); err != nil {
+		t.Fatalf("Declare failed: %v", err)
+	}
+	c := NewAIConsumer(b, chatService, Options{Workers: 2, Prefetch: 2, RetryBaseDelay: testRetryBaseDelay})
+	if err := c.StartConsuming(); err != nil {
+		t.Fatalf("StartConsuming failed: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		c.Shutdown(ctx)
+	})
+	return b
+}
+
+// publishAIJob publishes a job the way the outbox relay does.
+func publishAIJob(t *testing.T, b broker.Broker) services.AIJob {
+	t.Helper()
+	job := services.AIJob{MessageID: uuid.New().String(), SenderID: uuid.New().String(), Content: "@AI hi"}
+	body, _ := json.Marshal(job)
+	if err := b.Publish(services.EventsExchange, services.AIJobTopic, broker.Message{Body: body}); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	return job
+}
+
+func TestAIConsumerRetriesJobs(t *testing.T) {
+	chatService := &flakyAIChatService{failures: 2, answered: make(chan services.AIJob, 1), failed: make(chan services.AIJob, 1)}
+	b := startAIConsumer(t, chatService)
+
+	job := publishAIJob(t, b)
+
+	select {
+	case answered := <-chatService.answered:
+		if answered != job {
+			t.Errorf("answered %+v, want %+v", answered, job)
+		}
+	case <-chatService.failed:
+		t.Fatal("job failed, want it answered after retrying")
+	case <-time.After(2 * time.Second):
+		t.Fatal("job was not answered")
+	}
+	if chatService.attempts != 3 {
+		t.Errorf("attempts = %d, want 3", chatService.attempts)
+	}
+}
+
+func TestAIConsumerPostsFailureAfterMaxRetries(t *testing.T) {
+	chatService := &flakyAIChatService{failures: AIMaxRetryCount + 1, answered: make(chan services.AIJob, 1), failed: make(chan services.AIJob, 1)}
+	b := startAIConsumer(t, chatService)
+
+	job := publishAIJob(t, b)
+
+	select {
+	case failed := <-chatService.failed:
+		if failed != job {
+			t.Errorf("failed %+v, want %+v", failed, job)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("job did not fail")
+	}
+	if chatService.attempts != AIMaxRetryCount+1 {
+		t.Errorf("attempts = %d, want %d", chatService.attempts, AIMaxRetryCount+1)
+	}
+}
@@ -1,266 +1,342 @@
 package consumer
 
 import (
+	"context"
 	"encoding/json"
 	"log"
+	"math/rand"
+	"my-chat-app/broker"
+	"my-chat-app/models"
+	"my-chat-app/repositories"
 	"my-chat-app/services"
 	"my-chat-app/websockets"
 	"strconv"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/streadway/amqp"
 )
 
 const (
 	MaxRetryCount    = 5
 	RetryCountHeader = "x-retry-count"
+
+	// Set on dead-lettered messages and persisted with them.
+	FailureReasonHeader = "x-failure-reason"
+	FailedAtHeader      = "x-failed-at"
+	FailedQueueHeader   = "x-failed-queue"
+
+	// How long to wait before retrying a dead letter that could not be stored.
+	deadLetterStoreBackoff = time.Second
+
+	// Failed messages wait in chat_retry_<attempt> until their expiration,
+	// which doubles with each attempt, and then dead-letter back to
+	// chat_queue through requeueExchange.
+	retryQueuePrefix = "chat_retry_"
+	requeueExchange  = "chat_requeue"
+	// Each retry waits up to this fraction less than its attempt's delay, so that
+	// messages failing together do not all come back at once.
+	retryJitter = 0.2
+
+	consumerTag    = "chat_consumer"
+	dlqConsumerTag = "chat_dlq_consumer"
 )
 
 type Consumer struct {
-	conn             *amqp.Connection
-	channel          *amqp.Channel
+	broker           broker.Broker
 	ChatService      services.ChatService
 	queueName        string
 	dlxName          string // Dead Letter Exchange name
 	dlqName          string // Dead Letter Queue name
+	options          Options
 	retryMetric      *prometheus.CounterVec
 	deadLetterMetric prometheus.Counter
+
+	// Optional: deliveries being handled, and handling time by worker.
+	InFlightMetric prometheus.Gauge
+	LatencyMetric  *prometheus.HistogramVec
+
+	// Closed once the delivery loop has handled its last message.
+	done chan struct{}
 }
 
-func NewConsumer(amqpURL string, chatService services.ChatService,
-	retryMetric *prometheus.CounterVec, deadLetterMetric prometheus.Counter) (*Consumer, error) {
-	conn, err := amqp.Dial(amqpURL)
-	if err != nil {
-		return nil, err
+// NewConsumer consumes chat_queue; ChatTopology must already be declared.
+func NewConsumer(b broker.Broker, chatService services.ChatService, options Options,
+	retryMetric *prometheus.CounterVec, deadLetterMetric prometheus.Counter) *Consumer {
+	return &Consumer{
+		broker:           b,
+		ChatService:      chatService,
+		queueName:        chatQueue,
+		dlxName:          deadLetterExchange,
+		dlqName:          deadLetterQueue,
+		options:          options,
+		retryMetric:      retryMetric,
+		deadLetterMetric: deadLetterMetric,
+		done:             make(chan struct{}),
 	}
+}
 
-	channel, err := conn.Channel()
+// StartConsuming hands deliveries to the worker pool and blocks until
+// Shutdown.
+func (c *Consumer) StartConsuming() error {
+	msgs, err := c.broker.Subscribe(c.queueName, consumerTag, c.options.Prefetch)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	// First, try to delete the existing queue if it exists
-	// This is necessary because we can't modify the arguments of an existing queue
-	_, err = channel.QueueDelete(
-		"chat_queue", // name
-		false,        // ifUnused (false = delete even if in use)
-		false,        // ifEmpty (false = delete even if not empty)
-		false,        // noWait
-	)
-	// Ignore the error - it might not exist yet
-
-	// Declare the Dead Letter Exchange
-	dlxName := "chat_dlx"
-	err = channel.ExchangeDeclare(
-		dlxName,  // name
-		"direct", // type
-		true,     // durable
-		false,    // auto-deleted
-		false,    // internal
-		false,    // no-wait
-		nil,      // arguments
-	)
-	if err != nil {
-		return nil, err
+	go func() {
+		// The channel closes when Shutdown cancels the consumer.
+		defer close(c.done)
+		c.dispatch(msgs)
+	}()
+
+	log.Printf(" [*] Waiting for messages with %d workers. To exit press CTRL+C", c.options.Workers)
+	<-c.done
+
+	return nil
+}
+
+// handle saves one delivery. Transient failures are retried up to
+// MaxRetryCount times with exponential backoff before the message is
+// dead-lettered; permanent ones are dead-lettered at once.
+func (c *Consumer) handle(d *broker.Delivery) {
+	log.Printf("Received a message: %s", d.Body)
+
+	retryCount := retryCount(d.Headers)
+
+	var wsMessage websockets.WebSocketMessage
+	if err := json.Unmarshal(d.Body, &wsMessage); err != nil {
+		log.Printf("Error unmarshaling message: %v", err)
+		// Don't retry parse errors - send directly to DLQ
+		c.deadLetterMetric.Inc() // Increment dead letter counter
+		c.reply(d, Reply{Status: ReplyFailed, Error: "malformed message: " + err.Error()})
+		c.deadLetter(d, "malformed message: "+err.Error())
+		return
 	}
 
-	// Declare the Dead Letter Queue
-	dlqName := "chat_dlq"
-	_, err = channel.QueueDeclare(
-		dlqName, // name
-		true,    // durable
-		false,   // delete when unused
-		false,   // exclusive
-		false,   // no-wait
-		nil,     // arguments
+	// Process the message
+	messageID, err := c.ChatService.SendMessage(
+		wsMessage.SenderID,
+		wsMessage.ReceiverID,
+		wsMessage.GroupID,
+		wsMessage.Content,
+		wsMessage.ReplyToMessageID,
+		wsMessage.FileName,
+		wsMessage.FilePath,
+		wsMessage.FileType,
+		wsMessage.FileSize,
+		wsMessage.FileChecksum,
+		wsMessage.ClientMessageID,
 	)
-	if err != nil {
-		return nil, err
+	if err == nil {
+		// Successfully processed
+		c.replySaved(d, messageID)
+		d.Ack()
+		return
 	}
 
-	// Bind the Dead Letter Queue to the Dead Letter Exchange
-	err = channel.QueueBind(
-		dlqName,  // queue name
-		"failed", // routing key
-		dlxName,  // exchange
-		false,    // no-wait
-		nil,      // arguments
-	)
-	if err != nil {
-		return nil, err
+	log.Printf("Error processing message: %v", err)
+
+	if services.IsPermanent(err) {
+		log.Printf("Message cannot succeed, sending to DLQ")
+		c.deadLetterMetric.Inc() // Increment dead letter counter
+		c.reply(d, Reply{Status: ReplyFailed, Error: err.Error()})
+		c.deadLetter(d, err.Error())
+		return
 	}
 
-	// Declare the main queue with dead letter configuration
-	args := amqp.Table{
-		"x-dead-letter-exchange":    dlxName,
-		"x-dead-letter-routing-key": "failed",
+	// Check if we've reached max retries
+	if retryCount >= MaxRetryCount {
+		log.Printf("Message failed after %d retries, sending to DLQ", MaxRetryCount)
+		c.deadLetterMetric.Inc() // Increment dead letter counter
+		c.reply(d, Reply{Status: ReplyFailed, Error: err.Error()})
+		c.deadLetter(d, err.Error())
+		return
 	}
 
-	_, err = channel.QueueDeclare(
-		"chat_queue", // name
-		true,         // durable
-		false,        // delete when unused
-		false,        // exclusive
-		false,        // no-wait
-		args,         // arguments with DLX configuration
-	)
+	// Increment retry count and park the message until its retry is due
+	retryCount++
+	delay := jittered(retryDelay(c.options.RetryBaseDelay, retryCount))
+	log.Printf("Retrying message in %s, attempt %d of %d", delay, retryCount, MaxRetryCount)
+
+	// Increment retry metric with the attempt number
+	c.retryMetric.WithLabelValues(strconv.Itoa(retryCount)).Inc()
+
+	err = scheduleRetry(c.broker, retryQueue(retryCount), d, retryCount, delay)
 	if err != nil {
-		return nil, err
+		log.Printf("Error scheduling retry: %v", err)
+		if err := retryInPlace(c.broker, c.queueName, d, retryCount, delay); err != nil {
+			log.Printf("Error requeueing message, sending to DLQ: %v", err)
+			c.deadLetterMetric.Inc() // Increment dead letter counter
+			c.reply(d, Reply{Status: ReplyFailed, Error: err.Error()})
+			c.deadLetter(d, "could not schedule retry: "+err.Error())
+			return
+		}
 	}
 
-	return &Consumer{
-		conn:             conn,
-		channel:          channel,
-		ChatService:      chatService,
-		queueName:        "chat_queue",
-		dlxName:          dlxName,
-		dlqName:          dlqName,
-		retryMetric:      retryMetric,
-		deadLetterMetric: deadLetterMetric,
-	}, nil
+	// Acknowledge the original message
+	d.Ack()
 }
 
-func (c *Consumer) StartConsuming() error {
-	msgs, err := c.channel.Consume(
-		c.queueName, // queue
-		"",          // consumer
-		false,       // auto-ack  <-- CRITICAL: Set to false!
-		false,       // exclusive
-		false,       // no-local
-		false,       // no-wait
-		nil,         // args
-	)
-	if err != nil {
-		return err
-	}
+func retryQueue(attempt int) string {
+	return retryQueuePrefix + strconv.Itoa(attempt)
+}
 
-	forever := make(chan bool)
+// scheduleRetry parks a copy of d in queue, from where it dead-letters back
+// after delay, recording the attempt in RetryCountHeader. The reply address is
+// kept for a sender still waiting on the outcome.
+func scheduleRetry(p broker.Publisher, queue string, d *broker.Delivery, attempt int, delay time.Duration) error {
+	return p.Publish(
+		"",    // exchange
+		queue, // routing key
+		broker.Message{
+			ContentType:   "application/json",
+			Body:          d.Body,
+			Headers:       map[string]interface{}{RetryCountHeader: attempt},
+			ReplyTo:       d.ReplyTo,
+			CorrelationID: d.CorrelationID,
+			Expiration:    delay,
+		},
+	)
+}
 
-	go func() {
-		for d := range msgs {
-			log.Printf("Received a message: %s", d.Body)
-
-			// Check retry count from headers
-			retryCount := 0
-			if d.Headers != nil {
-				if count, exists := d.Headers[RetryCountHeader]; exists {
-					if countInt, ok := count.(int32); ok {
-						retryCount = int(countInt)
-					}
-				}
-			}
+// retryInPlace is the fallback when the retry queue cannot take d: it waits
+// out delay here and puts a copy of d, still counting attempt, straight back
+// on queue.
+func retryInPlace(p broker.Publisher, queue string, d *broker.Delivery, attempt int, delay time.Duration) error {
+	time.Sleep(delay)
+	return scheduleRetry(p, queue, d, attempt, 0)
+}
 
-			var wsMessage websockets.WebSocketMessage
-			if err := json.Unmarshal(d.Body, &wsMessage); err != nil {
-				log.Printf("Error unmarshaling message: %v", err)
-				// Don't retry parse errors - send directly to DLQ
-				c.deadLetterMetric.Inc() // Increment dead letter counter
-				d.Nack(false, false)
-				continue
-			}
+// retryDelay is how long the given attempt waits: base, doubling per attempt.
+func retryDelay(base time.Duration, attempt int) time.Duration {
+	return base << (attempt - 1)
+}
 
-			// Process the message
-			_, err := c.ChatService.SendMessage(
-				wsMessage.SenderID,
-				wsMessage.ReceiverID,
-				wsMessage.GroupID,
-				wsMessage.Content,
-				wsMessage.ReplyToMessageID,
-				wsMessage.FileName,
-				wsMessage.FilePath,
-				wsMessage.FileType,
-				wsMessage.FileSize,
-				wsMessage.FileChecksum,
-			)
-
-			if err != nil {
-				log.Printf("Error processing message: %v", err)
-
-				// Check if we've reached max retries
-				if retryCount >= MaxRetryCount {
-					log.Printf("Message failed after %d retries, sending to DLQ", MaxRetryCount)
-					c.deadLetterMetric.Inc() // Increment dead letter counter
-					d.Nack(false, false)     // Don't requeue, will go to DLQ
-				} else {
-					// Increment retry count and republish
-					retryCount++
-					log.Printf("Retrying message, attempt %d of %d", retryCount, MaxRetryCount)
-
-					// Increment retry metric with the attempt number
-					c.retryMetric.WithLabelValues(strconv.Itoa(retryCount)).Inc()
-
-					// Create headers for the next attempt
-					headers := amqp.Table{
-						RetryCountHeader: retryCount,
-					}
-
-					// Republish with updated retry count
-					err = c.channel.Publish(
-						"",          // exchange
-						c.queueName, // routing key
-						false,       // mandatory
-						false,       // immediate
-						amqp.Publishing{
-							ContentType: "application/json",
-							Body:        d.Body,
-							Headers:     headers,
-						},
-					)
-
-					if err != nil {
-						log.Printf("Error republishing message: %v", err)
-					}
-
-					// Acknowledge the original message
-					d.Ack(false)
-				}
-			} else {
-				// Successfully processed
-				d.Ack(false)
-			}
-		}
-	}()
+// jittered shortens delay by a random amount of up to retryJitter of it.
+func jittered(delay time.Duration) time.Duration {
+	if spread := int64(float64(delay) * retryJitter); spread > 0 {
+		delay -= time.Duration(rand.Int63n(spread))
+	}
+	return delay
+}
 
-	log.Printf(" [*] Waiting for messages. To exit press CTRL+C")
-	<-forever
+// deadLetter sends d to the DLQ with why and when it failed. If that publish
+// fails, rejecting d still dead-letters it through the queue's DLX, only
+// without the failure details.
+func (c *Consumer) deadLetter(d *broker.Delivery, reason string) {
+	headers := make(map[string]interface{}, len(d.Headers)+3)
+	for key, value := range d.Headers {
+		headers[key] = value
+	}
+	headers[FailureReasonHeader] = reason
+	headers[FailedAtHeader] = time.Now().UTC().Format(time.RFC3339Nano)
+	headers[FailedQueueHeader] = c.queueName
+
+	err := c.broker.Publish(c.dlxName, deadLetterRoutingKey, broker.Message{
+		ContentType:   d.ContentType,
+		CorrelationID: d.CorrelationID,
+		Headers:       headers,
+		Body:          d.Body,
+	})
+	if err != nil {
+		log.Printf("Error publishing to DLQ, rejecting instead: %v", err)
+		d.Nack(false) // Don't requeue, will go to DLQ
+		return
+	}
+	d.Ack()
+}
 
-	return nil
+// retryCount reads RetryCountHeader. AMQP decodes it as int32; the memory
+// broker keeps the int it was published with.
+func retryCount(headers map[string]interface{}) int {
+	switch count := headers[RetryCountHeader].(type) {
+	case int:
+		return count
+	case int32:
+		return int(count)
+	case int64:
+		return int(count)
+	}
+	return 0
 }
 
-// Add a method to process failed messages from DLQ if needed
-func (c *Consumer) ProcessDeadLetterQueue() error {
-	msgs, err := c.channel.Consume(
-		c.dlqName, // queue
-		"",        // consumer
-		false,     // auto-ack
-		false,     // exclusive
-		false,     // no-local
-		false,     // no-wait
-		nil,       // args
-	)
+// ProcessDeadLetterQueue stores DLQ messages in store for inspection and
+// replay. A message that cannot be stored goes back to the DLQ.
+func (c *Consumer) ProcessDeadLetterQueue(store repositories.DeadLetterRepository) error {
+	msgs, err := c.broker.Subscribe(c.dlqName, dlqConsumerTag, 1)
 	if err != nil {
 		return err
 	}
 
 	go func() {
 		for d := range msgs {
-			log.Printf("Processing dead letter message: %s", d.Body)
-			// Here you could implement logic to handle failed messages
-			// For example, storing them in a database for later analysis
-
-			// Acknowledge the message from DLQ
-			d.Ack(false)
+			deadLetter := newDeadLetter(d, c.queueName)
+			if err := store.Create(deadLetter); err != nil {
+				log.Printf("Error storing dead letter: %v", err)
+				time.Sleep(deadLetterStoreBackoff)
+				d.Nack(true)
+				continue
+			}
+			log.Printf("Stored dead letter %s: %s", deadLetter.ID, deadLetter.FailureReason)
+			d.Ack()
 		}
 	}()
 
 	return nil
 }
 
-func (c *Consumer) Close() {
-	if c.channel != nil {
-		c.channel.Close()
+// newDeadLetter reads the failure details set by deadLetter. Messages rejected
+// without them are attributed to defaultQueue at the time they are read.
+func newDeadLetter(d *broker.Delivery, defaultQueue string) *models.DeadLetter {
+	headers := make(map[string]interface{}, len(d.Headers))
+	for key, value := range d.Headers {
+		headers[key] = value
+	}
+	deadLetter := &models.DeadLetter{
+		ID:            uuid.New(),
+		Queue:         defaultQueue,
+		Body:          string(d.Body),
+		ContentType:   d.ContentType,
+		CorrelationID: d.CorrelationID,
+		RetryCount:    retryCount(headers),
+		FailedAt:      time.Now(),
+	}
+	if queue, ok := headers[FailedQueueHeader].(string); ok && queue != "" {
+		deadLetter.Queue = queue
+	}
+	if reason, ok := headers[FailureReasonHeader].(string); ok {
+		deadLetter.FailureReason = reason
+	}
+	if failedAt, ok := headers[FailedAtHeader].(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, failedAt); err == nil {
+			deadLetter.FailedAt = t
+		}
+	}
+	delete(headers, FailureReasonHeader)
+	delete(headers, FailedAtHeader)
+	delete(headers, FailedQueueHeader)
+	if len(headers) > 0 {
+		if encoded, err := json.Marshal(headers); err == nil {
+			deadLetter.Headers = encoded
+		}
+	}
+	return deadLetter
+}
+
+// Shutdown stops taking deliveries and waits for the message being processed
+// to be acked. Unacked prefetched messages go back to the queue. It gives up
+// waiting when ctx is done. The broker is left open for its owner to close.
+func (c *Consumer) Shutdown(ctx context.Context) error {
+	for _, tag := range []string{consumerTag, dlqConsumerTag} {
+		if err := c.broker.Cancel(tag); err != nil {
+			log.Printf("Consumer: Error cancelling %s: %v", tag, err)
+		}
 	}
-	if c.conn != nil {
-		c.conn.Close()
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
@@ -0,0 +1,275 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"my-chat-app/broker"
+	"my-chat-app/models"
+	"my-chat-app/repositories"
+	"my-chat-app/services"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const testRetryBaseDelay = 5 * time.Millisecond
+
+// flakyChatService fails the first failures sends and succeeds afterwards.
+type flakyChatService struct {
+	services.ChatService
+
+	mu       sync.Mutex
+	failures int
+	err      error // Returned while failing; a transient error by default
+	attempts []time.Time
+}
+
+func (s *flakyChatService) SendMessage(senderID, receiverID, groupID, content, replyToMessageID, fileName, filePath, fileType string, fileSize int64, checksum, clientMessageID string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts = append(s.attempts, time.Now())
+	if len(s.attempts) <= s.failures {
+		if s.err != nil {
+			return "", s.err
+		}
+		return "", errors.New("database unavailable")
+	}
+	return uuid.New().String(), nil
+}
+
+func (s *flakyChatService) GetMessage(messageID string) (*models.Message, error) {
+	return &models.Message{ID: uuid.MustParse(messageID)}, nil
+}
+
+// startConsumer runs a consumer on an in-memory broker and returns the broker
+// and a reply queue subscription.
+func startConsumer(t *testing.T, chatService services.ChatService) (*Consumer, broker.Broker, string, <-chan *broker.Delivery) {
+	t.Helper()
+	return startConsumerOn(t, broker.NewMemory(), chatService)
+}
+
+func startConsumerOn(t *testing.T, b broker.Broker, chatService services.ChatService) (*Consumer, broker.Broker, string, <-chan *broker.Delivery) {
+	t.Helper()
+	if err := ChatTopology().Declare(b, false); err != nil {
+		t.Fatalf("Declare failed: %v", err)
+	}
+	c := NewConsumer(b, chatService, Options{Workers: 4, Prefetch: 16, RetryBaseDelay: testRetryBaseDelay},
+		prometheus.NewCounterVec(prometheus.CounterOpts{Name: "retries"}, []string{"attempt"}),
+		prometheus.NewCounter(prometheus.CounterOpts{Name: "dead_letters"}))
+	go c.StartConsuming()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		c.Shutdown(ctx)
+	})
+
+	replyQueue, err := b.DeclareQueue("", broker.QueueOptions{Exclusive: true})
+	if err != nil {
+		t.Fatalf("DeclareQueue failed: %v", err)
+	}
+	replies, err := b.Subscribe(replyQueue, "", 0)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	return c, b, replyQueue, replies
+}
+
+func publishChatMessage(t *testing.T, b broker.Broker, replyTo string) {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"sender_id": uuid.New().String(), "content": "hello"})
+	err := b.Publish("", "chat_queue", broker.Message{Body: body, ReplyTo: replyTo, CorrelationID: "c-1"})
+	if err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+}
+
+func awaitReply(t *testing.T, replies <-chan *broker.Delivery) Reply {
+	t.Helper()
+	select {
+	case d := <-replies:
+		d.Ack()
+		if d.CorrelationID != "c-1" {
+			t.Errorf("reply correlation ID = %q, want c-1", d.CorrelationID)
+		}
+		var reply Reply
+		if err := json.Unmarshal(d.Body, &reply); err != nil {
+			t.Fatalf("bad reply: %v", err)
+		}
+		return reply
+	case <-time.After(2 * time.Second):
+		t.Fatal("no reply")
+	}
+	return Reply{}
+}
+
+func TestConsumerRetriesUntilSaved(t *testing.T) {
+	chatService := &flakyChatService{failures: 2}
+	c, b, replyQueue, replies := startConsumer(t, chatService)
+
+	publishChatMessage(t, b, replyQueue)
+
+	if reply := awaitReply(t, replies); reply.Status != ReplySaved || reply.Message == nil {
+		t.Fatalf("reply = %+v, want saved message", reply)
+	}
+	if len(chatService.attempts) != 3 {
+		t.Fatalf("attempts = %d, want 3", len(chatService.attempts))
+	}
+	// Retries back off: base, then twice base, each less up to the jitter.
+	for i, want := range []time.Duration{testRetryBaseDelay, 2 * testRetryBaseDelay} {
+		minimum := time.Duration(float64(want) * (1 - retryJitter))
+		if waited := chatService.attempts[i+1].Sub(chatService.attempts[i]); waited < minimum {
+			t.Errorf("retry %d after %s, want at least %s", i+1, waited, minimum)
+		}
+	}
+	if got := testutil.ToFloat64(c.retryMetric.WithLabelValues("2")); got != 1 {
+		t.Errorf("second retry metric = %v, want 1", got)
+	}
+	if depth, _ := b.QueueDepth("chat_dlq"); depth != 0 {
+		t.Errorf("DLQ depth = %d, want 0", depth)
+	}
+}
+
+func TestConsumerDeadLettersAfterMaxRetries(t *testing.T) {
+	chatService := &flakyChatService{failures: MaxRetryCount + 1}
+	c, b, replyQueue, replies := startConsumer(t, chatService)
+
+	publishChatMessage(t, b, replyQueue)
+
+	if reply := awaitReply(t, replies); reply.Status != ReplyFailed {
+		t.Fatalf("reply = %+v, want failed", reply)
+	}
+	if len(chatService.attempts) != MaxRetryCount+1 {
+		t.Errorf("attempts = %d, want %d", len(chatService.attempts), MaxRetryCount+1)
+	}
+	if got := testutil.ToFloat64(c.deadLetterMetric); got != 1 {
+		t.Errorf("dead letter metric = %v, want 1", got)
+	}
+	// The reply goes out just before the message is dead-lettered.
+	deadline := time.Now().Add(time.Second)
+	for {
+		depth, _ := b.QueueDepth("chat_dlq")
+		if depth == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("DLQ depth = %d, want 1", depth)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if depth, _ := b.QueueDepth("chat_queue"); depth != 0 {
+		t.Errorf("chat_queue depth = %d, want 0", depth)
+	}
+}
+
+// retryQueuesDown fails every publish to a chat retry queue.
+type retryQueuesDown struct {
+	broker.Broker
+}
+
+func (b retryQueuesDown) Publish(exchange, routingKey string, msg broker.Message) error {
+	if strings.HasPrefix(routingKey, retryQueuePrefix) {
+		return fmt.Errorf("queue %s unavailable", routingKey)
+	}
+	return b.Broker.Publish(exchange, routingKey, msg)
+}
+
+func TestConsumerCountsRetriesTheRetryQueueCannotTake(t *testing.T) {
+	chatService := &flakyChatService{failures: MaxRetryCount + 1}
+	_, b, replyQueue, replies := startConsumerOn(t, retryQueuesDown{broker.NewMemory()}, chatService)
+
+	publishChatMessage(t, b, replyQueue)
+
+	if reply := awaitReply(t, replies); reply.Status != ReplyFailed {
+		t.Fatalf("reply = %+v, want failed", reply)
+	}
+	chatService.mu.Lock()
+	attempts := len(chatService.attempts)
+	chatService.mu.Unlock()
+	if attempts != MaxRetryCount+1 {
+		t.Errorf("attempts = %d, want %d", attempts, MaxRetryCount+1)
+	}
+}
+
+func TestConsumerDeadLettersMalformedMessages(t *testing.T) {
+	chatService := &flakyChatService{}
+	_, b, _, _ := startConsumer(t, chatService)
+
+	if err := b.Publish("", "chat_queue", broker.Message{Body: []byte("{")}); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if depth, _ := b.QueueDepth("chat_dlq"); depth == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("malformed message was not dead-lettered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(chatService.attempts) != 0 {
+		t.Errorf("attempts = %d, want 0", len(chatService.attempts))
+	}
+}
+
+func TestConsumerDeadLettersPermanentErrorsWithoutRetrying(t *testing.T) {
+	chatService := &flakyChatService{failures: 1, err: fmt.Errorf("saving: %w", services.ErrInvalidMessage)}
+	c, b, replyQueue, replies := startConsumer(t, chatService)
+
+	publishChatMessage(t, b, replyQueue)
+
+	if reply := awaitReply(t, replies); reply.Status != ReplyFailed {
+		t.Fatalf("reply = %+v, want failed", reply)
+	}
+	if len(chatService.attempts) != 1 {
+		t.Errorf("attempts = %d, want 1", len(chatService.attempts))
+	}
+	if got := testutil.ToFloat64(c.retryMetric.WithLabelValues("1")); got != 0 {
+		t.Errorf("retry metric = %v, want 0", got)
+	}
+}
+
+// recordingDeadLetterRepo stores dead letters in memory.
+type recordingDeadLetterRepo struct {
+	repositories.DeadLetterRepository
+
+	stored chan *models.DeadLetter
+}
+
+func (r *recordingDeadLetterRepo) Create(deadLetter *models.DeadLetter) error {
+	r.stored <- deadLetter
+	return nil
+}
+
+func TestDeadLettersAreStoredWithFailureDetails(t *testing.T) {
+	chatService := &flakyChatService{failures: MaxRetryCount + 1}
+	c, b, _, _ := startConsumer(t, chatService)
+	store := &recordingDeadLetterRepo{stored: make(chan *models.DeadLetter, 1)}
+	if err := c.ProcessDeadLetterQueue(store); err != nil {
+		t.Fatalf("ProcessDeadLetterQueue failed: %v", err)
+	}
+
+	publishChatMessage(t, b, "")
+
+	select {
+	case deadLetter := <-store.stored:
+		if deadLetter.Queue != "chat_queue" || deadLetter.FailureReason != "database unavailable" {
+			t.Errorf("dead letter = %+v, want chat_queue failure with the error", deadLetter)
+		}
+		if deadLetter.RetryCount != MaxRetryCount {
+			t.Errorf("retry count = %d, want %d", deadLetter.RetryCount, MaxRetryCount)
+		}
+		if deadLetter.CorrelationID != "c-1" {
+			t.Errorf("correlation ID = %q, want c-1", deadLetter.CorrelationID)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("dead letter was not stored")
+	}
+}
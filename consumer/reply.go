@@ -0,0 +1,60 @@
+package consumer
+
+import (
+	"encoding/json"
+	"log"
+	"my-chat-app/broker"
+	"my-chat-app/models"
+)
+
+// Reply statuses.
+const (
+	ReplySaved  = "saved"
+	ReplyFailed = "failed"
+)
+
+// Reply is sent to a delivery's reply-to queue once its outcome is final:
+// the persisted message, or the error that sent it to the DLQ.
+type Reply struct {
+	Status  string          `json:"status"`
+	Message *models.Message `json:"message,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// reply answers a delivery that asked for its outcome. Retries are not
+// reported; only success or dead-lettering is.
+func (c *Consumer) reply(d *broker.Delivery, reply Reply) {
+	if d.ReplyTo == "" {
+		return
+	}
+	body, err := json.Marshal(reply)
+	if err != nil {
+		log.Printf("Error marshaling reply: %v", err)
+		return
+	}
+	err = c.broker.Publish(
+		"",        // exchange
+		d.ReplyTo, // routing key
+		broker.Message{
+			ContentType:   "application/json",
+			CorrelationID: d.CorrelationID,
+			Body:          body,
+		},
+	)
+	if err != nil {
+		log.Printf("Error sending reply to %s: %v", d.ReplyTo, err)
+	}
+}
+
+// replySaved answers with the persisted message.
+func (c *Consumer) replySaved(d *broker.Delivery, messageID string) {
+	if d.ReplyTo == "" {
+		return
+	}
+	message, err := c.ChatService.GetMessage(messageID)
+	if err != nil {
+		c.reply(d, Reply{Status: ReplyFailed, Error: "message saved but could not be loaded: " + err.Error()})
+		return
+	}
+	c.reply(d, Reply{Status: ReplySaved, Message: message})
+}
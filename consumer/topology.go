@@ -0,0 +1,193 @@
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"my-chat-app/broker"
+	"my-chat-app/services"
+	"time"
+)
+
+// TopologyVersion identifies the declarations in ChatTopology. Bump it with
+// any change to a queue's or exchange's arguments: brokers still holding the
+// old declarations then refuse to start until migrated. Declarations must not
+// depend on configuration, which the version cannot follow.
+//
+//	v1: chat_queue with DLX chat_dlx, chat_dlq bound with key failed
+//	v2: chat_retry_<n> TTL queues dead-lettering to chat_queue via chat_requeue
+//	v3: ai_jobs bound to chat_events, with ai_retry_<n> queues like chat_queue's
+//	v4: retry queues without a TTL; each retry carries its own expiration
+const TopologyVersion = 4
+
+const (
+	chatQueue            = "chat_queue"
+	deadLetterExchange   = "chat_dlx"
+	deadLetterQueue      = "chat_dlq"
+	deadLetterRoutingKey = "failed"
+
+	// Messages are parked here while their queue is redeclared.
+	migrationQueueSuffix = ".migrating"
+	// A drain ends once the queue has been empty this long.
+	drainIdle = 500 * time.Millisecond
+)
+
+type Exchange struct {
+	Name, Kind string
+}
+
+type Queue struct {
+	Name    string
+	Options broker.QueueOptions
+}
+
+type Binding struct {
+	Queue, Exchange, RoutingKey string
+}
+
+// Topology is every exchange, queue and binding the app relies on, declared
+// together, in order, at startup.
+type Topology struct {
+	Version   int
+	Exchanges []Exchange
+	Queues    []Queue
+	Bindings  []Binding
+}
+
+// ChatTopology is chat_queue with its retry queues and dead letter queue, and
+// ai_jobs with its retry queues.
+func ChatTopology() Topology {
+	t := Topology{
+		Version: TopologyVersion,
+		Exchanges: []Exchange{
+			{deadLetterExchange, broker.Direct},
+			{requeueExchange, broker.Direct},
+			{services.EventsExchange, broker.Topic},
+		},
+		Queues: []Queue{
+			{deadLetterQueue, broker.QueueOptions{Durable: true}},
+			{chatQueue, broker.QueueOptions{
+				Durable:              true,
+				DeadLetterExchange:   deadLetterExchange,
+				DeadLetterRoutingKey: deadLetterRoutingKey,
+			}},
+			// Failed AI jobs get an apology reply instead of a dead letter.
+			{aiJobsQueue, broker.QueueOptions{Durable: true}},
+		},
+		Bindings: []Binding{
+			{deadLetterQueue, deadLetterExchange, deadLetterRoutingKey},
+			{chatQueue, requeueExchange, chatQueue},
+			{aiJobsQueue, services.EventsExchange, services.AIJobTopic},
+			{aiJobsQueue, requeueExchange, aiJobsQueue},
+		},
+	}
+	for attempt := 1; attempt <= MaxRetryCount; attempt++ {
+		t.Queues = append(t.Queues, Queue{retryQueue(attempt), broker.QueueOptions{
+			Durable:              true,
+			DeadLetterExchange:   requeueExchange,
+			DeadLetterRoutingKey: chatQueue,
+		}})
+	}
+	for attempt := 1; attempt <= AIMaxRetryCount; attempt++ {
+		t.Queues = append(t.Queues, Queue{aiRetryQueue(attempt), broker.QueueOptions{
+			Durable:              true,
+			DeadLetterExchange:   requeueExchange,
+			DeadLetterRoutingKey: aiJobsQueue,
+		}})
+	}
+	return t
+}
+
+// Declare creates whatever is missing and checks that what exists matches.
+// A queue declared with other arguments, typically by an older version, is a
+// startup error unless migrate is set, in which case the queue is recreated
+// with its messages moved aside and back. Migrate with the other instances
+// stopped: messages published to the queue while it is recreated are lost.
+func (t Topology) Declare(b broker.Broker, migrate bool) error {
+	for _, exchange := range t.Exchanges {
+		if err := b.DeclareExchange(exchange.Name, exchange.Kind); err != nil {
+			return t.failure("exchange "+exchange.Name, err)
+		}
+	}
+	for _, queue := range t.Queues {
+		_, err := b.DeclareQueue(queue.Name, queue.Options)
+		if errors.Is(err, broker.ErrTopologyMismatch) && migrate {
+			log.Printf("Topology v%d: migrating queue %s", t.Version, queue.Name)
+			err = migrateQueue(b, queue)
+		}
+		if err != nil {
+			return t.failure("queue "+queue.Name, err)
+		}
+	}
+	for _, binding := range t.Bindings {
+		if err := b.BindQueue(binding.Queue, binding.Exchange, binding.RoutingKey); err != nil {
+			return t.failure("binding "+binding.Queue+" to "+binding.Exchange, err)
+		}
+	}
+	log.Printf("Topology v%d declared", t.Version)
+	return nil
+}
+
+func (t Topology) failure(what string, err error) error {
+	if errors.Is(err, broker.ErrTopologyMismatch) {
+		return fmt.Errorf("topology v%d: %s exists with other arguments, likely from an older version; "+
+			"restart with BROKER_MIGRATE_TOPOLOGY=true to migrate it: %w", t.Version, what, err)
+	}
+	return fmt.Errorf("topology v%d: declaring %s: %w", t.Version, what, err)
+}
+
+// migrateQueue recreates queue with its new options, keeping its messages in
+// a holding queue meanwhile. A holding queue left by an interrupted migration
+// is emptied back as well.
+func migrateQueue(b broker.Broker, queue Queue) error {
+	holding := queue.Name + migrationQueueSuffix
+	if _, err := b.DeclareQueue(holding, broker.QueueOptions{Durable: true}); err != nil {
+		return err
+	}
+	moved, err := drain(b, queue.Name, holding)
+	if err != nil {
+		return fmt.Errorf("moving messages aside: %w", err)
+	}
+	if err := b.DeleteQueue(queue.Name); err != nil {
+		return err
+	}
+	if _, err := b.DeclareQueue(queue.Name, queue.Options); err != nil {
+		return err
+	}
+	if _, err := drain(b, holding, queue.Name); err != nil {
+		return fmt.Errorf("moving messages back, they remain in %s: %w", holding, err)
+	}
+	log.Printf("Migrated queue %s with %d messages", queue.Name, moved)
+	return b.DeleteQueue(holding)
+}
+
+// drain moves every message from one queue to another, returning how many.
+func drain(b broker.Broker, from, to string) (int, error) {
+	tag := "migrate_" + from
+	deliveries, err := b.Subscribe(from, tag, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer b.Cancel(tag)
+
+	moved := 0
+	for {
+		select {
+		case d, ok := <-deliveries:
+			if !ok {
+				return moved, fmt.Errorf("subscription to %s closed", from)
+			}
+			if err := b.Publish("", to, d.Message); err != nil {
+				d.Nack(true)
+				return moved, err
+			}
+			d.Ack()
+			moved++
+		case <-time.After(drainIdle):
+			depth, err := b.QueueDepth(from)
+			if err != nil || depth == 0 {
+				return moved, err
+			}
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"my-chat-app/broker"
+	"testing"
+)
+
+func TestTopologyMigratesQueueKeepingMessages(t *testing.T) {
+	b := broker.NewMemory()
+	// chat_queue as an older version declared it, with messages waiting.
+	if _, err := b.DeclareQueue(chatQueue, broker.QueueOptions{Durable: true}); err != nil {
+		t.Fatalf("DeclareQueue failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		b.Publish("", chatQueue, broker.Message{Body: []byte(fmt.Sprint(i))})
+	}
+	topology := ChatTopology()
+
+	err := topology.Declare(b, false)
+	if !errors.Is(err, broker.ErrTopologyMismatch) {
+		t.Fatalf("Declare = %v, want ErrTopologyMismatch", err)
+	}
+	if depth, _ := b.QueueDepth(chatQueue); depth != 3 {
+		t.Fatalf("depth after refused startup = %d, want 3", depth)
+	}
+
+	if err := topology.Declare(b, true); err != nil {
+		t.Fatalf("Declare with migration failed: %v", err)
+	}
+	if depth, _ := b.QueueDepth(chatQueue); depth != 3 {
+		t.Errorf("depth after migration = %d, want 3", depth)
+	}
+	if _, err := b.QueueDepth(chatQueue + migrationQueueSuffix); err == nil {
+		t.Error("holding queue was not deleted")
+	}
+	// Declaring again, as the next startup does, is a no-op.
+	if err := topology.Declare(b, false); err != nil {
+		t.Errorf("second Declare failed: %v", err)
+	}
+
+	// The migrated queue dead-letters like the new declaration says.
+	deliveries, _ := b.Subscribe(chatQueue, "test", 0)
+	for i := 0; i < 3; i++ {
+		d := <-deliveries
+		if string(d.Body) != fmt.Sprint(i) {
+			t.Errorf("message %d = %s, order not kept", i, d.Body)
+		}
+		d.Nack(false)
+	}
+	if depth, _ := b.QueueDepth(deadLetterQueue); depth != 3 {
+		t.Errorf("DLQ depth = %d, want 3", depth)
+	}
+}
@@ -0,0 +1,108 @@
+package consumer
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"my-chat-app/broker"
+	"my-chat-app/config"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Options sizes the consumer.
+type Options struct {
+	// Workers handle deliveries in parallel. Messages of one conversation
+	// always go to the same worker, so they are saved in the order received.
+	Workers int
+	// Prefetch caps the deliveries taken from the broker and not yet acked.
+	Prefetch int
+	// RetryBaseDelay is the wait before the first retry, doubling per attempt.
+	RetryBaseDelay time.Duration
+}
+
+// OptionsFromConfig reads the consumer settings from cfg.
+func OptionsFromConfig(cfg config.Config) Options {
+	return Options{
+		Workers:        cfg.ConsumerWorkers,
+		Prefetch:       cfg.ConsumerPrefetch,
+		RetryBaseDelay: cfg.ConsumerRetryBaseDelay,
+	}
+}
+
+// dispatch routes each delivery to the worker owning its conversation until
+// msgs closes, then waits for the workers to finish. Each worker queue holds
+// up to Prefetch deliveries, so a slow conversation only holds up the others
+// sharing its worker once the prefetch window is used up.
+//
+// Ordering holds between deliveries; a message that is retried goes through
+// the retry queues and can be overtaken by later ones.
+func (c *Consumer) dispatch(msgs <-chan *broker.Delivery) {
+	workers := c.options.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	queues := make([]chan *broker.Delivery, workers)
+	var wg sync.WaitGroup
+	for i := range queues {
+		queues[i] = make(chan *broker.Delivery, c.options.Prefetch)
+		wg.Add(1)
+		go func(worker int, queue <-chan *broker.Delivery) {
+			defer wg.Done()
+			label := strconv.Itoa(worker)
+			for d := range queue {
+				c.work(label, d)
+			}
+		}(i, queues[i])
+	}
+
+	for d := range msgs {
+		if c.InFlightMetric != nil {
+			c.InFlightMetric.Inc()
+		}
+		queues[workerFor(conversationKey(d.Body), workers)] <- d
+	}
+	for _, queue := range queues {
+		close(queue)
+	}
+	wg.Wait()
+}
+
+// work handles one delivery on the given worker, recording metrics.
+func (c *Consumer) work(worker string, d *broker.Delivery) {
+	start := time.Now()
+	c.handle(d)
+	if c.LatencyMetric != nil {
+		c.LatencyMetric.WithLabelValues(worker).Observe(time.Since(start).Seconds())
+	}
+	if c.InFlightMetric != nil {
+		c.InFlightMetric.Dec()
+	}
+}
+
+// conversationKey identifies the conversation a queued message belongs to: its
+// group, or the pair of users in either order. Undecodable bodies share "".
+func conversationKey(body []byte) string {
+	var msg struct {
+		SenderID   string `json:"sender_id"`
+		ReceiverID string `json:"receiver_id"`
+		GroupID    string `json:"group_id"`
+	}
+	if json.Unmarshal(body, &msg) != nil {
+		return ""
+	}
+	if msg.GroupID != "" {
+		return "group:" + msg.GroupID
+	}
+	if msg.SenderID > msg.ReceiverID {
+		msg.SenderID, msg.ReceiverID = msg.ReceiverID, msg.SenderID
+	}
+	return "dm:" + msg.SenderID + ":" + msg.ReceiverID
+}
+
+// workerFor hashes key onto one of n workers, always the same one for a key.
+func workerFor(key string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(n))
+}
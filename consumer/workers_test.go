@@ -0,0 +1,85 @@
+package consumer
+
+import (
+	"encoding/json"
+	"my-chat-app/broker"
+	"my-chat-app/services"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// gatedChatService blocks sends of content "slow" until release is closed and
+// reports saved contents in order.
+type gatedChatService struct {
+	services.ChatService
+
+	release chan struct{}
+	savedCh chan string
+}
+
+func (s *gatedChatService) SendMessage(senderID, receiverID, groupID, content, replyToMessageID, fileName, filePath, fileType string, fileSize int64, checksum, clientMessageID string) (string, error) {
+	if content == "slow" {
+		<-s.release
+	}
+	s.savedCh <- content
+	return uuid.New().String(), nil
+}
+
+func publishToGroup(t *testing.T, b broker.Broker, groupID, content string) {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"sender_id": uuid.New().String(), "group_id": groupID, "content": content})
+	if err := b.Publish("", chatQueue, broker.Message{Body: body}); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+}
+
+func TestWorkersKeepConversationOrderAndRunOthersInParallel(t *testing.T) {
+	chatService := &gatedChatService{release: make(chan struct{}), savedCh: make(chan string, 10)}
+	_, b, _, _ := startConsumer(t, chatService)
+
+	slowGroup := uuid.New().String()
+	otherGroup := uuid.New().String()
+	for workerFor("group:"+otherGroup, 4) == workerFor("group:"+slowGroup, 4) {
+		otherGroup = uuid.New().String()
+	}
+
+	publishToGroup(t, b, slowGroup, "slow")
+	publishToGroup(t, b, slowGroup, "after slow")
+	publishToGroup(t, b, otherGroup, "other")
+
+	select {
+	case content := <-chatService.savedCh:
+		if content != "other" {
+			t.Fatalf("first saved = %q, want the other conversation's message", content)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a slow conversation blocked the others")
+	}
+	select {
+	case content := <-chatService.savedCh:
+		t.Fatalf("%q saved while the conversation's earlier message was still in progress", content)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(chatService.release)
+	for _, want := range []string{"slow", "after slow"} {
+		select {
+		case content := <-chatService.savedCh:
+			if content != want {
+				t.Errorf("saved %q, want %q", content, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%q was not saved", want)
+		}
+	}
+}
+
+func TestConversationKeyIgnoresDirection(t *testing.T) {
+	forward := conversationKey([]byte(`{"sender_id":"a","receiver_id":"b"}`))
+	backward := conversationKey([]byte(`{"sender_id":"b","receiver_id":"a"}`))
+	if forward != backward {
+		t.Errorf("keys differ by direction: %q, %q", forward, backward)
+	}
+}
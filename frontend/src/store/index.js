@@ -13,6 +13,8 @@ export default createStore({
         unreadCounts: {},
         replyingTo: null,
         groupMembers: [], // Store group members
+        groupPersonas: [], // AI personas of the selected group
+        canConfigurePersonas: false,
     },
     mutations: {
         setUser(state, user) {
@@ -146,6 +148,20 @@ export default createStore({
                 state.messages[messageIndex].status = status;
             }
         },
+        // Streamed AI replies: seq 0 starts the content over
+        appendMessageChunk(state, { messageId, seq, delta }) {
+            const message = state.messages.find(m => m.id === messageId);
+            if (message) {
+                message.content = seq === 0 ? delta : message.content + delta;
+            }
+        },
+        completeMessage(state, { messageId, content }) {
+            const message = state.messages.find(m => m.id === messageId);
+            if (message) {
+                message.content = content;
+                message.status = 'sent';
+            }
+        },
         updateReaction(state, { messageId, userId, emoji, type }) {
             const messageIndex = state.messages.findIndex(m => m.id === messageId);
             if (messageIndex === -1) return;
@@ -182,6 +198,10 @@ export default createStore({
         clearGroupMembers(state) {
             state.groupMembers = [];
         },
+        setGroupPersonas(state, { personas, canConfigure }) {
+            state.groupPersonas = personas;
+            state.canConfigurePersonas = canConfigure;
+        },
     },
     actions: {
         login({ commit }, { user, token }) {
@@ -265,6 +285,12 @@ export default createStore({
         updateMessageStatus({ commit }, { messageId, status }) {
             commit('updateMessageStatus', { messageId, status });
         },
+        appendMessageChunk({ commit }, payload) {
+            commit('appendMessageChunk', payload);
+        },
+        completeMessage({ commit }, payload) {
+            commit('completeMessage', payload);
+        },
         updateReaction({ commit }, payload) {
             commit('updateReaction', payload);
         },
@@ -281,6 +307,29 @@ export default createStore({
         clearGroupMembers({ commit }) {
             commit('clearGroupMembers');
         },
+        async fetchGroupPersonas({ commit }, groupID) {
+            if (!groupID) {
+                commit('setGroupPersonas', { personas: [], canConfigure: false });
+                return;
+            }
+            try {
+                const response = await api.get(`/groups/${groupID}/ai-personas`);
+                commit('setGroupPersonas', {
+                    personas: response.data.personas || [],
+                    canConfigure: response.data.can_configure
+                });
+            } catch (error) {
+                console.error("Failed to fetch AI personas:", error);
+            }
+        },
+        async saveGroupPersona({ dispatch }, { groupID, handle, settings }) {
+            await api.put(`/groups/${groupID}/ai-personas/${encodeURIComponent(handle)}`, settings);
+            await dispatch('fetchGroupPersonas', groupID);
+        },
+        async deleteGroupPersona({ dispatch }, { groupID, handle }) {
+            await api.delete(`/groups/${groupID}/ai-personas/${encodeURIComponent(handle)}`);
+            await dispatch('fetchGroupPersonas', groupID);
+        },
     },
     getters: {
         currentUser: state => state.user,
@@ -310,5 +359,10 @@ export default createStore({
             return state.usersOnline.find(user => user.id === userId);
         },
         groupMembers: state => state.groupMembers,
+        groupPersonas: state => state.groupPersonas,
+        canConfigurePersonas: state => state.canConfigurePersonas,
+        getPersonaByBotId: (state) => (botId) => {
+            return state.groupPersonas.find(persona => persona.bot_user_id === botId);
+        },
     },
 });
\ No newline at end of file
@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"my-chat-app/utils"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminOnly lets through only the given user IDs. It must run after
+// JWTAuthMiddleware.
+func AdminOnly(adminIDs []string) gin.HandlerFunc {
+	admins := make(map[string]bool, len(adminIDs))
+	for _, id := range adminIDs {
+		admins[id] = true
+	}
+	return func(c *gin.Context) {
+		userID, _ := c.Get("userID")
+		if id, ok := userID.(string); !ok || !admins[id] {
+			utils.RespondWithError(c, http.StatusForbidden, "Admin access required")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
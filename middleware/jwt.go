@@ -11,9 +11,10 @@ import (
 
 func JWTAuthMiddleware(jwtService services.JWTService) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// For WebSocket connections, get token from query parameter
+		// For WebSocket and EventSource connections, get token from query parameter
+		// (browsers cannot set headers on either)
 		var tokenString string
-		if c.Request.URL.Path == "/api/ws" {
+		if c.Request.URL.Path == "/api/ws" || c.Request.URL.Path == "/api/events" {
 			tokenString = c.Query("token")
 		} else {
 			// Regular API endpoints get token from Authorization header
@@ -0,0 +1,18 @@
+CREATE TABLE calls (
+                       id UUID PRIMARY KEY,
+                       caller_id UUID NOT NULL,
+                       receiver_id UUID,
+                       group_id UUID,
+                       media VARCHAR(10) NOT NULL,
+                       status VARCHAR(20) NOT NULL DEFAULT 'ringing', -- ringing, active, ended, missed, declined
+                       started_at TIMESTAMP WITH TIME ZONE NOT NULL,
+                       answered_at TIMESTAMP WITH TIME ZONE,
+                       ended_at TIMESTAMP WITH TIME ZONE,
+                       FOREIGN KEY (caller_id) REFERENCES users(id) ON DELETE CASCADE,
+                       FOREIGN KEY (receiver_id) REFERENCES users(id) ON DELETE CASCADE,
+                       FOREIGN KEY (group_id) REFERENCES groups(id) ON DELETE CASCADE
+);
+
+CREATE INDEX idx_calls_caller_started ON calls (caller_id, started_at DESC);
+CREATE INDEX idx_calls_receiver_started ON calls (receiver_id, started_at DESC);
+CREATE INDEX idx_calls_group_started ON calls (group_id, started_at DESC);
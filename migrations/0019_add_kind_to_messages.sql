@@ -0,0 +1,3 @@
+-- Distinguish user messages from system notices such as missed calls
+ALTER TABLE messages
+    ADD COLUMN kind VARCHAR(20) NOT NULL DEFAULT 'text';
@@ -0,0 +1,13 @@
+-- Events written with the message insert and published by the outbox relay
+CREATE TABLE outbox (
+                        id BIGSERIAL PRIMARY KEY,
+                        aggregate_id UUID NOT NULL,
+                        topic VARCHAR(50) NOT NULL,
+                        payload JSONB NOT NULL,
+                        created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+                        published_at TIMESTAMP WITH TIME ZONE,
+                        attempts INT NOT NULL DEFAULT 0,
+                        last_error TEXT
+);
+
+CREATE INDEX idx_outbox_pending ON outbox (id) WHERE published_at IS NULL;
@@ -0,0 +1,15 @@
+-- Messages the consumer gave up on, kept for inspection and replay
+CREATE TABLE dead_letters (
+                              id UUID PRIMARY KEY,
+                              queue VARCHAR(255) NOT NULL,
+                              body TEXT NOT NULL,
+                              content_type VARCHAR(255),
+                              headers JSONB,
+                              correlation_id VARCHAR(255),
+                              failure_reason TEXT,
+                              retry_count INT NOT NULL DEFAULT 0,
+                              failed_at TIMESTAMP WITH TIME ZONE NOT NULL,
+                              created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_dead_letters_failed_at ON dead_letters (failed_at);
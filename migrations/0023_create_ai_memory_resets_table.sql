@@ -0,0 +1,6 @@
+-- When each conversation's AI memory was last reset; the AI ignores older messages
+CREATE TABLE ai_memory_resets (
+                                  conversation_key VARCHAR(100) PRIMARY KEY,
+                                  reset_at TIMESTAMP WITH TIME ZONE NOT NULL,
+                                  reset_by UUID NOT NULL
+);
@@ -0,0 +1,3 @@
+-- Group admins are the group's creator; groups created before have none
+ALTER TABLE groups
+ADD COLUMN created_by UUID REFERENCES users(id) ON DELETE SET NULL;
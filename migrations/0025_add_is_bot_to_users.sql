@@ -0,0 +1,3 @@
+-- Bots post a group AI persona's replies; they are not listed as users
+ALTER TABLE users
+ADD COLUMN is_bot BOOLEAN NOT NULL DEFAULT FALSE;
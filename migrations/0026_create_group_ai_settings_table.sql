@@ -0,0 +1,15 @@
+-- AI personas of groups, each answering mentions of its handle with its own bot
+CREATE TABLE group_ai_settings (
+                                   id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+                                   group_id UUID NOT NULL REFERENCES groups(id) ON DELETE CASCADE,
+                                   handle VARCHAR(32) NOT NULL,
+                                   bot_user_id UUID NOT NULL REFERENCES users(id),
+                                   display_name VARCHAR(100) NOT NULL,
+                                   avatar_url VARCHAR(500),
+                                   system_prompt TEXT NOT NULL DEFAULT '',
+                                   model VARCHAR(100),
+                                   temperature REAL,
+                                   created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+                                   updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+                                   UNIQUE (group_id, handle)
+);
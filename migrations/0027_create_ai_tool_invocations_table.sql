@@ -0,0 +1,15 @@
+-- Audit log of the tools AI replies ran, on whose behalf and with what result
+CREATE TABLE ai_tool_invocations (
+                                     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+                                     message_id UUID NOT NULL,
+                                     requester_id UUID NOT NULL,
+                                     bot_id UUID NOT NULL,
+                                     tool VARCHAR(64) NOT NULL,
+                                     arguments TEXT NOT NULL,
+                                     result TEXT,
+                                     error TEXT,
+                                     duration_ms BIGINT NOT NULL DEFAULT 0,
+                                     created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_ai_tool_invocations_requester ON ai_tool_invocations (requester_id, created_at);
@@ -0,0 +1,7 @@
+-- Entries the relay gave up on after too many attempts; they no longer hold
+-- back the entries behind them
+ALTER TABLE outbox
+    ADD COLUMN failed_at TIMESTAMP WITH TIME ZONE;
+
+DROP INDEX idx_outbox_pending;
+CREATE INDEX idx_outbox_pending ON outbox (id) WHERE published_at IS NULL AND failed_at IS NULL;
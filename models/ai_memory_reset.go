@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AIMemoryReset records when a conversation's AI memory was last reset. The
+// AI leaves messages sent before ResetAt out of its context.
+type AIMemoryReset struct {
+	ConversationKey string    `gorm:"type:varchar(100);primaryKey" json:"conversation_key"` // group:<id> or dm:<id>:<id>
+	ResetAt         time.Time `gorm:"not null" json:"reset_at"`
+	ResetBy         uuid.UUID `gorm:"type:uuid;not null" json:"reset_by"`
+}
@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AIToolInvocation records a tool run while the AI answered a message: who
+// asked, the arguments the model gave, and what it got back.
+type AIToolInvocation struct {
+	ID          uuid.UUID `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
+	MessageID   uuid.UUID `gorm:"type:uuid;not null" json:"message_id"` // The message answered
+	RequesterID uuid.UUID `gorm:"type:uuid;not null" json:"requester_id"`
+	BotID       uuid.UUID `gorm:"type:uuid;not null" json:"bot_id"`
+	Tool        string    `gorm:"type:varchar(64);not null" json:"tool"`
+	Arguments   string    `gorm:"type:text;not null" json:"arguments"` // As given by the model, possibly invalid
+	Result      string    `gorm:"type:text" json:"result"`
+	Error       string    `gorm:"type:text" json:"error,omitempty"`
+	DurationMS  int64     `gorm:"not null;default:0" json:"duration_ms"`
+	CreatedAt   time.Time `json:"created_at"`
+}
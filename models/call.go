@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Call is a voice or video call placed in a direct or group conversation.
+// Media flows peer-to-peer; only the signaling outcome is recorded here.
+type Call struct {
+	ID         uuid.UUID  `gorm:"type:uuid;primaryKey" json:"id"`
+	CallerID   uuid.UUID  `gorm:"type:uuid;not null" json:"caller_id"`
+	ReceiverID *uuid.UUID `gorm:"type:uuid" json:"receiver_id"` // Nullable for group calls
+	GroupID    *uuid.UUID `gorm:"type:uuid" json:"group_id"`
+	Media      string     `gorm:"type:varchar(10);not null" json:"media"`                  // audio, video
+	Status     string     `gorm:"type:varchar(20);not null;default:ringing" json:"status"` // ringing, active, ended, missed, declined
+	StartedAt  time.Time  `gorm:"type:timestamp with time zone;not null" json:"started_at"`
+	AnsweredAt *time.Time `gorm:"type:timestamp with time zone" json:"answered_at"`
+	EndedAt    *time.Time `gorm:"type:timestamp with time zone" json:"ended_at"`
+}
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/datatypes"
+)
+
+// DeadLetter is a message the consumer gave up on, with why and when. Body is
+// kept as received, which may not be valid JSON.
+type DeadLetter struct {
+	ID            uuid.UUID      `gorm:"type:uuid;primaryKey" json:"id"`
+	Queue         string         `gorm:"type:varchar(255);not null" json:"queue"` // Queue the message failed on
+	Body          string         `gorm:"type:text;not null" json:"body"`
+	ContentType   string         `gorm:"type:varchar(255)" json:"content_type"`
+	Headers       datatypes.JSON `gorm:"type:jsonb" json:"headers"`
+	CorrelationID string         `gorm:"type:varchar(255)" json:"correlation_id,omitempty"`
+	FailureReason string         `gorm:"type:text" json:"failure_reason"`
+	RetryCount    int            `gorm:"not null;default:0" json:"retry_count"`
+	FailedAt      time.Time      `gorm:"not null" json:"failed_at"`
+	CreatedAt     time.Time      `json:"created_at"`
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// GroupAISetting is an AI persona of a group. Mentioning @Handle in the group
+// asks it, and it answers through its own bot account with its prompt and
+// generation settings. The handle "ai" configures plain @AI mentions.
+type GroupAISetting struct {
+	ID           uuid.UUID `gorm:"type:uuid;primaryKey;default:gen_random_uuid()" json:"id"`
+	GroupID      uuid.UUID `gorm:"type:uuid;not null" json:"group_id"`
+	Handle       string    `gorm:"type:varchar(32);not null" json:"handle"` // Lowercase
+	BotUserID    uuid.UUID `gorm:"type:uuid;not null" json:"bot_user_id"`
+	DisplayName  string    `gorm:"type:varchar(100);not null" json:"display_name"`
+	AvatarURL    string    `gorm:"type:varchar(500)" json:"avatar_url"`
+	SystemPrompt string    `gorm:"type:text;not null" json:"system_prompt"`
+	Model        string    `gorm:"type:varchar(100)" json:"model"` // Empty uses the configured model
+	Temperature  *float32  `gorm:"type:real" json:"temperature"`   // Nil uses the configured temperature
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// botUserNamespace scopes the IDs of persona bots.
+var botUserNamespace = uuid.MustParse("b0f4c2a8-3d6e-4f1b-8c59-7e2a1d9f0c34")
+
+// BotUserUUID derives the ID of the bot of a group's persona, so that a
+// persona deleted and created again posts as the same user.
+func BotUserUUID(groupID, handle string) uuid.UUID {
+	return uuid.NewSHA1(botUserNamespace, []byte(groupID+"/"+handle))
+}
@@ -14,7 +14,9 @@ type Message struct {
 	ReceiverID       *uuid.UUID     `gorm:"type:uuid" json:"receiver_id"` //Nullable for group chat
 	GroupID          *uuid.UUID     `gorm:"type:uuid" json:"group_id"`    // Add GroupID, nullable
 	Content          string         `gorm:"not null" json:"content"`
-	Status           string         `gorm:"default:sent" json:"status"` // sent, received, read
+	Status           string         `gorm:"default:sent" json:"status"`                          // sent, received, read
+	Kind             string         `gorm:"type:varchar(20);default:text" json:"kind"`           // text, system
+	ClientMessageID  *string        `gorm:"type:varchar(64)" json:"client_message_id,omitempty"` // Unique per sender when set
 	CreatedAt        time.Time      `json:"created_at"`
 	Sender           *User          `gorm:"foreignKey:SenderID;references:ID" json:"sender"`                             // Don't include in JSON
 	Receiver         *User          `gorm:"foreignKey:ReceiverID;references:ID" json:"receiver"`                         // Don't include in JSON
@@ -41,3 +43,16 @@ func (m *Message) BeforeCreate(tx *gorm.DB) (err error) {
 	}
 	return
 }
+
+// MaxClientMessageIDLength is the longest client_message_id accepted.
+const MaxClientMessageIDLength = 64
+
+// clientMessageNamespace scopes message IDs derived from client message IDs.
+var clientMessageNamespace = uuid.MustParse("6f1c3b1e-8f0a-4d55-9a43-2b5f0c7e9d21")
+
+// ClientMessageUUID derives the server message ID for a client_message_id.
+// Every retry of a submission maps to the same ID, so the sender learns the
+// canonical ID before the message is saved and duplicates cannot be inserted.
+func ClientMessageUUID(senderID, clientMessageID string) uuid.UUID {
+	return uuid.NewSHA1(clientMessageNamespace, []byte(senderID+"/"+clientMessageID))
+}
@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/datatypes"
+)
+
+// OutboxEntry is an event written in the same transaction as the change it
+// announces. The relay publishes pending entries and stamps PublishedAt, or
+// FailedAt when it gives up on one.
+type OutboxEntry struct {
+	ID          int64          `gorm:"primaryKey;autoIncrement" json:"id"`
+	AggregateID uuid.UUID      `gorm:"type:uuid;not null" json:"aggregate_id"` // The message the event is about
+	Topic       string         `gorm:"type:varchar(50);not null" json:"topic"` // new_message, ...
+	Payload     datatypes.JSON `gorm:"type:jsonb;not null" json:"payload"`
+	CreatedAt   time.Time      `json:"created_at"`
+	PublishedAt *time.Time     `gorm:"type:timestamp with time zone" json:"published_at"`
+	FailedAt    *time.Time     `gorm:"type:timestamp with time zone" json:"failed_at"`
+	Attempts    int            `gorm:"not null;default:0" json:"attempts"`
+	LastError   string         `gorm:"type:text" json:"last_error"`
+}
+
+func (OutboxEntry) TableName() string { return "outbox" }
@@ -19,6 +19,7 @@ type User struct {
 	OTP                string     `gorm:"type:varchar(6)" json:"-"`
 	OTPExpiry          *time.Time `gorm:"type:timestamp with time zone" json:"-"`
 	IsVerified         bool       `gorm:"default:false" json:"is_verified"`
+	IsBot              bool       `gorm:"default:false" json:"is_bot"` // Posts for a group AI persona
 	OTPAttempts        int        `gorm:"default:0" json:"-"`
 	OTPAttemptsResetAt *time.Time `gorm:"type:timestamp with time zone" json:"-"`
 	Groups             []*Group   `gorm:"many2many:user_groups;" json:"groups"`
@@ -0,0 +1,40 @@
+package repositories
+
+import (
+	"errors"
+	"my-chat-app/models"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type AIMemoryRepository interface {
+	// Reset records a reset of the conversation's AI memory, replacing any
+	// earlier one.
+	Reset(reset *models.AIMemoryReset) error
+	// ResetAt returns when the conversation's AI memory was last reset, or
+	// the zero time if never.
+	ResetAt(conversationKey string) (time.Time, error)
+}
+
+type aiMemoryRepository struct {
+	db *gorm.DB
+}
+
+func NewAIMemoryRepository(db *gorm.DB) AIMemoryRepository {
+	return &aiMemoryRepository{db}
+}
+
+func (r *aiMemoryRepository) Reset(reset *models.AIMemoryReset) error {
+	return r.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(reset).Error
+}
+
+func (r *aiMemoryRepository) ResetAt(conversationKey string) (time.Time, error) {
+	var reset models.AIMemoryReset
+	err := r.db.Where("conversation_key = ?", conversationKey).First(&reset).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return time.Time{}, nil
+	}
+	return reset.ResetAt, err
+}
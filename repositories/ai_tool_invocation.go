@@ -0,0 +1,23 @@
+package repositories
+
+import (
+	"my-chat-app/models"
+
+	"gorm.io/gorm"
+)
+
+type AIToolInvocationRepository interface {
+	Create(invocation *models.AIToolInvocation) error
+}
+
+type aiToolInvocationRepository struct {
+	db *gorm.DB
+}
+
+func NewAIToolInvocationRepository(db *gorm.DB) AIToolInvocationRepository {
+	return &aiToolInvocationRepository{db}
+}
+
+func (r *aiToolInvocationRepository) Create(invocation *models.AIToolInvocation) error {
+	return r.db.Create(invocation).Error
+}
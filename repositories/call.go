@@ -0,0 +1,41 @@
+package repositories
+
+import (
+	"my-chat-app/models"
+
+	"gorm.io/gorm"
+)
+
+type CallRepository interface {
+	Create(call *models.Call) error
+	Update(call *models.Call) error
+	ListForUser(userID string, limit int) ([]models.Call, error)
+}
+
+type callRepository struct {
+	db *gorm.DB
+}
+
+func NewCallRepository(db *gorm.DB) CallRepository {
+	return &callRepository{db}
+}
+
+func (r *callRepository) Create(call *models.Call) error {
+	return r.db.Create(call).Error
+}
+
+func (r *callRepository) Update(call *models.Call) error {
+	return r.db.Save(call).Error
+}
+
+// ListForUser returns the most recent calls the user placed or was invited to,
+// including calls in their groups.
+func (r *callRepository) ListForUser(userID string, limit int) ([]models.Call, error) {
+	var calls []models.Call
+	err := r.db.Where("caller_id = ? OR receiver_id = ? OR group_id IN (?)",
+		userID, userID, r.db.Table("user_groups").Select("group_id").Where("user_id = ?", userID)).
+		Order("started_at DESC").
+		Limit(limit).
+		Find(&calls).Error
+	return calls, err
+}
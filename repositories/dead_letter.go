@@ -0,0 +1,83 @@
+package repositories
+
+import (
+	"my-chat-app/models"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type DeadLetterRepository interface {
+	Create(deadLetter *models.DeadLetter) error
+	List(limit, offset int) ([]models.DeadLetter, int64, error)
+	GetByID(id string) (*models.DeadLetter, error)
+	// IDs returns the IDs of all entries, oldest failure first.
+	IDs() ([]string, error)
+	Delete(ids []string) (int64, error)
+	DeleteAll() (int64, error)
+	// Stats returns how many entries there are and when the oldest failed.
+	Stats() (count int64, oldest *time.Time, err error)
+}
+
+type deadLetterRepository struct {
+	db *gorm.DB
+}
+
+func NewDeadLetterRepository(db *gorm.DB) DeadLetterRepository {
+	return &deadLetterRepository{db}
+}
+
+func (r *deadLetterRepository) Create(deadLetter *models.DeadLetter) error {
+	return r.db.Create(deadLetter).Error
+}
+
+// List returns a page of entries, most recent failure first, and the total.
+func (r *deadLetterRepository) List(limit, offset int) ([]models.DeadLetter, int64, error) {
+	var total int64
+	if err := r.db.Model(&models.DeadLetter{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	var deadLetters []models.DeadLetter
+	err := r.db.Order("failed_at DESC").Limit(limit).Offset(offset).Find(&deadLetters).Error
+	return deadLetters, total, err
+}
+
+func (r *deadLetterRepository) GetByID(id string) (*models.DeadLetter, error) {
+	var deadLetter models.DeadLetter
+	if err := r.db.Where("id = ?", id).First(&deadLetter).Error; err != nil {
+		return nil, err
+	}
+	return &deadLetter, nil
+}
+
+func (r *deadLetterRepository) IDs() ([]string, error) {
+	var uuids []uuid.UUID
+	if err := r.db.Model(&models.DeadLetter{}).Order("failed_at ASC").Pluck("id", &uuids).Error; err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(uuids))
+	for i, id := range uuids {
+		ids[i] = id.String()
+	}
+	return ids, nil
+}
+
+func (r *deadLetterRepository) Delete(ids []string) (int64, error) {
+	result := r.db.Where("id IN ?", ids).Delete(&models.DeadLetter{})
+	return result.RowsAffected, result.Error
+}
+
+func (r *deadLetterRepository) DeleteAll() (int64, error) {
+	result := r.db.Where("1 = 1").Delete(&models.DeadLetter{})
+	return result.RowsAffected, result.Error
+}
+
+func (r *deadLetterRepository) Stats() (int64, *time.Time, error) {
+	var stats struct {
+		Count  int64
+		Oldest *time.Time
+	}
+	err := r.db.Model(&models.DeadLetter{}).Select("COUNT(*) AS count, MIN(failed_at) AS oldest").Scan(&stats).Error
+	return stats.Count, stats.Oldest, err
+}
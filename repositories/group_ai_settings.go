@@ -0,0 +1,64 @@
+package repositories
+
+import (
+	"my-chat-app/models"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type GroupAISettingsRepository interface {
+	ListForGroup(groupID string) ([]models.GroupAISetting, error)
+	GetByID(id string) (*models.GroupAISetting, error)
+	// Save creates or updates the group's persona with setting's handle, and
+	// its bot's account.
+	Save(setting *models.GroupAISetting, bot *models.User) error
+	// Delete removes a persona. Its bot is kept: its replies refer to it.
+	Delete(groupID, handle string) error
+}
+
+type groupAISettingsRepository struct {
+	db *gorm.DB
+}
+
+func NewGroupAISettingsRepository(db *gorm.DB) GroupAISettingsRepository {
+	return &groupAISettingsRepository{db}
+}
+
+func (r *groupAISettingsRepository) ListForGroup(groupID string) ([]models.GroupAISetting, error) {
+	var settings []models.GroupAISetting
+	err := r.db.Where("group_id = ?", groupID).Order("handle").Find(&settings).Error
+	return settings, err
+}
+
+func (r *groupAISettingsRepository) GetByID(id string) (*models.GroupAISetting, error) {
+	var setting models.GroupAISetting
+	err := r.db.Where("id = ?", id).First(&setting).Error
+	return &setting, err
+}
+
+func (r *groupAISettingsRepository) Save(setting *models.GroupAISetting, bot *models.User) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"username", "deleted_at", "updated_at"}),
+		}).Create(bot).Error
+		if err != nil {
+			return err
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "group_id"}, {Name: "handle"}},
+			DoUpdates: clause.AssignmentColumns([]string{
+				"display_name", "avatar_url", "system_prompt", "model", "temperature", "updated_at",
+			}),
+		}).Create(setting).Error
+	})
+}
+
+func (r *groupAISettingsRepository) Delete(groupID, handle string) error {
+	result := r.db.Where("group_id = ? AND handle = ?", groupID, handle).Delete(&models.GroupAISetting{})
+	if result.Error == nil && result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return result.Error
+}
@@ -2,15 +2,38 @@ package repositories
 
 import (
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"my-chat-app/models"
+	"strings"
+	"time"
 )
 
+// MessageSearch selects messages of one conversation, like GetRecent: the DM
+// between User1ID and User2ID, or GroupID. Zero fields match any message.
+type MessageSearch struct {
+	User1ID, User2ID, GroupID string
+	Text                      string // In the content or file name, ignoring case
+	SenderID                  string
+	Since, Until              time.Time
+	FilesOnly                 bool
+	Limit                     int
+}
+
 type MessageRepository interface {
 	Create(message *models.Message) error
+	CreateWithOutbox(message *models.Message, entries ...*models.OutboxEntry) error
 	GetConversation(user1ID, user2ID string, limit, offset int) ([]models.Message, int64, error) // Return messages and total count
 	GetGroupConversation(groupID string, limit, offset int) ([]models.Message, int64, error)     // Return messages and total count
 	GetByID(id string) (*models.Message, error)
 	Update(message *models.Message) error
+	UpdateWithOutbox(message *models.Message, entries ...*models.OutboxEntry) error
+	// GetRecent returns up to limit messages of the DM between user1ID and
+	// user2ID, or of groupID, sent after since and no later than before,
+	// newest first. A DM includes the replies to its messages sent outside
+	// it, which are the AI's answers to mentions.
+	GetRecent(user1ID, user2ID, groupID string, since, before time.Time, limit int) ([]models.Message, error)
+	// Search returns up to search.Limit matching messages, newest first.
+	Search(search MessageSearch) ([]models.Message, error)
 }
 
 type messageRepository struct {
@@ -33,6 +56,23 @@ func (r *messageRepository) Create(message *models.Message) error {
 	return result.Error
 }
 
+// CreateWithOutbox inserts message and its outbox entries in one transaction,
+// so the events are published if and only if the message was saved.
+func (r *messageRepository) CreateWithOutbox(message *models.Message, entries ...*models.OutboxEntry) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(message).Error; err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			entry.AggregateID = message.ID
+			if err := tx.Create(entry).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func (r *messageRepository) GetConversation(user1ID, user2ID string, limit, offset int) ([]models.Message, int64, error) {
 	var messages []models.Message
 	var count int64
@@ -74,6 +114,50 @@ func (r *messageRepository) GetGroupConversation(groupID string, limit, offset i
 	return messages, count, err
 }
 
+func (r *messageRepository) GetRecent(user1ID, user2ID, groupID string, since, before time.Time, limit int) ([]models.Message, error) {
+	query := r.inConversation(user1ID, user2ID, groupID).Where("created_at > ? AND created_at <= ?", since, before)
+	var messages []models.Message
+	err := query.Order("created_at desc").Limit(limit).Find(&messages).Error
+	return messages, err
+}
+
+func (r *messageRepository) Search(search MessageSearch) ([]models.Message, error) {
+	query := r.inConversation(search.User1ID, search.User2ID, search.GroupID)
+	if search.Text != "" {
+		pattern := "%" + likeEscaper.Replace(search.Text) + "%"
+		query = query.Where("(content ILIKE ? OR file_name ILIKE ?)", pattern, pattern)
+	}
+	if search.SenderID != "" {
+		query = query.Where("sender_id = ?", search.SenderID)
+	}
+	if !search.Since.IsZero() {
+		query = query.Where("created_at >= ?", search.Since)
+	}
+	if !search.Until.IsZero() {
+		query = query.Where("created_at < ?", search.Until)
+	}
+	if search.FilesOnly {
+		query = query.Where("file_name <> ''")
+	}
+	var messages []models.Message
+	err := query.Order("created_at desc").Limit(search.Limit).Find(&messages).Error
+	return messages, err
+}
+
+// likeEscaper makes text match itself in a LIKE pattern.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// inConversation selects the messages of a group, or of a DM with the replies
+// to its messages sent outside it.
+func (r *messageRepository) inConversation(user1ID, user2ID, groupID string) *gorm.DB {
+	if groupID != "" {
+		return r.db.Where("group_id = ?", groupID)
+	}
+	pair := "(sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)"
+	inPair := r.db.Model(&models.Message{}).Select("id").Where(pair, user1ID, user2ID, user2ID, user1ID)
+	return r.db.Where(r.db.Where(pair, user1ID, user2ID, user2ID, user1ID).Or("reply_to_message_id IN (?)", inPair))
+}
+
 func (r *messageRepository) GetByID(id string) (*models.Message, error) {
 	var message models.Message
 	err := r.db.Where("id = ?", id).First(&message).Error
@@ -83,3 +167,20 @@ func (r *messageRepository) GetByID(id string) (*models.Message, error) {
 func (r *messageRepository) Update(message *models.Message) error {
 	return r.db.Save(message).Error
 }
+
+// UpdateWithOutbox saves message and inserts its outbox entries in one
+// transaction. Associations, such as a preloaded reply, are left untouched.
+func (r *messageRepository) UpdateWithOutbox(message *models.Message, entries ...*models.OutboxEntry) error {
+	return r.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Omit(clause.Associations).Save(message).Error; err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			entry.AggregateID = message.ID
+			if err := tx.Create(entry).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,81 @@
+package repositories
+
+import (
+	"log"
+	"my-chat-app/models"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type OutboxRepository interface {
+	Relay(limit, maxAttempts int, publish func(entry models.OutboxEntry) error) ([]models.OutboxEntry, error)
+	DeletePublishedBefore(before time.Time) (int64, error)
+}
+
+type outboxRepository struct {
+	db *gorm.DB
+}
+
+func NewOutboxRepository(db *gorm.DB) OutboxRepository {
+	return &outboxRepository{db}
+}
+
+// Relay locks up to limit pending entries, oldest first, and hands each to
+// publish. Published entries are stamped; a failure is recorded on its entry
+// and ends the batch so that events stay in order, unless the entry reached
+// maxAttempts: it is then marked failed and the batch goes on. Entries locked
+// by another relay are skipped. It returns the entries published once the
+// transaction committed, and the failure that ended the batch, if any.
+func (r *outboxRepository) Relay(limit, maxAttempts int, publish func(entry models.OutboxEntry) error) ([]models.OutboxEntry, error) {
+	var published []models.OutboxEntry
+	var publishErr error
+	err := r.db.Transaction(func(tx *gorm.DB) error {
+		var entries []models.OutboxEntry
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("published_at IS NULL AND failed_at IS NULL").
+			Order("id").
+			Limit(limit).
+			Find(&entries).Error
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := publish(entry); err != nil {
+				updates := map[string]interface{}{"attempts": gorm.Expr("attempts + 1"), "last_error": err.Error()}
+				giveUp := entry.Attempts+1 >= maxAttempts
+				if giveUp {
+					updates["failed_at"] = time.Now()
+				}
+				if err := tx.Model(&models.OutboxEntry{}).Where("id = ?", entry.ID).Updates(updates).Error; err != nil {
+					return err
+				}
+				if giveUp {
+					log.Printf("Outbox: Giving up on entry %d after %d attempts: %v", entry.ID, entry.Attempts+1, err)
+					continue
+				}
+				publishErr = err
+				return nil
+			}
+			now := time.Now()
+			if err := tx.Model(&models.OutboxEntry{}).Where("id = ?", entry.ID).
+				Update("published_at", now).Error; err != nil {
+				return err
+			}
+			entry.PublishedAt = &now
+			published = append(published, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return published, publishErr
+}
+
+// DeletePublishedBefore removes entries published before the cutoff.
+func (r *outboxRepository) DeletePublishedBefore(before time.Time) (int64, error) {
+	result := r.db.Where("published_at < ?", before).Delete(&models.OutboxEntry{})
+	return result.RowsAffected, result.Error
+}
@@ -19,6 +19,8 @@ type UserRepository interface {
 	SoftDelete(user *models.User) error
 	GetByUsernameIncludingDeleted(username string) (*models.User, error)
 	GetByEmailIncludingDeleted(email string) (*models.User, error)
+	UpdateLastSeen(id string, at time.Time) error
+	GetPresenceAudience(id string) ([]string, error)
 }
 
 type userRepository struct {
@@ -55,7 +57,7 @@ func (r *userRepository) Update(user *models.User) error {
 }
 func (r *userRepository) GetAll() ([]models.User, error) {
 	var users []models.User
-	err := r.db.Where("deleted_at IS NULL").Find(&users).Error
+	err := r.db.Where("deleted_at IS NULL AND NOT is_bot").Find(&users).Error
 	return users, err
 }
 
@@ -92,3 +94,32 @@ func (r *userRepository) GetByEmailIncludingDeleted(email string) (*models.User,
 	err := r.db.Unscoped().Where("email = ?", email).First(&user).Error
 	return &user, err
 }
+
+// UpdateLastSeen records when the user was last connected.
+func (r *userRepository) UpdateLastSeen(id string, at time.Time) error {
+	return r.db.Model(&models.User{}).Where("id = ?", id).Update("last_seen", at).Error
+}
+
+// GetPresenceAudience returns the IDs of users who may see this user's presence:
+// direct-message contacts and members of the groups they share.
+func (r *userRepository) GetPresenceAudience(id string) ([]string, error) {
+	var ids []string
+	err := r.db.Raw(`
+		SELECT receiver_id::text FROM messages WHERE sender_id = ? AND receiver_id IS NOT NULL
+		UNION
+		SELECT sender_id::text FROM messages WHERE receiver_id = ?
+		UNION
+		SELECT other.user_id::text FROM user_groups mine
+		JOIN user_groups other ON other.group_id = mine.group_id
+		WHERE mine.user_id = ?`, id, id, id).Scan(&ids).Error
+	if err != nil {
+		return nil, err
+	}
+	audience := ids[:0]
+	for _, other := range ids {
+		if other != id {
+			audience = append(audience, other)
+		}
+	}
+	return audience, nil
+}
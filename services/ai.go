@@ -2,68 +2,234 @@ package services
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/google/generative-ai-go/genai"
-	"os"
+	"my-chat-app/config"
 	"strings"
+	"time"
+)
+
+// aiSystemPrompt tells the model who it is and how the conversation it is
+// given is laid out. It is followed by the persona's own prompt, if any.
+const aiSystemPrompt = "You are %s, a helpful assistant in a chat app. " +
+	"User messages are prefixed with the speaker's username; answer the last one."
+
+// ErrAIUnavailable is returned by NewAIService when no AI provider is
+// configured. The app runs without one: messages to the AI are answered with
+// a notice that it is unavailable.
+var ErrAIUnavailable = errors.New("no AI provider configured")
 
-	"google.golang.org/api/option"
+// maxAIToolRounds bounds how many times a response may call tools before
+// the model must answer with what it has.
+const maxAIToolRounds = 4
+
+// Roles of the messages in an AIRequest.
+const (
+	AIRoleUser      = "user"
+	AIRoleAssistant = "assistant"
+	AIRoleTool      = "tool" // The result of a tool call
 )
 
+// AIMessage is one turn of the conversation sent to a provider.
+type AIMessage struct {
+	Role    string
+	Content string
+	// Tools an assistant turn called, each answered by an AIRoleTool turn
+	// with its ID and name.
+	ToolCalls  []AIToolCall
+	ToolCallID string
+	ToolName   string
+}
+
+// AIToolSpec describes a tool the model may call.
+type AIToolSpec struct {
+	Name        string
+	Description string
+	Params      []AIToolParam
+}
+
+// AIToolParam is an argument of a tool.
+type AIToolParam struct {
+	Name        string
+	Type        string // string, integer or boolean
+	Description string
+	Required    bool
+}
+
+// AIToolCall is the model asking to run a tool with JSON object arguments.
+type AIToolCall struct {
+	ID        string
+	Name      string
+	Arguments json.RawMessage
+}
+
+// AITools are the tools a response may call, bound to who asked.
+type AITools interface {
+	Specs() []AIToolSpec
+	// Call runs call and returns its result for the model, which explains
+	// failures too.
+	Call(ctx context.Context, call AIToolCall) string
+}
+
+// AIRequest is what a provider generates a response to: the conversation so
+// far, ending with the message to answer or with tool results.
+type AIRequest struct {
+	SystemPrompt string
+	Messages     []AIMessage
+	Tools        []AIToolSpec
+	Model        string
+	Temperature  float32
+	MaxTokens    int // Zero leaves the limit to the provider
+}
+
+// AIProvider generates text with a language model.
+type AIProvider interface {
+	// Stream generates a response to req, passing each piece of text to
+	// onChunk as it arrives, and returns the tools the model called, if any.
+	// It stops early with ctx's error when ctx is cancelled.
+	Stream(ctx context.Context, req AIRequest, onChunk func(chunk string)) ([]AIToolCall, error)
+}
+
+// AIPersona is who the AI answers as. Zero fields keep the service's
+// defaults.
+type AIPersona struct {
+	Name         string
+	AvatarURL    string // Shown with its replies
+	SystemPrompt string
+	Model        string
+	Temperature  *float32
+}
+
 type AIService interface {
 	ProcessMessage(message string) (string, error)
 	HandleMention(message string, username string) (string, error)
+	// StreamMessage generates persona's next turn of conversation, passing
+	// each piece to onChunk as it arrives. The model may look things up with
+	// tools, which may be nil. It stops early with ctx's error when ctx is
+	// cancelled.
+	StreamMessage(ctx context.Context, persona AIPersona, conversation []AIMessage, tools AITools, onChunk func(chunk string)) error
 }
 
 type aiService struct {
-	client *genai.Client
-	model  *genai.GenerativeModel
+	provider    AIProvider
+	model       string
+	temperature float32
+	maxTokens   int
 }
 
-func NewAIService() (AIService, error) {
-	// Get API key from environment variable
-	apiKey := os.Getenv("GEMINI_API_KEY")
-	if apiKey == "" {
-		return nil, fmt.Errorf("GEMINI_API_KEY environment variable not set")
+// NewAIService sets up the provider selected by cfg.AIProvider. It returns
+// ErrAIUnavailable when none is configured.
+func NewAIService(cfg config.Config) (AIService, error) {
+	name := cfg.AIProvider
+	if name == "" && cfg.GeminiAPIKey != "" {
+		name = "gemini"
 	}
 
-	ctx := context.Background()
-	client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
+	var provider AIProvider
+	var defaultModel string
+	var err error
+	switch name {
+	case "", "none":
+		return nil, ErrAIUnavailable
+	case "gemini":
+		provider, err = NewGeminiProvider(cfg.GeminiAPIKey)
+		defaultModel = defaultGeminiModel
+	case "openai":
+		provider = NewOpenAIProvider(cfg.AIBaseURL, cfg.AIAPIKey)
+		defaultModel = defaultOpenAIModel
+	case "echo":
+		provider = NewEchoProvider()
+	default:
+		return nil, fmt.Errorf("unknown AI provider %q", name)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to create genai client: %v", err)
+		return nil, err
 	}
 
-	// Initialize the model (using Gemini-Pro)
-	model := client.GenerativeModel("gemini-2.0-pro-exp-02-05")
+	model := cfg.AIModel
+	if model == "" {
+		model = defaultModel
+	}
+	return NewAIServiceWithProvider(provider, model, cfg.AITemperature, cfg.AIMaxTokens), nil
+}
 
+// NewAIServiceWithProvider generates with provider using the given settings.
+func NewAIServiceWithProvider(provider AIProvider, model string, temperature float32, maxTokens int) AIService {
 	return &aiService{
-		client: client,
-		model:  model,
-	}, nil
+		provider:    provider,
+		model:       model,
+		temperature: temperature,
+		maxTokens:   maxTokens,
+	}
 }
 
 func (s *aiService) ProcessMessage(message string) (string, error) {
-	ctx := context.Background()
-
 	// Remove the /ai prefix if present
 	message = strings.TrimPrefix(message, "/ai")
 	message = strings.TrimSpace(message)
 
-	// Generate response
-	resp, err := s.model.GenerateContent(ctx, genai.Text(message))
+	var response strings.Builder
+	conversation := []AIMessage{{Role: AIRoleUser, Content: message}}
+	err := s.StreamMessage(context.Background(), AIPersona{}, conversation, nil, func(chunk string) {
+		response.WriteString(chunk)
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to generate content: %v", err)
+		return "", err
 	}
+	return response.String(), nil
+}
 
-	// Get the response text
-	response := ""
-	for _, candidate := range resp.Candidates {
-		for _, part := range candidate.Content.Parts {
-			response += fmt.Sprint(part)
-		}
+func (s *aiService) StreamMessage(ctx context.Context, persona AIPersona, conversation []AIMessage, tools AITools, onChunk func(chunk string)) error {
+	req := AIRequest{
+		SystemPrompt: fmt.Sprintf(aiSystemPrompt, aiUsername),
+		Messages:     append([]AIMessage(nil), conversation...), // Tool rounds append to it
+		Model:        s.model,
+		Temperature:  s.temperature,
+		MaxTokens:    s.maxTokens,
+	}
+	if persona.Name != "" {
+		req.SystemPrompt = fmt.Sprintf(aiSystemPrompt, persona.Name)
+	}
+	if persona.SystemPrompt != "" {
+		req.SystemPrompt += "\n\n" + persona.SystemPrompt
+	}
+	if persona.Model != "" {
+		req.Model = persona.Model
+	}
+	if persona.Temperature != nil {
+		req.Temperature = *persona.Temperature
+	}
+	if tools != nil {
+		req.SystemPrompt += "\n\nThe current time is " + time.Now().Format(time.RFC3339) +
+			". Use the tools to look up this chat's messages, files and members when asked about them."
 	}
 
-	return response, nil
+	// Each round either answers or calls tools, whose results are added to
+	// the conversation for the next round.
+	for round := 0; ; round++ {
+		req.Tools = nil
+		if tools != nil && round < maxAIToolRounds {
+			req.Tools = tools.Specs()
+		}
+		var text strings.Builder
+		calls, err := s.provider.Stream(ctx, req, func(chunk string) {
+			text.WriteString(chunk)
+			onChunk(chunk)
+		})
+		if err != nil || len(calls) == 0 || req.Tools == nil {
+			return err
+		}
+		req.Messages = append(req.Messages, AIMessage{Role: AIRoleAssistant, Content: text.String(), ToolCalls: calls})
+		for _, call := range calls {
+			req.Messages = append(req.Messages, AIMessage{
+				Role:       AIRoleTool,
+				Content:    tools.Call(ctx, call),
+				ToolCallID: call.ID,
+				ToolName:   call.Name,
+			})
+		}
+	}
 }
 
 func (s *aiService) HandleMention(message string, username string) (string, error) {
@@ -0,0 +1,200 @@
+package services
+
+import (
+	"my-chat-app/models"
+	"my-chat-app/repositories"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// How many replied-to messages the AI follows up the thread.
+	aiContextThreadDepth = 5
+	// Rough tokens per message on top of its text, for roles and separators.
+	aiTokensPerMessage = 4
+)
+
+// AIContextBuilder assembles what the AI sees of a conversation: its recent
+// messages since the last memory reset, and the thread of the message being
+// answered, within a token budget.
+type AIContextBuilder struct {
+	messageRepo repositories.MessageRepository
+	userRepo    repositories.UserRepository
+	memoryRepo  repositories.AIMemoryRepository
+	maxMessages int
+	maxTokens   int
+}
+
+// NewAIContextBuilder looks back at most maxMessages messages and keeps the
+// context within about maxTokens tokens.
+func NewAIContextBuilder(messageRepo repositories.MessageRepository, userRepo repositories.UserRepository, memoryRepo repositories.AIMemoryRepository, maxMessages, maxTokens int) *AIContextBuilder {
+	return &AIContextBuilder{
+		messageRepo: messageRepo,
+		userRepo:    userRepo,
+		memoryRepo:  memoryRepo,
+		maxMessages: maxMessages,
+		maxTokens:   maxTokens,
+	}
+}
+
+// Build returns the conversation for job, oldest first and ending with the
+// message to answer, which is always included. The replied-to thread is kept
+// ahead of other recent messages when the budget runs out. Messages are
+// prefixed with their sender's username, other bots' included; only the
+// replies of job's own bot are the assistant's turns.
+func (b *AIContextBuilder) Build(job AIJob) ([]AIMessage, error) {
+	current, err := b.messageRepo.GetByID(job.MessageID)
+	if err != nil {
+		return nil, err
+	}
+	since, err := b.memoryRepo.ResetAt(aiConversationKey(job.SenderID, job.ReceiverID, job.GroupID))
+	if err != nil {
+		return nil, err
+	}
+	recent, err := b.messageRepo.GetRecent(job.SenderID, job.ReceiverID, job.GroupID, since, current.CreatedAt, b.maxMessages)
+	if err != nil {
+		return nil, err
+	}
+
+	usernames := make(map[uuid.UUID]string)
+	bot := job.bot()
+	last := b.turn(*current, bot, usernames)
+	budget := b.maxTokens - estimateTokens(last.Content)
+	picked := map[uuid.UUID]bool{current.ID: true}
+	var messages []models.Message
+	// take adds message if it fits, reporting false once the budget is spent.
+	take := func(message models.Message) bool {
+		if picked[message.ID] || !usableInContext(message) {
+			return true
+		}
+		cost := estimateTokens(b.turn(message, bot, usernames).Content)
+		if cost > budget {
+			return false
+		}
+		budget -= cost
+		picked[message.ID] = true
+		messages = append(messages, message)
+		return true
+	}
+
+	for id, depth := current.ReplyToMessageID, 0; id != nil && depth < aiContextThreadDepth; depth++ {
+		parent, err := b.messageRepo.GetByID(id.String())
+		// A reply may point into another conversation; the thread ends there.
+		if err != nil || !b.inConversation(*parent, job) || !parent.CreatedAt.After(since) || !take(*parent) {
+			break
+		}
+		id = parent.ReplyToMessageID
+	}
+	for _, message := range recent {
+		if !take(message) {
+			break
+		}
+	}
+
+	sort.Slice(messages, func(i, j int) bool { return messages[i].CreatedAt.Before(messages[j].CreatedAt) })
+	var conversation []AIMessage
+	for _, message := range messages {
+		conversation = appendTurn(conversation, b.turn(message, bot, usernames))
+	}
+	return appendTurn(conversation, last), nil
+}
+
+// Reset makes the AI forget the conversation's messages sent until now.
+func (b *AIContextBuilder) Reset(userID, receiverID, groupID string) error {
+	userUUID, err := uuid.Parse(userID)
+	if err != nil {
+		return err
+	}
+	return b.memoryRepo.Reset(&models.AIMemoryReset{
+		ConversationKey: aiConversationKey(userID, receiverID, groupID),
+		ResetAt:         time.Now(),
+		ResetBy:         userUUID,
+	})
+}
+
+// turn is message as bot sees it.
+func (b *AIContextBuilder) turn(message models.Message, bot string, usernames map[uuid.UUID]string) AIMessage {
+	if message.SenderID.String() == bot {
+		return AIMessage{Role: AIRoleAssistant, Content: message.Content}
+	}
+	username, ok := usernames[message.SenderID]
+	if !ok {
+		username = "unknown"
+		if user, err := b.userRepo.GetByID(message.SenderID.String()); err == nil {
+			username = user.Username
+		}
+		usernames[message.SenderID] = username
+	}
+	content := message.Content
+	if message.FileName != "" {
+		content = strings.TrimSpace(content + " [shared file: " + message.FileName + "]")
+	}
+	return AIMessage{Role: AIRoleUser, Content: username + ": " + content}
+}
+
+// inConversation reports whether message belongs to job's conversation, as
+// GetRecent selects it: the group's messages, or the direct chat's messages
+// and the replies to them sent outside it.
+func (b *AIContextBuilder) inConversation(message models.Message, job AIJob) bool {
+	if job.GroupID != "" {
+		return message.GroupID != nil && message.GroupID.String() == job.GroupID
+	}
+	if message.GroupID != nil {
+		return false
+	}
+	if inPair(message, job) {
+		return true
+	}
+	if message.ReplyToMessageID == nil {
+		return false
+	}
+	parent, err := b.messageRepo.GetByID(message.ReplyToMessageID.String())
+	return err == nil && parent.GroupID == nil && inPair(*parent, job)
+}
+
+// inPair reports whether message was sent between job's sender and receiver.
+func inPair(message models.Message, job AIJob) bool {
+	if message.ReceiverID == nil {
+		return false
+	}
+	sender, receiver := message.SenderID.String(), message.ReceiverID.String()
+	return (sender == job.SenderID && receiver == job.ReceiverID) ||
+		(sender == job.ReceiverID && receiver == job.SenderID)
+}
+
+// usableInContext leaves out system notices and unfinished or empty replies.
+func usableInContext(message models.Message) bool {
+	return message.Kind != "system" && message.Status != aiStreamingStatus &&
+		(message.Content != "" || message.FileName != "")
+}
+
+// appendTurn adds turn to conversation, merging consecutive turns of the same
+// role, which some providers reject.
+func appendTurn(conversation []AIMessage, turn AIMessage) []AIMessage {
+	if n := len(conversation); n > 0 && conversation[n-1].Role == turn.Role {
+		conversation[n-1].Content += "\n" + turn.Content
+		return conversation
+	}
+	return append(conversation, turn)
+}
+
+// estimateTokens approximates the tokens of text, at about four characters
+// per token.
+func estimateTokens(text string) int {
+	return (utf8.RuneCountInString(text)+3)/4 + aiTokensPerMessage
+}
+
+// aiConversationKey identifies a DM, in either direction, or a group.
+func aiConversationKey(userID, receiverID, groupID string) string {
+	if groupID != "" {
+		return "group:" + groupID
+	}
+	if userID > receiverID {
+		userID, receiverID = receiverID, userID
+	}
+	return "dm:" + userID + ":" + receiverID
+}
@@ -0,0 +1,182 @@
+package services
+
+import (
+	"my-chat-app/models"
+	"my-chat-app/repositories"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func (r *fakeMessageRepo) GetRecent(user1ID, user2ID, groupID string, since, before time.Time, limit int) ([]models.Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	inPair := func(m models.Message) bool {
+		return m.ReceiverID != nil && (m.SenderID.String() == user1ID && m.ReceiverID.String() == user2ID ||
+			m.SenderID.String() == user2ID && m.ReceiverID.String() == user1ID)
+	}
+	pairIDs := map[uuid.UUID]bool{}
+	for _, m := range r.created {
+		if inPair(m) {
+			pairIDs[m.ID] = true
+		}
+	}
+	var messages []models.Message
+	for _, m := range r.created {
+		if !m.CreatedAt.After(since) || m.CreatedAt.After(before) {
+			continue
+		}
+		if groupID != "" && m.GroupID != nil && m.GroupID.String() == groupID ||
+			groupID == "" && (inPair(m) || m.ReplyToMessageID != nil && pairIDs[*m.ReplyToMessageID]) {
+			messages = append(messages, m)
+		}
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].CreatedAt.After(messages[j].CreatedAt) })
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return messages, nil
+}
+
+type fakeAIMemoryRepo struct {
+	repositories.AIMemoryRepository
+	resets map[string]time.Time
+}
+
+func (r *fakeAIMemoryRepo) Reset(reset *models.AIMemoryReset) error {
+	r.resets[reset.ConversationKey] = reset.ResetAt
+	return nil
+}
+
+func (r *fakeAIMemoryRepo) ResetAt(conversationKey string) (time.Time, error) {
+	return r.resets[conversationKey], nil
+}
+
+// contextTest is a DM between the caller and the callee, one message a minute.
+type contextTest struct {
+	messageRepo *fakeMessageRepo
+	builder     *AIContextBuilder
+	sent        time.Time
+}
+
+func newContextTest(maxMessages, maxTokens int) *contextTest {
+	messageRepo := &fakeMessageRepo{}
+	memoryRepo := &fakeAIMemoryRepo{resets: map[string]time.Time{}}
+	return &contextTest{
+		messageRepo: messageRepo,
+		builder:     NewAIContextBuilder(messageRepo, fakeUserRepo{}, memoryRepo, maxMessages, maxTokens),
+		sent:        time.Now().Add(-time.Hour),
+	}
+}
+
+func (c *contextTest) send(senderID, receiverID, content string, replyTo *models.Message) *models.Message {
+	c.sent = c.sent.Add(time.Minute)
+	receiverUUID := uuid.MustParse(receiverID)
+	message := models.Message{
+		ID:         uuid.New(),
+		SenderID:   uuid.MustParse(senderID),
+		ReceiverID: &receiverUUID,
+		Content:    content,
+		Status:     "sent",
+		CreatedAt:  c.sent,
+	}
+	if replyTo != nil {
+		message.ReplyToMessageID = &replyTo.ID
+	}
+	c.messageRepo.created = append(c.messageRepo.created, message)
+	return &message
+}
+
+func (c *contextTest) build(t *testing.T, message *models.Message) []AIMessage {
+	t.Helper()
+	conversation, err := c.builder.Build(AIJob{MessageID: message.ID.String(), SenderID: callerID, ReceiverID: calleeID, Content: message.Content})
+	if err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	return conversation
+}
+
+func TestAIContextAttributesSpeakersAndAIAnswers(t *testing.T) {
+	c := newContextTest(20, 1000)
+	question := c.send(callerID, calleeID, "@AI what is 2+2?", nil)
+	c.send(AIUserID, callerID, "4", question)
+	c.send(calleeID, callerID, "thanks", nil)
+	last := c.send(callerID, calleeID, "@AI and times 3?", nil)
+
+	caller, callee := "user-"+callerID[:4], "user-"+calleeID[:4]
+	want := []AIMessage{
+		{Role: AIRoleUser, Content: caller + ": @AI what is 2+2?"},
+		{Role: AIRoleAssistant, Content: "4"},
+		{Role: AIRoleUser, Content: callee + ": thanks\n" + caller + ": @AI and times 3?"},
+	}
+	if got := c.build(t, last); !equalConversations(got, want) {
+		t.Errorf("conversation = %q, want %q", got, want)
+	}
+}
+
+func TestAIContextKeepsTheThreadWithinTheBudget(t *testing.T) {
+	c := newContextTest(20, 40)
+	root := c.send(calleeID, callerID, "the plan is to ship on friday", nil)
+	for i := 0; i < 10; i++ {
+		c.send(calleeID, callerID, strings.Repeat("unrelated chatter ", 3), nil)
+	}
+	last := c.send(callerID, calleeID, "@AI is that realistic?", root)
+
+	got := c.build(t, last)
+	if len(got) != 1 || !strings.Contains(got[0].Content, "ship on friday") || !strings.HasSuffix(got[0].Content, "is that realistic?") {
+		t.Errorf("conversation = %q, want the replied-to message and the question", got)
+	}
+	tokens := 0
+	for _, message := range got {
+		tokens += estimateTokens(message.Content)
+	}
+	if tokens > 40 {
+		t.Errorf("conversation is about %d tokens, over the budget of 40", tokens)
+	}
+}
+
+func TestAIContextThreadStaysInTheConversation(t *testing.T) {
+	c := newContextTest(20, 1000)
+	outsiderID := uuid.New().String()
+	secret := c.send(outsiderID, calleeID, "the launch code is 1234", nil)
+	answer := c.send(AIUserID, callerID, "noted", c.send(callerID, calleeID, "@AI remember this", nil))
+	last := c.send(callerID, calleeID, "@AI what do you know?", secret)
+	reply := c.send(callerID, calleeID, "@AI and before that?", answer)
+
+	if got := c.build(t, last); len(got) != 3 || strings.Contains(got[0].Content, "1234") {
+		t.Errorf("conversation = %q, want no message from another chat", got)
+	}
+	if got := c.build(t, reply); len(got) != 3 || !strings.Contains(got[0].Content, "remember this") || got[1].Content != "noted" {
+		t.Errorf("conversation = %q, want the thread through the AI's reply", got)
+	}
+}
+
+func TestAIMemoryResetForgetsEarlierMessages(t *testing.T) {
+	c := newContextTest(20, 1000)
+	c.send(callerID, calleeID, "my password hint is blue", nil)
+	if err := c.builder.Reset(calleeID, callerID, ""); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	c.sent = time.Now()
+	last := c.send(callerID, calleeID, "@AI what was my hint?", nil)
+
+	got := c.build(t, last)
+	if len(got) != 1 || strings.Contains(got[0].Content, "blue") {
+		t.Errorf("conversation = %q, want only the question", got)
+	}
+}
+
+func equalConversations(a, b []AIMessage) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Role != b[i].Role || a[i].Content != b[i].Content {
+			return false
+		}
+	}
+	return true
+}
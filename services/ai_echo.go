@@ -0,0 +1,30 @@
+package services
+
+import (
+	"context"
+	"strings"
+)
+
+type echoProvider struct{}
+
+// NewEchoProvider answers every request with the message it answers, word by
+// word. It is deterministic and needs no model, for tests and development.
+func NewEchoProvider() AIProvider {
+	return echoProvider{}
+}
+
+// Stream never calls tools.
+func (echoProvider) Stream(ctx context.Context, req AIRequest, onChunk func(chunk string)) ([]AIToolCall, error) {
+	var message string
+	if len(req.Messages) > 0 {
+		message = req.Messages[len(req.Messages)-1].Content
+	}
+	// Split after spaces so that the chunks join back into the message.
+	for _, word := range strings.SplitAfter("Echo: "+message, " ") {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		onChunk(word)
+	}
+	return nil, nil
+}
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/generative-ai-go/genai"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+const defaultGeminiModel = "gemini-2.0-pro-exp-02-05"
+
+type geminiProvider struct {
+	client *genai.Client
+}
+
+// NewGeminiProvider generates with Google's Gemini models.
+func NewGeminiProvider(apiKey string) (AIProvider, error) {
+	if apiKey == "" {
+		return nil, fmt.Errorf("GEMINI_API_KEY environment variable not set")
+	}
+	client, err := genai.NewClient(context.Background(), option.WithAPIKey(apiKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create genai client: %v", err)
+	}
+	return &geminiProvider{client: client}, nil
+}
+
+func (p *geminiProvider) Stream(ctx context.Context, req AIRequest, onChunk func(chunk string)) ([]AIToolCall, error) {
+	if len(req.Messages) == 0 {
+		return nil, fmt.Errorf("no message to answer")
+	}
+	model := p.client.GenerativeModel(req.Model)
+	model.SetTemperature(req.Temperature)
+	if req.MaxTokens > 0 {
+		model.SetMaxOutputTokens(int32(req.MaxTokens))
+	}
+	if req.SystemPrompt != "" {
+		model.SystemInstruction = genai.NewUserContent(genai.Text(req.SystemPrompt))
+	}
+	if len(req.Tools) > 0 {
+		tool := &genai.Tool{}
+		for _, spec := range req.Tools {
+			tool.FunctionDeclarations = append(tool.FunctionDeclarations, geminiFunction(spec))
+		}
+		model.Tools = []*genai.Tool{tool}
+	}
+
+	// Earlier turns are the chat history; the last is sent.
+	contents := geminiContents(req.Messages)
+	chat := model.StartChat()
+	last := len(contents) - 1
+	chat.History = contents[:last]
+
+	var calls []AIToolCall
+	iter := chat.SendMessageStream(ctx, contents[last].Parts...)
+	for {
+		resp, err := iter.Next()
+		if err == iterator.Done {
+			return calls, nil
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("failed to generate content: %v", err)
+		}
+		for _, candidate := range resp.Candidates {
+			if candidate.Content == nil {
+				continue
+			}
+			for _, part := range candidate.Content.Parts {
+				call, ok := part.(genai.FunctionCall)
+				if !ok {
+					onChunk(fmt.Sprint(part))
+					continue
+				}
+				args, err := json.Marshal(call.Args)
+				if err != nil {
+					return nil, err
+				}
+				// Gemini matches results to calls by name; the ID is ours.
+				id := fmt.Sprintf("%s-%d", call.Name, len(calls))
+				calls = append(calls, AIToolCall{ID: id, Name: call.Name, Arguments: args})
+			}
+		}
+	}
+}
+
+// geminiContents converts messages to Gemini's turns, where the assistant is
+// "model" and the results of one round of tool calls form a single turn.
+func geminiContents(messages []AIMessage) []*genai.Content {
+	var contents []*genai.Content
+	for _, message := range messages {
+		switch message.Role {
+		case AIRoleAssistant:
+			content := &genai.Content{Role: "model"}
+			if message.Content != "" {
+				content.Parts = append(content.Parts, genai.Text(message.Content))
+			}
+			for _, call := range message.ToolCalls {
+				var args map[string]any
+				json.Unmarshal(call.Arguments, &args)
+				content.Parts = append(content.Parts, genai.FunctionCall{Name: call.Name, Args: args})
+			}
+			contents = append(contents, content)
+		case AIRoleTool:
+			var result any
+			if err := json.Unmarshal([]byte(message.Content), &result); err != nil {
+				result = message.Content
+			}
+			part := genai.FunctionResponse{Name: message.ToolName, Response: map[string]any{"result": result}}
+			if n := len(contents); n > 0 && contents[n-1].Role == "function" {
+				contents[n-1].Parts = append(contents[n-1].Parts, part)
+			} else {
+				contents = append(contents, &genai.Content{Role: "function", Parts: []genai.Part{part}})
+			}
+		default:
+			contents = append(contents, &genai.Content{Role: "user", Parts: []genai.Part{genai.Text(message.Content)}})
+		}
+	}
+	return contents
+}
+
+// geminiFunction declares spec to Gemini.
+func geminiFunction(spec AIToolSpec) *genai.FunctionDeclaration {
+	schema := &genai.Schema{Type: genai.TypeObject, Properties: make(map[string]*genai.Schema)}
+	for _, param := range spec.Params {
+		paramType := genai.TypeString
+		switch param.Type {
+		case "integer":
+			paramType = genai.TypeInteger
+		case "boolean":
+			paramType = genai.TypeBoolean
+		}
+		schema.Properties[param.Name] = &genai.Schema{Type: paramType, Description: param.Description}
+		if param.Required {
+			schema.Required = append(schema.Required, param.Name)
+		}
+	}
+	return &genai.FunctionDeclaration{Name: spec.Name, Description: spec.Description, Parameters: schema}
+}
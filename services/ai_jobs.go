@@ -0,0 +1,444 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"my-chat-app/models"
+	"my-chat-app/websockets"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+const (
+	// AIJobTopic is the outbox topic of AI jobs. The relay publishes them to
+	// EventsExchange, from where they are routed to the ai_jobs queue.
+	AIJobTopic = "ai_job"
+
+	aiUsername         = "AI_Assistant"
+	aiFailureReply     = "Sorry, I couldn't process your request."
+	aiCancelledReply   = "_Generation cancelled._"
+	aiUnavailableReply = "The AI assistant is not available right now."
+	aiReplyIDPrefix    = "ai-reply:"
+	aiStreamingStatus  = "streaming" // Status of an AI reply still being generated
+	aiPersonaHandle    = "ai"        // A group persona with this handle answers @AI
+)
+
+// mentionPattern finds the @handles mentioned in a message.
+var mentionPattern = regexp.MustCompile(`@(\w+)`)
+
+// AIJob asks the AI to answer a saved message, addressed directly to the AI
+// or mentioning it.
+type AIJob struct {
+	MessageID  string `json:"message_id"`
+	SenderID   string `json:"sender_id"`
+	ReceiverID string `json:"receiver_id,omitempty"`
+	GroupID    string `json:"group_id,omitempty"`
+	Content    string `json:"content"`
+	// Set when a group persona is asked rather than the AI assistant.
+	PersonaID string `json:"persona_id,omitempty"`
+	BotID     string `json:"bot_id,omitempty"`
+}
+
+// bot is the ID of the user answering job.
+func (j AIJob) bot() string {
+	if j.BotID != "" {
+		return j.BotID
+	}
+	return AIUserID
+}
+
+// aiJobs returns a job for each AI that message asks: each group persona
+// whose handle it mentions, and the AI assistant when sent to it or
+// mentioning @AI, unless the group has a persona for @AI.
+func (s *chatService) aiJobs(message AIJob) ([]AIJob, error) {
+	var jobs []AIJob
+	mentionsAI := strings.Contains(message.Content, "@AI")
+	if message.GroupID != "" && s.personaRepo != nil && strings.Contains(message.Content, "@") {
+		personas, err := s.personaRepo.ListForGroup(message.GroupID)
+		if err != nil {
+			return nil, err
+		}
+		mentioned := make(map[string]bool)
+		for _, match := range mentionPattern.FindAllStringSubmatch(message.Content, -1) {
+			mentioned[strings.ToLower(match[1])] = true
+		}
+		for _, persona := range personas {
+			if !mentioned[persona.Handle] {
+				continue
+			}
+			job := message
+			job.PersonaID = persona.ID.String()
+			job.BotID = persona.BotUserID.String()
+			jobs = append(jobs, job)
+			if persona.Handle == aiPersonaHandle {
+				mentionsAI = false
+			}
+		}
+	}
+	if message.ReceiverID == AIUserID || mentionsAI {
+		jobs = append(jobs, message)
+	}
+	return jobs, nil
+}
+
+func newAIJobEntry(job AIJob) (*models.OutboxEntry, error) {
+	payload, err := json.Marshal(job)
+	if err != nil {
+		return nil, err
+	}
+	return &models.OutboxEntry{Topic: AIJobTopic, Payload: datatypes.JSON(payload)}, nil
+}
+
+// ProcessAIJob streams the AI's answer to job's message into a reply. The
+// reply is posted at once as a placeholder, filled by message_chunk events as
+// the answer arrives and saved with a message_completed event at the end.
+// Jobs are delivered at least once: a retry reuses the placeholder and starts
+// its content over, and a job whose reply was completed is a no-op.
+func (s *chatService) ProcessAIJob(job AIJob) error {
+	reply, err := s.aiReply(job)
+	if err != nil {
+		return err
+	}
+	if reply != nil && reply.Status != aiStreamingStatus {
+		return nil
+	}
+	persona, err := s.aiPersona(job)
+	if err != nil {
+		return err
+	}
+	if s.aiService == nil {
+		// Without a provider there is nothing to retry: say so right away.
+		if reply == nil {
+			_, err = s.postAIReply(job, persona, aiUnavailableReply, "sent")
+			return err
+		}
+		return s.completeAIReply(job, reply, aiUnavailableReply, false)
+	}
+	if reply == nil {
+		if reply, err = s.postAIReply(job, persona, "", aiStreamingStatus); err != nil {
+			return err
+		}
+	}
+
+	conversation := s.aiConversation(job)
+	ctx, done := s.generations.start(reply.ID.String(), job.SenderID)
+	defer done()
+	s.broadcastAITyping(job, persona, true)
+	defer s.broadcastAITyping(job, persona, false)
+
+	var tools AITools
+	if s.aiTools != nil {
+		tools = s.aiTools.For(job)
+	}
+	var content strings.Builder
+	seq := 0
+	err = s.aiService.StreamMessage(ctx, persona, conversation, tools, func(chunk string) {
+		content.WriteString(chunk)
+		s.broadcastChunk(job, reply.ID.String(), seq, chunk)
+		seq++
+	})
+	if ctx.Err() != nil {
+		// Cancelled by the requester: keep what was generated so far.
+		log.Printf("chatService: AI reply to message %s cancelled", job.MessageID)
+		partial := content.String()
+		if partial == "" {
+			partial = aiCancelledReply
+		}
+		return s.completeAIReply(job, reply, partial, true)
+	}
+	if err != nil {
+		return err
+	}
+	return s.completeAIReply(job, reply, content.String(), false)
+}
+
+// FailAIJob posts an apology in place of the answer to a job that ran out of
+// retries or cannot succeed.
+func (s *chatService) FailAIJob(job AIJob) error {
+	reply, err := s.aiReply(job)
+	if err != nil {
+		return err
+	}
+	if reply == nil {
+		persona, err := s.aiPersona(job)
+		if err != nil {
+			return err
+		}
+		_, err = s.postAIReply(job, persona, aiFailureReply, "sent")
+		return err
+	}
+	if reply.Status == aiStreamingStatus {
+		return s.completeAIReply(job, reply, aiFailureReply, false)
+	}
+	return nil
+}
+
+// CancelGeneration stops the AI reply messageID being generated. Only the
+// user who asked the AI can cancel its reply.
+func (s *chatService) CancelGeneration(userID, messageID string) error {
+	return s.generations.cancel(messageID, userID)
+}
+
+// ResetAIMemory makes the AI forget what was said in a conversation so far:
+// later questions are answered without the earlier messages.
+func (s *chatService) ResetAIMemory(userID, receiverID, groupID string) error {
+	if s.aiContext == nil {
+		return websockets.NewCommandError(websockets.ErrCodeBadRequest, "The AI assistant is not available")
+	}
+	if err := s.aiContext.Reset(userID, receiverID, groupID); err != nil {
+		return err
+	}
+	if s.hub != nil {
+		envelope := websockets.Envelope{SenderID: userID, ReceiverID: receiverID, GroupID: groupID}
+		s.hub.Broadcast <- &websockets.AIMemoryResetEvent{Type: "ai_memory_reset", Envelope: envelope}
+	}
+	return nil
+}
+
+// aiConversation is what the AI is asked to continue for job: the
+// conversation so far when it can be loaded, and the message alone otherwise.
+func (s *chatService) aiConversation(job AIJob) []AIMessage {
+	if s.aiContext != nil {
+		conversation, err := s.aiContext.Build(job)
+		if err == nil {
+			return conversation
+		}
+		log.Printf("chatService: no context for AI reply to message %s: %v", job.MessageID, err)
+	}
+	content := strings.TrimSpace(strings.TrimPrefix(job.Content, "/ai"))
+	return []AIMessage{{Role: AIRoleUser, Content: content}}
+}
+
+// aiPersona returns who answers job: the group persona it asks, or the AI
+// assistant, also when the persona was deleted since.
+func (s *chatService) aiPersona(job AIJob) (AIPersona, error) {
+	if job.PersonaID == "" || s.personaRepo == nil {
+		return AIPersona{Name: aiUsername}, nil
+	}
+	setting, err := s.personaRepo.GetByID(job.PersonaID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return AIPersona{Name: aiUsername}, nil
+	}
+	if err != nil {
+		return AIPersona{}, err
+	}
+	return AIPersona{
+		Name:         setting.DisplayName,
+		AvatarURL:    setting.AvatarURL,
+		SystemPrompt: setting.SystemPrompt,
+		Model:        setting.Model,
+		Temperature:  setting.Temperature,
+	}, nil
+}
+
+// aiReplyID derives the AI reply's ID from the message it answers and who
+// answers it, so a redelivered job cannot post a second reply.
+func aiReplyID(job AIJob) uuid.UUID {
+	return models.ClientMessageUUID(job.bot(), aiReplyIDPrefix+job.MessageID)
+}
+
+// aiReply returns job's reply, or nil if none was posted yet.
+func (s *chatService) aiReply(job AIJob) (*models.Message, error) {
+	reply, err := s.messageRepo.GetByID(aiReplyID(job).String())
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	return reply, err
+}
+
+// aiEnvelope addresses the AI's events about job: to the group for group
+// messages, and back to the sender otherwise.
+func aiEnvelope(job AIJob) websockets.Envelope {
+	envelope := websockets.Envelope{SenderID: job.bot(), GroupID: job.GroupID}
+	if job.GroupID == "" {
+		envelope.ReceiverID = job.SenderID
+	}
+	return envelope
+}
+
+// aiAddressees names who gets the AI's events about a direct message: both
+// participants, which its Envelope from the AI cannot express. Group events
+// go to the group.
+func aiAddressees(job AIJob) websockets.Addressees {
+	if job.GroupID != "" {
+		return websockets.Addressees{}
+	}
+	return websockets.Addressees{RecipientIDs: []string{job.SenderID, job.ReceiverID}}
+}
+
+// postAIReply saves persona's reply to job's message with content and status.
+func (s *chatService) postAIReply(job AIJob, persona AIPersona, content, status string) (*models.Message, error) {
+	messageID, err := uuid.Parse(job.MessageID)
+	if err != nil {
+		return nil, invalidMessage("invalid message ID: %v", err)
+	}
+	senderUUID, err := uuid.Parse(job.SenderID)
+	if err != nil {
+		return nil, invalidMessage("invalid sender ID: %v", err)
+	}
+	botUUID, err := uuid.Parse(job.bot())
+	if err != nil {
+		return nil, invalidMessage("invalid bot ID: %v", err)
+	}
+
+	aiMessage := &models.Message{
+		ID:               aiReplyID(job),
+		SenderID:         botUUID,
+		Content:          content,
+		Status:           status,
+		ReplyToMessageID: &messageID,
+	}
+	event := &websockets.NewMessageEvent{
+		Type:             "new_message",
+		Envelope:         aiEnvelope(job),
+		Addressees:       aiAddressees(job),
+		SenderUsername:   persona.Name,
+		SenderAvatarURL:  persona.AvatarURL,
+		Content:          content,
+		ReplyToMessageID: job.MessageID,
+		ReplyToMessage: &websockets.ReplyPreview{
+			ID:       job.MessageID,
+			Content:  job.Content,
+			SenderID: job.SenderID,
+		},
+	}
+	if status == aiStreamingStatus {
+		event.Status = status
+	}
+	if job.GroupID != "" {
+		groupUUID, err := uuid.Parse(job.GroupID)
+		if err != nil {
+			return nil, invalidMessage("invalid group ID: %v", err)
+		}
+		aiMessage.GroupID = &groupUUID
+	} else {
+		aiMessage.ReceiverID = &senderUUID
+	}
+
+	if err := s.saveWithEvent(aiMessage, event); err != nil {
+		// A concurrent delivery of the same job may have won the insert.
+		if existing, getErr := s.aiReply(job); getErr == nil && existing != nil {
+			return existing, nil
+		}
+		return nil, err
+	}
+	if status == aiStreamingStatus && s.hub != nil {
+		// Chunks skip the outbox, so the placeholder must not wait for the
+		// relay either; clients drop the relayed copy as a redelivery.
+		s.hub.Broadcast <- event
+	}
+	return aiMessage, nil
+}
+
+// completeAIReply saves the final content of a streamed reply together with
+// its message_completed event.
+func (s *chatService) completeAIReply(job AIJob, reply *models.Message, content string, cancelled bool) error {
+	reply.Content = content
+	reply.Status = "sent"
+
+	payload, err := json.Marshal(&websockets.MessageCompletedEvent{
+		Type:             "message_completed",
+		Envelope:         aiEnvelope(job),
+		Addressees:       aiAddressees(job),
+		MessageID:        reply.ID.String(),
+		ReplyToMessageID: job.MessageID,
+		Content:          content,
+		Cancelled:        cancelled,
+	})
+	if err != nil {
+		return err
+	}
+	entry := &models.OutboxEntry{Topic: "message_completed", Payload: datatypes.JSON(payload)}
+	if err := s.messageRepo.UpdateWithOutbox(reply, entry); err != nil {
+		return err
+	}
+	if s.outbox != nil {
+		s.outbox.Notify()
+	}
+	log.Printf("chatService: AI replied to message %s", job.MessageID)
+	return nil
+}
+
+// broadcastAITyping shows or hides persona typing in job's conversation.
+func (s *chatService) broadcastAITyping(job AIJob, persona AIPersona, typing bool) {
+	if s.hub == nil {
+		return
+	}
+	s.hub.Broadcast <- &websockets.AITypingEvent{
+		Type:             "ai_typing",
+		Envelope:         aiEnvelope(job),
+		Addressees:       aiAddressees(job),
+		ReplyToMessageID: job.MessageID,
+		Username:         persona.Name,
+		Typing:           typing,
+	}
+}
+
+// broadcastChunk pushes a piece of a streamed reply straight to the hub.
+// Chunks are not persisted: message_completed carries the whole content.
+func (s *chatService) broadcastChunk(job AIJob, replyID string, seq int, delta string) {
+	if s.hub == nil {
+		return
+	}
+	s.hub.Broadcast <- &websockets.MessageChunkEvent{
+		Type:             "message_chunk",
+		Envelope:         aiEnvelope(job),
+		Addressees:       aiAddressees(job),
+		MessageID:        replyID,
+		ReplyToMessageID: job.MessageID,
+		Seq:              seq,
+		Delta:            delta,
+	}
+}
+
+// generations tracks the AI replies being generated on this instance so that
+// their requesters can cancel them.
+type generations struct {
+	mu     sync.Mutex
+	active map[string]*generation // By reply message ID
+}
+
+type generation struct {
+	requesterID string
+	cancel      context.CancelFunc
+}
+
+func newGenerations() *generations {
+	return &generations{active: make(map[string]*generation)}
+}
+
+// start registers the generation of replyID for requesterID. The returned
+// context is cancelled by cancel; done must be called when generation ends.
+func (g *generations) start(replyID, requesterID string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	g.mu.Lock()
+	g.active[replyID] = &generation{requesterID: requesterID, cancel: cancel}
+	g.mu.Unlock()
+	return ctx, func() {
+		g.mu.Lock()
+		delete(g.active, replyID)
+		g.mu.Unlock()
+		cancel()
+	}
+}
+
+func (g *generations) cancel(replyID, userID string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	gen, ok := g.active[replyID]
+	if !ok {
+		return websockets.NewCommandError(websockets.ErrCodeBadRequest, "No reply is being generated for this message")
+	}
+	if gen.requesterID != userID {
+		return websockets.NewCommandError(websockets.ErrCodeForbidden, "Only the user who asked can cancel this reply")
+	}
+	gen.cancel()
+	return nil
+}
@@ -0,0 +1,208 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultOpenAIModel = "gpt-4o-mini"
+
+	// How long to wait for the first byte of a response. Generation itself
+	// may take longer and is bounded by the request context.
+	openAIResponseTimeout = time.Minute
+)
+
+type openAIProvider struct {
+	baseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+// NewOpenAIProvider generates with the chat completions API of OpenAI or of
+// any server compatible with it, such as Ollama or llama.cpp. apiKey may be
+// empty for servers that need none.
+func NewOpenAIProvider(baseURL, apiKey string) AIProvider {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = openAIResponseTimeout
+	return &openAIProvider{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		apiKey:  apiKey,
+		client:  &http.Client{Transport: transport},
+	}
+}
+
+type openAIMessage struct {
+	Role       string           `json:"role"`
+	Content    string           `json:"content"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+type openAIToolCall struct {
+	Index    int    `json:"index"` // Of the call in a streamed response
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+type openAITool struct {
+	Type     string `json:"type"` // function
+	Function struct {
+		Name        string         `json:"name"`
+		Description string         `json:"description"`
+		Parameters  map[string]any `json:"parameters"`
+	} `json:"function"`
+}
+
+type openAIChatRequest struct {
+	Model       string          `json:"model"`
+	Messages    []openAIMessage `json:"messages"`
+	Tools       []openAITool    `json:"tools,omitempty"`
+	Temperature float32         `json:"temperature"`
+	MaxTokens   int             `json:"max_tokens,omitempty"`
+	Stream      bool            `json:"stream"`
+}
+
+// openAIChunk is one server-sent event of a streamed chat completion. Tool
+// calls arrive in pieces, to be joined by index.
+type openAIChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content   string           `json:"content"`
+			ToolCalls []openAIToolCall `json:"tool_calls"`
+		} `json:"delta"`
+	} `json:"choices"`
+}
+
+// openAIToolSchema is spec's parameters as a JSON schema.
+func openAIToolSchema(spec AIToolSpec) map[string]any {
+	properties := make(map[string]any, len(spec.Params))
+	required := []string{}
+	for _, param := range spec.Params {
+		properties[param.Name] = map[string]any{"type": param.Type, "description": param.Description}
+		if param.Required {
+			required = append(required, param.Name)
+		}
+	}
+	return map[string]any{"type": "object", "properties": properties, "required": required}
+}
+
+func (p *openAIProvider) Stream(ctx context.Context, req AIRequest, onChunk func(chunk string)) ([]AIToolCall, error) {
+	chatReq := openAIChatRequest{
+		Model:       req.Model,
+		Temperature: req.Temperature,
+		MaxTokens:   req.MaxTokens,
+		Stream:      true,
+	}
+	if req.SystemPrompt != "" {
+		chatReq.Messages = append(chatReq.Messages, openAIMessage{Role: "system", Content: req.SystemPrompt})
+	}
+	for _, message := range req.Messages {
+		chatMessage := openAIMessage{Role: message.Role, Content: message.Content, ToolCallID: message.ToolCallID}
+		for _, call := range message.ToolCalls {
+			toolCall := openAIToolCall{ID: call.ID, Type: "function"}
+			toolCall.Function.Name = call.Name
+			toolCall.Function.Arguments = string(call.Arguments)
+			chatMessage.ToolCalls = append(chatMessage.ToolCalls, toolCall)
+		}
+		chatReq.Messages = append(chatReq.Messages, chatMessage)
+	}
+	for _, spec := range req.Tools {
+		tool := openAITool{Type: "function"}
+		tool.Function.Name = spec.Name
+		tool.Function.Description = spec.Description
+		tool.Function.Parameters = openAIToolSchema(spec)
+		chatReq.Tools = append(chatReq.Tools, tool)
+	}
+	body, err := json.Marshal(chatReq)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "text/event-stream")
+	if p.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("chat completion request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("chat completion failed: %s: %s", resp.Status, strings.TrimSpace(string(detail)))
+	}
+
+	var calls []AIToolCall
+	// toolCalls returns the calls once the stream is complete.
+	toolCalls := func() []AIToolCall {
+		for i := range calls {
+			if len(calls[i].Arguments) == 0 {
+				calls[i].Arguments = json.RawMessage("{}")
+			}
+		}
+		return calls
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue // Blank separators and comments
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			return toolCalls(), nil
+		}
+		var chunk openAIChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return nil, fmt.Errorf("bad chat completion chunk: %w", err)
+		}
+		for _, choice := range chunk.Choices {
+			if choice.Delta.Content != "" {
+				onChunk(choice.Delta.Content)
+			}
+			for _, piece := range choice.Delta.ToolCalls {
+				for len(calls) <= piece.Index {
+					calls = append(calls, AIToolCall{})
+				}
+				call := &calls[piece.Index]
+				if piece.ID != "" {
+					call.ID = piece.ID
+				}
+				if piece.Function.Name != "" {
+					call.Name = piece.Function.Name
+				}
+				call.Arguments = append(call.Arguments, piece.Function.Arguments...)
+			}
+		}
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return toolCalls(), nil
+}
@@ -0,0 +1,209 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"my-chat-app/models"
+	"my-chat-app/repositories"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+)
+
+const (
+	maxPersonasPerGroup      = 10
+	maxPersonaPromptLength   = 4000
+	maxPersonaNameLength     = 100
+	maxPersonaModelLength    = 100
+	maxPersonaAvatarLength   = 500
+	maxPersonaTemperature    = 2
+	botPasswordNotApplicable = "not_applicable" // Bots never log in
+)
+
+var (
+	// ErrNotGroupMember rejects looking at the personas of another group.
+	ErrNotGroupMember = errors.New("not a member of this group")
+	// ErrNotGroupAdmin rejects configuring personas by anyone but the
+	// group's creator and the app's admins.
+	ErrNotGroupAdmin = errors.New("only group admins can configure AI personas")
+	// ErrInvalidPersona matches the errors of persona settings that cannot
+	// be saved as given.
+	ErrInvalidPersona = errors.New("invalid AI persona")
+	// ErrPersonaUsernameTaken rejects a handle whose bot username,
+	// handle@code, already belongs to someone else.
+	ErrPersonaUsernameTaken = errors.New("AI persona username is taken")
+)
+
+var personaHandlePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{1,31}$`)
+
+// AIPersonaSettings are the configurable parts of a group AI persona.
+type AIPersonaSettings struct {
+	DisplayName  string   `json:"display_name"`
+	AvatarURL    string   `json:"avatar_url"`
+	SystemPrompt string   `json:"system_prompt"`
+	Model        string   `json:"model"`       // Empty uses the configured model
+	Temperature  *float32 `json:"temperature"` // Nil uses the configured temperature
+}
+
+// AIPersonaService manages the AI personas of groups, which members mention
+// by handle, such as @reviewer. Group admins configure them.
+type AIPersonaService interface {
+	// List returns the group's personas and whether userID may configure
+	// them.
+	List(groupID, userID string) ([]models.GroupAISetting, bool, error)
+	Save(groupID, userID, handle string, settings AIPersonaSettings) (*models.GroupAISetting, error)
+	Delete(groupID, userID, handle string) error
+}
+
+type aiPersonaService struct {
+	personaRepo repositories.GroupAISettingsRepository
+	groupRepo   repositories.GroupRepository
+	userRepo    repositories.UserRepository
+	admins      map[string]bool
+}
+
+// NewAIPersonaService lets the creator of each group and adminIDs configure
+// the group's personas.
+func NewAIPersonaService(personaRepo repositories.GroupAISettingsRepository, groupRepo repositories.GroupRepository, userRepo repositories.UserRepository, adminIDs []string) AIPersonaService {
+	admins := make(map[string]bool, len(adminIDs))
+	for _, id := range adminIDs {
+		admins[id] = true
+	}
+	return &aiPersonaService{personaRepo: personaRepo, groupRepo: groupRepo, userRepo: userRepo, admins: admins}
+}
+
+func (s *aiPersonaService) List(groupID, userID string) ([]models.GroupAISetting, bool, error) {
+	group, err := s.groupRepo.GetByID(groupID)
+	if err != nil {
+		return nil, false, err
+	}
+	if !isMember(group, userID) {
+		return nil, false, ErrNotGroupMember
+	}
+	personas, err := s.personaRepo.ListForGroup(groupID)
+	return personas, s.isAdmin(group, userID), err
+}
+
+// Save creates the persona handle, or updates it, along with its bot.
+func (s *aiPersonaService) Save(groupID, userID, handle string, settings AIPersonaSettings) (*models.GroupAISetting, error) {
+	group, err := s.groupRepo.GetByID(groupID)
+	if err != nil {
+		return nil, err
+	}
+	if !s.isAdmin(group, userID) {
+		return nil, ErrNotGroupAdmin
+	}
+	handle = strings.ToLower(handle)
+	if err := validatePersona(handle, &settings); err != nil {
+		return nil, err
+	}
+
+	personas, err := s.personaRepo.ListForGroup(groupID)
+	if err != nil {
+		return nil, err
+	}
+	exists := false
+	for _, persona := range personas {
+		exists = exists || persona.Handle == handle
+	}
+	if !exists && len(personas) >= maxPersonasPerGroup {
+		return nil, fmt.Errorf("%w: a group can have at most %d personas", ErrInvalidPersona, maxPersonasPerGroup)
+	}
+
+	botID := models.BotUserUUID(groupID, handle)
+	bot := &models.User{
+		ID:         botID,
+		Username:   handle + "@" + group.Code,
+		Password:   botPasswordNotApplicable,
+		Email:      botID.String() + "@bots.internal",
+		IsVerified: true,
+		IsBot:      true,
+	}
+	// Deleted accounts keep their usernames, so they count as taken too.
+	existing, err := s.userRepo.GetByUsernameIncludingDeleted(bot.Username)
+	if err == nil && existing.ID != botID {
+		return nil, usernameTaken(bot.Username)
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	persona := &models.GroupAISetting{
+		GroupID:      group.ID,
+		Handle:       handle,
+		BotUserID:    botID,
+		DisplayName:  settings.DisplayName,
+		AvatarURL:    settings.AvatarURL,
+		SystemPrompt: settings.SystemPrompt,
+		Model:        settings.Model,
+		Temperature:  settings.Temperature,
+	}
+	if err := s.personaRepo.Save(persona, bot); err != nil {
+		if isDuplicateKey(err) {
+			// Someone registered the username since it was checked.
+			return nil, usernameTaken(bot.Username)
+		}
+		return nil, err
+	}
+	return persona, nil
+}
+
+func usernameTaken(username string) error {
+	return fmt.Errorf("%w: %s already exists, choose another handle", ErrPersonaUsernameTaken, username)
+}
+
+func (s *aiPersonaService) Delete(groupID, userID, handle string) error {
+	group, err := s.groupRepo.GetByID(groupID)
+	if err != nil {
+		return err
+	}
+	if !s.isAdmin(group, userID) {
+		return ErrNotGroupAdmin
+	}
+	return s.personaRepo.Delete(groupID, strings.ToLower(handle))
+}
+
+// isAdmin reports whether userID administers group: its creator, as long as
+// they are a member, or an admin of the app.
+func (s *aiPersonaService) isAdmin(group *models.Group, userID string) bool {
+	if s.admins[userID] {
+		return true
+	}
+	return group.CreatedBy != nil && group.CreatedBy.String() == userID && isMember(group, userID)
+}
+
+func isMember(group *models.Group, userID string) bool {
+	for _, user := range group.Users {
+		if user.ID.String() == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// validatePersona checks handle and settings, trimming their text.
+func validatePersona(handle string, settings *AIPersonaSettings) error {
+	if !personaHandlePattern.MatchString(handle) {
+		return fmt.Errorf("%w: the handle must be 2 to 32 letters, digits or underscores, starting with a letter", ErrInvalidPersona)
+	}
+	settings.DisplayName = strings.TrimSpace(settings.DisplayName)
+	settings.AvatarURL = strings.TrimSpace(settings.AvatarURL)
+	settings.SystemPrompt = strings.TrimSpace(settings.SystemPrompt)
+	settings.Model = strings.TrimSpace(settings.Model)
+	switch {
+	case settings.DisplayName == "" || utf8.RuneCountInString(settings.DisplayName) > maxPersonaNameLength:
+		return fmt.Errorf("%w: the display name must be 1 to %d characters", ErrInvalidPersona, maxPersonaNameLength)
+	case utf8.RuneCountInString(settings.SystemPrompt) > maxPersonaPromptLength:
+		return fmt.Errorf("%w: the system prompt exceeds %d characters", ErrInvalidPersona, maxPersonaPromptLength)
+	case len(settings.Model) > maxPersonaModelLength:
+		return fmt.Errorf("%w: the model exceeds %d characters", ErrInvalidPersona, maxPersonaModelLength)
+	case len(settings.AvatarURL) > maxPersonaAvatarLength ||
+		settings.AvatarURL != "" && !strings.HasPrefix(settings.AvatarURL, "https://") &&
+			!strings.HasPrefix(settings.AvatarURL, "http://") && !strings.HasPrefix(settings.AvatarURL, "/"):
+		return fmt.Errorf("%w: the avatar must be an http(s) URL or a path of at most %d characters", ErrInvalidPersona, maxPersonaAvatarLength)
+	case settings.Temperature != nil && (*settings.Temperature < 0 || *settings.Temperature > maxPersonaTemperature):
+		return fmt.Errorf("%w: the temperature must be between 0 and %d", ErrInvalidPersona, maxPersonaTemperature)
+	}
+	return nil
+}
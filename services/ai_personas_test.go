@@ -0,0 +1,165 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"my-chat-app/models"
+	"my-chat-app/repositories"
+	"testing"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const groupID = "33333333-3333-3333-3333-333333333333"
+
+type fakeGroupRepo struct {
+	repositories.GroupRepository
+	group   models.Group
+	members []*models.User
+}
+
+func (r *fakeGroupRepo) GetByID(id string) (*models.Group, error) {
+	if id != r.group.ID.String() {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &r.group, nil
+}
+
+type fakePersonaRepo struct {
+	repositories.GroupAISettingsRepository
+	personas []models.GroupAISetting
+	bots     []models.User
+}
+
+func (r *fakePersonaRepo) ListForGroup(groupID string) ([]models.GroupAISetting, error) {
+	return r.personas, nil
+}
+
+func (r *fakePersonaRepo) GetByID(id string) (*models.GroupAISetting, error) {
+	for _, persona := range r.personas {
+		if persona.ID.String() == id {
+			return &persona, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *fakePersonaRepo) Save(setting *models.GroupAISetting, bot *models.User) error {
+	setting.ID = uuid.New()
+	r.personas = append(r.personas, *setting)
+	r.bots = append(r.bots, *bot)
+	return nil
+}
+
+// newPersonaTest is a group created by the caller, with the callee as member.
+func newPersonaTest() (AIPersonaService, *fakePersonaRepo) {
+	creator := uuid.MustParse(callerID)
+	groupRepo := &fakeGroupRepo{group: models.Group{
+		ID:        uuid.MustParse(groupID),
+		Code:      "ENG123",
+		CreatedBy: &creator,
+		Users:     []*models.User{{ID: creator}, {ID: uuid.MustParse(calleeID)}},
+	}}
+	personaRepo := &fakePersonaRepo{}
+	return NewAIPersonaService(personaRepo, groupRepo, &fakeUsernameRepo{}, nil), personaRepo
+}
+
+// fakeUsernameRepo knows the users in taken by username.
+type fakeUsernameRepo struct {
+	fakeUserRepo
+	taken map[string]uuid.UUID
+}
+
+func (r *fakeUsernameRepo) GetByUsernameIncludingDeleted(username string) (*models.User, error) {
+	id, ok := r.taken[username]
+	if !ok {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &models.User{ID: id, Username: username}, nil
+}
+
+func TestOnlyGroupAdminsConfigurePersonas(t *testing.T) {
+	service, personaRepo := newPersonaTest()
+	settings := AIPersonaSettings{DisplayName: "Code Reviewer", SystemPrompt: "Be terse."}
+
+	if _, err := service.Save(groupID, calleeID, "reviewer", settings); !errors.Is(err, ErrNotGroupAdmin) {
+		t.Errorf("member saved a persona: err = %v", err)
+	}
+	if _, err := service.Save(groupID, callerID, "@reviewer", settings); !errors.Is(err, ErrInvalidPersona) {
+		t.Errorf("invalid handle accepted: err = %v", err)
+	}
+	persona, err := service.Save(groupID, callerID, "Reviewer", settings)
+	if err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	if persona.Handle != "reviewer" || persona.BotUserID != models.BotUserUUID(groupID, "reviewer") {
+		t.Errorf("persona = %+v, want handle reviewer with its bot", persona)
+	}
+	if bot := personaRepo.bots[0]; !bot.IsBot || bot.ID != persona.BotUserID || bot.Username != "reviewer@ENG123" {
+		t.Errorf("bot = %+v, want a bot account for the persona", bot)
+	}
+
+	personas, canConfigure, err := service.List(groupID, calleeID)
+	if err != nil || len(personas) != 1 || canConfigure {
+		t.Errorf("member's list = %v, %v, %v; want the persona, read-only", personas, canConfigure, err)
+	}
+	if _, _, err := service.List(groupID, uuid.New().String()); !errors.Is(err, ErrNotGroupMember) {
+		t.Errorf("outsider listed personas: err = %v", err)
+	}
+}
+
+func TestPersonaHandlesCannotTakeExistingUsernames(t *testing.T) {
+	creator := uuid.MustParse(callerID)
+	groupRepo := &fakeGroupRepo{group: models.Group{ID: uuid.MustParse(groupID), Code: "ENG123", CreatedBy: &creator, Users: []*models.User{{ID: creator}}}}
+	userRepo := &fakeUsernameRepo{taken: map[string]uuid.UUID{
+		"reviewer@ENG123": uuid.MustParse(calleeID),
+		"tester@ENG123":   models.BotUserUUID(groupID, "tester"), // The persona's own bot
+	}}
+	service := NewAIPersonaService(&fakePersonaRepo{}, groupRepo, userRepo, nil)
+	settings := AIPersonaSettings{DisplayName: "Bot", SystemPrompt: "Be terse."}
+
+	if _, err := service.Save(groupID, callerID, "reviewer", settings); !errors.Is(err, ErrPersonaUsernameTaken) {
+		t.Errorf("Save with a taken username: err = %v, want ErrPersonaUsernameTaken", err)
+	}
+	if _, err := service.Save(groupID, callerID, "tester", settings); err != nil {
+		t.Errorf("saving the persona again failed: %v", err)
+	}
+}
+
+func TestMentionedPersonasAnswerAsTheirBots(t *testing.T) {
+	personaService, personaRepo := newPersonaTest()
+	for _, handle := range []string{"reviewer", "ai"} {
+		if _, err := personaService.Save(groupID, callerID, handle, AIPersonaSettings{DisplayName: handle + " bot", SystemPrompt: "Be terse."}); err != nil {
+			t.Fatalf("Save failed: %v", err)
+		}
+	}
+	messageRepo := &fakeMessageRepo{}
+	aiService := &fakeAIService{}
+	service := NewChatService(messageRepo, nil, fakeUserRepo{}, nil, aiService, nil, personaRepo, nil, nil)
+
+	if _, err := service.SendMessage(callerID, "", groupID, "@Reviewer and @AI, thoughts?", "", "", "", "", 0, "", ""); err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	var jobs []AIJob
+	for _, entry := range messageRepo.outbox[1:] {
+		var job AIJob
+		json.Unmarshal(entry.Payload, &job)
+		jobs = append(jobs, job)
+	}
+	// The group's @AI persona answers @AI instead of the AI assistant.
+	if len(jobs) != 2 || jobs[0].BotID != personaRepo.personas[0].BotUserID.String() || jobs[1].BotID != personaRepo.personas[1].BotUserID.String() {
+		t.Fatalf("jobs = %+v, want one per persona", jobs)
+	}
+
+	if err := service.ProcessAIJob(jobs[0]); err != nil {
+		t.Fatalf("ProcessAIJob failed: %v", err)
+	}
+	reply := messageRepo.created[1]
+	if reply.SenderID != personaRepo.personas[0].BotUserID || reply.Content != "an answer" {
+		t.Errorf("reply = %+v, want the reviewer bot's answer", reply)
+	}
+	if aiService.persona.Name != "reviewer bot" || aiService.persona.SystemPrompt != "Be terse." {
+		t.Errorf("persona = %+v, want the reviewer's settings", aiService.persona)
+	}
+}
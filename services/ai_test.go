@@ -0,0 +1,112 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"my-chat-app/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOpenAIProviderStreamsChatCompletion(t *testing.T) {
+	var got openAIChatRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" || r.Header.Get("Authorization") != "Bearer key" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, delta := range []string{"Hel", "lo"} {
+			fmt.Fprintf(w, "data: {\"choices\":[{\"delta\":{\"content\":%q}}]}\n\n", delta)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	service := NewAIServiceWithProvider(NewOpenAIProvider(server.URL+"/v1/", "key"), "llama3", 0.9, 64)
+	temperature := float32(0.2)
+	persona := AIPersona{Name: "Reviewer", SystemPrompt: "Be terse.", Temperature: &temperature}
+	var chunks []string
+	err := service.StreamMessage(context.Background(), persona, []AIMessage{{Role: AIRoleUser, Content: "hi"}}, nil, func(chunk string) {
+		chunks = append(chunks, chunk)
+	})
+	if err != nil {
+		t.Fatalf("StreamMessage failed: %v", err)
+	}
+	if strings.Join(chunks, "|") != "Hel|lo" {
+		t.Errorf("chunks = %q, want Hel and lo", chunks)
+	}
+	if !got.Stream || got.Model != "llama3" || got.Temperature != 0.2 || got.MaxTokens != 64 {
+		t.Errorf("request = %+v, want the configured settings", got)
+	}
+	if len(got.Messages) != 2 || got.Messages[0].Role != "system" || got.Messages[1].Role != "user" || got.Messages[1].Content != "hi" {
+		t.Errorf("messages = %+v, want the system prompt and the user's message", got.Messages)
+	}
+	if prompt := got.Messages[0].Content; !strings.HasPrefix(prompt, "You are Reviewer,") || !strings.HasSuffix(prompt, "\n\nBe terse.") {
+		t.Errorf("system prompt = %q, want the persona's", prompt)
+	}
+}
+
+func TestOpenAIProviderReportsErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "model not found", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	_, err := NewOpenAIProvider(server.URL, "").Stream(context.Background(), AIRequest{Messages: []AIMessage{{Role: AIRoleUser, Content: "hi"}}}, func(string) {})
+	if err == nil || !strings.Contains(err.Error(), "model not found") {
+		t.Errorf("err = %v, want the server's error", err)
+	}
+}
+
+func TestEchoProvider(t *testing.T) {
+	service := NewAIServiceWithProvider(NewEchoProvider(), "", 0, 0)
+	response, err := service.ProcessMessage("hello there")
+	if err != nil || response != "Echo: hello there" {
+		t.Errorf("response = %q, %v; want the echoed message", response, err)
+	}
+}
+
+func TestNewAIServiceWithoutProvider(t *testing.T) {
+	if _, err := NewAIService(config.Config{}); !errors.Is(err, ErrAIUnavailable) {
+		t.Errorf("err = %v, want ErrAIUnavailable", err)
+	}
+	if _, err := NewAIService(config.Config{AIProvider: "echo"}); err != nil {
+		t.Errorf("echo provider: %v", err)
+	}
+	if _, err := NewAIService(config.Config{AIProvider: "nonsense"}); err == nil {
+		t.Errorf("unknown provider accepted")
+	}
+}
+
+func TestOpenAIProviderJoinsStreamedToolCalls(t *testing.T) {
+	var got openAIChatRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&got)
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, `data: {"choices":[{"delta":{"tool_calls":[{"index":0,"id":"call-1","type":"function","function":{"name":"search_messages","arguments":"{\"que"}}]}}]}`+"\n\n")
+		fmt.Fprint(w, `data: {"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"ry\":\"budget\"}"}}]}}]}`+"\n\n")
+		fmt.Fprint(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	req := AIRequest{
+		Messages: []AIMessage{{Role: AIRoleUser, Content: "who shared the budget?"}},
+		Tools:    []AIToolSpec{{Name: "search_messages", Params: []AIToolParam{{Name: "query", Type: "string", Required: true}}}},
+	}
+	calls, err := NewOpenAIProvider(server.URL, "").Stream(context.Background(), req, func(string) {})
+	if err != nil {
+		t.Fatalf("Stream failed: %v", err)
+	}
+	if len(calls) != 1 || calls[0].ID != "call-1" || calls[0].Name != "search_messages" || string(calls[0].Arguments) != `{"query":"budget"}` {
+		t.Errorf("calls = %+v, want the joined search_messages call", calls)
+	}
+	if len(got.Tools) != 1 || got.Tools[0].Function.Name != "search_messages" || got.Tools[0].Function.Parameters["required"] == nil {
+		t.Errorf("tools = %+v, want search_messages declared", got.Tools)
+	}
+}
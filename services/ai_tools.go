@@ -0,0 +1,309 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"my-chat-app/models"
+	"my-chat-app/repositories"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultAIToolResults = 20
+	maxAIToolResults     = 50
+	// Longer message contents are cut in tool results.
+	maxAIToolContentLength = 500
+)
+
+// errAIToolDenied answers tool calls about conversations the requester is
+// not part of, without telling whether they exist.
+var errAIToolDenied = errors.New("no access to that conversation")
+
+// AIToolRegistry holds the tools AI replies may call to look up chat data.
+// Tools act with the permissions of the user who asked: they only read
+// conversations that user takes part in. Every call is audited.
+type AIToolRegistry struct {
+	messageRepo repositories.MessageRepository
+	groupRepo   repositories.GroupRepository
+	userRepo    repositories.UserRepository
+	auditRepo   repositories.AIToolInvocationRepository
+	tools       []aiTool
+}
+
+type aiTool struct {
+	spec AIToolSpec
+	run  func(t *jobTools, args aiToolArgs) (any, error)
+}
+
+// aiToolArgs are the arguments of all tools; each uses some. GroupID is not
+// offered to the model; it is read only to deny calls that name a group.
+type aiToolArgs struct {
+	Query        string `json:"query"`
+	FromUsername string `json:"from_username"`
+	Since        string `json:"since"`
+	Until        string `json:"until"`
+	GroupID      string `json:"group_id"`
+	Limit        int    `json:"limit"`
+}
+
+// aiToolMessage is a message as tools return it.
+type aiToolMessage struct {
+	ID       string `json:"id"`
+	From     string `json:"from"`
+	SentAt   string `json:"sent_at"`
+	Content  string `json:"content,omitempty"`
+	FileName string `json:"file_name,omitempty"`
+	FileType string `json:"file_type,omitempty"`
+	FileSize int64  `json:"file_size,omitempty"`
+}
+
+var aiToolSearchParams = []AIToolParam{
+	{Name: "query", Type: "string", Description: "Text to look for, ignoring case; empty matches everything"},
+	{Name: "from_username", Type: "string", Description: "Only messages sent by this username"},
+	{Name: "since", Type: "string", Description: "Only messages sent at or after this date (YYYY-MM-DD) or RFC 3339 time"},
+	{Name: "until", Type: "string", Description: "Only messages sent before this date (YYYY-MM-DD) or RFC 3339 time"},
+	{Name: "limit", Type: "integer", Description: fmt.Sprintf("Most results to return, newest first; at most %d", maxAIToolResults)},
+}
+
+func NewAIToolRegistry(messageRepo repositories.MessageRepository, groupRepo repositories.GroupRepository, userRepo repositories.UserRepository, auditRepo repositories.AIToolInvocationRepository) *AIToolRegistry {
+	return &AIToolRegistry{
+		messageRepo: messageRepo,
+		groupRepo:   groupRepo,
+		userRepo:    userRepo,
+		auditRepo:   auditRepo,
+		tools: []aiTool{
+			{
+				spec: AIToolSpec{
+					Name:        "search_messages",
+					Description: "Search the messages of this chat.",
+					Params:      aiToolSearchParams,
+				},
+				run: func(t *jobTools, args aiToolArgs) (any, error) { return t.searchMessages(args, false) },
+			},
+			{
+				spec: AIToolSpec{
+					Name:        "list_shared_files",
+					Description: "List the files shared in this chat; query matches file names.",
+					Params:      aiToolSearchParams,
+				},
+				run: func(t *jobTools, args aiToolArgs) (any, error) { return t.searchMessages(args, true) },
+			},
+			{
+				spec: AIToolSpec{
+					Name:        "list_group_members",
+					Description: "List the usernames of the members of this group chat.",
+				},
+				run: (*jobTools).listGroupMembers,
+			},
+		},
+	}
+}
+
+// For returns the tools for answering job, acting as job's sender.
+func (r *AIToolRegistry) For(job AIJob) AITools {
+	return &jobTools{registry: r, job: job, usernames: make(map[uuid.UUID]string)}
+}
+
+// jobTools are the registry's tools bound to one job.
+type jobTools struct {
+	registry  *AIToolRegistry
+	job       AIJob
+	usernames map[uuid.UUID]string
+}
+
+func (t *jobTools) Specs() []AIToolSpec {
+	specs := make([]AIToolSpec, len(t.registry.tools))
+	for i, tool := range t.registry.tools {
+		specs[i] = tool.spec
+	}
+	return specs
+}
+
+func (t *jobTools) Call(ctx context.Context, call AIToolCall) string {
+	started := time.Now()
+	result, err := t.run(call)
+	if ctxErr := ctx.Err(); err == nil && ctxErr != nil {
+		err = ctxErr // The reply was cancelled meanwhile
+	}
+	content := ""
+	if err == nil {
+		var payload []byte
+		payload, err = json.Marshal(result)
+		content = string(payload)
+	}
+	errText := ""
+	if err != nil {
+		errText = err.Error()
+		payload, _ := json.Marshal(map[string]string{"error": errText})
+		content = string(payload)
+	}
+	t.audit(call, content, errText, time.Since(started))
+	return content
+}
+
+func (t *jobTools) run(call AIToolCall) (any, error) {
+	var args aiToolArgs
+	if len(call.Arguments) > 0 {
+		if err := json.Unmarshal(call.Arguments, &args); err != nil {
+			return nil, fmt.Errorf("arguments must be a JSON object: %v", err)
+		}
+	}
+	for _, tool := range t.registry.tools {
+		if tool.spec.Name == call.Name {
+			return tool.run(t, args)
+		}
+	}
+	return nil, fmt.Errorf("unknown tool %q", call.Name)
+}
+
+// audit records call. Failing to is logged: the reply goes on.
+func (t *jobTools) audit(call AIToolCall, result, errText string, took time.Duration) {
+	if t.registry.auditRepo == nil {
+		return
+	}
+	messageID, _ := uuid.Parse(t.job.MessageID)
+	requesterID, _ := uuid.Parse(t.job.SenderID)
+	botID, _ := uuid.Parse(t.job.bot())
+	err := t.registry.auditRepo.Create(&models.AIToolInvocation{
+		MessageID:   messageID,
+		RequesterID: requesterID,
+		BotID:       botID,
+		Tool:        call.Name,
+		Arguments:   string(call.Arguments),
+		Result:      result,
+		Error:       errText,
+		DurationMS:  took.Milliseconds(),
+	})
+	if err != nil {
+		log.Printf("AI tools: failed to audit %s for message %s: %v", call.Name, t.job.MessageID, err)
+	}
+}
+
+// conversation returns the conversation a tool reads: always the job's own.
+// The reply is seen by everyone in it, so naming another group is denied,
+// even one the requester belongs to. The group is checked for membership on
+// every call, so members who left lose access.
+func (t *jobTools) conversation(groupID string) (user1ID, user2ID, group string, err error) {
+	if groupID != "" && groupID != t.job.GroupID {
+		return "", "", "", errAIToolDenied
+	}
+	groupID = t.job.GroupID
+	if groupID == "" {
+		return t.job.SenderID, t.job.ReceiverID, "", nil
+	}
+	members, err := t.registry.groupRepo.GetMembers(groupID)
+	if err != nil {
+		return "", "", "", err
+	}
+	for _, member := range members {
+		if member.ID.String() == t.job.SenderID {
+			return "", "", groupID, nil
+		}
+	}
+	return "", "", "", errAIToolDenied
+}
+
+func (t *jobTools) searchMessages(args aiToolArgs, filesOnly bool) (any, error) {
+	search := repositories.MessageSearch{Text: args.Query, FilesOnly: filesOnly, Limit: args.Limit}
+	var err error
+	if search.User1ID, search.User2ID, search.GroupID, err = t.conversation(args.GroupID); err != nil {
+		return nil, err
+	}
+	if search.Limit <= 0 || search.Limit > maxAIToolResults {
+		search.Limit = defaultAIToolResults
+	}
+	if search.Since, err = parseAIToolTime(args.Since); err != nil {
+		return nil, err
+	}
+	if search.Until, err = parseAIToolTime(args.Until); err != nil {
+		return nil, err
+	}
+	if args.FromUsername != "" {
+		sender, err := t.registry.userRepo.GetByUsername(args.FromUsername)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("no user is named %q", args.FromUsername)
+		}
+		if err != nil {
+			return nil, err
+		}
+		search.SenderID = sender.ID.String()
+	}
+
+	messages, err := t.registry.messageRepo.Search(search)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]aiToolMessage, 0, len(messages))
+	for _, message := range messages {
+		if message.Status == aiStreamingStatus || message.ID.String() == t.job.MessageID {
+			continue
+		}
+		content := message.Content
+		if utf8.RuneCountInString(content) > maxAIToolContentLength {
+			content = string([]rune(content)[:maxAIToolContentLength]) + "…"
+		}
+		results = append(results, aiToolMessage{
+			ID:       message.ID.String(),
+			From:     t.username(message.SenderID),
+			SentAt:   message.CreatedAt.Format(time.RFC3339),
+			Content:  content,
+			FileName: message.FileName,
+			FileType: message.FileType,
+			FileSize: message.FileSize,
+		})
+	}
+	return map[string]any{"messages": results}, nil
+}
+
+func (t *jobTools) listGroupMembers(args aiToolArgs) (any, error) {
+	_, _, groupID, err := t.conversation(args.GroupID)
+	if err != nil {
+		return nil, err
+	}
+	if groupID == "" {
+		return nil, errors.New("this chat is not a group")
+	}
+	members, err := t.registry.groupRepo.GetMembers(groupID)
+	if err != nil {
+		return nil, err
+	}
+	usernames := make([]string, 0, len(members))
+	for _, member := range members {
+		usernames = append(usernames, member.Username)
+	}
+	return map[string]any{"members": usernames}, nil
+}
+
+func (t *jobTools) username(id uuid.UUID) string {
+	if username, ok := t.usernames[id]; ok {
+		return username
+	}
+	username := "unknown"
+	if user, err := t.registry.userRepo.GetByID(id.String()); err == nil {
+		username = user.Username
+	}
+	t.usernames[id] = username
+	return username
+}
+
+// parseAIToolTime accepts a date or an RFC 3339 time; empty is the zero time.
+func parseAIToolTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad time %q: use YYYY-MM-DD or RFC 3339", value)
+	}
+	return t, nil
+}
@@ -0,0 +1,169 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"my-chat-app/models"
+	"my-chat-app/repositories"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func (r *fakeMessageRepo) Search(search repositories.MessageSearch) ([]models.Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var messages []models.Message
+	for _, m := range r.created {
+		inGroup := m.GroupID != nil && m.GroupID.String() == search.GroupID
+		if search.GroupID == "" || !inGroup || search.FilesOnly && m.FileName == "" {
+			continue
+		}
+		text := strings.ToLower(m.Content + " " + m.FileName)
+		if strings.Contains(text, strings.ToLower(search.Text)) {
+			messages = append(messages, m)
+		}
+	}
+	return messages, nil
+}
+
+func (r *fakeGroupRepo) GetMembers(groupID string) ([]*models.User, error) {
+	if groupID != r.group.ID.String() {
+		return nil, nil
+	}
+	return r.members, nil
+}
+
+type fakeToolAuditRepo struct {
+	repositories.AIToolInvocationRepository
+	invocations []models.AIToolInvocation
+}
+
+func (r *fakeToolAuditRepo) Create(invocation *models.AIToolInvocation) error {
+	r.invocations = append(r.invocations, *invocation)
+	return nil
+}
+
+// scriptedProvider calls the scripted tools in its first rounds, then answers.
+type scriptedProvider struct {
+	rounds   [][]AIToolCall
+	answer   string
+	requests []AIRequest
+}
+
+func (p *scriptedProvider) Stream(ctx context.Context, req AIRequest, onChunk func(chunk string)) ([]AIToolCall, error) {
+	p.requests = append(p.requests, req)
+	if round := len(p.requests) - 1; round < len(p.rounds) {
+		return p.rounds[round], nil
+	}
+	onChunk(p.answer)
+	return nil, nil
+}
+
+// newToolsTest is a group of the caller and the callee where the callee
+// shared a budget; another group shares one too.
+func newToolsTest() (*AIToolRegistry, *fakeToolAuditRepo) {
+	group, otherGroup := uuid.MustParse(groupID), uuid.New()
+	messageRepo := &fakeMessageRepo{created: []models.Message{
+		{ID: uuid.New(), SenderID: uuid.MustParse(calleeID), GroupID: &group, Content: "here you go", FileName: "Budget-2026.xlsx", Status: "sent", CreatedAt: time.Now()},
+		{ID: uuid.New(), SenderID: uuid.MustParse(calleeID), GroupID: &group, Content: "the budget is due friday", Status: "sent", CreatedAt: time.Now()},
+		{ID: uuid.New(), SenderID: uuid.New(), GroupID: &otherGroup, FileName: "secret-budget.pdf", Status: "sent", CreatedAt: time.Now()},
+	}}
+	groupRepo := &fakeGroupRepo{
+		group: models.Group{ID: group},
+		members: []*models.User{
+			{ID: uuid.MustParse(callerID), Username: "user-" + callerID[:4]},
+			{ID: uuid.MustParse(calleeID), Username: "user-" + calleeID[:4]},
+		},
+	}
+	auditRepo := &fakeToolAuditRepo{}
+	return NewAIToolRegistry(messageRepo, groupRepo, fakeUserRepo{}, auditRepo), auditRepo
+}
+
+func TestAIRepliesLookUpSharedFilesWithTools(t *testing.T) {
+	registry, auditRepo := newToolsTest()
+	provider := &scriptedProvider{
+		rounds: [][]AIToolCall{{{ID: "call-1", Name: "list_shared_files", Arguments: json.RawMessage(`{"query":"BUDGET"}`)}}},
+		answer: "user-2222 shared Budget-2026.xlsx.",
+	}
+	service := NewAIServiceWithProvider(provider, "", 0, 0)
+	job := AIJob{MessageID: uuid.NewString(), SenderID: callerID, GroupID: groupID, Content: "@AI who shared the budget?"}
+
+	var reply strings.Builder
+	err := service.StreamMessage(context.Background(), AIPersona{}, []AIMessage{{Role: AIRoleUser, Content: job.Content}}, registry.For(job), func(chunk string) {
+		reply.WriteString(chunk)
+	})
+	if err != nil || reply.String() != provider.answer {
+		t.Fatalf("reply = %q, %v; want the answer", reply.String(), err)
+	}
+	if len(provider.requests) != 2 || len(provider.requests[0].Tools) == 0 {
+		t.Fatalf("requests = %+v, want a round with tools, then the answer", provider.requests)
+	}
+	messages := provider.requests[1].Messages
+	result := messages[len(messages)-1]
+	if result.Role != AIRoleTool || result.ToolCallID != "call-1" {
+		t.Fatalf("last message = %+v, want the tool result", result)
+	}
+	if !strings.Contains(result.Content, "Budget-2026.xlsx") || !strings.Contains(result.Content, "user-"+calleeID[:4]) {
+		t.Errorf("result = %s, want the file and who shared it", result.Content)
+	}
+	if strings.Contains(result.Content, "due friday") || strings.Contains(result.Content, "secret-budget.pdf") {
+		t.Errorf("result = %s, want only this group's files", result.Content)
+	}
+
+	if len(auditRepo.invocations) != 1 {
+		t.Fatalf("audited %d calls, want 1", len(auditRepo.invocations))
+	}
+	audited := auditRepo.invocations[0]
+	if audited.Tool != "list_shared_files" || audited.RequesterID.String() != callerID || audited.BotID.String() != AIUserID ||
+		audited.Error != "" || audited.Result != result.Content {
+		t.Errorf("audited %+v, want the call and its result", audited)
+	}
+}
+
+func TestAIToolsOnlyReadTheRequestersConversations(t *testing.T) {
+	registry, auditRepo := newToolsTest()
+	outsider := AIJob{MessageID: uuid.NewString(), SenderID: uuid.NewString(), ReceiverID: AIUserID}
+	call := AIToolCall{ID: "call-1", Name: "list_shared_files", Arguments: json.RawMessage(`{"group_id":"` + groupID + `"}`)}
+
+	result := registry.For(outsider).Call(context.Background(), call)
+	if !strings.Contains(result, errAIToolDenied.Error()) || strings.Contains(result, "Budget") {
+		t.Errorf("result = %s, want access denied", result)
+	}
+	if len(auditRepo.invocations) != 1 || auditRepo.invocations[0].Error != errAIToolDenied.Error() {
+		t.Errorf("audited %+v, want the denied call", auditRepo.invocations)
+	}
+
+}
+
+func TestAIToolsDenyGroupsOtherThanTheReplysConversation(t *testing.T) {
+	registry, auditRepo := newToolsTest()
+	// The caller is in the group, but the callee in this DM would see the reply.
+	provider := &scriptedProvider{
+		rounds: [][]AIToolCall{{{ID: "call-1", Name: "list_shared_files", Arguments: json.RawMessage(`{"group_id":"` + groupID + `"}`)}}},
+		answer: "I cannot look there.",
+	}
+	service := NewAIServiceWithProvider(provider, "", 0, 0)
+	job := AIJob{MessageID: uuid.NewString(), SenderID: callerID, ReceiverID: calleeID, Content: "@AI what files are in our team group?"}
+
+	err := service.StreamMessage(context.Background(), AIPersona{}, []AIMessage{{Role: AIRoleUser, Content: job.Content}}, registry.For(job), func(string) {})
+	if err != nil {
+		t.Fatalf("StreamMessage failed: %v", err)
+	}
+	for _, spec := range registry.For(job).Specs() {
+		for _, param := range spec.Params {
+			if param.Name == "group_id" {
+				t.Errorf("%s offers group_id", spec.Name)
+			}
+		}
+	}
+	messages := provider.requests[1].Messages
+	if result := messages[len(messages)-1].Content; !strings.Contains(result, errAIToolDenied.Error()) || strings.Contains(result, "Budget") {
+		t.Errorf("result = %s, want access denied", result)
+	}
+	if len(auditRepo.invocations) != 1 || auditRepo.invocations[0].Error != errAIToolDenied.Error() {
+		t.Errorf("audited %+v, want the denied call", auditRepo.invocations)
+	}
+}
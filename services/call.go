@@ -0,0 +1,472 @@
+package services
+
+import (
+	"log"
+	"my-chat-app/models"
+	"my-chat-app/repositories"
+	"my-chat-app/websockets"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Call statuses recorded in the calls table.
+const (
+	CallRinging  = "ringing"
+	CallActive   = "active"
+	CallEnded    = "ended"
+	CallMissed   = "missed"
+	CallDeclined = "declined"
+)
+
+// CallService relays WebRTC signaling between the participants of a call and
+// records each call's outcome.
+type CallService interface {
+	Signal(userID string, msg websockets.WebSocketMessage) error
+	ListCalls(userID string, limit int) ([]models.Call, error)
+	// Disconnected hangs up userID's calls once their last connection closed.
+	Disconnected(userID string)
+}
+
+type callService struct {
+	callRepo        repositories.CallRepository
+	messageRepo     repositories.MessageRepository
+	groupRepo       repositories.GroupRepository
+	userRepo        repositories.UserRepository
+	hub             *websockets.Hub
+	outbox          OutboxRelay
+	ringTimeout     time.Duration
+	maxParticipants int
+
+	mu    sync.Mutex // Guards calls only; each call has its own lock
+	calls map[string]*liveCall
+}
+
+// liveCall is a call that is ringing or in progress. Its state is guarded by
+// mu, which is never held while writing to the database or the hub.
+type liveCall struct {
+	mu           sync.Mutex
+	call         *models.Call
+	participants map[string]bool // Everyone invited, including the caller; never changes
+	joined       map[string]bool // Participants who answered (and the caller)
+	declined     map[string]bool
+	timer        *time.Timer
+	finished     bool
+	version      int // Of call, bumped by each change to save
+
+	saveMu       sync.Mutex // Orders this call's saves
+	savedVersion int
+}
+
+// callEffects are the writes and events a change to a call produces, carried
+// out once the call's lock is released.
+type callEffects struct {
+	save    *models.Call // Snapshot of the call to record
+	version int
+	missed  bool // Write a missed-call notice too
+	relays  []callRelay
+}
+
+type callRelay struct {
+	event      *websockets.CallEvent
+	recipients []string
+}
+
+func (fx *callEffects) relay(event *websockets.CallEvent, recipients []string) {
+	fx.relays = append(fx.relays, callRelay{event, recipients})
+}
+
+func NewCallService(callRepo repositories.CallRepository, messageRepo repositories.MessageRepository, groupRepo repositories.GroupRepository, userRepo repositories.UserRepository, hub *websockets.Hub, outbox OutboxRelay, ringTimeout time.Duration, maxParticipants int) CallService {
+	return &callService{
+		callRepo:        callRepo,
+		messageRepo:     messageRepo,
+		groupRepo:       groupRepo,
+		userRepo:        userRepo,
+		hub:             hub,
+		outbox:          outbox,
+		ringTimeout:     ringTimeout,
+		maxParticipants: maxParticipants,
+		calls:           make(map[string]*liveCall),
+	}
+}
+
+func (s *callService) ListCalls(userID string, limit int) ([]models.Call, error) {
+	return s.callRepo.ListForUser(userID, limit)
+}
+
+// Signal handles one signaling command from userID.
+func (s *callService) Signal(userID string, msg websockets.WebSocketMessage) error {
+	id, err := uuid.Parse(msg.CallID)
+	if err != nil {
+		return websockets.NewCommandError(websockets.ErrCodeBadRequest, "call_id must be a UUID")
+	}
+	msg.CallID = id.String()
+
+	live := s.live(msg.CallID)
+	if live == nil {
+		if msg.Type != "call_offer" {
+			return websockets.NewCommandError(websockets.ErrCodeBadRequest, "Unknown or finished call")
+		}
+		return s.start(userID, msg)
+	}
+
+	live.mu.Lock()
+	fx, err := s.signalLocked(live, userID, msg)
+	live.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	s.apply(live, fx)
+	return nil
+}
+
+func (s *callService) live(callID string) *liveCall {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[callID]
+}
+
+func (s *callService) signalLocked(live *liveCall, userID string, msg websockets.WebSocketMessage) (callEffects, error) {
+	var fx callEffects
+	if live.finished {
+		return fx, websockets.NewCommandError(websockets.ErrCodeBadRequest, "Unknown or finished call")
+	}
+	if !live.participants[userID] {
+		return fx, websockets.NewCommandError(websockets.ErrCodeForbidden, "Not a participant of this call")
+	}
+	if msg.TargetID != "" && (!live.participants[msg.TargetID] || msg.TargetID == userID) {
+		return fx, websockets.NewCommandError(websockets.ErrCodeBadRequest, "target_id is not a participant of this call")
+	}
+
+	switch msg.Type {
+	case "call_offer":
+		// Renegotiation, or a mesh offer to another group participant.
+		if msg.SDP == "" {
+			return fx, websockets.NewCommandError(websockets.ErrCodeBadRequest, "sdp is required")
+		}
+		fx.relay(s.event(live, userID, msg), s.peers(live, userID, msg.TargetID))
+
+	case "call_ringing":
+		fx.relay(s.event(live, userID, msg), s.peers(live, userID, msg.TargetID))
+
+	case "call_answer":
+		if msg.SDP == "" {
+			return fx, websockets.NewCommandError(websockets.ErrCodeBadRequest, "sdp is required")
+		}
+		if live.call.Status == CallRinging {
+			live.timer.Stop()
+			now := time.Now()
+			live.call.Status = CallActive
+			live.call.AnsweredAt = &now
+			s.saveLocked(live, &fx)
+		}
+		live.joined[userID] = true
+		target := msg.TargetID
+		if target == "" {
+			target = live.call.CallerID.String()
+		}
+		fx.relay(s.event(live, userID, msg), []string{target})
+
+	case "ice_candidate":
+		if msg.Candidate == nil {
+			return fx, websockets.NewCommandError(websockets.ErrCodeBadRequest, "candidate is required")
+		}
+		fx.relay(s.event(live, userID, msg), s.peers(live, userID, msg.TargetID))
+
+	case "call_hangup":
+		s.hangupLocked(live, userID, msg, &fx)
+	}
+	return fx, nil
+}
+
+// start places a new call and rings everyone else in the conversation.
+func (s *callService) start(callerID string, msg websockets.WebSocketMessage) error {
+	if msg.SDP == "" {
+		return websockets.NewCommandError(websockets.ErrCodeBadRequest, "sdp is required")
+	}
+	media := msg.Media
+	if media == "" {
+		media = "audio"
+	}
+	if media != "audio" && media != "video" {
+		return websockets.NewCommandError(websockets.ErrCodeBadRequest, "media must be audio or video")
+	}
+	if (msg.ReceiverID == "") == (msg.GroupID == "") {
+		return websockets.NewCommandError(websockets.ErrCodeBadRequest, "Specify either receiver_id or group_id, not both")
+	}
+
+	call := &models.Call{
+		ID:        uuid.MustParse(msg.CallID),
+		CallerID:  uuid.MustParse(callerID),
+		Media:     media,
+		Status:    CallRinging,
+		StartedAt: time.Now(),
+	}
+	participants := map[string]bool{callerID: true}
+	if msg.GroupID != "" {
+		groupID, err := uuid.Parse(msg.GroupID)
+		if err != nil {
+			return websockets.NewCommandError(websockets.ErrCodeBadRequest, "Invalid group_id")
+		}
+		members, err := s.groupRepo.GetMembers(msg.GroupID)
+		if err != nil {
+			return websockets.NewCommandError(websockets.ErrCodeBadRequest, "Group not found")
+		}
+		inGroup := false
+		for _, member := range members {
+			participants[member.ID.String()] = true
+			inGroup = inGroup || member.ID.String() == callerID
+		}
+		if !inGroup {
+			return websockets.NewCommandError(websockets.ErrCodeForbidden, "Not a member of this group")
+		}
+		if len(participants) > s.maxParticipants {
+			return websockets.NewCommandError(websockets.ErrCodeForbidden, "Group is too large for a call")
+		}
+		call.GroupID = &groupID
+	} else {
+		receiverID, err := uuid.Parse(msg.ReceiverID)
+		if err != nil || msg.ReceiverID == callerID || msg.ReceiverID == AIUserID {
+			return websockets.NewCommandError(websockets.ErrCodeBadRequest, "Invalid receiver_id")
+		}
+		if _, err := s.userRepo.GetByID(msg.ReceiverID); err != nil {
+			return websockets.NewCommandError(websockets.ErrCodeForbidden, "Cannot call this user")
+		}
+		participants[msg.ReceiverID] = true
+		call.ReceiverID = &receiverID
+	}
+
+	// Recorded before anyone hears of the call, so answers find the row.
+	if err := s.callRepo.Create(call); err != nil {
+		log.Printf("CallService: Error creating call %s: %v", call.ID, err)
+		return websockets.NewCommandError(websockets.ErrCodeFailed, "Could not start call")
+	}
+	live := &liveCall{
+		call:         call,
+		participants: participants,
+		joined:       map[string]bool{callerID: true},
+		declined:     make(map[string]bool),
+	}
+	live.mu.Lock()
+	s.mu.Lock()
+	s.calls[msg.CallID] = live
+	s.mu.Unlock()
+	live.timer = time.AfterFunc(s.ringTimeout, func() { s.ringExpired(live) })
+	var fx callEffects
+	fx.relay(s.event(live, callerID, msg), s.peers(live, callerID, ""))
+	live.mu.Unlock()
+
+	s.apply(live, fx)
+	return nil
+}
+
+// hangupLocked handles a participant leaving, cancelling or declining a call.
+func (s *callService) hangupLocked(live *liveCall, userID string, msg websockets.WebSocketMessage, fx *callEffects) {
+	callerID := live.call.CallerID.String()
+	if live.call.Status == CallRinging {
+		if userID == callerID {
+			// The caller gave up before anyone answered.
+			s.finishLocked(live, CallMissed, "cancelled", fx)
+			return
+		}
+		live.declined[userID] = true
+		if len(live.declined) == len(live.participants)-1 {
+			s.finishLocked(live, CallDeclined, "declined", fx)
+			return
+		}
+		// In a group call, tell the caller who declined.
+		fx.relay(s.event(live, userID, msg), []string{callerID})
+		return
+	}
+
+	delete(live.joined, userID)
+	if len(live.joined) < 2 {
+		s.finishLocked(live, CallEnded, "ended", fx)
+		return
+	}
+	fx.relay(s.event(live, userID, msg), s.peers(live, userID, ""))
+}
+
+// ringExpired marks a call nobody answered as missed.
+func (s *callService) ringExpired(live *liveCall) {
+	live.mu.Lock()
+	var fx callEffects
+	if !live.finished && live.call.Status == CallRinging {
+		s.finishLocked(live, CallMissed, "timeout", &fx)
+	}
+	live.mu.Unlock()
+	s.apply(live, fx)
+}
+
+// Disconnected hangs up each call userID takes part in, as if they had left
+// it, so that nobody stays in a call with someone who is gone.
+func (s *callService) Disconnected(userID string) {
+	s.mu.Lock()
+	var lives []*liveCall
+	for _, live := range s.calls {
+		if live.participants[userID] {
+			lives = append(lives, live)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, live := range lives {
+		live.mu.Lock()
+		var fx callEffects
+		if !live.finished {
+			hangup := websockets.WebSocketMessage{Type: "call_hangup", CallID: live.call.ID.String(), Reason: "disconnected"}
+			s.hangupLocked(live, userID, hangup, &fx)
+		}
+		live.mu.Unlock()
+		s.apply(live, fx)
+	}
+}
+
+// finishLocked ends the call: it records the outcome, tells every participant
+// it is over and writes a missed-call notice into the conversation when
+// nobody answered.
+func (s *callService) finishLocked(live *liveCall, status, reason string, fx *callEffects) {
+	live.finished = true
+	live.timer.Stop()
+	s.mu.Lock()
+	delete(s.calls, live.call.ID.String())
+	s.mu.Unlock()
+
+	now := time.Now()
+	live.call.Status = status
+	live.call.EndedAt = &now
+	s.saveLocked(live, fx)
+	fx.missed = status == CallMissed
+
+	hangup := &websockets.CallEvent{
+		Type:     "call_hangup",
+		Envelope: callEnvelope(live.call, live.call.CallerID.String()),
+		CallID:   live.call.ID.String(),
+		Reason:   reason,
+	}
+	var everyone []string
+	for participant := range live.participants {
+		everyone = append(everyone, participant)
+	}
+	fx.relay(hangup, everyone)
+}
+
+// saveLocked schedules the call's current state to be recorded.
+func (s *callService) saveLocked(live *liveCall, fx *callEffects) {
+	live.version++
+	snapshot := *live.call
+	fx.save = &snapshot
+	fx.version = live.version
+}
+
+// apply carries out fx: the call is recorded and the notice written before
+// the participants hear of them.
+func (s *callService) apply(live *liveCall, fx callEffects) {
+	if fx.save != nil {
+		s.save(live, fx.save, fx.version)
+		if fx.missed {
+			s.writeMissedCall(fx.save)
+		}
+	}
+	for _, r := range fx.relays {
+		s.relay(r.event, r.recipients)
+	}
+}
+
+// save records a snapshot of the call unless a later one was recorded already.
+func (s *callService) save(live *liveCall, call *models.Call, version int) {
+	live.saveMu.Lock()
+	defer live.saveMu.Unlock()
+	if version <= live.savedVersion {
+		return
+	}
+	if err := s.callRepo.Update(call); err != nil {
+		log.Printf("CallService: Error updating call %s: %v", call.ID, err)
+		return
+	}
+	live.savedVersion = version
+}
+
+// writeMissedCall saves a system message from the caller into the
+// conversation, through the outbox like any other message. Its ID is derived
+// from the call, so it is written once.
+func (s *callService) writeMissedCall(call *models.Call) {
+	content := "Missed voice call"
+	if call.Media == "video" {
+		content = "Missed video call"
+	}
+	callerID := call.CallerID.String()
+	message := &models.Message{
+		ID:         models.ClientMessageUUID(callerID, "missed-call:"+call.ID.String()),
+		SenderID:   call.CallerID,
+		ReceiverID: call.ReceiverID,
+		GroupID:    call.GroupID,
+		Content:    content,
+		Status:     "sent",
+		Kind:       "system",
+	}
+	event := &websockets.NewMessageEvent{
+		Type:     "new_message",
+		Envelope: callEnvelope(call, callerID),
+		Content:  content,
+		Kind:     "system",
+	}
+	if caller, err := s.userRepo.GetByID(callerID); err == nil {
+		event.SenderUsername = caller.Username
+	}
+	err := saveMessageWithEvent(s.messageRepo, s.outbox, message, event)
+	if err != nil && !isDuplicateKey(err) {
+		log.Printf("CallService: Error saving missed call message for %s: %v", call.ID, err)
+	}
+}
+
+// event builds the relayed form of msg, stamped with the sender.
+func (s *callService) event(live *liveCall, senderID string, msg websockets.WebSocketMessage) *websockets.CallEvent {
+	return &websockets.CallEvent{
+		Type:      msg.Type,
+		Envelope:  callEnvelope(live.call, senderID),
+		CallID:    live.call.ID.String(),
+		Media:     live.call.Media,
+		SDP:       msg.SDP,
+		Candidate: msg.Candidate,
+		Reason:    msg.Reason,
+	}
+}
+
+// callEnvelope addresses an event to the call's conversation.
+func callEnvelope(call *models.Call, senderID string) websockets.Envelope {
+	envelope := websockets.Envelope{SenderID: senderID}
+	if call.GroupID != nil {
+		envelope.GroupID = call.GroupID.String()
+	} else if call.ReceiverID != nil {
+		envelope.ReceiverID = call.ReceiverID.String()
+	}
+	return envelope
+}
+
+// peers returns target when set, otherwise everyone else in the call: joined
+// participants once it is active, every invitee while it rings.
+func (s *callService) peers(live *liveCall, senderID, target string) []string {
+	if target != "" {
+		return []string{target}
+	}
+	pool := live.participants
+	if live.call.Status == CallActive {
+		pool = live.joined
+	}
+	var peers []string
+	for userID := range pool {
+		if userID != senderID {
+			peers = append(peers, userID)
+		}
+	}
+	return peers
+}
+
+func (s *callService) relay(event *websockets.CallEvent, recipients []string) {
+	if len(recipients) == 0 {
+		return
+	}
+	s.hub.Broadcast <- event.To(recipients...)
+}
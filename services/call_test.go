@@ -0,0 +1,212 @@
+package services
+
+import (
+	"my-chat-app/models"
+	"my-chat-app/repositories"
+	"my-chat-app/websockets"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type fakeCallRepo struct {
+	mu    sync.Mutex
+	calls map[uuid.UUID]models.Call
+}
+
+func (r *fakeCallRepo) Create(call *models.Call) error { return r.Update(call) }
+
+func (r *fakeCallRepo) Update(call *models.Call) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls[call.ID] = *call
+	return nil
+}
+
+func (r *fakeCallRepo) ListForUser(userID string, limit int) ([]models.Call, error) {
+	return nil, nil
+}
+
+func (r *fakeCallRepo) status(id string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.calls[uuid.MustParse(id)].Status
+}
+
+type fakeMessageRepo struct {
+	repositories.MessageRepository
+	mu      sync.Mutex
+	created []models.Message
+	outbox  []models.OutboxEntry
+}
+
+func (r *fakeMessageRepo) Create(message *models.Message) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	message.ID = uuid.New()
+	r.created = append(r.created, *message)
+	return nil
+}
+
+type fakeUserRepo struct {
+	repositories.UserRepository
+}
+
+func (fakeUserRepo) GetByID(id string) (*models.User, error) {
+	return &models.User{ID: uuid.MustParse(id), Username: "user-" + id[:4]}, nil
+}
+
+func newCallTest(ringTimeout time.Duration) (CallService, *fakeCallRepo, *fakeMessageRepo, map[string]*websockets.Client) {
+	hub := websockets.NewHub()
+	go hub.Run()
+	clients := map[string]*websockets.Client{}
+	for _, id := range []string{callerID, calleeID} {
+		client := websockets.NewVirtualClient(hub, id, websockets.Limits{})
+		hub.Register <- client
+		clients[id] = client
+	}
+	callRepo := &fakeCallRepo{calls: map[uuid.UUID]models.Call{}}
+	messageRepo := &fakeMessageRepo{}
+	service := NewCallService(callRepo, messageRepo, nil, fakeUserRepo{}, hub, nil, ringTimeout, 8)
+	return service, callRepo, messageRepo, clients
+}
+
+const (
+	callerID = "11111111-1111-1111-1111-111111111111"
+	calleeID = "22222222-2222-2222-2222-222222222222"
+)
+
+// nextCallEvent waits for the next call event delivered to client.
+func nextCallEvent(t *testing.T, client *websockets.Client) *websockets.CallEvent {
+	t.Helper()
+	for {
+		select {
+		case event := <-client.Send:
+			if call, ok := event.(*websockets.CallEvent); ok {
+				return call
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("No call event for %s", client.UserID)
+			return nil
+		}
+	}
+}
+
+func TestCallAnsweredAndHungUp(t *testing.T) {
+	service, callRepo, messageRepo, clients := newCallTest(time.Minute)
+	callID := uuid.New().String()
+
+	offer := websockets.WebSocketMessage{Type: "call_offer", CallID: callID, ReceiverID: calleeID, Media: "video", SDP: "offer-sdp", SenderID: "spoofed"}
+	if err := service.Signal(callerID, offer); err != nil {
+		t.Fatalf("call_offer failed: %v", err)
+	}
+	got := nextCallEvent(t, clients[calleeID])
+	if got.Type != "call_offer" || got.SDP != "offer-sdp" || got.SenderID != callerID || got.Media != "video" {
+		t.Errorf("callee got %+v", got)
+	}
+
+	// Someone outside the call cannot inject signaling.
+	stranger := uuid.New().String()
+	if err := service.Signal(stranger, websockets.WebSocketMessage{Type: "call_answer", CallID: callID, SDP: "x"}); err == nil {
+		t.Errorf("stranger answered the call")
+	}
+
+	if err := service.Signal(calleeID, websockets.WebSocketMessage{Type: "call_answer", CallID: callID, SDP: "answer-sdp"}); err != nil {
+		t.Fatalf("call_answer failed: %v", err)
+	}
+	if got := nextCallEvent(t, clients[callerID]); got.Type != "call_answer" || got.SDP != "answer-sdp" {
+		t.Errorf("caller got %+v", got)
+	}
+	if status := callRepo.status(callID); status != CallActive {
+		t.Errorf("status = %s, want active", status)
+	}
+
+	candidate := &websockets.ICECandidate{Candidate: "candidate:1 1 udp 2122260223 10.0.0.1 5000 typ host"}
+	if err := service.Signal(callerID, websockets.WebSocketMessage{Type: "ice_candidate", CallID: callID, Candidate: candidate}); err != nil {
+		t.Fatalf("ice_candidate failed: %v", err)
+	}
+	if got := nextCallEvent(t, clients[calleeID]); got.Type != "ice_candidate" || got.Candidate.Candidate != candidate.Candidate {
+		t.Errorf("callee got %+v", got)
+	}
+
+	if err := service.Signal(calleeID, websockets.WebSocketMessage{Type: "call_hangup", CallID: callID}); err != nil {
+		t.Fatalf("call_hangup failed: %v", err)
+	}
+	for _, id := range []string{callerID, calleeID} {
+		if got := nextCallEvent(t, clients[id]); got.Type != "call_hangup" || got.Reason != "ended" {
+			t.Errorf("%s got %+v, want call_hangup ended", id, got)
+		}
+	}
+	if status := callRepo.status(callID); status != CallEnded {
+		t.Errorf("status = %s, want ended", status)
+	}
+	if len(messageRepo.created) != 0 {
+		t.Errorf("answered call wrote %d messages", len(messageRepo.created))
+	}
+}
+
+func TestCallRingTimeoutIsMissed(t *testing.T) {
+	service, callRepo, messageRepo, clients := newCallTest(50 * time.Millisecond)
+	callID := uuid.New().String()
+
+	if err := service.Signal(callerID, websockets.WebSocketMessage{Type: "call_offer", CallID: callID, ReceiverID: calleeID, SDP: "offer-sdp"}); err != nil {
+		t.Fatalf("call_offer failed: %v", err)
+	}
+	nextCallEvent(t, clients[calleeID])
+	if err := service.Signal(calleeID, websockets.WebSocketMessage{Type: "call_ringing", CallID: callID}); err != nil {
+		t.Fatalf("call_ringing failed: %v", err)
+	}
+	if got := nextCallEvent(t, clients[callerID]); got.Type != "call_ringing" {
+		t.Errorf("caller got %+v, want call_ringing", got)
+	}
+
+	for _, id := range []string{callerID, calleeID} {
+		if got := nextCallEvent(t, clients[id]); got.Type != "call_hangup" || got.Reason != "timeout" {
+			t.Errorf("%s got %+v, want call_hangup timeout", id, got)
+		}
+	}
+	// The call is recorded and the notice written before the hangup is sent.
+	if err := service.Signal(calleeID, websockets.WebSocketMessage{Type: "call_answer", CallID: callID, SDP: "late"}); err == nil {
+		t.Errorf("answering a finished call succeeded")
+	}
+	if status := callRepo.status(callID); status != CallMissed {
+		t.Errorf("status = %s, want missed", status)
+	}
+	messageRepo.mu.Lock()
+	defer messageRepo.mu.Unlock()
+	if len(messageRepo.created) != 1 || messageRepo.created[0].Kind != "system" || messageRepo.created[0].Content != "Missed voice call" {
+		t.Errorf("missed call messages = %+v", messageRepo.created)
+	}
+	if len(messageRepo.outbox) != 1 || messageRepo.outbox[0].Topic != "new_message" {
+		t.Errorf("outbox = %+v, want the notice's new_message", messageRepo.outbox)
+	}
+}
+
+func TestCallEndsWhenAParticipantGoesOffline(t *testing.T) {
+	service, callRepo, _, clients := newCallTest(time.Minute)
+	hub := clients[callerID].Hub
+	hub.OnOffline = service.Disconnected
+	callID := uuid.New().String()
+
+	if err := service.Signal(callerID, websockets.WebSocketMessage{Type: "call_offer", CallID: callID, ReceiverID: calleeID, SDP: "offer-sdp"}); err != nil {
+		t.Fatalf("call_offer failed: %v", err)
+	}
+	nextCallEvent(t, clients[calleeID])
+	if err := service.Signal(calleeID, websockets.WebSocketMessage{Type: "call_answer", CallID: callID, SDP: "answer-sdp"}); err != nil {
+		t.Fatalf("call_answer failed: %v", err)
+	}
+	nextCallEvent(t, clients[callerID])
+
+	hub.Disconnect(clients[calleeID])
+	if got := nextCallEvent(t, clients[callerID]); got.Type != "call_hangup" || got.Reason != "ended" {
+		t.Errorf("caller got %+v, want call_hangup ended", got)
+	}
+	if status := callRepo.status(callID); status != CallEnded {
+		t.Errorf("status = %s, want ended", status)
+	}
+	if err := service.Signal(callerID, websockets.WebSocketMessage{Type: "ice_candidate", CallID: callID, Candidate: &websockets.ICECandidate{}}); err == nil {
+		t.Errorf("the call is still live")
+	}
+}
@@ -2,6 +2,7 @@ package services
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"my-chat-app/models"
@@ -9,22 +10,33 @@ import (
 	"my-chat-app/websockets"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
 	"gorm.io/datatypes"
+	"gorm.io/gorm"
 )
 
 // AIUserID is a constant for the AI Assistant's user ID.
 const AIUserID = "00000000-0000-0000-0000-000000000000"
 
 type ChatService interface {
-	SendMessage(senderID, receiverID, groupID, content, replyToMessageID, fileName, filePath, fileType string, fileSize int64, checksum string) (string, error)
+	SendMessage(senderID, receiverID, groupID, content, replyToMessageID, fileName, filePath, fileType string, fileSize int64, checksum, clientMessageID string) (string, error)
 	SendMessageForWebSocket(senderID, receiverID, groupID, content, replyToMessageID string) error
 	GetConversation(user1ID, user2ID string, pageStr, pageSizeStr string) ([]models.Message, int64, error)
 	GetGroupConversation(groupID string, pageStr, pageSizeStr string) ([]models.Message, int64, error)
-	UpdateMessageStatus(messageID string, status string) error
+	GetMessage(messageID string) (*models.Message, error)
+	UpdateMessageStatus(messageID, userID, status string) error
+	MarkRead(messageID, readerID string) error
 	AddReaction(messageID, userID, reaction string) error
 	RemoveReaction(messageID, userID, reaction string) error
+	IsGroupMember(groupID, userID string) (bool, error)
+	CanMessageUser(senderID, receiverID string) (bool, error)
+	ProcessAIJob(job AIJob) error
+	FailAIJob(job AIJob) error
+	CancelGeneration(userID, messageID string) error
+	ResetAIMemory(userID, receiverID, groupID string) error
 }
 
 type chatService struct {
@@ -33,23 +45,70 @@ type chatService struct {
 	userRepo    repositories.UserRepository
 	hub         *websockets.Hub
 	aiService   AIService
+	aiContext   *AIContextBuilder
+	personaRepo repositories.GroupAISettingsRepository
+	aiTools     *AIToolRegistry // Nil answers without tools
+	outbox      OutboxRelay
+	generations *generations
 }
 
-func NewChatService(messageRepo repositories.MessageRepository, groupRepo repositories.GroupRepository, userRepo repositories.UserRepository, hub *websockets.Hub, aiService AIService) ChatService {
-	return &chatService{messageRepo, groupRepo, userRepo, hub, aiService}
+// ErrInvalidMessage matches SendMessage errors caused by the message itself,
+// which fail the same way however often they are retried.
+var ErrInvalidMessage = errors.New("invalid message")
+
+type invalidMessageError struct {
+	msg string
+}
+
+func (e *invalidMessageError) Error() string        { return e.msg }
+func (e *invalidMessageError) Is(target error) bool { return target == ErrInvalidMessage }
+
+func invalidMessage(format string, args ...interface{}) error {
+	return &invalidMessageError{fmt.Sprintf(format, args...)}
+}
+
+// IsPermanent reports whether a SendMessage or ProcessAIJob error will recur
+// on retry: an invalid message, or one Postgres rejects as bad data or a
+// constraint violation, such as a receiver that does not exist. Anything
+// else, like a lost connection, is worth retrying.
+func IsPermanent(err error) bool {
+	if errors.Is(err, ErrInvalidMessage) {
+		return true
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// Classes 22 data_exception and 23 integrity_constraint_violation
+		return strings.HasPrefix(pgErr.Code, "22") || strings.HasPrefix(pgErr.Code, "23")
+	}
+	return false
+}
+
+// isDuplicateKey reports whether err is Postgres rejecting a row whose key
+// already exists. The database is opened without gorm's error translation,
+// which would hide the codes IsPermanent relies on.
+func isDuplicateKey(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.Is(err, gorm.ErrDuplicatedKey) || errors.As(err, &pgErr) && pgErr.Code == "23505"
+}
+
+func NewChatService(messageRepo repositories.MessageRepository, groupRepo repositories.GroupRepository, userRepo repositories.UserRepository, hub *websockets.Hub, aiService AIService, aiContext *AIContextBuilder, personaRepo repositories.GroupAISettingsRepository, aiTools *AIToolRegistry, outbox OutboxRelay) ChatService {
+	return &chatService{messageRepo, groupRepo, userRepo, hub, aiService, aiContext, personaRepo, aiTools, outbox, newGenerations()}
 }
 
 func (s *chatService) SendMessageForWebSocket(senderID, receiverID, groupID, content, replyToMessageID string) error {
 	// Call the *full* SendMessage, with default values for file-related parameters.
-	_, err := s.SendMessage(senderID, receiverID, groupID, content, replyToMessageID, "", "", "", 0, "")
+	_, err := s.SendMessage(senderID, receiverID, groupID, content, replyToMessageID, "", "", "", 0, "", "")
 	return err
 }
 
-func (s *chatService) SendMessage(senderID, receiverID, groupID, content, replyToMessageID, fileName, filePath, fileType string, fileSize int64, checksum string) (string, error) {
+// SendMessage saves a message and queues its new_message event. With a
+// clientMessageID the call is idempotent: a retry returns the ID of the message
+// saved the first time instead of inserting another one.
+func (s *chatService) SendMessage(senderID, receiverID, groupID, content, replyToMessageID, fileName, filePath, fileType string, fileSize int64, checksum, clientMessageID string) (string, error) {
 	// Check content size
 	const maxContentSize = 8192 // 8KB
 	if len(content) > maxContentSize {
-		return "", fmt.Errorf("message content exceeds maximum size limit")
+		return "", invalidMessage("message content exceeds maximum size limit")
 	}
 
 	log.Printf("chatService.SendMessage: senderID=%s, receiverID=%s, groupID=%s, content=%s, replyToMessageID=%s, fileName=%s, filePath=%s, fileType=%s, fileSize=%d, checksum=%s",
@@ -57,14 +116,27 @@ func (s *chatService) SendMessage(senderID, receiverID, groupID, content, replyT
 
 	senderUUID, err := uuid.Parse(senderID)
 	if err != nil {
-		return "", fmt.Errorf("invalid sender ID: %v", err)
+		return "", invalidMessage("invalid sender ID: %v", err)
+	}
+
+	// A retried submission: the message was already saved.
+	var canonicalID uuid.UUID
+	if clientMessageID != "" {
+		if len(clientMessageID) > models.MaxClientMessageIDLength {
+			return "", invalidMessage("client_message_id exceeds %d characters", models.MaxClientMessageIDLength)
+		}
+		canonicalID = models.ClientMessageUUID(senderID, clientMessageID)
+		if s.messageExists(canonicalID) {
+			log.Printf("chatService.SendMessage: %s from %s already saved", clientMessageID, senderID)
+			return canonicalID.String(), nil
+		}
 	}
 
 	var receiverUUID *uuid.UUID
 	if receiverID != "" {
 		id, err := uuid.Parse(receiverID)
 		if err != nil {
-			return "", fmt.Errorf("invalid receiver ID: %v", err)
+			return "", invalidMessage("invalid receiver ID: %v", err)
 		}
 		receiverUUID = &id
 	}
@@ -73,7 +145,7 @@ func (s *chatService) SendMessage(senderID, receiverID, groupID, content, replyT
 	if groupID != "" {
 		id, err := uuid.Parse(groupID)
 		if err != nil {
-			return "", fmt.Errorf("invalid group ID: %v", err)
+			return "", invalidMessage("invalid group ID: %v", err)
 		}
 		groupUUID = &id
 	}
@@ -82,35 +154,14 @@ func (s *chatService) SendMessage(senderID, receiverID, groupID, content, replyT
 	if replyToMessageID != "" {
 		replyID, err := uuid.Parse(replyToMessageID)
 		if err != nil {
-			return "", fmt.Errorf("invalid reply_to_message_id: %v", err)
+			return "", invalidMessage("invalid reply_to_message_id: %v", err)
 		}
 		replyToUUID = &replyID
 	}
 
-	// --- DIRECT AI MESSAGE HANDLING ---
-	isDirectAIMessage := receiverID == AIUserID
-
-	var aiResponse string
-	if isDirectAIMessage {
-		// Immediately process the message with the AI service.
-		aiResponse, err = s.aiService.ProcessMessage(content) // No need for @AI now
-		if err != nil {
-			log.Printf("Error processing AI message: %v", err)
-			aiResponse = "Sorry, I couldn't process your request."
-		}
-	} else if strings.Contains(content, "@AI") {
-		// Check for AI mention *before* saving the original message.
-		aiResponse, err = s.aiService.ProcessMessage(content)
-		if err != nil {
-			log.Printf("Error processing AI message: %v", err)
-			//  Return the original message and add an error
-			aiResponse = "Sorry, I couldn't process your request."
-		}
-	}
-	// --- END DIRECT AI MESSAGE HANDLING ---
-
 	// Create the user's message (always create this).
 	userMessage := &models.Message{
+		ID:               canonicalID,
 		SenderID:         senderUUID,
 		ReceiverID:       receiverUUID,
 		GroupID:          groupUUID,
@@ -124,143 +175,114 @@ func (s *chatService) SendMessage(senderID, receiverID, groupID, content, replyT
 		FileChecksum:     checksum,
 	}
 
-	//Save User message to DB.
-	err = s.messageRepo.Create(userMessage)
-	if err != nil {
-		return "", err
-	}
 	// Get Sender Username.
 	senderUser, err := s.userRepo.GetByID(senderID)
 	if err != nil {
 		fmt.Printf("Error fetching sender user: %v\n", err)
 	}
 
-	// Prepare the user message data for broadcasting.
-	userMsgData := map[string]interface{}{
-		"type":            "new_message",
-		"sender_id":       senderID,
-		"sender_username": senderUser.Username,
-		"content":         content,
-		"message_id":      userMessage.ID.String(),
-		"created_at":      userMessage.CreatedAt.Format("2006-01-02 15:04:05"),
-		"file_name":       fileName,
-		"file_path":       filePath,
-		"file_type":       fileType,
-		"file_size":       fileSize,
+	// Prepare the user message event for broadcasting.
+	userMsgEvent := &websockets.NewMessageEvent{
+		Type:            "new_message",
+		Envelope:        websockets.Envelope{SenderID: senderID},
+		SenderUsername:  senderUser.Username,
+		Content:         content,
+		FileName:        fileName,
+		FilePath:        filePath,
+		FileType:        fileType,
+		FileSize:        fileSize,
+		ClientMessageID: clientMessageID,
+	}
+	if clientMessageID != "" {
+		userMessage.ClientMessageID = &clientMessageID
 	}
 	if replyToUUID != nil {
-		userMsgData["reply_to_message_id"] = replyToMessageID
+		userMsgEvent.ReplyToMessageID = replyToMessageID
 		if originalMsg, err := s.messageRepo.GetByID(replyToMessageID); err == nil {
-			userMsgData["reply_to_message"] = map[string]interface{}{
-				"id":        originalMsg.ID.String(),
-				"content":   originalMsg.Content,
-				"sender_id": originalMsg.SenderID.String(),
+			userMsgEvent.ReplyToMessage = &websockets.ReplyPreview{
+				ID:       originalMsg.ID.String(),
+				Content:  originalMsg.Content,
+				SenderID: originalMsg.SenderID.String(),
 			}
 		}
 	}
 
 	//Add receiver_id and group_id to message data.
 	if groupUUID != nil {
-		userMsgData["group_id"] = groupID
+		userMsgEvent.GroupID = groupID
 	} else if receiverUUID != nil {
-		userMsgData["receiver_id"] = receiverID
+		userMsgEvent.ReceiverID = receiverID
 	}
 
-	// ---  BROADCAST USER MESSAGE ---
-	userMsgBytes, _ := json.Marshal(userMsgData)
-	log.Printf("Consumer about to broadcast: %s", string(userMsgBytes))
-	if groupUUID != nil {
-		// Group message:  Broadcast to group members.
-		for userID := range s.hub.Groups[groupID] {
-			if client, ok := s.hub.Clients[userID]; ok {
-				client.Send <- userMsgBytes // Send to each member
-			}
-		}
-	} else if receiverUUID != nil {
-		// Direct Message: Send to *BOTH* sender and receiver.
-		if senderClient, ok := s.hub.Clients[senderID]; ok {
-			senderClient.Send <- userMsgBytes
-		}
-		if receiverClient, ok := s.hub.Clients[receiverID]; ok {
-			receiverClient.Send <- userMsgBytes
+	// Messages to the AI or mentioning it or a group persona get a threaded
+	// reply from each. The jobs are queued with the message, so they run if
+	// and only if the message was saved.
+	jobs, err := s.aiJobs(AIJob{SenderID: senderID, ReceiverID: receiverID, GroupID: groupID, Content: content})
+	if err != nil {
+		return "", err
+	}
+	if len(jobs) > 0 && userMessage.ID == uuid.Nil {
+		userMessage.ID = uuid.New()
+	}
+	var aiJobs []*models.OutboxEntry
+	for _, job := range jobs {
+		job.MessageID = userMessage.ID.String()
+		entry, err := newAIJobEntry(job)
+		if err != nil {
+			return "", err
 		}
+		aiJobs = append(aiJobs, entry)
 	}
-	// --- END BROADCAST USER MESSAGE ---
-
-	// --- AI RESPONSE HANDLING (Both Direct and Mentions) ---
-	if isDirectAIMessage || strings.Contains(content, "@AI") { // Handle both cases
-		aiSenderUUID := uuid.MustParse(AIUserID) // AI's UUID
 
-		// For direct messages, set receiver to original sender
-		var aiReceiverUUID *uuid.UUID
-		if groupUUID == nil {
-			// In direct messages, AI responds to the original sender
-			aiReceiverUUID = &senderUUID
-		} else {
-			// In group messages, keep the same group context
-			aiReceiverUUID = receiverUUID
+	// Save the user message; the outbox relay broadcasts it after the commit.
+	if err := s.saveWithEvent(userMessage, userMsgEvent, aiJobs...); err != nil {
+		// A concurrent retry may have won the insert.
+		if clientMessageID != "" && s.messageExists(canonicalID) {
+			return canonicalID.String(), nil
 		}
+		return "", err
+	}
 
-		aiMessage := &models.Message{
-			SenderID:         aiSenderUUID, // AI is the sender
-			ReceiverID:       aiReceiverUUID,
-			GroupID:          groupUUID,  // Same group as the original message
-			Content:          aiResponse, // The AI's generated response
-			Status:           "sent",
-			ReplyToMessageID: &userMessage.ID, // Reply to the *user's* message
-		}
+	return userMessage.ID.String(), nil // Return the original message's ID.
+}
 
-		if err := s.messageRepo.Create(aiMessage); err != nil {
-			return "", err
-		}
+// saveWithEvent inserts message together with a new_message outbox entry for
+// event and any extra entries, then wakes the outbox relay to deliver them.
+func (s *chatService) saveWithEvent(message *models.Message, event *websockets.NewMessageEvent, extra ...*models.OutboxEntry) error {
+	return saveMessageWithEvent(s.messageRepo, s.outbox, message, event, extra...)
+}
 
-		// Prepare AI message for broadcast.
-		aiMsgData := map[string]interface{}{
-			"type":                "new_message",
-			"sender_id":           AIUserID,       // Clearly indicate AI sender
-			"sender_username":     "AI_Assistant", // Set sender username for AI
-			"message_id":          aiMessage.ID.String(),
-			"content":             aiResponse,
-			"created_at":          aiMessage.CreatedAt.Format("2006-01-02 15:04:05"),
-			"reply_to_message_id": userMessage.ID.String(), // Reply to the user's message
-			// Include reply message data
-			"reply_to_message": map[string]interface{}{
-				"id":        userMessage.ID.String(),
-				"content":   userMessage.Content,
-				"sender_id": userMessage.SenderID.String(),
-			},
-		}
-		if groupUUID != nil {
-			aiMsgData["group_id"] = groupID
-		} else if receiverUUID != nil {
-			aiMsgData["receiver_id"] = senderID
-		}
+// saveMessageWithEvent is saveWithEvent for services other than chat that
+// post messages, such as missed-call notices. outbox may be nil.
+func saveMessageWithEvent(messageRepo repositories.MessageRepository, outbox OutboxRelay, message *models.Message, event *websockets.NewMessageEvent, extra ...*models.OutboxEntry) error {
+	// The event needs the ID and timestamp before the row is written.
+	if message.ID == uuid.Nil {
+		message.ID = uuid.New()
+	}
+	message.CreatedAt = time.Now()
+	event.MessageID = message.ID.String()
+	event.CreatedAt = message.CreatedAt.Format("2006-01-02 15:04:05")
 
-		// --- BROADCAST AI RESPONSE ---
-		aiMsgBytes, _ := json.Marshal(aiMsgData)
-		if groupUUID != nil {
-			// Group message: send to all group members
-			for userID := range s.hub.Groups[groupID] {
-				if client, ok := s.hub.Clients[userID]; ok {
-					client.Send <- aiMsgBytes
-				}
-			}
-		} else if receiverUUID != nil {
-			// Direct Message:  Send to *BOTH* sender and receiver.
-			if senderClient, ok := s.hub.Clients[senderID]; ok {
-				senderClient.Send <- aiMsgBytes
-			}
-			if receiverClient, ok := s.hub.Clients[receiverID]; ok {
-				receiverClient.Send <- aiMsgBytes
-			}
-		}
-		// --- END BROADCAST AI RESPONSE ---
-		return aiMessage.ID.String(), nil // Return AI message ID for consistency
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	entry := &models.OutboxEntry{Topic: "new_message", Payload: datatypes.JSON(payload)}
+	if err := messageRepo.CreateWithOutbox(message, append([]*models.OutboxEntry{entry}, extra...)...); err != nil {
+		return err
+	}
+	if outbox != nil {
+		outbox.Notify()
 	}
-	// --- END AI RESPONSE HANDLING ---
+	return nil
+}
 
-	return userMessage.ID.String(), nil // Return the original message's ID.
+// messageExists reports whether a message with id was saved.
+func (s *chatService) messageExists(id uuid.UUID) bool {
+	_, err := s.messageRepo.GetByID(id.String())
+	return err == nil
 }
+
 func (s *chatService) GetConversation(user1ID, user2ID string, pageStr, pageSizeStr string) ([]models.Message, int64, error) {
 	page, err := strconv.Atoi(pageStr)
 	if err != nil || page < 1 {
@@ -292,14 +314,88 @@ func (s *chatService) GetGroupConversation(groupID string, pageStr, pageSizeStr
 
 	return s.messageRepo.GetGroupConversation(groupID, pageSize, offset) // Return count as well
 }
-func (s *chatService) UpdateMessageStatus(messageID string, status string) error {
-	message, err := s.messageRepo.GetByID(messageID)
+func (s *chatService) GetMessage(messageID string) (*models.Message, error) {
+	return s.messageRepo.GetByID(messageID)
+}
+
+// UpdateMessageStatus records that the message was delivered or read, as
+// reported by userID, and sends the update to its conversation. Only its
+// receiver or group members may report it.
+func (s *chatService) UpdateMessageStatus(messageID, userID, status string) error {
+	if status != "delivered" && status != "read" {
+		return websockets.NewCommandError(websockets.ErrCodeBadRequest, "status must be delivered or read")
+	}
+	message, envelope, err := s.receipt(messageID, userID)
 	if err != nil {
 		return err
 	}
 
 	message.Status = status
-	return s.messageRepo.Update(message)
+	if err := s.messageRepo.Update(message); err != nil {
+		return err
+	}
+	if s.hub != nil {
+		s.hub.Broadcast <- &websockets.MessageStatusEvent{
+			Type:      "message_status",
+			Envelope:  envelope,
+			MessageID: messageID,
+			Status:    status,
+		}
+	}
+	return nil
+}
+
+// MarkRead sends a read receipt for the message to its conversation: back to
+// the sender of a direct message, or to the group. Only its receiver or
+// group members may mark it read.
+func (s *chatService) MarkRead(messageID, readerID string) error {
+	_, envelope, err := s.receipt(messageID, readerID)
+	if err != nil {
+		return err
+	}
+	if s.hub != nil {
+		s.hub.Broadcast <- &websockets.ReadEvent{
+			Type:      "read_message",
+			Envelope:  envelope,
+			MessageID: messageID,
+			ReadBy:    readerID,
+		}
+	}
+	return nil
+}
+
+// receipt loads the message userID reports on and addresses the report to
+// its conversation. Only its receiver or group members may report on it.
+func (s *chatService) receipt(messageID, userID string) (*models.Message, websockets.Envelope, error) {
+	var envelope websockets.Envelope
+	if _, err := uuid.Parse(messageID); err != nil {
+		return nil, envelope, websockets.NewCommandError(websockets.ErrCodeBadRequest, "Invalid message_id")
+	}
+	message, err := s.messageRepo.GetByID(messageID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, envelope, websockets.NewCommandError(websockets.ErrCodeBadRequest, "Message not found")
+	}
+	if err != nil {
+		return nil, envelope, err
+	}
+
+	envelope.SenderID = userID
+	if message.GroupID != nil {
+		member, err := s.IsGroupMember(message.GroupID.String(), userID)
+		if err != nil {
+			return nil, envelope, err
+		}
+		if !member {
+			return nil, envelope, websockets.NewCommandError(websockets.ErrCodeForbidden, "Not a member of this group")
+		}
+		envelope.GroupID = message.GroupID.String()
+	} else {
+		if message.ReceiverID == nil || message.ReceiverID.String() != userID {
+			return nil, envelope, websockets.NewCommandError(websockets.ErrCodeForbidden, "Not the receiver of this message")
+		}
+		envelope.ReceiverID = message.SenderID.String()
+	}
+	return message, envelope, nil
 }
 
 // AddReaction adds a reaction to a message.
@@ -345,50 +441,12 @@ func (s *chatService) AddReaction(messageID, userID, reaction string) error {
 	}
 	message.Reactions = datatypes.JSON(updatedReactions)
 
-	// *** BROADCAST ADDED REACTION ***
-	broadcastMessage := map[string]interface{}{
-		"type":       "reaction_added",
-		"message_id": messageID,
-		"user_id":    userID,
-		"emoji":      reaction,
-		// NO group_id here initially
-	}
-
-	// Add group_id ONLY if it's a group message
-	if message.GroupID != nil {
-		broadcastMessage["group_id"] = message.GroupID.String()
-	}
-
-	broadcastBytes, _ := json.Marshal(broadcastMessage)
-
-	// Determine who to broadcast to (group or specific user)
-	if message.GroupID != nil {
-		// Iterate through the group members in the hub.
-		for memberUserID := range s.hub.Groups[message.GroupID.String()] {
-			if client, ok := s.hub.Clients[memberUserID]; ok {
-				select {
-				case client.Send <- broadcastBytes: // Send to each member
-				default:
-					close(client.Send)
-					delete(s.hub.Clients, memberUserID) // Clean up
-				}
-			}
-		}
-	} else if message.ReceiverID != nil {
-		// It's a direct message, broadcast to the sender and receiver
-		if client, ok := s.hub.Clients[message.ReceiverID.String()]; ok {
-			client.Send <- broadcastBytes
-		}
-		// Also send back to sender
-		if client, ok := s.hub.Clients[message.SenderID.String()]; ok {
-			client.Send <- broadcastBytes
-		}
-	}
 	err = s.messageRepo.Update(message)
 	if err != nil {
 		return err
 	}
-	return nil // Return the result of the database update
+	s.broadcastReaction("reaction_added", message, userID, reaction)
+	return nil
 }
 
 // RemoveReaction removes a reaction from a message.
@@ -440,48 +498,67 @@ func (s *chatService) RemoveReaction(messageID, userID, reaction string) error {
 	}
 	message.Reactions = datatypes.JSON(updatedReactions)
 
-	// *** BROADCAST REMOVED REACTION ***
-	broadcastMessage := map[string]interface{}{
-		"type":       "reaction_removed",
-		"message_id": messageID,
-		"user_id":    userID,
-		"emoji":      reaction,
-		// NO group_id here initially
+	err = s.messageRepo.Update(message) // Update the message in the repo
+	if err != nil {
+		return err
 	}
+	s.broadcastReaction("reaction_removed", message, userID, reaction)
+	return nil
+}
 
-	// Add group_id ONLY if it's a group message
-	if message.GroupID != nil {
-		broadcastMessage["group_id"] = message.GroupID.String()
+// broadcastReaction sends a reaction update to message's conversation
+// through the hub, which applies the subscription and backpressure policy.
+func (s *chatService) broadcastReaction(eventType string, message *models.Message, userID, reaction string) {
+	if s.hub == nil {
+		return
 	}
-
-	broadcastBytes, _ := json.Marshal(broadcastMessage)
-
-	// Determine who to broadcast to (group or specific user)
+	envelope := websockets.Envelope{SenderID: message.SenderID.String()}
 	if message.GroupID != nil {
-		// Iterate through the group members in the hub.
-		for memberUserID := range s.hub.Groups[message.GroupID.String()] {
-			if client, ok := s.hub.Clients[memberUserID]; ok {
-				select {
-				case client.Send <- broadcastBytes:
-				default:
-					close(client.Send)
-					delete(s.hub.Clients, memberUserID)
-				}
-			}
-		}
+		envelope.GroupID = message.GroupID.String()
 	} else if message.ReceiverID != nil {
-		// It's a direct message, broadcast to the sender and receiver
-		if client, ok := s.hub.Clients[message.ReceiverID.String()]; ok {
-			client.Send <- broadcastBytes
-		}
-		//Also send back to sender
-		if client, ok := s.hub.Clients[message.SenderID.String()]; ok {
-			client.Send <- broadcastBytes
+		envelope.ReceiverID = message.ReceiverID.String()
+	}
+	s.hub.Broadcast <- &websockets.ReactionEvent{
+		Type:      eventType,
+		Envelope:  envelope,
+		MessageID: message.ID.String(),
+		UserID:    userID,
+		Emoji:     reaction,
+	}
+}
+
+// IsGroupMember reports whether userID belongs to groupID.
+func (s *chatService) IsGroupMember(groupID, userID string) (bool, error) {
+	if _, err := uuid.Parse(groupID); err != nil {
+		return false, nil
+	}
+	members, err := s.groupRepo.GetMembers(groupID)
+	if err == gorm.ErrRecordNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, member := range members {
+		if member.ID.String() == userID {
+			return true, nil
 		}
 	}
-	err = s.messageRepo.Update(message) // Update the message in the repo
+	return false, nil
+}
+
+// CanMessageUser reports whether senderID may address receiverID directly,
+// which requires the receiver to be an existing, active account.
+func (s *chatService) CanMessageUser(senderID, receiverID string) (bool, error) {
+	if _, err := uuid.Parse(receiverID); err != nil {
+		return false, nil
+	}
+	_, err := s.userRepo.GetByID(receiverID)
+	if err == gorm.ErrRecordNotFound {
+		return false, nil
+	}
 	if err != nil {
-		return err
+		return false, err
 	}
-	return nil
+	return true, nil
 }
@@ -0,0 +1,391 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"my-chat-app/models"
+	"my-chat-app/websockets"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgconn"
+	"gorm.io/gorm"
+)
+
+func (r *fakeMessageRepo) CreateWithOutbox(message *models.Message, entries ...*models.OutboxEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.created {
+		if existing.ID == message.ID {
+			return &pgconn.PgError{Code: "23505"} // unique_violation, as Postgres reports it
+		}
+	}
+	r.created = append(r.created, *message)
+	for _, entry := range entries {
+		entry.AggregateID = message.ID
+		r.outbox = append(r.outbox, *entry)
+	}
+	return nil
+}
+
+func (r *fakeMessageRepo) UpdateWithOutbox(message *models.Message, entries ...*models.OutboxEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.created {
+		if r.created[i].ID == message.ID {
+			r.created[i] = *message
+		}
+	}
+	for _, entry := range entries {
+		entry.AggregateID = message.ID
+		r.outbox = append(r.outbox, *entry)
+	}
+	return nil
+}
+
+func (r *fakeMessageRepo) GetByID(id string) (*models.Message, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, message := range r.created {
+		if message.ID.String() == id {
+			return &message, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *fakeMessageRepo) Update(message *models.Message) error {
+	return r.UpdateWithOutbox(message)
+}
+
+func TestSendMessageIsIdempotentPerClientMessageID(t *testing.T) {
+	messageRepo := &fakeMessageRepo{}
+	service := NewChatService(messageRepo, nil, fakeUserRepo{}, nil, nil, nil, nil, nil, nil)
+
+	first, err := service.SendMessage(callerID, calleeID, "", "hello", "", "", "", "", 0, "", "c-1")
+	if err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	if first != models.ClientMessageUUID(callerID, "c-1").String() {
+		t.Errorf("message ID = %s, want the ID derived from the client message ID", first)
+	}
+	retry, err := service.SendMessage(callerID, calleeID, "", "hello", "", "", "", "", 0, "", "c-1")
+	if err != nil || retry != first {
+		t.Errorf("retry = %s, %v; want %s", retry, err, first)
+	}
+	if len(messageRepo.created) != 1 {
+		t.Errorf("saved %d messages, want 1", len(messageRepo.created))
+	}
+
+	// The same client ID from another sender is a different message.
+	other, _ := service.SendMessage(calleeID, callerID, "", "hello", "", "", "", "", 0, "", "c-1")
+	if other == first {
+		t.Errorf("client message IDs collide across senders")
+	}
+}
+
+func TestIsPermanent(t *testing.T) {
+	service := NewChatService(&fakeMessageRepo{}, nil, fakeUserRepo{}, nil, nil, nil, nil, nil, nil)
+	_, err := service.SendMessage("not-a-uuid", calleeID, "", "hello", "", "", "", "", 0, "", "")
+	if !IsPermanent(err) {
+		t.Errorf("IsPermanent(%v) = false, want true", err)
+	}
+	if !IsPermanent(fmt.Errorf("insert: %w", &pgconn.PgError{Code: "23503"})) {
+		t.Error("foreign key violation should be permanent")
+	}
+	if IsPermanent(&pgconn.PgError{Code: "57P01"}) || IsPermanent(errors.New("connection refused")) {
+		t.Error("connection failures should be retried")
+	}
+}
+
+func TestIsDuplicateKey(t *testing.T) {
+	if !isDuplicateKey(fmt.Errorf("insert: %w", &pgconn.PgError{Code: "23505"})) {
+		t.Error("unique violation should be a duplicate key")
+	}
+	if isDuplicateKey(&pgconn.PgError{Code: "23503"}) || isDuplicateKey(errors.New("connection refused")) {
+		t.Error("other errors should not be duplicate keys")
+	}
+}
+
+// fakeAIService streams every answer as the same chunks.
+type fakeAIService struct {
+	AIService
+	calls   int
+	persona AIPersona
+}
+
+func (s *fakeAIService) StreamMessage(ctx context.Context, persona AIPersona, conversation []AIMessage, tools AITools, onChunk func(chunk string)) error {
+	s.calls++
+	s.persona = persona
+	onChunk("an ")
+	onChunk("answer")
+	return nil
+}
+
+func TestSendMessageQueuesAIJobsWithTheMessage(t *testing.T) {
+	messageRepo := &fakeMessageRepo{}
+	aiService := &fakeAIService{}
+	service := NewChatService(messageRepo, nil, fakeUserRepo{}, nil, aiService, nil, nil, nil, nil)
+
+	messageID, err := service.SendMessage(callerID, calleeID, "", "@AI what's up?", "", "", "", "", 0, "", "")
+	if err != nil {
+		t.Fatalf("SendMessage failed: %v", err)
+	}
+	if aiService.calls != 0 {
+		t.Errorf("AI called %d times while sending, want 0", aiService.calls)
+	}
+	if len(messageRepo.outbox) != 2 || messageRepo.outbox[1].Topic != AIJobTopic {
+		t.Fatalf("outbox = %+v, want new_message and ai_job", messageRepo.outbox)
+	}
+	var job AIJob
+	if err := json.Unmarshal(messageRepo.outbox[1].Payload, &job); err != nil {
+		t.Fatalf("bad job: %v", err)
+	}
+	if job.MessageID != messageID || job.SenderID != callerID || job.Content != "@AI what's up?" {
+		t.Errorf("job = %+v, want the saved message", job)
+	}
+
+	// Once per job, even when delivered twice.
+	for i := 0; i < 2; i++ {
+		if err := service.ProcessAIJob(job); err != nil {
+			t.Fatalf("ProcessAIJob failed: %v", err)
+		}
+	}
+	if aiService.calls != 1 || len(messageRepo.created) != 2 {
+		t.Fatalf("AI calls = %d, messages = %d; want 1 and 2", aiService.calls, len(messageRepo.created))
+	}
+	reply := messageRepo.created[1]
+	if reply.SenderID.String() != AIUserID || reply.Content != "an answer" {
+		t.Errorf("reply = %+v, want the AI's answer", reply)
+	}
+	if reply.ReplyToMessageID == nil || reply.ReplyToMessageID.String() != messageID {
+		t.Errorf("reply is not threaded under %s", messageID)
+	}
+	if reply.ReceiverID == nil || reply.ReceiverID.String() != callerID {
+		t.Errorf("reply receiver = %v, want the sender", reply.ReceiverID)
+	}
+}
+
+func TestProcessAIJobWithoutProviderRepliesUnavailable(t *testing.T) {
+	messageRepo := &fakeMessageRepo{}
+	service := NewChatService(messageRepo, nil, fakeUserRepo{}, nil, nil, nil, nil, nil, nil)
+	err := service.ProcessAIJob(AIJob{MessageID: uuid.New().String(), SenderID: callerID, Content: "@AI hi"})
+	if err != nil {
+		t.Fatalf("ProcessAIJob failed: %v", err)
+	}
+	if len(messageRepo.created) != 1 || messageRepo.created[0].Content != aiUnavailableReply {
+		t.Errorf("messages = %+v, want the unavailable notice", messageRepo.created)
+	}
+}
+
+func TestProcessAIJobStreamsChunksToTheConversation(t *testing.T) {
+	_, _, _, clients := newCallTest(time.Minute)
+	messageRepo := &fakeMessageRepo{}
+	service := NewChatService(messageRepo, nil, fakeUserRepo{}, clients[callerID].Hub, &fakeAIService{}, nil, nil, nil, nil)
+	job := AIJob{MessageID: uuid.New().String(), SenderID: callerID, ReceiverID: AIUserID, Content: "hi"}
+
+	done := make(chan error, 1)
+	go func() { done <- service.ProcessAIJob(job) }()
+
+	// The placeholder comes first, then the chunks in order.
+	var placeholder *websockets.NewMessageEvent
+	var content string
+	for typing := true; typing; {
+		select {
+		case event := <-clients[callerID].Send:
+			switch event := event.(type) {
+			case *websockets.NewMessageEvent:
+				placeholder = event
+			case *websockets.MessageChunkEvent:
+				if placeholder == nil || event.MessageID != placeholder.MessageID {
+					t.Fatalf("chunk %+v before its placeholder", event)
+				}
+				content += event.Delta
+			case *websockets.AITypingEvent:
+				typing = event.Typing
+			}
+		case <-time.After(time.Second):
+			t.Fatal("AI stopped typing too late")
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("ProcessAIJob failed: %v", err)
+	}
+	if placeholder.Status != "streaming" || content != "an answer" {
+		t.Errorf("placeholder status %q, streamed %q", placeholder.Status, content)
+	}
+	reply := messageRepo.created[0]
+	if reply.Status != "sent" || reply.Content != "an answer" {
+		t.Errorf("reply = %+v, want the completed answer", reply)
+	}
+	if last := messageRepo.outbox[len(messageRepo.outbox)-1]; last.Topic != "message_completed" {
+		t.Errorf("last outbox entry is %s, want message_completed", last.Topic)
+	}
+}
+
+func TestProcessAIJobStreamsDirectMentionsToBothParticipants(t *testing.T) {
+	_, _, _, clients := newCallTest(time.Minute)
+	messageRepo := &fakeMessageRepo{}
+	service := NewChatService(messageRepo, nil, fakeUserRepo{}, clients[callerID].Hub, &fakeAIService{}, nil, nil, nil, nil)
+	job := AIJob{MessageID: uuid.New().String(), SenderID: callerID, ReceiverID: calleeID, Content: "@AI hi"}
+	if err := service.ProcessAIJob(job); err != nil {
+		t.Fatalf("ProcessAIJob failed: %v", err)
+	}
+
+	for _, userID := range []string{callerID, calleeID} {
+		var placeholder, content string
+		for typing := true; typing; {
+			select {
+			case event := <-clients[userID].Send:
+				switch event := event.(type) {
+				case *websockets.NewMessageEvent:
+					placeholder = event.MessageID
+				case *websockets.MessageChunkEvent:
+					content += event.Delta
+				case *websockets.AITypingEvent:
+					typing = event.Typing
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("%s did not see the AI stop typing", userID)
+			}
+		}
+		if placeholder == "" || content != "an answer" {
+			t.Errorf("%s got placeholder %q and %q, want the streamed reply", userID, placeholder, content)
+		}
+	}
+	var completed websockets.MessageCompletedEvent
+	json.Unmarshal(messageRepo.outbox[len(messageRepo.outbox)-1].Payload, &completed)
+	if recipients := completed.Recipients(); len(recipients) != 2 || recipients[0] != callerID || recipients[1] != calleeID {
+		t.Errorf("message_completed goes to %v, want both participants", recipients)
+	}
+}
+
+func TestReactionsFollowSubscriptions(t *testing.T) {
+	_, _, _, clients := newCallTest(time.Minute)
+	receiverID := uuid.MustParse(calleeID)
+	message := models.Message{ID: uuid.New(), SenderID: uuid.MustParse(callerID), ReceiverID: &receiverID, Content: "lunch?"}
+	messageRepo := &fakeMessageRepo{created: []models.Message{message}}
+	service := NewChatService(messageRepo, nil, fakeUserRepo{}, clients[callerID].Hub, nil, nil, nil, nil, nil)
+	// The callee only follows another conversation.
+	if err := clients[calleeID].Subscribe([]string{"user:" + uuid.NewString()}); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	if err := service.AddReaction(message.ID.String(), calleeID, "👍"); err != nil {
+		t.Fatalf("AddReaction failed: %v", err)
+	}
+	select {
+	case event := <-clients[callerID].Send:
+		if reaction, ok := event.(*websockets.ReactionEvent); !ok || reaction.Emoji != "👍" || reaction.UserID != calleeID {
+			t.Errorf("sender got %+v, want the reaction", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("sender did not get the reaction")
+	}
+	select {
+	case event := <-clients[calleeID].Send:
+		t.Errorf("unsubscribed receiver got %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestReadReceiptsReachTheSender(t *testing.T) {
+	_, _, _, clients := newCallTest(time.Minute)
+	receiverID := uuid.MustParse(calleeID)
+	message := models.Message{ID: uuid.New(), SenderID: uuid.MustParse(callerID), ReceiverID: &receiverID, Content: "lunch?"}
+	messageRepo := &fakeMessageRepo{created: []models.Message{message}}
+	service := NewChatService(messageRepo, nil, fakeUserRepo{}, clients[callerID].Hub, nil, nil, nil, nil, nil)
+
+	if err := service.MarkRead(message.ID.String(), callerID); err == nil {
+		t.Errorf("the sender marked their own message read")
+	}
+	if err := service.MarkRead(message.ID.String(), calleeID); err != nil {
+		t.Fatalf("MarkRead failed: %v", err)
+	}
+	select {
+	case event := <-clients[callerID].Send:
+		if read, ok := event.(*websockets.ReadEvent); !ok || read.MessageID != message.ID.String() || read.ReadBy != calleeID {
+			t.Errorf("sender got %+v, want the read receipt", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("sender did not get the read receipt")
+	}
+}
+
+func TestMessageStatusReachesOnlyTheStoredConversation(t *testing.T) {
+	_, _, _, clients := newCallTest(time.Minute)
+	receiverID := uuid.MustParse(calleeID)
+	message := models.Message{ID: uuid.New(), SenderID: uuid.MustParse(callerID), ReceiverID: &receiverID, Content: "lunch?", Status: "sent"}
+	messageRepo := &fakeMessageRepo{created: []models.Message{message}}
+	service := NewChatService(messageRepo, nil, fakeUserRepo{}, clients[callerID].Hub, nil, nil, nil, nil, nil)
+
+	if err := service.UpdateMessageStatus(message.ID.String(), uuid.New().String(), "delivered"); err == nil {
+		t.Errorf("an outsider updated the message status")
+	}
+	if err := service.UpdateMessageStatus(message.ID.String(), calleeID, "delivered"); err != nil {
+		t.Fatalf("UpdateMessageStatus failed: %v", err)
+	}
+	select {
+	case event := <-clients[callerID].Send:
+		status, ok := event.(*websockets.MessageStatusEvent)
+		if !ok || status.MessageID != message.ID.String() || status.Status != "delivered" {
+			t.Errorf("sender got %+v, want the delivery status", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("sender did not get the delivery status")
+	}
+	if got := messageRepo.created[0].Status; got != "delivered" {
+		t.Errorf("stored status = %q, want delivered", got)
+	}
+}
+
+// blockingAIService streams one chunk and then waits to be cancelled.
+type blockingAIService struct {
+	AIService
+	started chan struct{}
+}
+
+func (s *blockingAIService) StreamMessage(ctx context.Context, persona AIPersona, conversation []AIMessage, tools AITools, onChunk func(chunk string)) error {
+	onChunk("partial")
+	close(s.started)
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestCancelGenerationKeepsPartialReply(t *testing.T) {
+	messageRepo := &fakeMessageRepo{}
+	aiService := &blockingAIService{started: make(chan struct{})}
+	service := NewChatService(messageRepo, nil, fakeUserRepo{}, nil, aiService, nil, nil, nil, nil)
+	job := AIJob{MessageID: uuid.New().String(), SenderID: callerID, ReceiverID: AIUserID, Content: "hi"}
+	replyID := aiReplyID(job).String()
+
+	done := make(chan error, 1)
+	go func() { done <- service.ProcessAIJob(job) }()
+	<-aiService.started
+
+	if err := service.CancelGeneration(calleeID, replyID); err == nil {
+		t.Errorf("another user cancelled the reply")
+	}
+	if err := service.CancelGeneration(callerID, replyID); err != nil {
+		t.Fatalf("CancelGeneration failed: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("ProcessAIJob failed: %v", err)
+	}
+
+	reply := messageRepo.created[0]
+	if reply.Status != "sent" || reply.Content != "partial" {
+		t.Errorf("reply = %+v, want the partial answer", reply)
+	}
+	var completed websockets.MessageCompletedEvent
+	json.Unmarshal(messageRepo.outbox[len(messageRepo.outbox)-1].Payload, &completed)
+	if !completed.Cancelled {
+		t.Errorf("completed event = %+v, want cancelled", completed)
+	}
+	if err := service.CancelGeneration(callerID, replyID); err == nil {
+		t.Errorf("cancelled a finished reply")
+	}
+}
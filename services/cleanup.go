@@ -1,6 +1,7 @@
 package services
 
 import (
+	"context"
 	"log"
 	"my-chat-app/repositories"
 	"time"
@@ -8,7 +9,7 @@ import (
 
 type CleanupService interface {
 	CleanupUnverifiedAccounts() error
-	StartCleanupScheduler(interval time.Duration)
+	StartCleanupScheduler(ctx context.Context, interval time.Duration)
 }
 
 type cleanupService struct {
@@ -42,13 +43,19 @@ func (s *cleanupService) CleanupUnverifiedAccounts() error {
 	return nil
 }
 
-// StartCleanupScheduler runs the cleanup process at regular intervals
-func (s *cleanupService) StartCleanupScheduler(interval time.Duration) {
+// StartCleanupScheduler runs the cleanup process at regular intervals until ctx is done
+func (s *cleanupService) StartCleanupScheduler(ctx context.Context, interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	go func() {
-		for range ticker.C {
-			if err := s.CleanupUnverifiedAccounts(); err != nil {
-				log.Printf("Error during scheduled cleanup: %v", err)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.CleanupUnverifiedAccounts(); err != nil {
+					log.Printf("Error during scheduled cleanup: %v", err)
+				}
+			case <-ctx.Done():
+				return
 			}
 		}
 	}()
@@ -0,0 +1,122 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"my-chat-app/broker"
+	"my-chat-app/models"
+	"my-chat-app/repositories"
+
+	"gorm.io/gorm"
+)
+
+// ErrInvalidDeadLetterBody rejects an edited body that is not a JSON object.
+var ErrInvalidDeadLetterBody = errors.New("body must be a JSON object")
+
+// DeadLetterService inspects, replays and purges persisted dead letters.
+// Replayed entries go back to the queue they failed on, with a fresh retry
+// count, and are removed; if they fail again they come back as new entries.
+type DeadLetterService interface {
+	List(limit, offset int) ([]models.DeadLetter, int64, error)
+	Get(id string) (*models.DeadLetter, error)
+	Replay(ids []string) (int, error)
+	ReplayAll() (int, error)
+	EditAndReplay(id string, body json.RawMessage) error
+	Purge(ids []string) (int64, error)
+	PurgeAll() (int64, error)
+}
+
+type deadLetterService struct {
+	repo      repositories.DeadLetterRepository
+	publisher broker.Publisher
+}
+
+func NewDeadLetterService(repo repositories.DeadLetterRepository, publisher broker.Publisher) DeadLetterService {
+	return &deadLetterService{repo: repo, publisher: publisher}
+}
+
+func (s *deadLetterService) List(limit, offset int) ([]models.DeadLetter, int64, error) {
+	return s.repo.List(limit, offset)
+}
+
+func (s *deadLetterService) Get(id string) (*models.DeadLetter, error) {
+	return s.repo.GetByID(id)
+}
+
+// Replay republishes the given entries in order, stopping at the first
+// failure. It returns how many were replayed.
+func (s *deadLetterService) Replay(ids []string) (int, error) {
+	for i, id := range ids {
+		deadLetter, err := s.repo.GetByID(id)
+		if err != nil {
+			return i, err
+		}
+		if err := s.replay(deadLetter); err != nil {
+			return i, err
+		}
+	}
+	return len(ids), nil
+}
+
+// ReplayAll replays the entries there were when it started, oldest first, so
+// that messages failing again during the replay are not picked up in a loop.
+// Entries purged or replayed by someone else meanwhile are skipped.
+func (s *deadLetterService) ReplayAll() (int, error) {
+	ids, err := s.repo.IDs()
+	if err != nil {
+		return 0, err
+	}
+	replayed := 0
+	for _, id := range ids {
+		deadLetter, err := s.repo.GetByID(id)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		}
+		if err != nil {
+			return replayed, err
+		}
+		if err := s.replay(deadLetter); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+	return replayed, nil
+}
+
+// EditAndReplay replaces the entry's body, for fixing what made it fail, and
+// replays it.
+func (s *deadLetterService) EditAndReplay(id string, body json.RawMessage) error {
+	var object map[string]interface{}
+	if err := json.Unmarshal(body, &object); err != nil || object == nil {
+		return ErrInvalidDeadLetterBody
+	}
+	deadLetter, err := s.repo.GetByID(id)
+	if err != nil {
+		return err
+	}
+	deadLetter.Body = string(body)
+	return s.replay(deadLetter)
+}
+
+func (s *deadLetterService) Purge(ids []string) (int64, error) {
+	return s.repo.Delete(ids)
+}
+
+func (s *deadLetterService) PurgeAll() (int64, error) {
+	return s.repo.DeleteAll()
+}
+
+// replay publishes the entry back to its queue without the reply address,
+// whose sender stopped waiting long ago, and then deletes it.
+func (s *deadLetterService) replay(deadLetter *models.DeadLetter) error {
+	err := s.publisher.Publish("", deadLetter.Queue, broker.Message{
+		ContentType:   deadLetter.ContentType,
+		CorrelationID: deadLetter.CorrelationID,
+		Body:          []byte(deadLetter.Body),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = s.repo.Delete([]string{deadLetter.ID.String()})
+	return err
+}
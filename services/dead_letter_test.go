@@ -0,0 +1,172 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"my-chat-app/broker"
+	"my-chat-app/models"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type fakeDeadLetterRepo struct {
+	entries []models.DeadLetter
+}
+
+func (r *fakeDeadLetterRepo) Create(deadLetter *models.DeadLetter) error {
+	r.entries = append(r.entries, *deadLetter)
+	return nil
+}
+
+func (r *fakeDeadLetterRepo) List(limit, offset int) ([]models.DeadLetter, int64, error) {
+	end := offset + limit
+	if end > len(r.entries) {
+		end = len(r.entries)
+	}
+	return append([]models.DeadLetter(nil), r.entries[offset:end]...), int64(len(r.entries)), nil
+}
+
+func (r *fakeDeadLetterRepo) GetByID(id string) (*models.DeadLetter, error) {
+	for _, entry := range r.entries {
+		if entry.ID.String() == id {
+			return &entry, nil
+		}
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (r *fakeDeadLetterRepo) IDs() ([]string, error) {
+	entries := append([]models.DeadLetter(nil), r.entries...)
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].FailedAt.Before(entries[j].FailedAt) })
+	ids := make([]string, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.ID.String()
+	}
+	return ids, nil
+}
+
+func (r *fakeDeadLetterRepo) Delete(ids []string) (int64, error) {
+	var deleted int64
+	for _, id := range ids {
+		for i, entry := range r.entries {
+			if entry.ID.String() == id {
+				r.entries = append(r.entries[:i], r.entries[i+1:]...)
+				deleted++
+				break
+			}
+		}
+	}
+	return deleted, nil
+}
+
+func (r *fakeDeadLetterRepo) DeleteAll() (int64, error) {
+	deleted := int64(len(r.entries))
+	r.entries = nil
+	return deleted, nil
+}
+
+func (r *fakeDeadLetterRepo) Stats() (int64, *time.Time, error) {
+	return int64(len(r.entries)), nil, nil
+}
+
+func newDeadLetterTest(t *testing.T, bodies ...string) (*fakeDeadLetterRepo, *broker.Memory, <-chan *broker.Delivery) {
+	t.Helper()
+	repo := &fakeDeadLetterRepo{}
+	for _, body := range bodies {
+		repo.Create(&models.DeadLetter{ID: uuid.New(), Queue: "chat_queue", Body: body, FailedAt: time.Now()})
+	}
+	b := broker.NewMemory()
+	if _, err := b.DeclareQueue("chat_queue", broker.QueueOptions{Durable: true}); err != nil {
+		t.Fatalf("DeclareQueue failed: %v", err)
+	}
+	deliveries, err := b.Subscribe("chat_queue", "test", 0)
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return repo, b, deliveries
+}
+
+func receiveBody(t *testing.T, deliveries <-chan *broker.Delivery) string {
+	t.Helper()
+	select {
+	case d := <-deliveries:
+		d.Ack()
+		return string(d.Body)
+	case <-time.After(time.Second):
+		t.Fatal("nothing was replayed")
+	}
+	return ""
+}
+
+func TestReplayAllRepublishesAndRemovesDeadLetters(t *testing.T) {
+	repo, b, deliveries := newDeadLetterTest(t, `{"content":"one"}`, `{"content":"two"}`)
+	service := NewDeadLetterService(repo, b)
+
+	replayed, err := service.ReplayAll()
+	if err != nil || replayed != 2 {
+		t.Fatalf("ReplayAll = %d, %v; want 2", replayed, err)
+	}
+	if got := receiveBody(t, deliveries); got != `{"content":"one"}` {
+		t.Errorf("first replay = %s", got)
+	}
+	if got := receiveBody(t, deliveries); got != `{"content":"two"}` {
+		t.Errorf("second replay = %s", got)
+	}
+	if len(repo.entries) != 0 {
+		t.Errorf("%d entries left after replay", len(repo.entries))
+	}
+}
+
+// refailingPublisher dead-letters every message again as it is replayed.
+type refailingPublisher struct {
+	repo      *fakeDeadLetterRepo
+	published []string
+}
+
+func (p *refailingPublisher) Publish(exchange, routingKey string, msg broker.Message) error {
+	p.published = append(p.published, string(msg.Body))
+	return p.repo.Create(&models.DeadLetter{ID: uuid.New(), Queue: routingKey, Body: string(msg.Body), FailedAt: time.Now()})
+}
+
+func TestReplayAllReplaysEachEntryOnceOldestFirst(t *testing.T) {
+	repo := &fakeDeadLetterRepo{}
+	now := time.Now()
+	repo.Create(&models.DeadLetter{ID: uuid.New(), Queue: "chat_queue", Body: "newer", FailedAt: now.Add(-time.Minute)})
+	repo.Create(&models.DeadLetter{ID: uuid.New(), Queue: "chat_queue", Body: "older", FailedAt: now.Add(-time.Hour)})
+	publisher := &refailingPublisher{repo: repo}
+
+	replayed, err := NewDeadLetterService(repo, publisher).ReplayAll()
+	if err != nil || replayed != 2 {
+		t.Fatalf("ReplayAll = %d, %v; want 2", replayed, err)
+	}
+	if len(publisher.published) != 2 || publisher.published[0] != "older" || publisher.published[1] != "newer" {
+		t.Errorf("replayed %q, want older then newer once each", publisher.published)
+	}
+	if len(repo.entries) != 2 {
+		t.Errorf("%d entries left, want the 2 that failed again", len(repo.entries))
+	}
+}
+
+func TestEditAndReplay(t *testing.T) {
+	repo, b, deliveries := newDeadLetterTest(t, `{"content":`)
+	service := NewDeadLetterService(repo, b)
+	id := repo.entries[0].ID.String()
+
+	if err := service.EditAndReplay(id, json.RawMessage(`null`)); !errors.Is(err, ErrInvalidDeadLetterBody) {
+		t.Fatalf("EditAndReplay(null) = %v, want ErrInvalidDeadLetterBody", err)
+	}
+	if err := service.EditAndReplay(id, json.RawMessage(`{"content":"fixed"}`)); err != nil {
+		t.Fatalf("EditAndReplay failed: %v", err)
+	}
+	if got := receiveBody(t, deliveries); got != `{"content":"fixed"}` {
+		t.Errorf("replayed body = %s", got)
+	}
+	if _, err := service.Get(id); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("Get after replay = %v, want not found", err)
+	}
+}
@@ -37,7 +37,7 @@ func NewGroupService(groupRepo repositories.GroupRepository, userRepo repositori
 
 func (s *groupService) CreateGroup(name string, creatorID string) (*models.Group, error) {
 	// Parse the creatorID to ensure it's a valid UUID.
-	_, err := uuid.Parse(creatorID) // Use creatorID directly
+	creatorUUID, err := uuid.Parse(creatorID) // Use creatorID directly
 	if err != nil {
 		log.Printf("CreateGroup: Invalid creatorID: %v, Error: %v", creatorID, err)
 		return nil, fmt.Errorf("invalid creator ID: %w", err)
@@ -49,9 +49,10 @@ func (s *groupService) CreateGroup(name string, creatorID string) (*models.Group
 		return nil, fmt.Errorf("error generating group code: %w", err)
 	}
 	group := &models.Group{
-		Name:  name,
-		Code:  code,             // Set the code
-		Users: []*models.User{}, // Initialize the Users slice
+		Name:      name,
+		Code:      code,             // Set the code
+		CreatedBy: &creatorUUID,     // The creator administers the group
+		Users:     []*models.User{}, // Initialize the Users slice
 	}
 
 	err = s.groupRepo.Create(group)
@@ -0,0 +1,199 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"my-chat-app/broker"
+	"my-chat-app/models"
+	"my-chat-app/repositories"
+	"my-chat-app/websockets"
+	"time"
+)
+
+const (
+	// EventsExchange receives every relayed outbox event, routed by topic.
+	EventsExchange = "chat_events"
+
+	// Published outbox entries are kept this long for debugging.
+	outboxRetention = 24 * time.Hour
+
+	// After a failed batch the relay waits twice as long each time, up to
+	// this, before trying again.
+	outboxMaxBackoff = time.Minute
+)
+
+// EventPublisher publishes relayed outbox events to the broker. messageID is
+// sent as the AMQP message ID so consumers can drop redeliveries.
+type EventPublisher interface {
+	PublishEvent(topic, messageID string, payload []byte) error
+}
+
+// OutboxRelay publishes outbox entries to the broker with at-least-once
+// semantics: an entry is only marked published after the broker took it, so
+// a crash in between publishes it again. Consumers and clients dedupe by
+// message ID. Once the batch is committed, its events go to the hub. Entries
+// that keep failing are given up on after maxAttempts so that they do not
+// hold back the rest.
+type OutboxRelay interface {
+	Start(ctx context.Context)
+	Notify()
+	RelayPending() (int, error)
+}
+
+type outboxRelay struct {
+	outboxRepo  repositories.OutboxRepository
+	publisher   EventPublisher // Nil relays to the hub only
+	hub         *websockets.Hub
+	interval    time.Duration
+	batchSize   int
+	maxAttempts int
+	wake        chan struct{}
+}
+
+func NewOutboxRelay(outboxRepo repositories.OutboxRepository, publisher EventPublisher, hub *websockets.Hub, interval time.Duration, batchSize, maxAttempts int) OutboxRelay {
+	return &outboxRelay{
+		outboxRepo:  outboxRepo,
+		publisher:   publisher,
+		hub:         hub,
+		interval:    interval,
+		batchSize:   batchSize,
+		maxAttempts: maxAttempts,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Notify wakes the relay after a transaction wrote outbox entries. The
+// periodic poll still picks up entries whose notification was lost.
+func (r *outboxRelay) Notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start relays pending entries whenever notified and every interval until
+// ctx is done, backing off while batches fail.
+func (r *outboxRelay) Start(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	cleanup := time.NewTicker(time.Hour)
+	go func() {
+		defer ticker.Stop()
+		defer cleanup.Stop()
+		var backoff time.Duration
+		var retryAt time.Time
+		for {
+			select {
+			case <-r.wake:
+				if time.Now().Before(retryAt) {
+					continue
+				}
+			case <-ticker.C:
+				if time.Now().Before(retryAt) {
+					continue
+				}
+			case <-cleanup.C:
+				if _, err := r.outboxRepo.DeletePublishedBefore(time.Now().Add(-outboxRetention)); err != nil {
+					log.Printf("OutboxRelay: Error deleting published entries: %v", err)
+				}
+				continue
+			case <-ctx.Done():
+				return
+			}
+			// Keep going while full batches come back.
+			for {
+				n, err := r.RelayPending()
+				if err != nil {
+					backoff = min(max(2*backoff, r.interval), outboxMaxBackoff)
+					retryAt = time.Now().Add(backoff)
+					log.Printf("OutboxRelay: %v; retrying in %v", err, backoff)
+					break
+				}
+				backoff = 0
+				if n < r.batchSize {
+					break
+				}
+			}
+		}
+	}()
+	log.Printf("Outbox relay started with interval: %v", r.interval)
+}
+
+// RelayPending publishes one batch of pending entries to the broker, then
+// delivers the published ones to the hub, outside the batch's transaction so
+// that a slow hub does not keep entries locked.
+func (r *outboxRelay) RelayPending() (int, error) {
+	published, err := r.outboxRepo.Relay(r.batchSize, r.maxAttempts, r.publish)
+	for _, entry := range published {
+		r.deliver(entry)
+	}
+	return len(published), err
+}
+
+func (r *outboxRelay) publish(entry models.OutboxEntry) error {
+	if r.publisher == nil {
+		return nil
+	}
+	if err := r.publisher.PublishEvent(entry.Topic, entry.AggregateID.String(), entry.Payload); err != nil {
+		return fmt.Errorf("publishing outbox entry %d: %w", entry.ID, err)
+	}
+	return nil
+}
+
+// deliver sends a published entry's event to the hub.
+func (r *outboxRelay) deliver(entry models.OutboxEntry) {
+	event, err := decodeOutboxEvent(entry.Topic, entry.Payload)
+	if err != nil {
+		// Redelivering would fail the same way; the broker already has it.
+		log.Printf("OutboxRelay: Not delivering entry %d to the hub: %v", entry.ID, err)
+		return
+	}
+	if event != nil && r.hub != nil {
+		r.hub.Broadcast <- event
+	}
+}
+
+// decodeOutboxEvent turns an outbox payload back into a hub event. Topics
+// meant for the broker only, like AI jobs, have none.
+func decodeOutboxEvent(topic string, payload []byte) (websockets.Event, error) {
+	switch topic {
+	case AIJobTopic:
+		return nil, nil
+	case "message_completed":
+		var event websockets.MessageCompletedEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, err
+		}
+		return &event, nil
+	case "new_message":
+		var event websockets.NewMessageEvent
+		if err := json.Unmarshal(payload, &event); err != nil {
+			return nil, err
+		}
+		return &event, nil
+	}
+	return nil, fmt.Errorf("unknown outbox topic %q", topic)
+}
+
+// brokerEventPublisher publishes to EventsExchange; the broker confirms each
+// publish before returning.
+type brokerEventPublisher struct {
+	broker broker.Publisher
+}
+
+// NewBrokerEventPublisher declares EventsExchange on b and publishes to it.
+func NewBrokerEventPublisher(b broker.Broker) (EventPublisher, error) {
+	if err := b.DeclareExchange(EventsExchange, broker.Topic); err != nil {
+		return nil, err
+	}
+	return &brokerEventPublisher{broker: b}, nil
+}
+
+func (p *brokerEventPublisher) PublishEvent(topic, messageID string, payload []byte) error {
+	return p.broker.Publish(EventsExchange, topic, broker.Message{
+		ContentType: "application/json",
+		MessageID:   messageID,
+		Body:        payload,
+	})
+}
@@ -0,0 +1,130 @@
+package services
+
+import (
+	"errors"
+	"my-chat-app/models"
+	"my-chat-app/websockets"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/datatypes"
+)
+
+// fakeOutboxRepo keeps entries in memory with the same relay semantics.
+type fakeOutboxRepo struct {
+	entries []models.OutboxEntry
+}
+
+func (r *fakeOutboxRepo) Relay(limit, maxAttempts int, publish func(entry models.OutboxEntry) error) ([]models.OutboxEntry, error) {
+	var published []models.OutboxEntry
+	for i := range r.entries {
+		entry := &r.entries[i]
+		if entry.PublishedAt != nil || entry.FailedAt != nil || len(published) == limit {
+			continue
+		}
+		if err := publish(*entry); err != nil {
+			entry.Attempts++
+			entry.LastError = err.Error()
+			if entry.Attempts >= maxAttempts {
+				now := time.Now()
+				entry.FailedAt = &now
+				continue
+			}
+			return published, err
+		}
+		now := time.Now()
+		entry.PublishedAt = &now
+		published = append(published, *entry)
+	}
+	return published, nil
+}
+
+func (r *fakeOutboxRepo) DeletePublishedBefore(before time.Time) (int64, error) { return 0, nil }
+
+type flakyPublisher struct {
+	failures  int
+	poisoned  string // Never published
+	published []string
+}
+
+func (p *flakyPublisher) PublishEvent(topic, messageID string, payload []byte) error {
+	if messageID == p.poisoned {
+		return errors.New("rejected")
+	}
+	if p.failures > 0 {
+		p.failures--
+		return errors.New("broker unavailable")
+	}
+	p.published = append(p.published, messageID)
+	return nil
+}
+
+func TestOutboxRelayRetriesUntilPublished(t *testing.T) {
+	_, _, _, clients := newCallTest(time.Minute)
+	hub := clients[callerID].Hub
+	messageID := uuid.New()
+	repo := &fakeOutboxRepo{entries: []models.OutboxEntry{{
+		ID:          1,
+		AggregateID: messageID,
+		Topic:       "new_message",
+		Payload:     datatypes.JSON(`{"type":"new_message","sender_id":"` + callerID + `","receiver_id":"` + calleeID + `","message_id":"` + messageID.String() + `","content":"hi"}`),
+	}}}
+	publisher := &flakyPublisher{failures: 1}
+	relay := NewOutboxRelay(repo, publisher, hub, time.Hour, 10, 5)
+
+	// The broker is down: the entry stays pending and nobody hears of it.
+	if n, err := relay.RelayPending(); n != 0 || err == nil || repo.entries[0].Attempts != 1 || repo.entries[0].PublishedAt != nil {
+		t.Fatalf("after failure: published %d, entry %+v", n, repo.entries[0])
+	}
+	select {
+	case event := <-clients[calleeID].Send:
+		t.Fatalf("hub got %+v before the broker took the event", event)
+	default:
+	}
+
+	if n, _ := relay.RelayPending(); n != 1 || repo.entries[0].PublishedAt == nil {
+		t.Fatalf("after retry: published %d, entry %+v", n, repo.entries[0])
+	}
+	if len(publisher.published) != 1 || publisher.published[0] != messageID.String() {
+		t.Errorf("broker got %v", publisher.published)
+	}
+	for _, id := range []string{callerID, calleeID} {
+		select {
+		case event := <-clients[id].Send:
+			if msg, ok := event.(*websockets.NewMessageEvent); !ok || msg.MessageID != messageID.String() {
+				t.Errorf("%s got %+v", id, event)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s got no new_message", id)
+		}
+	}
+}
+
+func TestOutboxRelayGivesUpOnEntriesThatKeepFailing(t *testing.T) {
+	poisoned, next := uuid.New(), uuid.New()
+	repo := &fakeOutboxRepo{entries: []models.OutboxEntry{
+		{ID: 1, AggregateID: poisoned, Topic: AIJobTopic, Payload: datatypes.JSON(`{}`)},
+		{ID: 2, AggregateID: next, Topic: AIJobTopic, Payload: datatypes.JSON(`{}`)},
+	}}
+	publisher := &flakyPublisher{poisoned: poisoned.String()}
+	relay := NewOutboxRelay(repo, publisher, nil, time.Hour, 10, 2)
+
+	// The first failure holds back the entries behind it, to keep them in order.
+	if n, err := relay.RelayPending(); n != 0 || err == nil || repo.entries[1].PublishedAt != nil {
+		t.Fatalf("first attempt: published %d, %v", n, err)
+	}
+	// The last attempt gives up on it, and the rest goes through.
+	if n, err := relay.RelayPending(); n != 1 || err != nil {
+		t.Fatalf("last attempt: published %d, %v; want the next entry", n, err)
+	}
+	if repo.entries[0].FailedAt == nil || repo.entries[0].PublishedAt != nil {
+		t.Errorf("poisoned entry = %+v, want failed", repo.entries[0])
+	}
+	if len(publisher.published) != 1 || publisher.published[0] != next.String() {
+		t.Errorf("broker got %v, want only the next entry", publisher.published)
+	}
+	if n, err := relay.RelayPending(); n != 0 || err != nil || repo.entries[0].Attempts != 2 {
+		t.Errorf("failed entry was retried: published %d, %v, entry %+v", n, err, repo.entries[0])
+	}
+}
@@ -0,0 +1,40 @@
+package websockets
+
+// ICECandidate mirrors the browser's RTCIceCandidateInit.
+type ICECandidate struct {
+	Candidate        string  `json:"candidate"`
+	SDPMid           *string `json:"sdpMid,omitempty"`
+	SDPMLineIndex    *uint16 `json:"sdpMLineIndex,omitempty"`
+	UsernameFragment *string `json:"usernameFragment,omitempty"`
+}
+
+// CallSignaler runs the call state machine and relays WebRTC signaling
+// (call_offer, call_answer, ice_candidate, call_hangup, call_ringing) between
+// call participants. Media never passes through the server.
+type CallSignaler interface {
+	Signal(userID string, msg WebSocketMessage) error
+}
+
+// CallEvent is a signaling frame relayed to the other participants of a call.
+type CallEvent struct {
+	Type string `json:"type"`
+	Envelope
+	CallID    string        `json:"call_id"`
+	Media     string        `json:"media,omitempty"`
+	SDP       string        `json:"sdp,omitempty"`
+	Candidate *ICECandidate `json:"candidate,omitempty"`
+	Reason    string        `json:"reason,omitempty"`
+
+	recipients []string
+}
+
+func (e *CallEvent) EventType() string { return e.Type }
+
+// Recipients lists the participants the event is relayed to.
+func (e *CallEvent) Recipients() []string { return e.recipients }
+
+// To sets the participants the event is relayed to.
+func (e *CallEvent) To(userIDs ...string) *CallEvent {
+	e.recipients = userIDs
+	return e
+}
@@ -1,13 +1,15 @@
 package websockets
 
 import (
-	"encoding/json"
 	"log"
+	"my-chat-app/config"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// Defaults used when a Limits field is left zero.
 const (
 	// Time allowed to write a message to the peer.
 	writeWait = 10 * time.Second
@@ -15,13 +17,60 @@ const (
 	// Time allowed to read the next pong message from the peer.
 	pongWait = 60 * time.Second
 
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
-
 	// Maximum message size allowed from peer.
 	maxMessageSize = 8192 // 8KB
+
+	// Capacity of a client's outbound queue.
+	sendBufferSize = 256
+
+	// Minimum gap between forwarded typing events per conversation.
+	typingThrottle = 2 * time.Second
 )
 
+// Limits bounds a single WebSocket connection.
+type Limits struct {
+	MaxMessageSize int64
+	PongWait       time.Duration
+	WriteWait      time.Duration
+	SendBufferSize int
+	TypingThrottle time.Duration // Minimum gap between typing events per conversation
+}
+
+// LimitsFromConfig reads the connection limits from the application config.
+func LimitsFromConfig(cfg config.Config) Limits {
+	return Limits{
+		MaxMessageSize: cfg.WSMaxMessageSize,
+		PongWait:       cfg.WSPongWait,
+		WriteWait:      cfg.WSWriteWait,
+		SendBufferSize: cfg.WSSendBufferSize,
+		TypingThrottle: cfg.WSTypingThrottle,
+	}.withDefaults()
+}
+
+func (l Limits) withDefaults() Limits {
+	if l.MaxMessageSize <= 0 {
+		l.MaxMessageSize = maxMessageSize
+	}
+	if l.PongWait <= 0 {
+		l.PongWait = pongWait
+	}
+	if l.WriteWait <= 0 {
+		l.WriteWait = writeWait
+	}
+	if l.SendBufferSize <= 0 {
+		l.SendBufferSize = sendBufferSize
+	}
+	if l.TypingThrottle <= 0 {
+		l.TypingThrottle = typingThrottle
+	}
+	return l
+}
+
+// pingPeriod is how often pings are sent to the peer. Must be less than PongWait.
+func (l Limits) pingPeriod() time.Duration {
+	return (l.PongWait * 9) / 10
+}
+
 var (
 	newline = []byte{'\n'}
 	space   = []byte{' '}
@@ -34,13 +83,68 @@ type Client struct {
 	// The websocket connection.
 	Conn *websocket.Conn
 
-	// Buffered channel of outbound messages.
-	Send chan []byte
+	// Buffered channel of outbound events. Write through Hub.Deliver only;
+	// it is closed by the hub and never by senders.
+	Send chan Event
 	//UserID
 	UserID string
+
+	// Codec negotiated through the subprotocol header. Nil means JSON.
+	Codec Codec
+
+	// Limits for this connection. Zero fields use the package defaults.
+	Limits Limits
+
+	// Compression reports whether permessage-deflate was negotiated.
+	Compression bool
+
+	connectedAt time.Time
+	counters    connCounters
+
+	// Last forwarded typing event per conversation; used by ReadPump only.
+	typingSent map[string]time.Time
+
+	// Conversations whose access was recently verified; used by ReadPump only.
+	accessChecked map[string]time.Time
+
+	// Topics this connection subscribed to; see Subscribe.
+	subs subscriptions
+
+	// Guards Send against concurrent delivery and close; see Hub.Deliver.
+	mu         sync.Mutex
+	closed     bool
+	restarting bool // Closed by Hub.Shutdown
+	drops      int
+	spool      *spool
+	spoolReady chan struct{}
 }
+
+// NewClient wraps an upgraded connection for userID, picking the codec from
+// the negotiated subprotocol.
+func NewClient(hub *Hub, conn *websocket.Conn, userID string, limits Limits) *Client {
+	limits = limits.withDefaults()
+	return &Client{
+		Hub:         hub,
+		Conn:        conn,
+		Send:        make(chan Event, limits.SendBufferSize),
+		UserID:      userID,
+		Codec:       CodecFor(conn.Subprotocol()),
+		Limits:      limits,
+		connectedAt: time.Now(),
+		spoolReady:  make(chan struct{}, 1),
+	}
+}
+
+func (c *Client) codec() Codec {
+	if c.Codec == nil {
+		return JSONCodec{}
+	}
+	return c.Codec
+}
+
 type WebSocketMessage struct {
 	Type             string `json:"type"`
+	RequestID        string `json:"request_id,omitempty"` // Client-generated, echoed in ack / error
 	SenderID         string `json:"sender_id"`
 	ReceiverID       string `json:"receiver_id"`
 	GroupID          string `json:"group_id"`
@@ -49,6 +153,26 @@ type WebSocketMessage struct {
 	ReplyToMessageID string `json:"reply_to_message_id"`
 	Emoji            string `json:"emoji"`
 	Status           string `json:"status"`
+	ClientMessageID  string `json:"client_message_id,omitempty"` // Client-generated, makes new_message idempotent
+	// Presence fields (set_presence)
+	State           string `json:"state,omitempty"`
+	StatusText      string `json:"status_text,omitempty"`
+	StatusEmoji     string `json:"status_emoji,omitempty"`
+	StatusExpiresIn int64  `json:"status_expires_in,omitempty"` // Seconds
+	// Call signaling fields
+	CallID    string        `json:"call_id,omitempty"`
+	TargetID  string        `json:"target_id,omitempty"` // Peer to relay to in group calls
+	Media     string        `json:"media,omitempty"`     // audio, video
+	SDP       string        `json:"sdp,omitempty"`
+	Candidate *ICECandidate `json:"candidate,omitempty"`
+	Reason    string        `json:"reason,omitempty"`
+	// Ephemeral event fields
+	Kind     string                 `json:"kind,omitempty"`     // location, cursor, now_playing
+	Action   string                 `json:"action,omitempty"`   // start, update, stop
+	Duration int64                  `json:"duration,omitempty"` // Seconds a session lasts
+	Data     map[string]interface{} `json:"data,omitempty"`
+	// Subscription topics for subscribe / unsubscribe
+	Topics []string `json:"topics,omitempty"`
 	// File fields
 	FileName     string `json:"file_name"`
 	FilePath     string `json:"file_path"`
@@ -57,18 +181,18 @@ type WebSocketMessage struct {
 	FileChecksum string `json:"checksum"`
 }
 
-// ReadPump pumps messages from the websocket connection to the hub.
-func (c *Client) ReadPump(messageSaver MessageSaver) {
+// ReadPump pumps commands from the websocket connection to the hub. Every
+// command is answered with an ack (when it carries a request_id) or an error.
+func (c *Client) ReadPump(cmds Commands) {
 	defer func() {
-		// When client disconnects, send offline status before unregistering
-		offlineMsg := []byte(`{"type": "offline_status", "user_id": "` + c.UserID + `"}`)
-		c.Hub.Broadcast <- offlineMsg
-		c.Hub.Unregister <- c
+		// Unregistering reports the user offline
+		c.Hub.Disconnect(c)
 		c.Conn.Close()
 	}()
-	c.Conn.SetReadLimit(maxMessageSize)
-	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.Conn.SetPongHandler(func(string) error { c.Conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	limits := c.Limits.withDefaults()
+	c.Conn.SetReadLimit(limits.MaxMessageSize)
+	c.Conn.SetReadDeadline(time.Now().Add(limits.PongWait))
+	c.Conn.SetPongHandler(func(string) error { c.Conn.SetReadDeadline(time.Now().Add(limits.PongWait)); return nil })
 	for {
 		_, message, err := c.Conn.ReadMessage()
 		if err != nil {
@@ -77,120 +201,118 @@ func (c *Client) ReadPump(messageSaver MessageSaver) {
 			}
 			break
 		}
+		c.counters.bytesIn.Add(int64(len(message)))
 		var wsMessage WebSocketMessage
-		if err := json.Unmarshal(message, &wsMessage); err != nil {
+		if err := c.codec().Unmarshal(message, &wsMessage); err != nil {
 			log.Printf("Error unmarshaling message: %v", err)
-			continue // Skip to the next iteration if unmarshaling fails
+			c.reply("", NewCommandError(ErrCodeBadRequest, "Malformed frame"))
+			continue
 		}
-
-		switch wsMessage.Type {
-		case "new_message":
-			// *DO NOT* call chatService.SendMessage here!
-			// The consumer handles saving and broadcasting.
-			log.Printf("Received new_message via WebSocket.  This should NOT happen now.")
-
-		case "typing": // Handle typing indicator
-			wsMessage.SenderID = c.UserID
-			// Broadcast typing indicator to the recipient
-			c.Hub.Broadcast <- message // Just forward the original message
-		case "online_status":
-			// Handle user coming online
-			statusMsg := []byte(`{"type": "online_status", "user_id": "` + c.UserID + `"}`)
-			c.Hub.Broadcast <- statusMsg
-
-		case "offline_status": // Handle user going offline
-			// You might want to store last seen time here
-			statusMsg := []byte(`{"type": "offline_status", "user_id": "` + c.UserID + `"}`)
-			c.Hub.Broadcast <- statusMsg
-
-		case "read_message": // Handle message read status
-			c.Hub.Broadcast <- []byte(`{"type": "read_message", "message_id": "` + wsMessage.MessageID + `", "read_by": "` + c.UserID + `"}`)
-
-		case "join_group":
-			// Add the client to the group
-			c.Hub.AddClientToGroup(c.UserID, wsMessage.GroupID)
-			log.Printf("Client %s joined group %s", c.UserID, wsMessage.GroupID)
-		case "reaction":
-			// Handle adding reaction
-			if messageSaver, ok := messageSaver.(interface {
-				AddReaction(messageID, userID, emoji string) error
-			}); ok {
-				err := messageSaver.AddReaction(wsMessage.MessageID, c.UserID, wsMessage.Emoji)
-				if err != nil {
-					log.Printf("Error adding reaction: %v", err)
-					continue
-				}
-				// Broadcast the reaction update
-				//c.Hub.Broadcast <- message // Remove this.  Backend handles it.
-			}
-
-		case "remove_reaction":
-			// Handle removing reaction
-			if messageSaver, ok := messageSaver.(interface {
-				RemoveReaction(messageID, userID, emoji string) error
-			}); ok {
-				err := messageSaver.RemoveReaction(wsMessage.MessageID, c.UserID, wsMessage.Emoji)
-				if err != nil {
-					log.Printf("Error removing reaction: %v", err)
-					continue
-				}
-				// Broadcast the reaction removal
-				//c.Hub.Broadcast <- message // Remove this.  Backend handles it.
-			}
-		case "message_status":
-			if messageSaver, ok := messageSaver.(interface {
-				UpdateMessageStatus(messageID string, status string) error
-			}); ok {
-				err := messageSaver.UpdateMessageStatus(wsMessage.MessageID, wsMessage.Status)
-				if err != nil {
-					log.Printf("Error updating message status: %v", err)
-					continue
-				}
-				// Broadcast the status update
-				c.Hub.Broadcast <- message
-			}
+		if err := c.handleCommand(cmds, wsMessage); err != nil {
+			log.Printf("Command %s from %s failed: %v", wsMessage.Type, c.UserID, err)
+			c.reply(wsMessage.RequestID, err)
+			continue
 		}
+		c.ack(wsMessage)
 	}
 }
 
 // WritePump pumps messages from the hub to the websocket connection.
+// Text codecs batch queued events into one frame separated by newlines;
+// binary codecs write one frame per event.
 func (c *Client) WritePump() {
-	ticker := time.NewTicker(pingPeriod)
+	codec := c.codec()
+	limits := c.Limits.withDefaults()
+	ticker := time.NewTicker(limits.pingPeriod())
 	defer func() {
 		ticker.Stop()
 		c.Conn.Close()
 	}()
 	for {
 		select {
-		case message, ok := <-c.Send:
-			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+		case event, ok := <-c.Send:
+			c.Conn.SetWriteDeadline(time.Now().Add(limits.WriteWait))
 			if !ok {
 				// The hub closed the channel.
-				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+				c.Conn.WriteMessage(websocket.CloseMessage, c.closeFrame())
 				return
 			}
 
+			message, err := codec.Marshal(event)
+			if err != nil {
+				log.Printf("Error encoding %s event: %v", event.EventType(), err)
+				c.recordDroppedFrame()
+				continue
+			}
+
+			if codec.FrameType() == websocket.BinaryMessage {
+				if err := c.Conn.WriteMessage(websocket.BinaryMessage, message); err != nil {
+					return
+				}
+				c.counters.bytesOut.Add(int64(len(message)))
+				continue
+			}
+
 			w, err := c.Conn.NextWriter(websocket.TextMessage)
 			if err != nil {
 				return
 			}
 			w.Write(message)
+			written := len(message)
 
 			// Add queued chat messages to the current websocket message.
 			n := len(c.Send)
 			for i := 0; i < n; i++ {
+				next, ok := <-c.Send
+				if !ok {
+					break
+				}
+				queued, err := codec.Marshal(next)
+				if err != nil {
+					log.Printf("Error encoding %s event: %v", next.EventType(), err)
+					c.recordDroppedFrame()
+					continue
+				}
 				w.Write(newline)
-				w.Write(<-c.Send)
+				w.Write(queued)
+				written += len(newline) + len(queued)
 			}
 
 			if err := w.Close(); err != nil {
 				return
 			}
+			c.counters.bytesOut.Add(int64(written))
+		case <-c.spoolReady:
+			// Spooled frames come after everything already in the queue.
+			if len(c.Send) > 0 {
+				select {
+				case c.spoolReady <- struct{}{}:
+				default:
+				}
+				continue
+			}
+			c.Conn.SetWriteDeadline(time.Now().Add(limits.WriteWait))
+			for _, frame := range c.drainSpool() {
+				if err := c.Conn.WriteMessage(codec.FrameType(), frame); err != nil {
+					return
+				}
+				c.counters.bytesOut.Add(int64(len(frame)))
+			}
 		case <-ticker.C:
-			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.Conn.SetWriteDeadline(time.Now().Add(limits.WriteWait))
 			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
 		}
 	}
 }
+
+// closeFrame is the close message sent once the hub closes the queue.
+func (c *Client) closeFrame() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.restarting {
+		return websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server shutting down")
+	}
+	return []byte{}
+}
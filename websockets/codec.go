@@ -0,0 +1,74 @@
+package websockets
+
+import (
+	"encoding/json"
+
+	"github.com/gorilla/websocket"
+	"github.com/ugorji/go/codec"
+)
+
+const (
+	// JSONSubprotocol is the default wire format.
+	JSONSubprotocol = "chat.json.v1"
+
+	// MsgpackSubprotocol is the compact binary wire format for mobile clients.
+	MsgpackSubprotocol = "chat.msgpack.v1"
+)
+
+// Subprotocols lists the supported subprotocols in server preference order.
+// Clients that do not request a subprotocol get JSON.
+var Subprotocols = []string{JSONSubprotocol, MsgpackSubprotocol}
+
+// Codec encodes outbound events and decodes inbound commands for one connection.
+type Codec interface {
+	// Subprotocol is the Sec-WebSocket-Protocol value the codec answers to.
+	Subprotocol() string
+	// FrameType is websocket.TextMessage or websocket.BinaryMessage.
+	FrameType() int
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// CodecFor returns the codec for a negotiated subprotocol, defaulting to JSON.
+func CodecFor(subprotocol string) Codec {
+	switch subprotocol {
+	case MsgpackSubprotocol:
+		return MsgpackCodec{}
+	default:
+		return JSONCodec{}
+	}
+}
+
+// JSONCodec encodes frames as JSON text messages.
+type JSONCodec struct{}
+
+func (JSONCodec) Subprotocol() string { return JSONSubprotocol }
+func (JSONCodec) FrameType() int      { return websocket.TextMessage }
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// msgpackHandle uses the json struct tags, so events share one schema across codecs.
+var msgpackHandle = func() *codec.MsgpackHandle {
+	h := &codec.MsgpackHandle{}
+	h.WriteExt = true    // str8 and bin types, as expected by current msgpack libraries
+	h.RawToString = true // decode raw bytes into string fields
+	return h
+}()
+
+// MsgpackCodec encodes frames as MessagePack binary messages.
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) Subprotocol() string { return MsgpackSubprotocol }
+func (MsgpackCodec) FrameType() int      { return websocket.BinaryMessage }
+
+func (MsgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var out []byte
+	err := codec.NewEncoderBytes(&out, msgpackHandle).Encode(v)
+	return out, err
+}
+
+func (MsgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return codec.NewDecoderBytes(data, msgpackHandle).Decode(v)
+}
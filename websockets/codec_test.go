@@ -0,0 +1,116 @@
+package websockets
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	event := &NewMessageEvent{
+		Type:           "new_message",
+		Envelope:       Envelope{SenderID: "u1", GroupID: "g1"},
+		SenderUsername: "alice",
+		Content:        "hello",
+		MessageID:      "m1",
+		ReplyToMessage: &ReplyPreview{ID: "m0", Content: "hi", SenderID: "u2"},
+		FileSize:       42,
+	}
+
+	for _, codec := range []Codec{JSONCodec{}, MsgpackCodec{}} {
+		t.Run(codec.Subprotocol(), func(t *testing.T) {
+			data, err := codec.Marshal(event)
+			if err != nil {
+				t.Fatalf("Marshal failed: %v", err)
+			}
+			var decoded NewMessageEvent
+			if err := codec.Unmarshal(data, &decoded); err != nil {
+				t.Fatalf("Unmarshal failed: %v", err)
+			}
+			if decoded.Type != event.Type || decoded.SenderID != "u1" || decoded.GroupID != "g1" ||
+				decoded.Content != "hello" || decoded.FileSize != 42 || decoded.ReplyToMessage == nil ||
+				decoded.ReplyToMessage.ID != "m0" {
+				t.Errorf("Decoded event mismatch: %+v", decoded)
+			}
+
+			// Inbound commands decode with the same codec.
+			var cmd WebSocketMessage
+			if err := codec.Unmarshal(data, &cmd); err != nil {
+				t.Fatalf("Unmarshal into WebSocketMessage failed: %v", err)
+			}
+			if cmd.Type != "new_message" || cmd.GroupID != "g1" {
+				t.Errorf("Decoded command mismatch: %+v", cmd)
+			}
+		})
+	}
+
+	jsonData, _ := JSONCodec{}.Marshal(event)
+	msgpackData, _ := MsgpackCodec{}.Marshal(event)
+	t.Logf("JSON size: %d bytes, MessagePack size: %d bytes", len(jsonData), len(msgpackData))
+}
+
+func TestCodecFor(t *testing.T) {
+	cases := map[string]string{
+		"":                 JSONSubprotocol,
+		JSONSubprotocol:    JSONSubprotocol,
+		MsgpackSubprotocol: MsgpackSubprotocol,
+		"unknown":          JSONSubprotocol,
+	}
+	for subprotocol, want := range cases {
+		if got := CodecFor(subprotocol).Subprotocol(); got != want {
+			t.Errorf("CodecFor(%q) = %q, want %q", subprotocol, got, want)
+		}
+	}
+}
+
+func TestWritePumpUsesNegotiatedCodec(t *testing.T) {
+	upgrader := websocket.Upgrader{Subprotocols: Subprotocols}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Upgrade failed: %v", err)
+			return
+		}
+		client := &Client{Conn: conn, Send: make(chan Event, 1), Codec: CodecFor(conn.Subprotocol())}
+		client.Send <- NewStatusEvent("online_status", "u1")
+		close(client.Send)
+		client.WritePump()
+	}))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	for _, subprotocol := range []string{"", MsgpackSubprotocol} {
+		t.Run("subprotocol="+subprotocol, func(t *testing.T) {
+			dialer := websocket.Dialer{}
+			if subprotocol != "" {
+				dialer.Subprotocols = []string{subprotocol}
+			}
+			conn, _, err := dialer.Dial(url, nil)
+			if err != nil {
+				t.Fatalf("Dial failed: %v", err)
+			}
+			defer conn.Close()
+
+			codec := CodecFor(conn.Subprotocol())
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			frameType, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("Read failed: %v", err)
+			}
+			if frameType != codec.FrameType() {
+				t.Errorf("Frame type = %d, want %d", frameType, codec.FrameType())
+			}
+			var status StatusEvent
+			if err := codec.Unmarshal(data, &status); err != nil {
+				t.Fatalf("Unmarshal failed: %v", err)
+			}
+			if status.Type != "online_status" || status.UserID != "u1" {
+				t.Errorf("Unexpected event: %+v", status)
+			}
+		})
+	}
+}
@@ -0,0 +1,309 @@
+package websockets
+
+import (
+	"errors"
+	"log"
+	"my-chat-app/models"
+	"time"
+)
+
+// Error codes sent in error events.
+const (
+	ErrCodeBadRequest     = "bad_request"
+	ErrCodeUnknownCommand = "unknown_command"
+	ErrCodeForbidden      = "forbidden"
+	ErrCodeTooLarge       = "too_large"
+	ErrCodeUnavailable    = "unavailable"
+	ErrCodeFailed         = "failed"
+)
+
+const (
+	// Longest custom status accepted by set_presence.
+	maxStatusTextLength = 128
+
+	// How long a verified conversation access is trusted before checking again.
+	accessCacheTTL = time.Minute
+)
+
+// CommandError is a command failure reported to the client with a stable code.
+type CommandError struct {
+	Code    string
+	Message string
+}
+
+func (e *CommandError) Error() string { return e.Message }
+
+// NewCommandError creates a CommandError.
+func NewCommandError(code, message string) *CommandError {
+	return &CommandError{Code: code, Message: message}
+}
+
+// Commands holds what ReadPump needs to execute inbound commands.
+type Commands struct {
+	Saver     MessageSaver
+	Publisher MessagePublisher
+	Access    ConversationAccess
+	Calls     CallSignaler
+	AI        AIControls
+}
+
+// reply sends the outcome of a command back to the client: an ack when it
+// succeeded and carried a request_id, an error event otherwise.
+func (c *Client) reply(requestID string, err error) {
+	if err == nil {
+		if requestID != "" {
+			c.Hub.Deliver(c, &AckEvent{Type: "ack", RequestID: requestID})
+		}
+		return
+	}
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		cmdErr = NewCommandError(ErrCodeFailed, err.Error())
+	}
+	c.Hub.Deliver(c, &ErrorEvent{Type: "error", RequestID: requestID, Code: cmdErr.Code, Message: cmdErr.Message})
+}
+
+// ack confirms a command that succeeded. A new_message carrying a
+// client_message_id is acked with its canonical server message ID.
+func (c *Client) ack(msg WebSocketMessage) {
+	if msg.RequestID == "" {
+		return
+	}
+	ack := &AckEvent{Type: "ack", RequestID: msg.RequestID}
+	if msg.Type == "new_message" && msg.ClientMessageID != "" {
+		ack.MessageID = models.ClientMessageUUID(c.UserID, msg.ClientMessageID).String()
+	}
+	c.Hub.Deliver(c, ack)
+}
+
+// handleCommand executes one inbound command for the client's user.
+func (c *Client) handleCommand(cmds Commands, msg WebSocketMessage) error {
+	switch msg.Type {
+	case "new_message":
+		c.markActive()
+		if cmds.Publisher == nil {
+			return NewCommandError(ErrCodeUnavailable, "Sending messages over the socket is not available")
+		}
+		// The sender is always the authenticated user.
+		msg.SenderID = c.UserID
+		if err := c.requireAccess(cmds, msg.ReceiverID, msg.GroupID); err != nil {
+			return err
+		}
+		// The consumer saves and broadcasts the message.
+		return cmds.Publisher.PublishMessage(msg)
+
+	case "typing", "stop_typing":
+		c.markActive()
+		if !c.allowTyping(msg.Type, msg.ReceiverID, msg.GroupID) {
+			break
+		}
+		if err := c.requireAccess(cmds, msg.ReceiverID, msg.GroupID); err != nil {
+			return err
+		}
+		c.Hub.Broadcast <- &TypingEvent{
+			Type:     msg.Type,
+			Envelope: Envelope{SenderID: c.UserID, ReceiverID: msg.ReceiverID, GroupID: msg.GroupID},
+		}
+
+	case "online_status", "offline_status", "heartbeat":
+		// Presence follows connections; heartbeats are sent while the user
+		// is active and silence means idle.
+		c.markActive()
+
+	case "set_presence":
+		if c.Hub.Presence == nil {
+			return NewCommandError(ErrCodeUnavailable, "Presence is not available")
+		}
+		if len(msg.StatusText) > maxStatusTextLength {
+			return NewCommandError(ErrCodeTooLarge, "status_text is too long")
+		}
+		var expiresAt time.Time
+		if msg.StatusExpiresIn > 0 {
+			expiresAt = time.Now().Add(time.Duration(msg.StatusExpiresIn) * time.Second)
+		}
+		err := c.Hub.Presence.SetStatus(c.UserID, PresenceState(msg.State), msg.StatusText, msg.StatusEmoji, expiresAt)
+		if errors.Is(err, ErrInvalidPresence) {
+			return NewCommandError(ErrCodeBadRequest, "state must be online, away, dnd or invisible")
+		}
+		return err
+
+	case "call_offer", "call_answer", "ice_candidate", "call_hangup", "call_ringing":
+		if cmds.Calls == nil {
+			return NewCommandError(ErrCodeUnavailable, "Calls are not available")
+		}
+		c.markActive()
+		return cmds.Calls.Signal(c.UserID, msg)
+
+	case "ephemeral":
+		if c.Hub.Ephemeral == nil {
+			return NewCommandError(ErrCodeUnavailable, "Ephemeral events are not available")
+		}
+		if err := c.requireAccess(cmds, msg.ReceiverID, msg.GroupID); err != nil {
+			return err
+		}
+		return c.Hub.Ephemeral.Publish(c.UserID, msg)
+
+	case "ephemeral_sync":
+		// Send the conversation's live sessions to a client that just opened it.
+		if c.Hub.Ephemeral == nil {
+			return NewCommandError(ErrCodeUnavailable, "Ephemeral events are not available")
+		}
+		if err := c.requireAccess(cmds, msg.ReceiverID, msg.GroupID); err != nil {
+			return err
+		}
+		for _, event := range c.Hub.Ephemeral.Sessions(c.UserID, msg.ReceiverID, msg.GroupID) {
+			c.Hub.Deliver(c, event)
+		}
+
+	case "subscribe":
+		if len(msg.Topics) == 0 {
+			return NewCommandError(ErrCodeBadRequest, "topics is required")
+		}
+		if err := c.Subscribe(msg.Topics); err != nil {
+			return NewCommandError(ErrCodeBadRequest, err.Error())
+		}
+
+	case "unsubscribe":
+		c.Unsubscribe(msg.Topics)
+
+	case "cancel_generation":
+		if msg.MessageID == "" {
+			return NewCommandError(ErrCodeBadRequest, "message_id is required")
+		}
+		if cmds.AI == nil {
+			return NewCommandError(ErrCodeUnavailable, "AI replies are not available")
+		}
+		return cmds.AI.CancelGeneration(c.UserID, msg.MessageID)
+
+	case "reset_ai_memory":
+		if err := c.requireAccess(cmds, msg.ReceiverID, msg.GroupID); err != nil {
+			return err
+		}
+		if cmds.AI == nil {
+			return NewCommandError(ErrCodeUnavailable, "AI replies are not available")
+		}
+		return cmds.AI.ResetAIMemory(c.UserID, msg.ReceiverID, msg.GroupID)
+
+	case "read_message":
+		if msg.MessageID == "" {
+			return NewCommandError(ErrCodeBadRequest, "message_id is required")
+		}
+		if cmds.Saver == nil {
+			return NewCommandError(ErrCodeUnavailable, "Read receipts are not available")
+		}
+		// The chat service sends the receipt to the message's conversation.
+		return cmds.Saver.MarkRead(msg.MessageID, c.UserID)
+
+	case "join_group":
+		if msg.GroupID == "" {
+			return NewCommandError(ErrCodeBadRequest, "group_id is required")
+		}
+		if err := c.requireAccess(cmds, "", msg.GroupID); err != nil {
+			return err
+		}
+		c.Hub.AddClientToGroup(c.UserID, msg.GroupID)
+		log.Printf("Client %s joined group %s", c.UserID, msg.GroupID)
+
+	case "leave_group":
+		if msg.GroupID == "" {
+			return NewCommandError(ErrCodeBadRequest, "group_id is required")
+		}
+		c.Hub.RemoveClientFromGroup(c.UserID, msg.GroupID)
+
+	case "reaction", "remove_reaction":
+		if msg.MessageID == "" || msg.Emoji == "" {
+			return NewCommandError(ErrCodeBadRequest, "message_id and emoji are required")
+		}
+		if cmds.Saver == nil {
+			return NewCommandError(ErrCodeUnavailable, "Reactions are not available")
+		}
+		// The chat service broadcasts the reaction update.
+		if msg.Type == "reaction" {
+			return cmds.Saver.AddReaction(msg.MessageID, c.UserID, msg.Emoji)
+		}
+		return cmds.Saver.RemoveReaction(msg.MessageID, c.UserID, msg.Emoji)
+
+	case "message_status":
+		if msg.MessageID == "" || msg.Status == "" {
+			return NewCommandError(ErrCodeBadRequest, "message_id and status are required")
+		}
+		if cmds.Saver == nil {
+			return NewCommandError(ErrCodeUnavailable, "Message status is not available")
+		}
+		// The chat service sends the update to the message's conversation.
+		return cmds.Saver.UpdateMessageStatus(msg.MessageID, c.UserID, msg.Status)
+
+	default:
+		return NewCommandError(ErrCodeUnknownCommand, "Unknown command type: "+msg.Type)
+	}
+	return nil
+}
+
+// markActive counts the command as user activity for idle detection.
+func (c *Client) markActive() {
+	if c.Hub.Presence != nil {
+		c.Hub.Presence.Heartbeat(c.UserID)
+	}
+}
+
+// requireAccess fails unless the client's user takes part in the conversation
+// with receiverID or groupID. Exactly one of them must be set.
+func (c *Client) requireAccess(cmds Commands, receiverID, groupID string) error {
+	if (receiverID == "") == (groupID == "") {
+		return NewCommandError(ErrCodeBadRequest, "Specify either receiver_id or group_id, not both")
+	}
+	if cmds.Access == nil {
+		return nil
+	}
+	key := "user:" + receiverID
+	if groupID != "" {
+		key = "group:" + groupID
+	}
+	if checked, ok := c.accessChecked[key]; ok && time.Since(checked) < accessCacheTTL {
+		return nil
+	}
+	var allowed bool
+	var err error
+	if groupID != "" {
+		allowed, err = cmds.Access.IsGroupMember(groupID, c.UserID)
+	} else {
+		allowed, err = cmds.Access.CanMessageUser(c.UserID, receiverID)
+	}
+	if err != nil {
+		log.Printf("Error checking access of %s to conversation %s%s: %v", c.UserID, receiverID, groupID, err)
+		return NewCommandError(ErrCodeFailed, "Could not verify conversation access")
+	}
+	if !allowed {
+		if groupID != "" {
+			return NewCommandError(ErrCodeForbidden, "Not a member of this group")
+		}
+		return NewCommandError(ErrCodeForbidden, "Cannot message this user")
+	}
+	if c.accessChecked == nil {
+		c.accessChecked = make(map[string]time.Time)
+	}
+	c.accessChecked[key] = time.Now()
+	return nil
+}
+
+// allowTyping throttles typing indicators to one per conversation per
+// TypingThrottle. stop_typing always passes and resets the throttle.
+func (c *Client) allowTyping(eventType, receiverID, groupID string) bool {
+	key := "user:" + receiverID
+	if groupID != "" {
+		key = "group:" + groupID
+	}
+	if eventType == "stop_typing" {
+		delete(c.typingSent, key)
+		return true
+	}
+	now := time.Now()
+	if last, ok := c.typingSent[key]; ok && now.Sub(last) < c.Limits.withDefaults().TypingThrottle {
+		return false
+	}
+	if c.typingSent == nil {
+		c.typingSent = make(map[string]time.Time)
+	}
+	c.typingSent[key] = now
+	return true
+}
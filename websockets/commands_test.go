@@ -0,0 +1,173 @@
+package websockets
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type fakePublisher struct {
+	published chan WebSocketMessage
+}
+
+func (p *fakePublisher) PublishMessage(msg WebSocketMessage) error {
+	p.published <- msg
+	return nil
+}
+
+// fakeAccess allows the listed groups and receivers.
+type fakeAccess map[string]bool
+
+func (a fakeAccess) IsGroupMember(groupID, userID string) (bool, error) {
+	return a[groupID], nil
+}
+
+func (a fakeAccess) CanMessageUser(senderID, receiverID string) (bool, error) {
+	return a[receiverID], nil
+}
+
+type fakeSaver struct{ MessageSaver }
+
+func (fakeSaver) AddReaction(messageID, userID, emoji string) error {
+	return errors.New("message not found")
+}
+
+func TestReadPumpRepliesToCommands(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	publisher := &fakePublisher{published: make(chan WebSocketMessage, 1)}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Upgrade failed: %v", err)
+			return
+		}
+		client := NewClient(hub, conn, "u1", Limits{})
+		hub.Register <- client
+		go client.WritePump()
+		client.ReadPump(Commands{Saver: fakeSaver{}, Publisher: publisher, Access: fakeAccess{"g1": true, "u2": true}})
+	}))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	// replyFor reads frames until the ack or error for requestID arrives.
+	replyFor := func(requestID string) ErrorEvent {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("Read failed waiting for %q: %v", requestID, err)
+			}
+			for _, frame := range strings.Split(string(data), "\n") {
+				var reply ErrorEvent
+				json.Unmarshal([]byte(frame), &reply)
+				if (reply.Type == "ack" || reply.Type == "error") && reply.RequestID == requestID {
+					return reply
+				}
+			}
+		}
+	}
+
+	cases := []struct {
+		name     string
+		frame    string
+		wantType string
+		wantCode string
+	}{
+		{"join own group", `{"type":"join_group","request_id":"r1","group_id":"g1"}`, "ack", ""},
+		{"join other group", `{"type":"join_group","request_id":"r2","group_id":"g2"}`, "error", ErrCodeForbidden},
+		{"unknown command", `{"type":"teleport","request_id":"r3"}`, "error", ErrCodeUnknownCommand},
+		{"missing fields", `{"type":"reaction","request_id":"r4"}`, "error", ErrCodeBadRequest},
+		{"service failure", `{"type":"reaction","request_id":"r5","message_id":"m1","emoji":"👍"}`, "error", ErrCodeFailed},
+		{"malformed frame", `{"type":`, "error", ErrCodeBadRequest},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(tc.frame)); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			requestID := ""
+			var probe WebSocketMessage
+			if json.Unmarshal([]byte(tc.frame), &probe) == nil {
+				requestID = probe.RequestID
+			}
+			reply := replyFor(requestID)
+			if reply.Type != tc.wantType || reply.Code != tc.wantCode {
+				t.Errorf("reply = %+v, want type %q code %q", reply, tc.wantType, tc.wantCode)
+			}
+		})
+	}
+
+	t.Run("new_message is published as the connected user", func(t *testing.T) {
+		frame := `{"type":"new_message","request_id":"r6","sender_id":"someone-else","receiver_id":"u2","content":"hi"}`
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if reply := replyFor("r6"); reply.Type != "ack" {
+			t.Fatalf("reply = %+v, want ack", reply)
+		}
+		msg := <-publisher.published
+		if msg.SenderID != "u1" || msg.ReceiverID != "u2" || msg.Content != "hi" {
+			t.Errorf("published %+v", msg)
+		}
+	})
+
+	t.Run("typing is stamped, scoped and throttled", func(t *testing.T) {
+		receiver := newTestClient(8)
+		receiver.UserID = "u2"
+		hub.Register <- receiver
+
+		frames := []string{
+			`{"type":"typing","request_id":"t1","sender_id":"spoofed","receiver_id":"u2"}`,
+			`{"type":"typing","request_id":"t2","receiver_id":"u2"}`, // Throttled
+			`{"type":"stop_typing","request_id":"t3","receiver_id":"u2"}`,
+		}
+		for i, frame := range frames {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+			if reply := replyFor(fmt.Sprintf("t%d", i+1)); reply.Type != "ack" {
+				t.Fatalf("reply = %+v, want ack", reply)
+			}
+		}
+		var got []string
+	collect:
+		for {
+			select {
+			case event := <-receiver.Send:
+				typing := event.(*TypingEvent)
+				if typing.SenderID != "u1" {
+					t.Errorf("typing sender = %q, want u1", typing.SenderID)
+				}
+				got = append(got, typing.Type)
+			case <-time.After(100 * time.Millisecond):
+				break collect
+			}
+		}
+		if len(got) != 2 || got[0] != "typing" || got[1] != "stop_typing" {
+			t.Errorf("receiver got %v, want [typing stop_typing]", got)
+		}
+
+		frame := `{"type":"typing","request_id":"t4","receiver_id":"u3"}`
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if reply := replyFor("t4"); reply.Code != ErrCodeForbidden {
+			t.Errorf("reply = %+v, want forbidden", reply)
+		}
+	})
+}
@@ -0,0 +1,127 @@
+package websockets
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// typicalEvents is a mix of frames a chat client receives in a busy group.
+var typicalEvents = []Event{
+	&NewMessageEvent{
+		Type:           "new_message",
+		Envelope:       Envelope{SenderID: "7f9c2ba4-e88f-4f4a-9d1a-3c1f8f6d2b11", GroupID: "c56a4180-65aa-42ec-a945-5fd21dec0538"},
+		SenderUsername: "alice",
+		Content:        "Hey everyone, the deploy finished. Can someone check the dashboard?",
+		MessageID:      "3e1b6f0a-2d4c-4f7e-8a9b-1c2d3e4f5a6b",
+		CreatedAt:      "2025-03-01 10:15:42",
+	},
+	&TypingEvent{Type: "typing", Envelope: Envelope{SenderID: "0b7e4f2a-9c1d-4e8f-a2b3-c4d5e6f7a8b9", GroupID: "c56a4180-65aa-42ec-a945-5fd21dec0538"}},
+	&NewMessageEvent{
+		Type:             "new_message",
+		Envelope:         Envelope{SenderID: "0b7e4f2a-9c1d-4e8f-a2b3-c4d5e6f7a8b9", GroupID: "c56a4180-65aa-42ec-a945-5fd21dec0538"},
+		SenderUsername:   "bob",
+		Content:          "Looks good on my side, latency is back to normal.",
+		MessageID:        "9a8b7c6d-5e4f-4a3b-2c1d-0e9f8a7b6c5d",
+		CreatedAt:        "2025-03-01 10:16:03",
+		ReplyToMessageID: "3e1b6f0a-2d4c-4f7e-8a9b-1c2d3e4f5a6b",
+		ReplyToMessage: &ReplyPreview{
+			ID:       "3e1b6f0a-2d4c-4f7e-8a9b-1c2d3e4f5a6b",
+			Content:  "Hey everyone, the deploy finished. Can someone check the dashboard?",
+			SenderID: "7f9c2ba4-e88f-4f4a-9d1a-3c1f8f6d2b11",
+		},
+	},
+	&ReactionEvent{
+		Type:      "reaction_added",
+		Envelope:  Envelope{GroupID: "c56a4180-65aa-42ec-a945-5fd21dec0538"},
+		MessageID: "9a8b7c6d-5e4f-4a3b-2c1d-0e9f8a7b6c5d",
+		UserID:    "7f9c2ba4-e88f-4f4a-9d1a-3c1f8f6d2b11",
+		Emoji:     "👍",
+	},
+	NewStatusEvent("online_status", "5d4c3b2a-1f0e-4d9c-8b7a-6f5e4d3c2b1a"),
+}
+
+type countingConn struct {
+	net.Conn
+	read *atomic.Int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+// BenchmarkWireBytes reports bytes on the wire per event for each codec,
+// with and without permessage-deflate.
+func BenchmarkWireBytes(b *testing.B) {
+	for _, bc := range []struct {
+		name        string
+		subprotocol string
+		compression bool
+	}{
+		{"json", JSONSubprotocol, false},
+		{"json+deflate", JSONSubprotocol, true},
+		{"msgpack", MsgpackSubprotocol, false},
+		{"msgpack+deflate", MsgpackSubprotocol, true},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			events := make(chan Event, 64)
+			upgrader := websocket.Upgrader{Subprotocols: Subprotocols, EnableCompression: bc.compression}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				conn, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					b.Errorf("Upgrade failed: %v", err)
+					return
+				}
+				client := NewClient(nil, conn, "bench", Limits{})
+				client.Send = events
+				client.WritePump()
+			}))
+			defer server.Close()
+
+			var wire atomic.Int64
+			dialer := websocket.Dialer{
+				Subprotocols:      []string{bc.subprotocol},
+				EnableCompression: bc.compression,
+				NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+					if err != nil {
+						return nil, err
+					}
+					return countingConn{Conn: conn, read: &wire}, nil
+				},
+			}
+			conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+			if err != nil {
+				b.Fatalf("Dial failed: %v", err)
+			}
+			defer conn.Close()
+			wire.Store(0)
+
+			// Events are sent one at a time, as in a live conversation, so
+			// WritePump does not batch them into a single frame.
+			b.ResetTimer()
+			var payload int64
+			for i := 0; i < b.N; i++ {
+				events <- typicalEvents[i%len(typicalEvents)]
+				_, data, err := conn.ReadMessage()
+				if err != nil {
+					b.Fatalf("Read failed: %v", err)
+				}
+				payload += int64(len(data))
+			}
+			b.StopTimer()
+			close(events)
+
+			b.ReportMetric(float64(wire.Load())/float64(b.N), "wire-B/event")
+			b.ReportMetric(float64(payload)/float64(b.N), "payload-B/event")
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package websockets
+
+import (
+	"log"
+	"my-chat-app/config"
+)
+
+// BackpressurePolicy decides what happens when a client's Send queue is full.
+type BackpressurePolicy string
+
+const (
+	// DropOldest discards the oldest queued event to make room.
+	DropOldest BackpressurePolicy = "drop_oldest"
+	// DropNewest discards the event being delivered.
+	DropNewest BackpressurePolicy = "drop_newest"
+	// Disconnect drops the event and closes the connection after MaxDrops drops.
+	Disconnect BackpressurePolicy = "disconnect"
+	// BufferToDisk spools overflow to a per-connection file, falling back to
+	// Disconnect once the spool is full.
+	BufferToDisk BackpressurePolicy = "buffer_to_disk"
+)
+
+// Delivery outcomes recorded in the delivery metric.
+const (
+	outcomeDelivered     = "delivered"
+	outcomeDroppedOldest = "dropped_oldest"
+	outcomeDroppedNewest = "dropped_newest"
+	outcomeSpooled       = "spooled"
+	outcomeDisconnected  = "disconnected"
+	outcomeClosed        = "closed"
+)
+
+// Backpressure configures how the hub treats slow consumers.
+type Backpressure struct {
+	Policy        BackpressurePolicy
+	MaxDrops      int    // Drops tolerated before disconnecting (Disconnect policy)
+	SpoolDir      string // Directory for BufferToDisk spool files
+	SpoolMaxBytes int64  // Per-connection spool size limit
+}
+
+// BackpressureFromConfig reads the slow-consumer policy from the application config.
+func BackpressureFromConfig(cfg config.Config) Backpressure {
+	return Backpressure{
+		Policy:        BackpressurePolicy(cfg.WSBackpressurePolicy),
+		MaxDrops:      cfg.WSMaxDrops,
+		SpoolDir:      cfg.WSSpoolDir,
+		SpoolMaxBytes: cfg.WSSpoolMaxBytes,
+	}.withDefaults()
+}
+
+func (b Backpressure) withDefaults() Backpressure {
+	switch b.Policy {
+	case DropOldest, DropNewest, Disconnect, BufferToDisk:
+	default:
+		b.Policy = Disconnect
+	}
+	if b.MaxDrops <= 0 {
+		b.MaxDrops = 1
+	}
+	if b.SpoolMaxBytes <= 0 {
+		b.SpoolMaxBytes = 1 << 20 // 1MB
+	}
+	return b
+}
+
+// Deliver queues event for client without ever blocking the caller, applying
+// the hub's backpressure policy when the queue is full. It is the only place
+// that writes to Client.Send, and together with Client.closeSend the only
+// place that closes it, so it is safe to call from any goroutine.
+func (h *Hub) Deliver(client *Client, event Event) {
+	policy := h.Backpressure.withDefaults()
+	outcome := client.enqueue(event, policy)
+	if h.DeliveryMetric != nil {
+		h.DeliveryMetric.WithLabelValues(string(policy.Policy), outcome).Inc()
+	}
+	if outcome == outcomeDisconnected {
+		log.Printf("Disconnecting slow client %s (%s)", client.UserID, policy.Policy)
+	}
+}
+
+func (c *Client) enqueue(event Event, policy Backpressure) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return outcomeClosed
+	}
+
+	// Once spooling has started, keep appending so events stay in order.
+	if c.spool != nil && !c.spool.empty() {
+		return c.spoolLocked(event, policy)
+	}
+
+	select {
+	case c.Send <- event:
+		c.drops = 0
+		return outcomeDelivered
+	default:
+	}
+
+	if policy.Policy == BufferToDisk {
+		return c.spoolLocked(event, policy)
+	}
+
+	c.counters.dropped.Add(1)
+	switch policy.Policy {
+	case DropOldest:
+		select {
+		case <-c.Send:
+		default:
+		}
+		select {
+		case c.Send <- event:
+		default:
+		}
+		return outcomeDroppedOldest
+	case DropNewest:
+		return outcomeDroppedNewest
+	default:
+		c.drops++
+		if c.drops >= policy.MaxDrops {
+			c.closeSendLocked()
+			return outcomeDisconnected
+		}
+		return outcomeDroppedNewest
+	}
+}
+
+func (c *Client) spoolLocked(event Event, policy Backpressure) string {
+	if c.spool == nil {
+		spool, err := newSpool(policy.SpoolDir, c.UserID)
+		if err != nil {
+			log.Printf("Error creating spool for %s: %v", c.UserID, err)
+			c.counters.dropped.Add(1)
+			c.closeSendLocked()
+			return outcomeDisconnected
+		}
+		c.spool = spool
+	}
+	frame, err := c.codec().Marshal(event)
+	if err == nil {
+		err = c.spool.append(frame, policy.SpoolMaxBytes)
+	}
+	if err != nil {
+		log.Printf("Error spooling event for %s: %v", c.UserID, err)
+		c.counters.dropped.Add(1)
+		c.closeSendLocked()
+		return outcomeDisconnected
+	}
+	select {
+	case c.spoolReady <- struct{}{}:
+	default:
+	}
+	return outcomeSpooled
+}
+
+// closeSend closes the Send channel once; WritePump then closes the connection.
+func (c *Client) closeSend() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeSendLocked()
+}
+
+func (c *Client) closeSendLocked() {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.Send)
+	if c.spool != nil {
+		c.spool.remove()
+	}
+}
+
+// drainSpool returns the spooled frames once the in-memory queue has been written.
+func (c *Client) drainSpool() [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.spool == nil || c.closed {
+		return nil
+	}
+	frames, err := c.spool.drain()
+	if err != nil {
+		log.Printf("Error reading spool for %s: %v", c.UserID, err)
+	}
+	return frames
+}
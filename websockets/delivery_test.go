@@ -0,0 +1,119 @@
+package websockets
+
+import (
+	"sync"
+	"testing"
+)
+
+func newTestClient(capacity int) *Client {
+	return &Client{
+		UserID:     "u1",
+		Send:       make(chan Event, capacity),
+		spoolReady: make(chan struct{}, 1),
+	}
+}
+
+func drain(c *Client) []string {
+	var ids []string
+	for {
+		select {
+		case event, ok := <-c.Send:
+			if !ok {
+				return ids
+			}
+			ids = append(ids, event.(*StatusEvent).UserID)
+		default:
+			return ids
+		}
+	}
+}
+
+func TestDeliverPolicies(t *testing.T) {
+	cases := []struct {
+		policy     BackpressurePolicy
+		wantQueued []string
+		wantClosed bool
+	}{
+		{DropOldest, []string{"b", "c"}, false},
+		{DropNewest, []string{"a", "b"}, false},
+		{Disconnect, []string{"a", "b"}, true},
+	}
+	for _, tc := range cases {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			hub := NewHub()
+			hub.Backpressure = Backpressure{Policy: tc.policy}
+			client := newTestClient(2)
+			for _, id := range []string{"a", "b", "c"} {
+				hub.Deliver(client, NewStatusEvent("online_status", id))
+			}
+			if client.closed != tc.wantClosed {
+				t.Errorf("closed = %v, want %v", client.closed, tc.wantClosed)
+			}
+			got := drain(client)
+			if len(got) != len(tc.wantQueued) || got[0] != tc.wantQueued[0] || got[1] != tc.wantQueued[1] {
+				t.Errorf("queued = %v, want %v", got, tc.wantQueued)
+			}
+			if dropped := client.Stats().DroppedFrames; dropped != 1 {
+				t.Errorf("dropped frames = %d, want 1", dropped)
+			}
+		})
+	}
+}
+
+func TestDeliverBufferToDisk(t *testing.T) {
+	hub := NewHub()
+	hub.Backpressure = Backpressure{Policy: BufferToDisk, SpoolDir: t.TempDir()}
+	client := newTestClient(1)
+	for _, id := range []string{"a", "b", "c"} {
+		hub.Deliver(client, NewStatusEvent("online_status", id))
+	}
+
+	// Once spooling, new events keep going to disk to preserve order.
+	if got := drain(client); len(got) != 1 || got[0] != "a" {
+		t.Fatalf("queued = %v, want [a]", got)
+	}
+	hub.Deliver(client, NewStatusEvent("online_status", "d"))
+	if len(client.Send) != 0 {
+		t.Fatalf("event bypassed the spool")
+	}
+
+	frames := client.drainSpool()
+	var ids []string
+	for _, frame := range frames {
+		var status StatusEvent
+		if err := client.codec().Unmarshal(frame, &status); err != nil {
+			t.Fatalf("Unmarshal spooled frame failed: %v", err)
+		}
+		ids = append(ids, status.UserID)
+	}
+	if len(ids) != 3 || ids[0] != "b" || ids[1] != "c" || ids[2] != "d" {
+		t.Errorf("spooled = %v, want [b c d]", ids)
+	}
+
+	// With the spool empty, delivery goes back to the channel.
+	hub.Deliver(client, NewStatusEvent("online_status", "e"))
+	if got := drain(client); len(got) != 1 || got[0] != "e" {
+		t.Errorf("queued = %v, want [e]", got)
+	}
+	client.closeSend()
+}
+
+func TestDeliverConcurrentWithClose(t *testing.T) {
+	hub := NewHub()
+	hub.Backpressure = Backpressure{Policy: DropOldest}
+	client := newTestClient(4)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				hub.Deliver(client, NewStatusEvent("online_status", "x"))
+			}
+		}()
+	}
+	client.closeSend()
+	client.closeSend() // Closing twice must not panic
+	wg.Wait()
+}
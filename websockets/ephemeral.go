@@ -0,0 +1,253 @@
+package websockets
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// EphemeralEvent is a conversation event that is relayed but never stored in
+// the messages table: live location, cursors, "now playing" and the like.
+type EphemeralEvent struct {
+	Type string `json:"type"`
+	Envelope
+	Kind      string                 `json:"kind"`
+	Action    string                 `json:"action"` // start, update, stop
+	Data      map[string]interface{} `json:"data,omitempty"`
+	ExpiresAt *time.Time             `json:"expires_at,omitempty"`
+	Reason    string                 `json:"reason,omitempty"` // Why a session stopped: stopped, expired
+}
+
+func (e *EphemeralEvent) EventType() string { return e.Type }
+
+// EphemeralKind describes one kind of ephemeral event.
+type EphemeralKind struct {
+	Name string
+
+	// Minimum gap between events from one sender in one conversation.
+	// Faster events are dropped.
+	MinInterval time.Duration
+
+	// Session kinds are started and stopped explicitly, expire after at most
+	// MaxDuration and keep their latest event in memory for late joiners.
+	Session     bool
+	MaxDuration time.Duration
+
+	// Validate checks the event data. Nil accepts anything.
+	Validate func(data map[string]interface{}) error
+}
+
+// DefaultEphemeralKinds returns the built-in kinds: live location sharing,
+// live cursors and now playing.
+func DefaultEphemeralKinds() []EphemeralKind {
+	return []EphemeralKind{
+		{Name: "location", MinInterval: time.Second, Session: true, MaxDuration: 8 * time.Hour, Validate: validateLocation},
+		{Name: "cursor", MinInterval: 50 * time.Millisecond},
+		{Name: "now_playing", MinInterval: time.Second, Session: true, MaxDuration: time.Hour},
+	}
+}
+
+// validateLocation requires numeric lat / lng within range.
+func validateLocation(data map[string]interface{}) error {
+	lat, ok := number(data["lat"])
+	if !ok || lat < -90 || lat > 90 {
+		return fmt.Errorf("data.lat must be a latitude")
+	}
+	lng, ok := number(data["lng"])
+	if !ok || lng < -180 || lng > 180 {
+		return fmt.Errorf("data.lng must be a longitude")
+	}
+	return nil
+}
+
+// number reads a decoded JSON or MessagePack number.
+func number(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// Ephemeral routes ephemeral events to conversation members, applying each
+// kind's rate limit and tracking live sessions.
+type Ephemeral struct {
+	hub   *Hub
+	kinds map[string]EphemeralKind
+
+	mu       sync.Mutex
+	lastSent map[ephemeralKey]time.Time
+	sessions map[ephemeralKey]*ephemeralSession
+}
+
+// ephemeralKey identifies one sender's stream of one kind in one conversation.
+type ephemeralKey struct {
+	kind, senderID, receiverID, groupID string
+}
+
+type ephemeralSession struct {
+	latest *EphemeralEvent
+	timer  *time.Timer
+}
+
+// NewEphemeral creates an ephemeral event router for kinds.
+func NewEphemeral(hub *Hub, kinds []EphemeralKind) *Ephemeral {
+	e := &Ephemeral{
+		hub:      hub,
+		kinds:    make(map[string]EphemeralKind),
+		lastSent: make(map[ephemeralKey]time.Time),
+		sessions: make(map[ephemeralKey]*ephemeralSession),
+	}
+	for _, kind := range kinds {
+		e.kinds[kind.Name] = kind
+	}
+	return e
+}
+
+// Publish handles an ephemeral command from senderID, whose access to the
+// conversation has already been checked.
+func (e *Ephemeral) Publish(senderID string, msg WebSocketMessage) error {
+	kind, ok := e.kinds[msg.Kind]
+	if !ok {
+		return NewCommandError(ErrCodeBadRequest, "Unknown ephemeral kind: "+msg.Kind)
+	}
+	action := msg.Action
+	if action == "" {
+		action = "update"
+	}
+	if action != "stop" && kind.Validate != nil {
+		if err := kind.Validate(msg.Data); err != nil {
+			return NewCommandError(ErrCodeBadRequest, err.Error())
+		}
+	}
+
+	key := ephemeralKey{kind: kind.Name, senderID: senderID, receiverID: msg.ReceiverID, groupID: msg.GroupID}
+	event := &EphemeralEvent{
+		Type:     "ephemeral",
+		Envelope: Envelope{SenderID: senderID, ReceiverID: msg.ReceiverID, GroupID: msg.GroupID},
+		Kind:     kind.Name,
+		Action:   action,
+		Data:     msg.Data,
+	}
+	now := time.Now()
+
+	e.mu.Lock()
+	if !kind.Session {
+		if action != "update" {
+			e.mu.Unlock()
+			return NewCommandError(ErrCodeBadRequest, kind.Name+" events only support update")
+		}
+		if !e.allowLocked(key, kind, now) {
+			e.mu.Unlock()
+			return nil
+		}
+		e.mu.Unlock()
+		e.hub.Broadcast <- event
+		return nil
+	}
+
+	session := e.sessions[key]
+	switch action {
+	case "start":
+		duration := time.Duration(msg.Duration) * time.Second
+		if duration <= 0 || duration > kind.MaxDuration {
+			duration = kind.MaxDuration
+		}
+		expiresAt := now.Add(duration)
+		event.ExpiresAt = &expiresAt
+		if session != nil {
+			session.timer.Stop()
+		}
+		session = &ephemeralSession{latest: event}
+		session.timer = time.AfterFunc(duration, func() { e.expire(key, session) })
+		e.sessions[key] = session
+		e.lastSent[key] = now
+
+	case "update":
+		if session == nil {
+			e.mu.Unlock()
+			return NewCommandError(ErrCodeBadRequest, "No active "+kind.Name+" session; send start first")
+		}
+		event.ExpiresAt = session.latest.ExpiresAt
+		// Keep the freshest state even when the update itself is rate-limited.
+		session.latest = event
+		if !e.allowLocked(key, kind, now) {
+			e.mu.Unlock()
+			return nil
+		}
+
+	case "stop":
+		if session == nil {
+			e.mu.Unlock()
+			return nil
+		}
+		session.timer.Stop()
+		delete(e.sessions, key)
+		delete(e.lastSent, key)
+		event.Data = nil
+		event.Reason = "stopped"
+
+	default:
+		e.mu.Unlock()
+		return NewCommandError(ErrCodeBadRequest, "action must be start, update or stop")
+	}
+	e.mu.Unlock()
+
+	e.hub.Broadcast <- event
+	return nil
+}
+
+// allowLocked applies the kind's rate limit to key.
+func (e *Ephemeral) allowLocked(key ephemeralKey, kind EphemeralKind, now time.Time) bool {
+	if last, ok := e.lastSent[key]; ok && now.Sub(last) < kind.MinInterval {
+		return false
+	}
+	e.lastSent[key] = now
+	return true
+}
+
+// expire ends a session that reached its duration.
+func (e *Ephemeral) expire(key ephemeralKey, session *ephemeralSession) {
+	e.mu.Lock()
+	if e.sessions[key] != session {
+		// Restarted or stopped in the meantime.
+		e.mu.Unlock()
+		return
+	}
+	delete(e.sessions, key)
+	delete(e.lastSent, key)
+	e.mu.Unlock()
+
+	e.hub.Broadcast <- &EphemeralEvent{
+		Type:     "ephemeral",
+		Envelope: session.latest.Envelope,
+		Kind:     key.kind,
+		Action:   "stop",
+		Reason:   "expired",
+	}
+}
+
+// Sessions returns the latest event of every live session in a conversation,
+// as seen by userID: the group's sessions, or both sides of a direct chat.
+func (e *Ephemeral) Sessions(userID, receiverID, groupID string) []*EphemeralEvent {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var events []*EphemeralEvent
+	for key, session := range e.sessions {
+		switch {
+		case groupID != "" && key.groupID == groupID,
+			groupID == "" && key.senderID == userID && key.receiverID == receiverID,
+			groupID == "" && key.senderID == receiverID && key.receiverID == userID:
+			events = append(events, session.latest)
+		}
+	}
+	return events
+}
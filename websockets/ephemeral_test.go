@@ -0,0 +1,77 @@
+package websockets
+
+import (
+	"testing"
+	"time"
+)
+
+// nextEphemeral waits for the next ephemeral event delivered to client.
+func nextEphemeral(t *testing.T, client *Client) *EphemeralEvent {
+	t.Helper()
+	for {
+		select {
+		case event := <-client.Send:
+			if e, ok := event.(*EphemeralEvent); ok {
+				return e
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("No ephemeral event for %s", client.UserID)
+			return nil
+		}
+	}
+}
+
+func TestLiveLocationSession(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	member := newTestClient(16)
+	member.UserID = "u2"
+	outsider := newTestClient(16)
+	outsider.UserID = "u3"
+	hub.Register <- member
+	hub.Register <- outsider
+	hub.AddClientToGroup("u2", "g1")
+
+	kinds := DefaultEphemeralKinds()
+	kinds[0].MinInterval = time.Hour
+	kinds[0].MaxDuration = 100 * time.Millisecond
+	ephemeral := NewEphemeral(hub, kinds)
+
+	at := func(lat, lng float64) map[string]interface{} {
+		return map[string]interface{}{"lat": lat, "lng": lng}
+	}
+	start := WebSocketMessage{Kind: "location", Action: "start", GroupID: "g1", Duration: 60, Data: at(52.5, 13.4)}
+	if err := ephemeral.Publish("u1", start); err != nil {
+		t.Fatalf("start failed: %v", err)
+	}
+	got := nextEphemeral(t, member)
+	if got.Action != "start" || got.SenderID != "u1" || got.ExpiresAt == nil {
+		t.Errorf("member got %+v", got)
+	}
+
+	// Rate-limited updates are not relayed, but the latest position is kept.
+	if err := ephemeral.Publish("u1", WebSocketMessage{Kind: "location", GroupID: "g1", Data: at(52.6, 13.5)}); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	sessions := ephemeral.Sessions("u2", "", "g1")
+	if len(sessions) != 1 || sessions[0].Data["lat"] != 52.6 {
+		t.Errorf("sessions = %+v, want latest position", sessions)
+	}
+
+	if err := ephemeral.Publish("u1", WebSocketMessage{Kind: "location", GroupID: "g1", Data: at(91, 0)}); err == nil {
+		t.Errorf("out of range latitude accepted")
+	}
+
+	// The session ends on its own after its duration.
+	if got := nextEphemeral(t, member); got.Action != "stop" || got.Reason != "expired" {
+		t.Errorf("member got %+v, want expired stop", got)
+	}
+	if sessions := ephemeral.Sessions("u2", "", "g1"); len(sessions) != 0 {
+		t.Errorf("sessions after expiry = %+v", sessions)
+	}
+	select {
+	case event := <-outsider.Send:
+		t.Errorf("outsider got %+v", event)
+	default:
+	}
+}
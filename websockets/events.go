@@ -0,0 +1,191 @@
+package websockets
+
+// Event is a typed frame pushed from the server to a connected client.
+// Events are encoded per connection by the negotiated Codec in WritePump.
+type Event interface {
+	EventType() string
+}
+
+// Envelope carries the addressing used by the hub to route conversation events.
+type Envelope struct {
+	SenderID   string `json:"sender_id,omitempty"`
+	ReceiverID string `json:"receiver_id,omitempty"`
+	GroupID    string `json:"group_id,omitempty"`
+}
+
+// Route returns the addressing of the event.
+func (e Envelope) Route() Envelope { return e }
+
+// Addressees lets a conversation event name its recipients when its
+// Envelope cannot, as when the AI answers a mention in a direct message.
+// They are part of the payload, so relayed copies reach the same users.
+type Addressees struct {
+	RecipientIDs []string `json:"recipient_ids,omitempty"`
+}
+
+// Recipients lists the users the event is delivered to; none routes it by
+// its Envelope.
+func (a Addressees) Recipients() []string { return a.RecipientIDs }
+
+// Routable is implemented by events that belong to a conversation.
+type Routable interface {
+	Event
+	Route() Envelope
+}
+
+// Targeted is implemented by events delivered to an explicit list of users.
+type Targeted interface {
+	Event
+	Recipients() []string
+}
+
+// ReplyPreview is the short form of a replied-to message embedded in new_message.
+type ReplyPreview struct {
+	ID       string `json:"id"`
+	Content  string `json:"content"`
+	SenderID string `json:"sender_id"`
+}
+
+// NewMessageEvent announces a persisted chat message.
+type NewMessageEvent struct {
+	Type string `json:"type"`
+	Envelope
+	Addressees
+	SenderUsername   string        `json:"sender_username"`
+	SenderAvatarURL  string        `json:"sender_avatar_url,omitempty"` // Set for group AI personas
+	Content          string        `json:"content"`
+	MessageID        string        `json:"message_id"`
+	CreatedAt        string        `json:"created_at"`
+	ReplyToMessageID string        `json:"reply_to_message_id,omitempty"`
+	ReplyToMessage   *ReplyPreview `json:"reply_to_message,omitempty"`
+	FileName         string        `json:"file_name"`
+	FilePath         string        `json:"file_path"`
+	FileType         string        `json:"file_type"`
+	FileSize         int64         `json:"file_size"`
+	Kind             string        `json:"kind,omitempty"` // "system" for notices such as missed calls
+	ClientMessageID  string        `json:"client_message_id,omitempty"`
+	Status           string        `json:"status,omitempty"` // "streaming" for an AI reply still being generated
+}
+
+func (e *NewMessageEvent) EventType() string { return e.Type }
+
+// StatusEvent is an online_status / offline_status presence change.
+type StatusEvent struct {
+	Type   string `json:"type"`
+	UserID string `json:"user_id"`
+}
+
+func (e *StatusEvent) EventType() string { return e.Type }
+
+// TypingEvent is a typing / stop_typing indicator.
+type TypingEvent struct {
+	Type string `json:"type"`
+	Envelope
+}
+
+func (e *TypingEvent) EventType() string { return e.Type }
+
+// AITypingEvent shows or hides the AI's typing indicator while it answers
+// the message ReplyToMessageID.
+type AITypingEvent struct {
+	Type string `json:"type"` // ai_typing
+	Envelope
+	Addressees
+	ReplyToMessageID string `json:"reply_to_message_id"`
+	Username         string `json:"username"` // Of the AI or group persona typing
+	Typing           bool   `json:"typing"`
+}
+
+func (e *AITypingEvent) EventType() string { return e.Type }
+
+// AIMemoryResetEvent tells a conversation that SenderID made the AI forget
+// its messages so far.
+type AIMemoryResetEvent struct {
+	Type string `json:"type"` // ai_memory_reset
+	Envelope
+}
+
+func (e *AIMemoryResetEvent) EventType() string { return e.Type }
+
+// MessageChunkEvent carries the next piece of a message being generated.
+// Seq 0 starts the content over, as happens when generation is retried.
+type MessageChunkEvent struct {
+	Type string `json:"type"` // message_chunk
+	Envelope
+	Addressees
+	MessageID        string `json:"message_id"`
+	ReplyToMessageID string `json:"reply_to_message_id,omitempty"` // Puts the chunk in the thread's topic
+	Seq              int    `json:"seq"`
+	Delta            string `json:"delta"`
+}
+
+func (e *MessageChunkEvent) EventType() string { return e.Type }
+
+// MessageCompletedEvent carries the final content of a generated message.
+type MessageCompletedEvent struct {
+	Type string `json:"type"` // message_completed
+	Envelope
+	Addressees
+	MessageID        string `json:"message_id"`
+	ReplyToMessageID string `json:"reply_to_message_id,omitempty"` // Puts the event in the thread's topic
+	Content          string `json:"content"`
+	Cancelled        bool   `json:"cancelled,omitempty"`
+}
+
+func (e *MessageCompletedEvent) EventType() string { return e.Type }
+
+// ReactionEvent is a reaction_added / reaction_removed update.
+type ReactionEvent struct {
+	Type string `json:"type"`
+	Envelope
+	MessageID string `json:"message_id"`
+	UserID    string `json:"user_id"`
+	Emoji     string `json:"emoji"`
+}
+
+func (e *ReactionEvent) EventType() string { return e.Type }
+
+// ReadEvent reports that a message was read.
+type ReadEvent struct {
+	Type string `json:"type"`
+	Envelope
+	MessageID string `json:"message_id"`
+	ReadBy    string `json:"read_by"`
+}
+
+func (e *ReadEvent) EventType() string { return e.Type }
+
+// MessageStatusEvent reports a delivery status change for a message.
+type MessageStatusEvent struct {
+	Type string `json:"type"`
+	Envelope
+	MessageID string `json:"message_id"`
+	Status    string `json:"status"`
+}
+
+func (e *MessageStatusEvent) EventType() string { return e.Type }
+
+// NewStatusEvent builds a presence event for userID.
+func NewStatusEvent(statusType, userID string) *StatusEvent {
+	return &StatusEvent{Type: statusType, UserID: userID}
+}
+
+// AckEvent confirms that the command with RequestID was accepted.
+type AckEvent struct {
+	Type      string `json:"type"`
+	RequestID string `json:"request_id"`
+	MessageID string `json:"message_id,omitempty"` // Canonical ID of a new_message sent with client_message_id
+}
+
+func (e *AckEvent) EventType() string { return e.Type }
+
+// ErrorEvent reports why the command with RequestID was rejected. RequestID is
+// empty when the frame could not be decoded or carried none.
+type ErrorEvent struct {
+	Type      string `json:"type"`
+	RequestID string `json:"request_id"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+}
+
+func (e *ErrorEvent) EventType() string { return e.Type }
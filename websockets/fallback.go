@@ -0,0 +1,269 @@
+package websockets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrClientClosed is returned when the hub has closed a virtual client's queue.
+var ErrClientClosed = errors.New("client closed")
+
+// NewVirtualClient creates a hub client for transports without a WebSocket
+// connection (Server-Sent Events, long-polling). It receives the same events
+// as a WebSocket client and always speaks JSON.
+func NewVirtualClient(hub *Hub, userID string, limits Limits) *Client {
+	limits = limits.withDefaults()
+	return &Client{
+		Hub:         hub,
+		Send:        make(chan Event, limits.SendBufferSize),
+		UserID:      userID,
+		Codec:       JSONCodec{},
+		Limits:      limits,
+		connectedAt: time.Now(),
+		spoolReady:  make(chan struct{}, 1),
+	}
+}
+
+// spooledEvent is a frame read back from the disk spool, already encoded as JSON.
+type spooledEvent []byte
+
+func (e spooledEvent) EventType() string { return "spooled" }
+
+func (e spooledEvent) MarshalJSON() ([]byte, error) { return e, nil }
+
+// next blocks until an event is available, the context ends or the client is closed.
+func (c *Client) next(ctx context.Context) ([]Event, error) {
+	for {
+		select {
+		case event, ok := <-c.Send:
+			if !ok {
+				return nil, ErrClientClosed
+			}
+			return []Event{event}, nil
+		case <-c.spoolReady:
+			if len(c.Send) > 0 {
+				select {
+				case c.spoolReady <- struct{}{}:
+				default:
+				}
+				continue
+			}
+			frames := c.drainSpool()
+			if len(frames) == 0 {
+				continue
+			}
+			events := make([]Event, len(frames))
+			for i, frame := range frames {
+				events[i] = spooledEvent(frame)
+			}
+			return events, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// pending returns already queued events without blocking.
+func (c *Client) pending() []Event {
+	var events []Event
+	for {
+		select {
+		case event, ok := <-c.Send:
+			if !ok {
+				return events
+			}
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+// ServeSSE streams the client's events as Server-Sent Events until the request
+// ends or the hub closes the client. Each event is one JSON "data:" line.
+func ServeSSE(w http.ResponseWriter, r *http.Request, client *Client) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return errors.New("streaming unsupported")
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no") // Disable nginx buffering
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Comment lines keep proxies from timing out idle streams.
+	heartbeat := time.NewTicker(client.Limits.withDefaults().pingPeriod())
+	defer heartbeat.Stop()
+	events := make(chan []Event)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			batch, err := client.next(r.Context())
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case events <- batch:
+			case <-r.Context().Done():
+				errs <- r.Context().Err()
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case batch := <-events:
+			for _, event := range batch {
+				data, err := json.Marshal(event)
+				if err != nil {
+					log.Printf("Error encoding %s event: %v", event.EventType(), err)
+					client.recordDroppedFrame()
+					continue
+				}
+				n, err := fmt.Fprintf(w, "data: %s\n\n", data)
+				if err != nil {
+					return err
+				}
+				client.counters.bytesOut.Add(int64(n))
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return err
+			}
+			flusher.Flush()
+		case err := <-errs:
+			if errors.Is(err, ErrClientClosed) || errors.Is(err, context.Canceled) {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// PollSessions keeps long-poll virtual clients registered with the hub between
+// requests. Sessions that are not polled within the idle timeout are unregistered.
+type PollSessions struct {
+	hub    *Hub
+	limits Limits
+	idle   time.Duration
+
+	mu       sync.Mutex
+	sessions map[string]*pollSession
+}
+
+type pollSession struct {
+	client   *Client
+	lastPoll time.Time
+}
+
+// NewPollSessions creates a long-poll session registry for hub.
+func NewPollSessions(hub *Hub, limits Limits, idle time.Duration) *PollSessions {
+	return &PollSessions{
+		hub:      hub,
+		limits:   limits,
+		idle:     idle,
+		sessions: make(map[string]*pollSession),
+	}
+}
+
+// Open returns the session's client, or registers a new virtual client for
+// userID when sessionID is empty or unknown. onRegister runs for new clients
+// before they are handed to the hub.
+func (p *PollSessions) Open(sessionID, userID string, onRegister func(*Client)) (string, *Client) {
+	p.mu.Lock()
+	if session, ok := p.sessions[sessionID]; ok && session.client.UserID == userID {
+		session.lastPoll = time.Now()
+		p.mu.Unlock()
+		return sessionID, session.client
+	}
+	sessionID = uuid.New().String()
+	client := NewVirtualClient(p.hub, userID, p.limits)
+	p.sessions[sessionID] = &pollSession{client: client, lastPoll: time.Now()}
+	p.mu.Unlock()
+
+	if onRegister != nil {
+		onRegister(client)
+	}
+	p.hub.Connect(client)
+	return sessionID, client
+}
+
+// Poll waits up to timeout for events on the session's client and returns
+// everything queued at that point. An empty slice means the poll timed out.
+func (p *PollSessions) Poll(ctx context.Context, sessionID string, client *Client, timeout time.Duration) ([]Event, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	events, err := client.next(ctx)
+	p.touch(sessionID)
+	if errors.Is(err, ErrClientClosed) {
+		p.Close(sessionID)
+		return nil, err
+	}
+	if err != nil {
+		return []Event{}, nil
+	}
+	return append(events, client.pending()...), nil
+}
+
+func (p *PollSessions) touch(sessionID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if session, ok := p.sessions[sessionID]; ok {
+		session.lastPoll = time.Now()
+	}
+}
+
+// Close unregisters the session's client from the hub.
+func (p *PollSessions) Close(sessionID string) {
+	p.mu.Lock()
+	session, ok := p.sessions[sessionID]
+	delete(p.sessions, sessionID)
+	p.mu.Unlock()
+	if ok {
+		p.hub.Disconnect(session.client)
+	}
+}
+
+// StartReaper unregisters idle sessions at regular intervals until ctx is done.
+func (p *PollSessions) StartReaper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.reap()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (p *PollSessions) reap() {
+	p.mu.Lock()
+	var expired []string
+	for id, session := range p.sessions {
+		if time.Since(session.lastPoll) > p.idle {
+			expired = append(expired, id)
+		}
+	}
+	p.mu.Unlock()
+	for _, id := range expired {
+		log.Printf("Long-poll session %s expired", id)
+		p.Close(id)
+	}
+}
@@ -0,0 +1,198 @@
+package websockets
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// findNewMessage returns the first new_message object among JSON frames.
+func findNewMessage(t *testing.T, frames [][]byte) []byte {
+	t.Helper()
+	for _, frame := range frames {
+		var probe struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(frame, &probe); err != nil {
+			t.Fatalf("Invalid JSON frame %q: %v", frame, err)
+		}
+		if probe.Type == "new_message" {
+			return frame
+		}
+	}
+	return nil
+}
+
+func TestTransportsReceiveSameFanOut(t *testing.T) {
+	hub := NewHub()
+	for _, userID := range []string{"ws-user", "sse-user", "poll-user"} {
+		hub.AddClientToGroup(userID, "g1")
+	}
+	go hub.Run()
+
+	upgrader := websocket.Upgrader{Subprotocols: Subprotocols}
+	wsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Upgrade failed: %v", err)
+			return
+		}
+		client := NewClient(hub, conn, "ws-user", Limits{})
+		hub.Register <- client
+		client.WritePump()
+	}))
+	defer wsServer.Close()
+
+	sseServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client := NewVirtualClient(hub, "sse-user", Limits{})
+		hub.Register <- client
+		defer func() { hub.Unregister <- client }()
+		ServeSSE(w, r, client)
+	}))
+	defer sseServer.Close()
+
+	polls := NewPollSessions(hub, Limits{}, time.Minute)
+	pollServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionID, client := polls.Open(r.URL.Query().Get("session"), "poll-user", nil)
+		timeout, _ := time.ParseDuration(r.URL.Query().Get("timeout"))
+		events, err := polls.Poll(r.Context(), sessionID, client, timeout)
+		if err != nil {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"session_id": sessionID, "events": events})
+	}))
+	defer pollServer.Close()
+
+	// WebSocket client
+	wsConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(wsServer.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer wsConn.Close()
+
+	// SSE client
+	sseResp, err := http.Get(sseServer.URL)
+	if err != nil {
+		t.Fatalf("SSE request failed: %v", err)
+	}
+	defer sseResp.Body.Close()
+	if ct := sseResp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("SSE Content-Type = %q", ct)
+	}
+
+	// Long-poll client: the first poll opens the session.
+	type pollResponse struct {
+		SessionID string            `json:"session_id"`
+		Events    []json.RawMessage `json:"events"`
+	}
+	resp, err := http.Get(pollServer.URL + "?timeout=0s")
+	if err != nil {
+		t.Fatalf("Poll request failed: %v", err)
+	}
+	var opened pollResponse
+	json.NewDecoder(resp.Body).Decode(&opened)
+	resp.Body.Close()
+	if opened.SessionID == "" {
+		t.Fatalf("Poll did not return a session ID")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(hub.ConnectionStats()) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Clients did not register: %+v", hub.ConnectionStats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	hub.Broadcast <- &NewMessageEvent{
+		Type:           "new_message",
+		Envelope:       Envelope{SenderID: "ws-user", GroupID: "g1"},
+		SenderUsername: "alice",
+		Content:        "same for everyone",
+		MessageID:      "m1",
+	}
+
+	// WebSocket frames may batch several events separated by newlines.
+	var wsMessage []byte
+	wsConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for wsMessage == nil {
+		_, data, err := wsConn.ReadMessage()
+		if err != nil {
+			t.Fatalf("WebSocket read failed: %v", err)
+		}
+		wsMessage = findNewMessage(t, bytes.Split(data, newline))
+	}
+
+	var sseMessage []byte
+	scanner := bufio.NewScanner(sseResp.Body)
+	for sseMessage == nil && scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "data: ") {
+			sseMessage = findNewMessage(t, [][]byte{[]byte(strings.TrimPrefix(line, "data: "))})
+		}
+	}
+
+	var pollMessage []byte
+	for pollMessage == nil {
+		resp, err := http.Get(pollServer.URL + "?timeout=2s&session=" + opened.SessionID)
+		if err != nil {
+			t.Fatalf("Poll request failed: %v", err)
+		}
+		var polled pollResponse
+		json.NewDecoder(resp.Body).Decode(&polled)
+		resp.Body.Close()
+		if polled.SessionID != opened.SessionID {
+			t.Fatalf("Poll session changed: %q -> %q", opened.SessionID, polled.SessionID)
+		}
+		if len(polled.Events) == 0 {
+			t.Fatalf("Poll timed out without the message")
+		}
+		frames := make([][]byte, len(polled.Events))
+		for i, event := range polled.Events {
+			frames[i] = event
+		}
+		pollMessage = findNewMessage(t, frames)
+	}
+
+	if !bytes.Equal(wsMessage, sseMessage) || !bytes.Equal(wsMessage, pollMessage) {
+		t.Errorf("Transports received different events:\nws:   %s\nsse:  %s\npoll: %s", wsMessage, sseMessage, pollMessage)
+	}
+}
+
+func TestUserOnTwoTransportsReceivesOnBoth(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	sse := NewVirtualClient(hub, "user-1", Limits{})
+	hub.Connect(sse)
+	polls := NewPollSessions(hub, Limits{}, time.Minute)
+	sessionID, poll := polls.Open("", "user-1", nil)
+
+	receive := func(client *Client, name string) {
+		t.Helper()
+		select {
+		case event := <-client.Send:
+			if message, ok := event.(*NewMessageEvent); !ok || message.MessageID != "m1" {
+				t.Errorf("%s got %+v, want the message", name, event)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s did not get the message", name)
+		}
+	}
+	hub.Broadcast <- &NewMessageEvent{Type: "new_message", Envelope: Envelope{SenderID: "user-2", ReceiverID: "user-1"}, MessageID: "m1"}
+	receive(sse, "SSE client")
+	receive(poll, "poll client")
+
+	// Closing one transport leaves the other connected.
+	polls.Close(sessionID)
+	hub.Broadcast <- &NewMessageEvent{Type: "new_message", Envelope: Envelope{SenderID: "user-2", ReceiverID: "user-1"}, MessageID: "m1"}
+	receive(sse, "SSE client")
+}
@@ -1,17 +1,19 @@
 package websockets
 
 import (
-	"encoding/json"
 	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // Hub maintains the set of active clients and broadcasts messages.
 type Hub struct {
-	// Registered clients.  Key is the UserID.
-	Clients map[string]*Client
+	// Registered clients.  Key is the UserID, value is the set of that
+	// user's connections, one per tab, device or fallback transport.
+	Clients map[string]map[*Client]bool
 
-	// Inbound messages from the clients.  DEPRECATED.
-	Broadcast chan []byte
+	// Events to route to clients by their addressing.
+	Broadcast chan Event
 
 	// Register requests from the clients.
 	Register chan *Client
@@ -21,48 +23,68 @@ type Hub struct {
 
 	// Group memberships.  Key is groupID, value is a set of userIDs.
 	Groups map[string]map[string]bool // Add this
+
+	// Slow-consumer policy applied by Deliver.
+	Backpressure Backpressure
+
+	// Optional counter of deliveries by policy and outcome.
+	DeliveryMetric *prometheus.CounterVec
+
+	// Optional presence tracker. Presence events only reach the user's
+	// contacts and shared group members; without a tracker none are sent.
+	Presence *Presence
+
+	// Optional router for ephemeral events (live location, cursors, ...).
+	Ephemeral *Ephemeral
+
+	// Optional hook run when a user's last connection closed, such as to
+	// hang up their calls. Without a presence tracker, every closed
+	// connection counts as the last.
+	OnOffline func(userID string)
+
+	// Stats requests, answered from the Run loop.
+	statsRequests chan chan []ConnStats
+
+	// Shutdown requests; once one is handled the hub refuses new clients.
+	shutdown chan shutdownRequest
+	closing  bool
 }
 
 func NewHub() *Hub {
 	return &Hub{
-		Broadcast:  make(chan []byte), // Keep this for now, but it's deprecated
+		Broadcast:  make(chan Event),
 		Register:   make(chan *Client),
 		Unregister: make(chan *Client),
-		Clients:    make(map[string]*Client),
+		Clients:    make(map[string]map[*Client]bool),
 		Groups:     make(map[string]map[string]bool), // Initialize Groups
+
+		statsRequests: make(chan chan []ConnStats),
+		shutdown:      make(chan shutdownRequest),
 	}
 }
 func (h *Hub) Run() {
 	for {
 		select {
 		case client := <-h.Register:
-			h.Clients[client.UserID] = client // Register by UserID
-			// Broadcast online status when client registers
-			statusMsg := []byte(`{"type": "online_status", "user_id": "` + client.UserID + `"}`)
-			for _, c := range h.Clients {
-				select {
-				case c.Send <- statusMsg:
-				default:
-					close(c.Send)
-					delete(h.Clients, c.UserID)
-				}
+			if h.closing {
+				// Shutting down: tell the client to come back later.
+				client.closeForRestart()
+				continue
+			}
+			if h.Clients[client.UserID] == nil {
+				h.Clients[client.UserID] = make(map[*Client]bool)
 			}
+			h.Clients[client.UserID][client] = true // Register by UserID
 			log.Printf("Client registered: %s", client.UserID)
 
 		case client := <-h.Unregister:
-			if _, ok := h.Clients[client.UserID]; ok {
-				// Broadcast offline status before removing client
-				statusMsg := []byte(`{"type": "offline_status", "user_id": "` + client.UserID + `"}`)
-				for _, c := range h.Clients {
-					select {
-					case c.Send <- statusMsg:
-					default:
-						close(c.Send)
-						delete(h.Clients, c.UserID)
-					}
-				}
+			if clients := h.Clients[client.UserID]; clients[client] {
+				delete(clients, client)
+				log.Printf("Client unregistered: %s", client.UserID)
+			}
+			// The user's other connections keep their group memberships.
+			if _, ok := h.Clients[client.UserID]; ok && len(h.Clients[client.UserID]) == 0 {
 				delete(h.Clients, client.UserID)
-				close(client.Send)
 				// Remove the client from all groups
 				for groupID, members := range h.Groups {
 					if _, ok := members[client.UserID]; ok {
@@ -73,135 +95,91 @@ func (h *Hub) Run() {
 						}
 					}
 				}
-				log.Printf("Client unregistered: %s", client.UserID)
 			}
-		case message := <-h.Broadcast: //Handle broadcast
-			// Check if it's a group message by attempting to unmarshal it and checking for group_id
-			var msg map[string]interface{}
-			//Try to unmarshal
-			if err := json.Unmarshal(message, &msg); err == nil {
-				msgType, _ := msg["type"].(string)
-
-				// Handle status messages differently
-				if msgType == "online_status" || msgType == "offline_status" {
-					// Broadcast status to all clients
-					for _, client := range h.Clients {
-						select {
-						case client.Send <- message:
-						default:
-							close(client.Send)
-							delete(h.Clients, client.UserID)
-						}
-					}
-					continue
+			client.closeSend()
+
+		case req := <-h.shutdown:
+			h.drain(req)
+
+		case reply := <-h.statsRequests:
+			stats := make([]ConnStats, 0, len(h.Clients))
+			for _, clients := range h.Clients {
+				for client := range clients {
+					stats = append(stats, client.Stats())
 				}
+			}
+			reply <- stats
 
-				// Handle reaction messages
-				if msgType == "reaction_added" || msgType == "reaction_removed" {
-					// Check group_id
-					if groupID, ok := msg["group_id"].(string); ok && groupID != "" {
-						// Group message: send only to members of the group
-						if members, ok := h.Groups[groupID]; ok {
-							for userID := range members {
-								if client, ok := h.Clients[userID]; ok {
-									select {
-									case client.Send <- message: // Send to the client
-									default:
-										// If the client's send channel is full, assume they're disconnected.
-										close(client.Send)
-										delete(h.Clients, client.UserID)
-										// Remove from group as well
-										delete(members, userID)
-									}
-								}
-							}
-							// If the group is now empty, delete it
-							if len(members) == 0 {
-								delete(h.Groups, groupID)
-							}
-						}
-						continue // Skip the default broadcast
-						// If not group message, it mean that this message is direct message
-					} else {
-						// Get receiverID from message
-						if receiverID, ok := msg["receiver_id"].(string); ok && receiverID != "" {
-							if client, ok := h.Clients[receiverID]; ok { // Check client exist
-								select {
-								case client.Send <- message:
-								default:
-									close(client.Send)
-									delete(h.Clients, receiverID)
-								}
-							}
-						}
-						// Also send back to sender
-						if senderID, ok := msg["sender_id"].(string); ok && senderID != "" {
-							if client, ok := h.Clients[senderID]; ok {
-								select {
-								case client.Send <- message:
-								default:
-									close(client.Send)
-									delete(h.Clients, senderID)
-								}
-							}
-						}
-					}
-					continue // Skip further process
+		case event := <-h.Broadcast: //Handle broadcast
+			// Targeted events name their recipients; conversation events
+			// only sometimes, and are routed by their Envelope otherwise
+			routable, isRoutable := event.(Routable)
+			if targeted, ok := event.(Targeted); ok && (!isRoutable || len(targeted.Recipients()) > 0) {
+				for _, userID := range targeted.Recipients() {
+					h.deliverToUser(userID, event)
 				}
-				//Check group_id
-				//if groupID, ok := msg["group_id"].(string); ok && groupID != "" {  // Removed the unnecessary type-specific check
-				if groupID, ok := msg["group_id"].(string); ok && groupID != "" {
-					// Group message: send only to members of the group
-					if members, ok := h.Groups[groupID]; ok {
-						for userID := range members {
-							if client, ok := h.Clients[userID]; ok {
-								select {
-								case client.Send <- message: // Send to the client
-								default:
-									// If the client's send channel is full, assume they're disconnected.
-									close(client.Send)
-									delete(h.Clients, client.UserID)
-									// Remove from group as well
-									delete(members, userID)
-								}
-							}
-						}
-						// If the group is now empty, delete it
-						if len(members) == 0 {
-							delete(h.Groups, groupID)
-						}
-					}
-					continue // Skip the default broadcast
-					// If not group message, it mean that this message is direct message
-				} else { // Direct message handling
-					// Get receiverID from message
-					if receiverID, ok := msg["receiver_id"].(string); ok && receiverID != "" {
-						if client, ok := h.Clients[receiverID]; ok { // Check client exist
-							select {
-							case client.Send <- message:
-							default:
-								close(client.Send)
-								delete(h.Clients, receiverID)
-							}
-						}
-					}
-					// Also send back to sender
-					if senderID, ok := msg["sender_id"].(string); ok && senderID != "" {
-						if client, ok := h.Clients[senderID]; ok {
-							select {
-							case client.Send <- message:
-							default:
-								close(client.Send)
-								delete(h.Clients, senderID)
-							}
-						}
-					}
+				continue
+			}
+
+			if !isRoutable {
+				continue
+			}
+			route := routable.Route()
+			if route.GroupID != "" {
+				// Group message: send only to members of the group
+				for userID := range h.Groups[route.GroupID] {
+					h.deliverToUser(userID, event)
+				}
+				continue
+			}
+			// Direct message: send to the receiver and back to the sender
+			for _, userID := range []string{route.ReceiverID, route.SenderID} {
+				if userID != "" {
+					h.deliverToUser(userID, event)
 				}
 			}
 		}
 	}
 }
 
+// deliverToUser delivers event to each of the user's connections that wants
+// it. It runs on the Run loop.
+func (h *Hub) deliverToUser(userID string, event Event) {
+	for client := range h.Clients[userID] {
+		if client.Wants(event) {
+			h.Deliver(client, event)
+		}
+	}
+}
+
+// Connect registers client and records the connection with the presence tracker.
+func (h *Hub) Connect(client *Client) {
+	h.Register <- client
+	if h.Presence != nil {
+		h.Presence.Connected(client.UserID)
+	}
+}
+
+// Disconnect unregisters client, records the closed connection with the
+// presence tracker and runs OnOffline if it was the user's last.
+func (h *Hub) Disconnect(client *Client) {
+	h.Unregister <- client
+	offline := true
+	if h.Presence != nil {
+		offline = h.Presence.Disconnected(client.UserID)
+	}
+	if offline && h.OnOffline != nil {
+		h.OnOffline(client.UserID)
+	}
+}
+
+// ConnectionStats returns a snapshot of every registered connection's counters.
+func (h *Hub) ConnectionStats() []ConnStats {
+	reply := make(chan []ConnStats, 1)
+	h.statsRequests <- reply
+	return <-reply
+}
+
 // AddClientToGroup adds a client (by UserID) to a group.
 func (h *Hub) AddClientToGroup(userID, groupID string) {
 	log.Printf("Hub add client to group: %v %v", userID, groupID)
@@ -2,8 +2,30 @@ package websockets
 
 // MessageSaver is an interface for saving messages.
 type MessageSaver interface {
-	SendMessage(senderID, receiverID, groupID, content, replyToMessageID, fileName, filePath, fileType string, fileSize int64, checksum string) (string, error)
+	SendMessage(senderID, receiverID, groupID, content, replyToMessageID, fileName, filePath, fileType string, fileSize int64, checksum, clientMessageID string) (string, error)
 	AddReaction(messageID, userID, emoji string) error
 	RemoveReaction(messageID, userID, emoji string) error
-	UpdateMessageStatus(messageID string, status string) error
+	// UpdateMessageStatus records a delivery status reported by userID and
+	// tells the message's conversation.
+	UpdateMessageStatus(messageID, userID, status string) error
+	// MarkRead tells the message's conversation that readerID read it.
+	MarkRead(messageID, readerID string) error
+}
+
+// MessagePublisher queues a chat message for the consumer to persist and fan out.
+type MessagePublisher interface {
+	PublishMessage(msg WebSocketMessage) error
+}
+
+// ConversationAccess reports whether a user takes part in a conversation.
+type ConversationAccess interface {
+	IsGroupMember(groupID, userID string) (bool, error)
+	CanMessageUser(senderID, receiverID string) (bool, error)
+}
+
+// AIControls are the AI assistant's commands: stopping a reply being
+// generated, and making it forget a conversation.
+type AIControls interface {
+	CancelGeneration(userID, messageID string) error
+	ResetAIMemory(userID, receiverID, groupID string) error
 }
@@ -0,0 +1,300 @@
+package websockets
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// PresenceState is what other users see of a user's availability.
+type PresenceState string
+
+const (
+	PresenceOnline    PresenceState = "online"
+	PresenceIdle      PresenceState = "idle"
+	PresenceAway      PresenceState = "away"
+	PresenceDND       PresenceState = "dnd"
+	PresenceInvisible PresenceState = "invisible"
+	PresenceOffline   PresenceState = "offline"
+)
+
+// ErrInvalidPresence is returned by SetStatus for states a user cannot pick.
+var ErrInvalidPresence = errors.New("invalid presence state")
+
+// PresenceStore persists last-seen times and knows who may see a user's presence.
+type PresenceStore interface {
+	UpdateLastSeen(userID string, at time.Time) error
+	// GetPresenceAudience returns the user's contacts and the members of the
+	// groups they share.
+	GetPresenceAudience(userID string) ([]string, error)
+}
+
+// PresenceEvent reports a user's presence to the users allowed to see it.
+type PresenceEvent struct {
+	Type            string        `json:"type"`
+	UserID          string        `json:"user_id"`
+	State           PresenceState `json:"state"`
+	StatusText      string        `json:"status_text,omitempty"`
+	StatusEmoji     string        `json:"status_emoji,omitempty"`
+	StatusExpiresAt *time.Time    `json:"status_expires_at,omitempty"`
+	LastSeen        *time.Time    `json:"last_seen,omitempty"`
+
+	recipients []string
+}
+
+func (e *PresenceEvent) EventType() string { return e.Type }
+
+// Recipients lists the users the event is delivered to.
+func (e *PresenceEvent) Recipients() []string { return e.recipients }
+
+// Presence tracks connections, client heartbeats and chosen statuses, and
+// broadcasts each user's effective state to their audience when it changes.
+type Presence struct {
+	hub       *Hub
+	store     PresenceStore
+	idleAfter time.Duration
+	awayAfter time.Duration
+
+	mu    sync.Mutex
+	users map[string]*userPresence
+}
+
+type userPresence struct {
+	connections  int
+	chosen       PresenceState // online, away, dnd or invisible
+	lastActivity time.Time
+	lastSeen     time.Time
+
+	statusText    string
+	statusEmoji   string
+	statusExpires time.Time
+
+	published PresenceState
+	audience  []string
+}
+
+// NewPresence creates a presence tracker. Users without heartbeats for
+// idleAfter become idle, and away after awayAfter.
+func NewPresence(hub *Hub, store PresenceStore, idleAfter, awayAfter time.Duration) *Presence {
+	return &Presence{
+		hub:       hub,
+		store:     store,
+		idleAfter: idleAfter,
+		awayAfter: awayAfter,
+		users:     make(map[string]*userPresence),
+	}
+}
+
+// effective computes the state shown to others at now.
+func (p *Presence) effective(u *userPresence, now time.Time) PresenceState {
+	switch {
+	case u.connections == 0, u.chosen == PresenceInvisible:
+		return PresenceOffline
+	case u.chosen == PresenceDND, u.chosen == PresenceAway:
+		return u.chosen
+	case p.awayAfter > 0 && now.Sub(u.lastActivity) >= p.awayAfter:
+		return PresenceAway
+	case p.idleAfter > 0 && now.Sub(u.lastActivity) >= p.idleAfter:
+		return PresenceIdle
+	}
+	return PresenceOnline
+}
+
+// eventLocked builds the presence event for userID as others see it.
+func (p *Presence) eventLocked(userID string, u *userPresence, now time.Time) *PresenceEvent {
+	event := &PresenceEvent{Type: "presence", UserID: userID, State: p.effective(u, now)}
+	if !u.statusExpires.IsZero() && now.After(u.statusExpires) {
+		u.statusText, u.statusEmoji, u.statusExpires = "", "", time.Time{}
+	}
+	if event.State != PresenceOffline {
+		event.StatusText = u.statusText
+		event.StatusEmoji = u.statusEmoji
+		if !u.statusExpires.IsZero() {
+			expires := u.statusExpires
+			event.StatusExpiresAt = &expires
+		}
+	}
+	if event.State == PresenceOffline && !u.lastSeen.IsZero() {
+		lastSeen := u.lastSeen
+		event.LastSeen = &lastSeen
+	}
+	// The user's own connections see it too, so other devices stay in sync.
+	event.recipients = append([]string{userID}, u.audience...)
+	return event
+}
+
+// publishLocked returns the event to broadcast if the visible presence changed.
+func (p *Presence) publishLocked(userID string, u *userPresence, now time.Time, force bool) *PresenceEvent {
+	event := p.eventLocked(userID, u, now)
+	if !force && event.State == u.published {
+		return nil
+	}
+	u.published = event.State
+	return event
+}
+
+func (p *Presence) broadcast(events ...*PresenceEvent) {
+	for _, event := range events {
+		if event != nil {
+			p.hub.Broadcast <- event
+		}
+	}
+}
+
+// Connected records a new connection for userID. The first connection loads
+// the audience, announces the user and sends them their audience's presence.
+func (p *Presence) Connected(userID string) {
+	var audience []string
+	if p.store != nil {
+		var err error
+		audience, err = p.store.GetPresenceAudience(userID)
+		if err != nil {
+			log.Printf("Presence: Error loading audience for %s: %v", userID, err)
+		}
+	}
+
+	now := time.Now()
+	p.mu.Lock()
+	u, ok := p.users[userID]
+	if !ok {
+		u = &userPresence{chosen: PresenceOnline}
+		p.users[userID] = u
+	}
+	u.connections++
+	u.lastActivity = now
+	first := u.connections == 1
+	if first {
+		u.audience = audience
+	}
+	event := p.publishLocked(userID, u, now, first)
+	var snapshot []*PresenceEvent
+	if first {
+		for _, id := range audience {
+			if other, ok := p.users[id]; ok && id != userID {
+				state := p.eventLocked(id, other, now)
+				state.recipients = []string{userID}
+				snapshot = append(snapshot, state)
+			}
+		}
+	}
+	p.mu.Unlock()
+
+	p.broadcast(event)
+	p.broadcast(snapshot...)
+}
+
+// Disconnected records a closed connection. When the last one closes the user
+// goes offline and LastSeen is persisted; it then reports true.
+func (p *Presence) Disconnected(userID string) bool {
+	now := time.Now()
+	p.mu.Lock()
+	u, ok := p.users[userID]
+	if !ok || u.connections == 0 {
+		p.mu.Unlock()
+		return true
+	}
+	u.connections--
+	if u.connections > 0 {
+		p.mu.Unlock()
+		return false
+	}
+	u.lastSeen = now
+	event := p.publishLocked(userID, u, now, true)
+	p.mu.Unlock()
+
+	if p.store != nil {
+		if err := p.store.UpdateLastSeen(userID, now); err != nil {
+			log.Printf("Presence: Error saving last seen for %s: %v", userID, err)
+		}
+	}
+	p.broadcast(event)
+	return true
+}
+
+// Heartbeat records client activity, bringing an idle or away user back online.
+func (p *Presence) Heartbeat(userID string) {
+	now := time.Now()
+	p.mu.Lock()
+	u, ok := p.users[userID]
+	if !ok {
+		p.mu.Unlock()
+		return
+	}
+	u.lastActivity = now
+	event := p.publishLocked(userID, u, now, false)
+	p.mu.Unlock()
+	p.broadcast(event)
+}
+
+// SetStatus sets the user's chosen state and custom status. A zero expiresAt
+// keeps the custom status until it is changed.
+func (p *Presence) SetStatus(userID string, state PresenceState, text, emoji string, expiresAt time.Time) error {
+	switch state {
+	case "":
+		state = PresenceOnline
+	case PresenceOnline, PresenceAway, PresenceDND, PresenceInvisible:
+	default:
+		return ErrInvalidPresence
+	}
+
+	now := time.Now()
+	p.mu.Lock()
+	u, ok := p.users[userID]
+	if !ok {
+		u = &userPresence{lastActivity: now}
+		p.users[userID] = u
+	}
+	u.chosen = state
+	u.statusText, u.statusEmoji, u.statusExpires = text, emoji, expiresAt
+	event := p.publishLocked(userID, u, now, true)
+	p.mu.Unlock()
+	p.broadcast(event)
+	return nil
+}
+
+// Get returns userID's presence as other users see it.
+func (p *Presence) Get(userID string) PresenceEvent {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	u, ok := p.users[userID]
+	if !ok {
+		return PresenceEvent{Type: "presence", UserID: userID, State: PresenceOffline}
+	}
+	return *p.eventLocked(userID, u, time.Now())
+}
+
+// sweep publishes idle / away transitions and expired custom statuses.
+func (p *Presence) sweep(now time.Time) {
+	var events []*PresenceEvent
+	p.mu.Lock()
+	for userID, u := range p.users {
+		expired := !u.statusExpires.IsZero() && now.After(u.statusExpires)
+		if event := p.publishLocked(userID, u, now, expired); event != nil {
+			events = append(events, event)
+		}
+		if u.connections == 0 && u.chosen == PresenceOnline && u.statusText == "" && u.statusEmoji == "" {
+			delete(p.users, userID)
+		}
+	}
+	p.mu.Unlock()
+	p.broadcast(events...)
+}
+
+// StartSweeper checks for idle users and expired statuses at regular
+// intervals until ctx is done.
+func (p *Presence) StartSweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				p.sweep(now)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
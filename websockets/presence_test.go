@@ -0,0 +1,139 @@
+package websockets
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakePresenceStore struct {
+	mu       sync.Mutex
+	audience map[string][]string
+	lastSeen map[string]time.Time
+}
+
+func (s *fakePresenceStore) UpdateLastSeen(userID string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSeen[userID] = at
+	return nil
+}
+
+func (s *fakePresenceStore) GetPresenceAudience(userID string) ([]string, error) {
+	return s.audience[userID], nil
+}
+
+func newPresenceClient(hub *Hub, userID string) *Client {
+	client := newTestClient(16)
+	client.Hub = hub
+	client.UserID = userID
+	return client
+}
+
+// presenceOf returns the states received by client for userID, in order.
+func presenceOf(client *Client, userID string) []PresenceState {
+	var states []PresenceState
+	for {
+		select {
+		case event := <-client.Send:
+			if p, ok := event.(*PresenceEvent); ok && p.UserID == userID {
+				states = append(states, p.State)
+			}
+		case <-time.After(50 * time.Millisecond):
+			return states
+		}
+	}
+}
+
+func TestPresenceOnlyReachesAudience(t *testing.T) {
+	hub := NewHub()
+	store := &fakePresenceStore{
+		audience: map[string][]string{"alice": {"bob"}, "bob": {"alice"}},
+		lastSeen: map[string]time.Time{},
+	}
+	hub.Presence = NewPresence(hub, store, time.Minute, 5*time.Minute)
+	go hub.Run()
+
+	bob := newPresenceClient(hub, "bob")
+	stranger := newPresenceClient(hub, "stranger")
+	hub.Connect(bob)
+	hub.Connect(stranger)
+
+	alice := newPresenceClient(hub, "alice")
+	hub.Connect(alice)
+
+	if got := presenceOf(bob, "alice"); len(got) != 1 || got[0] != PresenceOnline {
+		t.Errorf("bob saw alice as %v, want [online]", got)
+	}
+	if got := presenceOf(stranger, "alice"); len(got) != 0 {
+		t.Errorf("stranger saw alice as %v, want nothing", got)
+	}
+	// The connecting user gets a snapshot of their audience.
+	if got := presenceOf(alice, "bob"); len(got) != 1 || got[0] != PresenceOnline {
+		t.Errorf("alice saw bob as %v, want [online]", got)
+	}
+
+	hub.Disconnect(alice)
+	if got := presenceOf(bob, "alice"); len(got) != 1 || got[0] != PresenceOffline {
+		t.Errorf("bob saw alice as %v after disconnect, want [offline]", got)
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.lastSeen["alice"].IsZero() {
+		t.Errorf("last seen not saved on disconnect")
+	}
+}
+
+func TestPresenceStates(t *testing.T) {
+	hub := NewHub()
+	p := NewPresence(hub, nil, time.Minute, 5*time.Minute)
+	go hub.Run()
+
+	p.Connected("alice")
+	// rewind moves alice's last heartbeat into the past.
+	rewind := func(d time.Duration) {
+		p.mu.Lock()
+		p.users["alice"].lastActivity = time.Now().Add(-d)
+		p.mu.Unlock()
+		p.sweep(time.Now())
+	}
+
+	rewind(2 * time.Minute)
+	if got := p.Get("alice").State; got != PresenceIdle {
+		t.Errorf("state after 2m = %s, want idle", got)
+	}
+	rewind(6 * time.Minute)
+	if got := p.Get("alice").State; got != PresenceAway {
+		t.Errorf("state after 6m = %s, want away", got)
+	}
+	p.Heartbeat("alice")
+	if got := p.Get("alice").State; got != PresenceOnline {
+		t.Errorf("state after heartbeat = %s, want online", got)
+	}
+
+	expires := time.Now().Add(time.Hour)
+	if err := p.SetStatus("alice", PresenceDND, "Focusing", "🎧", expires); err != nil {
+		t.Fatalf("SetStatus failed: %v", err)
+	}
+	got := p.Get("alice")
+	if got.State != PresenceDND || got.StatusText != "Focusing" || got.StatusEmoji != "🎧" {
+		t.Errorf("presence = %+v, want dnd with custom status", got)
+	}
+	p.mu.Lock()
+	p.users["alice"].statusExpires = time.Now().Add(-time.Second)
+	p.mu.Unlock()
+	p.sweep(time.Now())
+	if got := p.Get("alice"); got.StatusText != "" || got.StatusExpiresAt != nil {
+		t.Errorf("custom status did not expire: %+v", got)
+	}
+
+	if err := p.SetStatus("alice", PresenceInvisible, "", "", time.Time{}); err != nil {
+		t.Fatalf("SetStatus failed: %v", err)
+	}
+	if got := p.Get("alice").State; got != PresenceOffline {
+		t.Errorf("invisible user shown as %s, want offline", got)
+	}
+	if err := p.SetStatus("alice", PresenceIdle, "", "", time.Time{}); err != ErrInvalidPresence {
+		t.Errorf("SetStatus(idle) error = %v, want ErrInvalidPresence", err)
+	}
+}
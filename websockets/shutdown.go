@@ -0,0 +1,55 @@
+package websockets
+
+import (
+	"math/rand"
+	"time"
+)
+
+// ServerShutdownEvent tells a client the server is going away and how long to
+// wait before reconnecting, spreading reconnects across the fleet.
+type ServerShutdownEvent struct {
+	Type             string `json:"type"`
+	ReconnectAfterMs int64  `json:"reconnect_after_ms"`
+}
+
+func (e *ServerShutdownEvent) EventType() string { return e.Type }
+
+// Shutdown sends every connected client a server_shutdown event with a random
+// reconnect delay of up to reconnectWithin, then closes its connection. Clients
+// connecting afterwards are closed straight away. It returns once every client
+// has been told.
+func (h *Hub) Shutdown(reconnectWithin time.Duration) {
+	done := make(chan struct{})
+	h.shutdown <- shutdownRequest{reconnectWithin: reconnectWithin, done: done}
+	<-done
+}
+
+type shutdownRequest struct {
+	reconnectWithin time.Duration
+	done            chan struct{}
+}
+
+// drain runs on the Run loop.
+func (h *Hub) drain(req shutdownRequest) {
+	h.closing = true
+	for _, clients := range h.Clients {
+		for client := range clients {
+			delay := time.Duration(0)
+			if req.reconnectWithin > 0 {
+				delay = time.Duration(rand.Int63n(int64(req.reconnectWithin)))
+			}
+			h.Deliver(client, &ServerShutdownEvent{Type: "server_shutdown", ReconnectAfterMs: delay.Milliseconds()})
+			client.closeForRestart()
+		}
+	}
+	close(req.done)
+}
+
+// closeForRestart closes the client's queue; WritePump then sends a "service
+// restart" close frame after flushing what is queued.
+func (c *Client) closeForRestart() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.restarting = true
+	c.closeSendLocked()
+}
@@ -0,0 +1,41 @@
+package websockets
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShutdownNotifiesAndClosesClients(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	client := newTestClient(8)
+	client.UserID = "u1"
+	hub.Register <- client
+
+	hub.Shutdown(time.Second)
+
+	event, ok := <-client.Send
+	if !ok {
+		t.Fatalf("Send closed before the shutdown event")
+	}
+	shutdown, ok := event.(*ServerShutdownEvent)
+	if !ok || shutdown.Type != "server_shutdown" || shutdown.ReconnectAfterMs < 0 || shutdown.ReconnectAfterMs >= 1000 {
+		t.Errorf("got %+v, want server_shutdown within 1s", event)
+	}
+	if _, ok := <-client.Send; ok {
+		t.Errorf("Send still open after shutdown")
+	}
+
+	// Late connections are turned away.
+	late := newTestClient(8)
+	late.UserID = "u2"
+	hub.Register <- late
+	select {
+	case _, ok := <-late.Send:
+		if ok {
+			t.Errorf("late client received an event")
+		}
+	case <-time.After(time.Second):
+		t.Errorf("late client was not closed")
+	}
+}
@@ -0,0 +1,81 @@
+package websockets
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+var errSpoolFull = errors.New("spool is full")
+
+// spool is an append-only file of length-prefixed, already-encoded frames
+// for a client whose Send queue overflowed.
+type spool struct {
+	file *os.File
+	size int64
+}
+
+func newSpool(dir, userID string) (*spool, error) {
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(dir, "ws-spool-"+userID+"-*")
+	if err != nil {
+		return nil, err
+	}
+	return &spool{file: file}, nil
+}
+
+func (s *spool) empty() bool {
+	return s.size == 0
+}
+
+func (s *spool) append(frame []byte, maxBytes int64) error {
+	if s.size+int64(len(frame))+4 > maxBytes {
+		return errSpoolFull
+	}
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(frame)))
+	if _, err := s.file.WriteAt(header[:], s.size); err != nil {
+		return err
+	}
+	if _, err := s.file.WriteAt(frame, s.size+4); err != nil {
+		return err
+	}
+	s.size += int64(len(frame)) + 4
+	return nil
+}
+
+// drain reads every spooled frame and empties the file.
+func (s *spool) drain() ([][]byte, error) {
+	if s.size == 0 {
+		return nil, nil
+	}
+	reader := io.NewSectionReader(s.file, 0, s.size)
+	var frames [][]byte
+	var header [4]byte
+	for {
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return frames, err
+		}
+		frame := make([]byte, binary.BigEndian.Uint32(header[:]))
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			return frames, err
+		}
+		frames = append(frames, frame)
+	}
+	s.size = 0
+	return frames, s.file.Truncate(0)
+}
+
+func (s *spool) remove() {
+	s.file.Close()
+	os.Remove(s.file.Name())
+}
@@ -0,0 +1,54 @@
+package websockets
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ConnStats is a snapshot of one connection's traffic counters.
+// Byte counts are payload sizes before permessage-deflate.
+type ConnStats struct {
+	UserID        string    `json:"user_id"`
+	Subprotocol   string    `json:"subprotocol"`
+	Compression   bool      `json:"compression"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	BytesIn       int64     `json:"bytes_in"`
+	BytesOut      int64     `json:"bytes_out"`
+	QueueDepth    int       `json:"queue_depth"`
+	QueueCapacity int       `json:"queue_capacity"`
+	DroppedFrames int64     `json:"dropped_frames"`
+	SpooledBytes  int64     `json:"spooled_bytes"`
+}
+
+type connCounters struct {
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	dropped  atomic.Int64
+}
+
+// recordDroppedFrame counts an event that could not be delivered to this client.
+func (c *Client) recordDroppedFrame() {
+	c.counters.dropped.Add(1)
+}
+
+// Stats returns the current counters for the connection.
+func (c *Client) Stats() ConnStats {
+	c.mu.Lock()
+	var spooled int64
+	if c.spool != nil {
+		spooled = c.spool.size
+	}
+	c.mu.Unlock()
+	return ConnStats{
+		UserID:        c.UserID,
+		Subprotocol:   c.codec().Subprotocol(),
+		Compression:   c.Compression,
+		ConnectedAt:   c.connectedAt,
+		BytesIn:       c.counters.bytesIn.Load(),
+		BytesOut:      c.counters.bytesOut.Load(),
+		QueueDepth:    len(c.Send),
+		QueueCapacity: cap(c.Send),
+		DroppedFrames: c.counters.dropped.Load(),
+		SpooledBytes:  spooled,
+	}
+}
@@ -0,0 +1,155 @@
+package websockets
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Subscription topics. Conversation topics are "group:<id>" or "user:<id>"
+// (the direct chat with that user); "thread:<message id>" matches a message
+// and its replies.
+const (
+	TopicPresence = "presence"
+	TopicReceipts = "receipts"
+
+	maxSubscriptions = 100
+)
+
+// subscriptions narrows what the hub delivers to one connection. A nil topic
+// set means the connection has not subscribed and receives everything.
+type subscriptions struct {
+	mu     sync.Mutex
+	topics map[string]bool
+}
+
+// ValidateTopic reports whether topic is one a client can subscribe to.
+func ValidateTopic(topic string) error {
+	switch topic {
+	case TopicPresence, TopicReceipts:
+		return nil
+	}
+	prefix, id, ok := strings.Cut(topic, ":")
+	if !ok || id == "" || (prefix != "group" && prefix != "user" && prefix != "thread") {
+		return fmt.Errorf("unknown topic %q", topic)
+	}
+	return nil
+}
+
+// Subscribe limits the connection to events matching topics, in addition to
+// any topics it already subscribed to.
+func (c *Client) Subscribe(topics []string) error {
+	for _, topic := range topics {
+		if err := ValidateTopic(topic); err != nil {
+			return err
+		}
+	}
+	c.subs.mu.Lock()
+	defer c.subs.mu.Unlock()
+	if c.subs.topics == nil {
+		c.subs.topics = make(map[string]bool)
+	}
+	for _, topic := range topics {
+		c.subs.topics[topic] = true
+	}
+	if len(c.subs.topics) > maxSubscriptions {
+		for _, topic := range topics {
+			delete(c.subs.topics, topic)
+		}
+		return fmt.Errorf("at most %d topics per connection", maxSubscriptions)
+	}
+	return nil
+}
+
+// Unsubscribe drops topics. With no topics it clears the filter and the
+// connection receives everything again.
+func (c *Client) Unsubscribe(topics []string) {
+	c.subs.mu.Lock()
+	defer c.subs.mu.Unlock()
+	if len(topics) == 0 {
+		c.subs.topics = nil
+		return
+	}
+	for _, topic := range topics {
+		delete(c.subs.topics, topic)
+	}
+}
+
+// Wants reports whether event passes the connection's subscription filter.
+func (c *Client) Wants(event Event) bool {
+	topics, filtered := eventTopics(event, c.UserID)
+	if !filtered {
+		return true
+	}
+	c.subs.mu.Lock()
+	defer c.subs.mu.Unlock()
+	if c.subs.topics == nil {
+		return true
+	}
+	for _, topic := range topics {
+		if c.subs.topics[topic] {
+			return true
+		}
+	}
+	return false
+}
+
+// eventTopics returns the topics event belongs to, as seen by userID. Events
+// that are not filtered, such as call signaling, report filtered=false.
+func eventTopics(event Event, userID string) (topics []string, filtered bool) {
+	switch e := event.(type) {
+	case *CallEvent:
+		// A ringing call must reach every device.
+		return nil, false
+	case *PresenceEvent:
+		return []string{TopicPresence}, true
+	case *MessageStatusEvent, *ReadEvent:
+		return []string{TopicReceipts}, true
+	case *NewMessageEvent:
+		return messageTopics(e, userID, e.MessageID, e.ReplyToMessageID), true
+	case *MessageChunkEvent:
+		return messageTopics(e, userID, e.MessageID, e.ReplyToMessageID), true
+	case *MessageCompletedEvent:
+		return messageTopics(e, userID, e.MessageID, e.ReplyToMessageID), true
+	case *AITypingEvent:
+		return messageTopics(e, userID, "", e.ReplyToMessageID), true
+	case Routable:
+		return []string{conversationTopic(e, userID)}, true
+	}
+	return nil, false
+}
+
+// messageTopics returns the conversation topic of an event about messageID
+// along with the threads of messageID and of the message it replies to.
+func messageTopics(event Routable, userID, messageID, replyToMessageID string) []string {
+	topics := []string{conversationTopic(event, userID)}
+	if messageID != "" {
+		topics = append(topics, "thread:"+messageID)
+	}
+	if replyToMessageID != "" {
+		topics = append(topics, "thread:"+replyToMessageID)
+	}
+	return topics
+}
+
+// conversationTopic names the conversation an event belongs to for userID.
+// A direct message event naming its recipients is in their conversation,
+// whoever sent it.
+func conversationTopic(event Routable, userID string) string {
+	route := event.Route()
+	if route.GroupID != "" {
+		return "group:" + route.GroupID
+	}
+	if targeted, ok := event.(Targeted); ok {
+		if recipients := targeted.Recipients(); len(recipients) == 2 {
+			if recipients[0] == userID {
+				return "user:" + recipients[1]
+			}
+			return "user:" + recipients[0]
+		}
+	}
+	if route.SenderID == userID {
+		return "user:" + route.ReceiverID
+	}
+	return "user:" + route.SenderID
+}
@@ -0,0 +1,109 @@
+package websockets
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSubscriptionsFilterDelivery(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	client := newTestClient(16)
+	client.UserID = "u1"
+	hub.Register <- client
+	hub.AddClientToGroup("u1", "g1")
+	hub.AddClientToGroup("u1", "g2")
+
+	if err := client.Subscribe([]string{"group:g1", "thread:m1", "bogus"}); err == nil {
+		t.Errorf("unknown topic accepted")
+	}
+	if err := client.Subscribe([]string{"group:g1", "thread:m1"}); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	events := []Event{
+		&TypingEvent{Type: "typing", Envelope: Envelope{SenderID: "u2", GroupID: "g1"}},                                                   // Subscribed group
+		&TypingEvent{Type: "typing", Envelope: Envelope{SenderID: "u2", GroupID: "g2"}},                                                   // Other group
+		&NewMessageEvent{Type: "new_message", Envelope: Envelope{SenderID: "u2", GroupID: "g2"}, MessageID: "m2", ReplyToMessageID: "m1"}, // Thread reply
+		&MessageStatusEvent{Type: "message_status", Envelope: Envelope{SenderID: "u2", ReceiverID: "u1"}},                                 // Receipts
+		&PresenceEvent{Type: "presence", UserID: "u2", recipients: []string{"u1"}},                                                        // Presence
+		(&CallEvent{Type: "call_offer", Envelope: Envelope{SenderID: "u3", ReceiverID: "u1"}}).To("u1"),                                   // Always delivered
+	}
+	for _, event := range events {
+		hub.Broadcast <- event
+	}
+
+	var got []string
+collect:
+	for {
+		select {
+		case event := <-client.Send:
+			route := ""
+			if routable, ok := event.(Routable); ok {
+				route = routable.Route().GroupID
+			}
+			got = append(got, event.EventType()+route)
+		case <-time.After(100 * time.Millisecond):
+			break collect
+		}
+	}
+	want := []string{"typingg1", "new_messageg2", "call_offer"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+
+	// Clearing the filter restores every event.
+	client.Unsubscribe(nil)
+	if !client.Wants(events[3]) || !client.Wants(events[1]) {
+		t.Errorf("unfiltered client rejects events")
+	}
+}
+
+func TestThreadSubscriberFollowsStreamedReplies(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	client := newTestClient(16)
+	client.UserID = "u1"
+	hub.Register <- client
+	hub.AddClientToGroup("u1", "g1")
+	if err := client.Subscribe([]string{"thread:m1"}); err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	group := Envelope{SenderID: "ai", GroupID: "g1"}
+	events := []Event{
+		&AITypingEvent{Type: "ai_typing", Envelope: group, ReplyToMessageID: "m1", Typing: true},
+		&NewMessageEvent{Type: "new_message", Envelope: group, MessageID: "r1", ReplyToMessageID: "m1"},
+		&MessageChunkEvent{Type: "message_chunk", Envelope: group, MessageID: "r1", ReplyToMessageID: "m1", Delta: "hi"},
+		&MessageCompletedEvent{Type: "message_completed", Envelope: group, MessageID: "r1", ReplyToMessageID: "m1", Content: "hi"},
+		&MessageChunkEvent{Type: "message_chunk", Envelope: group, MessageID: "r2", ReplyToMessageID: "m2", Delta: "other"}, // Other thread
+	}
+	for _, event := range events {
+		hub.Broadcast <- event
+	}
+
+	var got []string
+collect:
+	for {
+		select {
+		case event := <-client.Send:
+			got = append(got, event.EventType())
+		case <-time.After(100 * time.Millisecond):
+			break collect
+		}
+	}
+	want := []string{"ai_typing", "new_message", "message_chunk", "message_completed"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+}